@@ -6,6 +6,11 @@ Command line flags mirror the flags for the original program.  For information
 about, run lmdb_copy with the -h flag.
 
 	lmdb_copy -h
+
+With the -v flag the previous snapshot of the environment is copied rather than
+the latest one, discarding the last committed transaction.  This may recover an
+environment whose last commit was bad.  The source environment must not be in
+use by any other process.
 */
 package main
 
@@ -21,6 +26,7 @@ import (
 func main() {
 	opt := &Options{}
 	flag.BoolVar(&opt.Compact, "c", false, "Compact while copying.")
+	flag.BoolVar(&opt.PrevSnapshot, "v", false, "Copy the previous snapshot rather than the latest one.")
 	flag.Parse()
 
 	lmdbcmd.PrintVersion()
@@ -45,7 +51,8 @@ func main() {
 
 // Options contain the command line options for an lmdb_copy command.
 type Options struct {
-	Compact bool
+	Compact      bool
+	PrevSnapshot bool
 }
 
 func copyEnv(srcpath, dstpath string, opt *Options) error {
@@ -53,7 +60,11 @@ func copyEnv(srcpath, dstpath string, opt *Options) error {
 	if err != nil {
 		return err
 	}
-	err = env.Open(srcpath, lmdbcmd.OpenFlag(), 0644)
+	openFlags := lmdbcmd.OpenFlag()
+	if opt != nil && opt.PrevSnapshot {
+		openFlags |= lmdb.PrevSnapshot
+	}
+	err = env.Open(srcpath, openFlags, 0644)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,194 @@
+/*
+Command lmdb_diff compares a database in two LMDB environments and prints the
+key ranges and items which differ.  Optionally lmdb_diff repairs the second
+environment so that the database matches the first.
+
+Databases are compared using hash trees (see package lmdbmerkle) so only the
+ranges which differ are compared item by item.
+
+	lmdb_diff [-s subdb] [-b keys] [-k] [-repair] srcpath dstpath
+
+For information about command line flags run lmdb_diff with the -h flag.
+
+	lmdb_diff -h
+*/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/ledgerwatch/lmdb-go/exp/lmdbmerkle"
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbcmd"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+func main() {
+	opt := &Options{}
+	flag.StringVar(&opt.Sub, "s", "", "Compare a specific subdatabase instead of the main database.")
+	flag.IntVar(&opt.LeafKeys, "b", 1024, "The number of keys hashed per leaf of the hash tree.")
+	flag.BoolVar(&opt.PrintItems, "k", false, "Print the items which differ in each range.")
+	flag.BoolVar(&opt.Repair, "repair", false, "Write differing items to dstpath so that it matches srcpath.")
+	flag.Parse()
+
+	lmdbcmd.PrintVersion()
+
+	if flag.NArg() != 2 {
+		log.Fatalf("exactly two arguments must be specified")
+	}
+	if opt.LeafKeys <= 0 {
+		log.Fatalf("invalid leaf size: %d", opt.LeafKeys)
+	}
+	opt.SrcPath = flag.Arg(0)
+	opt.DstPath = flag.Arg(1)
+
+	w := bufio.NewWriter(os.Stdout)
+	ndiff, err := doMain(w, opt)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ndiff > 0 && !opt.Repair {
+		os.Exit(1)
+	}
+}
+
+// Options contains the command line options for an lmdb_diff command.
+type Options struct {
+	Sub        string
+	LeafKeys   int
+	PrintItems bool
+	Repair     bool
+
+	SrcPath string
+	DstPath string
+}
+
+func openEnv(path string, flags uint, opt *Options) (*lmdb.Env, error) {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return nil, err
+	}
+	if opt.Sub != "" {
+		err = env.SetMaxDBs(1)
+		if err != nil {
+			env.Close()
+			return nil, err
+		}
+	}
+	err = env.Open(path, lmdbcmd.OpenFlag()|flags, 0644)
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
+	return env, nil
+}
+
+func openDBI(txn *lmdb.Txn, opt *Options) (lmdb.DBI, error) {
+	if opt.Sub == "" {
+		return txn.OpenRoot(0)
+	}
+	return txn.OpenDBI(opt.Sub, 0)
+}
+
+// doMain compares the environments and returns the number of differing
+// ranges.
+func doMain(w io.Writer, opt *Options) (int, error) {
+	src, err := openEnv(opt.SrcPath, lmdb.Readonly, opt)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	var dstFlags uint
+	if !opt.Repair {
+		dstFlags = lmdb.Readonly
+	}
+	dst, err := openEnv(opt.DstPath, dstFlags, opt)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	var ranges []lmdbmerkle.Range
+	err = src.View(func(stxn *lmdb.Txn) (err error) {
+		stxn.RawRead = true
+		sdbi, err := openDBI(stxn, opt)
+		if err != nil {
+			return err
+		}
+		return dst.View(func(dtxn *lmdb.Txn) (err error) {
+			dtxn.RawRead = true
+			ddbi, err := openDBI(dtxn, opt)
+			if err != nil {
+				return err
+			}
+			ranges, err = lmdbmerkle.Compare(stxn, sdbi, dtxn, ddbi, opt.LeafKeys)
+			if err != nil {
+				return err
+			}
+			for _, r := range ranges {
+				fmt.Fprintf(w, "range [%s, %s)\n", formatBound(r.Start), formatBound(r.End))
+				if !opt.PrintItems {
+					continue
+				}
+				err = lmdbmerkle.DiffRange(stxn, sdbi, dtxn, ddbi, r, func(d *lmdbmerkle.ItemDiff) error {
+					return printItemDiff(w, d)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if opt.Repair && len(ranges) > 0 {
+		var n int
+		err = src.View(func(stxn *lmdb.Txn) (err error) {
+			sdbi, err := openDBI(stxn, opt)
+			if err != nil {
+				return err
+			}
+			return dst.Update(func(dtxn *lmdb.Txn) (err error) {
+				ddbi, err := openDBI(dtxn, opt)
+				if err != nil {
+					return err
+				}
+				n, err = lmdbmerkle.Repair(stxn, sdbi, dtxn, ddbi, ranges)
+				return err
+			})
+		})
+		if err != nil {
+			return len(ranges), err
+		}
+		fmt.Fprintf(w, "repaired %d items\n", n)
+	}
+	return len(ranges), nil
+}
+
+func formatBound(b []byte) string {
+	if b == nil {
+		return ""
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+func printItemDiff(w io.Writer, d *lmdbmerkle.ItemDiff) error {
+	var err error
+	if d.A != nil {
+		_, err = fmt.Fprintf(w, "  - %q: %q\n", d.Key, d.A)
+	}
+	if err == nil && d.B != nil {
+		_, err = fmt.Fprintf(w, "  + %q: %q\n", d.Key, d.B)
+	}
+	return err
+}
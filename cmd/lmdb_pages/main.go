@@ -0,0 +1,472 @@
+/*
+Command lmdb_pages inspects the pages of an LMDB data file.  It prints the meta
+pages, summarizes the B-tree of databases level by level, and decodes single
+pages.  It is intended for diagnosing why an environment uses more space than
+expected.
+
+	lmdb_pages [-meta] [-s subdb | -a] [-free] [-o] [-p pgno] path
+
+The file is read with package lmdbfile, so lmdb_pages does not require cgo.
+The path may be an environment directory or a data file.  The environment
+should not be written while lmdb_pages runs.
+
+For each database lmdb_pages prints, for each level of the tree, the number of
+pages of each type, the number of keys they hold, and how full they are.  Pages
+holding the duplicates of a DupSort database are reported separately from the
+main tree.  Distributions of key and value sizes follow, along with a summary
+of overflow page chains.
+
+For information about command line flags run lmdb_pages with the -h flag.
+
+	lmdb_pages -h
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ledgerwatch/lmdb-go/exp/lmdbfile"
+)
+
+func main() {
+	opt := &Options{}
+	flag.BoolVar(&opt.PrintMeta, "meta", false, "Display both meta pages.")
+	flag.StringVar(&opt.Sub, "s", "", "Walk a specific subdatabase instead of the main database.")
+	flag.BoolVar(&opt.All, "a", false, "Walk the main database and all subdatabases.")
+	flag.BoolVar(&opt.Free, "free", false, "Walk the free page database and count free pages.")
+	flag.BoolVar(&opt.PrintOverflow, "o", false, "Display each overflow page chain.")
+	flag.Int64Var(&opt.Page, "p", -1, "Display a single page in hex with its decoded nodes and exit.")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatalf("exactly one argument must be specified")
+	}
+	if opt.All && opt.Sub != "" {
+		log.Fatalf("-a and -s are mutually exclusive")
+	}
+	opt.Path = flag.Arg(0)
+
+	w := bufio.NewWriter(os.Stdout)
+	err := doMain(w, opt)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Options contains the command line options for an lmdb_pages command.
+type Options struct {
+	PrintMeta     bool
+	Sub           string
+	All           bool
+	Free          bool
+	PrintOverflow bool
+	Page          int64
+
+	Path string
+}
+
+func doMain(w io.Writer, opt *Options) error {
+	f, err := lmdbfile.Open(opt.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if opt.Page >= 0 {
+		return printPage(w, f, uint64(opt.Page))
+	}
+
+	m := f.Meta()
+	fmt.Fprintf(w, "Page size: %d\n", m.PageSize)
+	fmt.Fprintf(w, "Map size: %d\n", m.MapSize)
+	fmt.Fprintf(w, "Pages used: %d\n", m.LastPage+1)
+	fmt.Fprintf(w, "Current meta page: %d (txnid %d)\n", m.Page, m.TxnID)
+	if opt.PrintMeta {
+		for n := 0; n < 2; n++ {
+			printMeta(w, f, n)
+		}
+	}
+
+	if opt.Free {
+		err = printFree(w, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	switch {
+	case opt.All:
+		names, err = dbNames(f)
+		if err != nil {
+			return err
+		}
+		names = append([]string{""}, names...)
+	default:
+		names = []string{opt.Sub}
+	}
+	for _, name := range names {
+		db := f.Root()
+		if name != "" {
+			db, err = f.OpenDB(name)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		fmt.Fprintf(w, "\nDatabase %s\n", dbLabel(name))
+		err = printDB(w, f, db, opt)
+		if err != nil {
+			return fmt.Errorf("%s: %v", dbLabel(name), err)
+		}
+	}
+	return nil
+}
+
+func dbLabel(name string) string {
+	if name == "" {
+		return "(main)"
+	}
+	return fmt.Sprintf("%q", name)
+}
+
+// dbNames returns the names of the named databases in f.
+func dbNames(f *lmdbfile.File) ([]string, error) {
+	var names []string
+	err := f.Root().Walk(func(p *lmdbfile.Page, level int, dup bool) error {
+		for _, n := range p.Nodes {
+			if n.Flags&(lmdbfile.NodeSubData|lmdbfile.NodeDupData) == lmdbfile.NodeSubData {
+				names = append(names, string(n.Key))
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+func printMeta(w io.Writer, f *lmdbfile.File, n int) {
+	fmt.Fprintf(w, "\nMeta page %d\n", n)
+	m, err := f.ReadMeta(n)
+	if err != nil {
+		fmt.Fprintf(w, "  Invalid: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "  Txn ID: %d\n", m.TxnID)
+	fmt.Fprintf(w, "  Flags: %#x\n", m.Flags)
+	fmt.Fprintf(w, "  Map size: %d\n", m.MapSize)
+	fmt.Fprintf(w, "  Last page: %d\n", m.LastPage)
+	printRecord(w, "Free DB", m.Free)
+	printRecord(w, "Main DB", m.Main)
+}
+
+func printRecord(w io.Writer, label string, r lmdbfile.Record) {
+	root := "none"
+	if r.Root != lmdbfile.InvalidPage {
+		root = fmt.Sprint(r.Root)
+	}
+	fmt.Fprintf(w, "  %s: root %s, depth %d, branch pages %d, leaf pages %d, overflow pages %d, entries %d\n",
+		label, root, r.Depth, r.BranchPages, r.LeafPages, r.OverflowPages, r.Entries)
+}
+
+// printFree walks the free page database and counts the free pages it lists.
+func printFree(w io.Writer, f *lmdbfile.File) error {
+	db := f.FreeDB()
+	var txns, pages uint64
+	c := db.Cursor()
+	var err error
+	var v []byte
+	for _, v, err = c.First(); err == nil; _, v, err = c.Next() {
+		if len(v) < 8 {
+			return fmt.Errorf("free list entry too short: %d bytes", len(v))
+		}
+		txns++
+		pages += binary.LittleEndian.Uint64(v)
+	}
+	if err != lmdbfile.ErrNotFound {
+		return err
+	}
+	fmt.Fprintf(w, "\nFree pages: %d (listed by %d transactions)\n", pages, txns)
+	fmt.Fprintf(w, "\nDatabase (free)\n")
+	return printDB(w, f, db, &Options{})
+}
+
+// rowKey identifies a row of the per-level table.
+type rowKey struct {
+	level int
+	dup   bool
+	kind  int
+}
+
+// Page kinds, in the order rows are printed.
+const (
+	kindBranch = iota
+	kindLeaf
+	kindLeaf2
+	kindSubPage
+	kindOverflow
+)
+
+var kindNames = []string{"branch", "leaf", "leaf2", "sub-page", "overflow"}
+
+type row struct {
+	pages uint64
+	keys  uint64
+	used  uint64
+	size  uint64
+}
+
+// histogram counts sizes in power of two buckets.
+type histogram [65]uint64
+
+func (h *histogram) add(n int) {
+	h[bits.Len(uint(n))]++
+}
+
+func (h *histogram) print(w io.Writer, label string) {
+	total := uint64(0)
+	for _, c := range h {
+		total += c
+	}
+	if total == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %s:\n", label)
+	for b, c := range h {
+		if c == 0 {
+			continue
+		}
+		r := fmt.Sprint(b)
+		if b > 1 {
+			r = fmt.Sprintf("%d-%d", 1<<(b-1), 1<<b-1)
+		}
+		fmt.Fprintf(w, "    %-12s %10d  %5.1f%%\n", r, c, 100*float64(c)/float64(total))
+	}
+}
+
+// chain is an overflow page chain.
+type chain struct {
+	pgno  uint64
+	pages int
+	size  int
+	key   []byte
+}
+
+func printDB(w io.Writer, f *lmdbfile.File, db *lmdbfile.DB, opt *Options) error {
+	psize := uint64(f.PageSize())
+	rec := db.Record()
+	fmt.Fprintf(w, "  Flags: %#x\n", rec.Flags)
+	fmt.Fprintf(w, "  Depth: %d\n", rec.Depth)
+	fmt.Fprintf(w, "  Entries: %d\n", rec.Entries)
+
+	rows := make(map[rowKey]*row)
+	var keySizes, valSizes histogram
+	var chains []chain
+	pending := make(map[uint64]chain)
+	err := db.Walk(func(p *lmdbfile.Page, level int, dup bool) error {
+		k := rowKey{level: level, dup: dup}
+		switch {
+		case p.Flags&lmdbfile.PageOverflow != 0:
+			k.kind = kindOverflow
+		case p.Flags&lmdbfile.PageSubp != 0:
+			k.kind = kindSubPage
+		case p.Flags&lmdbfile.PageLeaf2 != 0:
+			k.kind = kindLeaf2
+		case p.Flags&lmdbfile.PageBranch != 0:
+			k.kind = kindBranch
+		default:
+			k.kind = kindLeaf
+		}
+		r := rows[k]
+		if r == nil {
+			r = &row{}
+			rows[k] = r
+		}
+		if k.kind == kindOverflow {
+			c, ok := pending[p.Pgno]
+			if !ok {
+				return fmt.Errorf("overflow page %d not referenced by a leaf", p.Pgno)
+			}
+			delete(pending, p.Pgno)
+			c.pages = p.Overflow
+			chains = append(chains, c)
+			r.pages += uint64(p.Overflow)
+			r.keys++
+			r.used += uint64(16 + c.size)
+			r.size += uint64(p.Overflow) * psize
+			return nil
+		}
+
+		r.pages++
+		r.keys += uint64(len(p.Nodes))
+		r.used += uint64(p.Used())
+		if k.kind == kindSubPage {
+			r.size += uint64(len(p.Raw))
+		} else {
+			r.size += psize
+		}
+		if k.kind == kindBranch || dup {
+			return nil
+		}
+		for _, n := range p.Nodes {
+			keySizes.add(len(n.Key))
+			if n.Flags&(lmdbfile.NodeSubData|lmdbfile.NodeDupData) == 0 {
+				valSizes.add(n.Size)
+			}
+			if n.Flags&lmdbfile.NodeBigData != 0 {
+				pending[n.Overflow] = chain{pgno: n.Overflow, size: n.Size, key: n.Key}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]rowKey, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.dup != b.dup {
+			return !a.dup
+		}
+		if a.level != b.level {
+			return a.level < b.level
+		}
+		return a.kind < b.kind
+	})
+	if len(keys) > 0 {
+		fmt.Fprintf(w, "  %-6s %-14s %10s %12s %14s %7s\n", "Level", "Type", "Pages", "Keys", "Bytes", "Fill")
+	}
+	var total uint64
+	for _, k := range keys {
+		r := rows[k]
+		kind := kindNames[k.kind]
+		if k.dup && k.kind != kindSubPage {
+			kind = "dup " + kind
+		}
+		if k.kind != kindSubPage {
+			total += r.size
+		}
+		fmt.Fprintf(w, "  %-6d %-14s %10d %12d %14d %6.1f%%\n",
+			k.level, kind, r.pages, r.keys, r.size, 100*float64(r.used)/float64(r.size))
+	}
+	fmt.Fprintf(w, "  Total: %d pages, %d bytes\n", total/psize, total)
+
+	keySizes.print(w, "Key sizes")
+	valSizes.print(w, "Value sizes")
+
+	if len(chains) > 0 {
+		var pages, largest int
+		for _, c := range chains {
+			pages += c.pages
+			if c.pages > largest {
+				largest = c.pages
+			}
+		}
+		fmt.Fprintf(w, "  Overflow chains: %d, pages %d, largest %d pages\n", len(chains), pages, largest)
+		if opt.PrintOverflow {
+			fmt.Fprintf(w, "    %-12s %6s %10s  %s\n", "Page", "Pages", "Size", "Key")
+			for _, c := range chains {
+				fmt.Fprintf(w, "    %-12d %6d %10d  %s\n", c.pgno, c.pages, c.size, formatKey(c.key))
+			}
+		}
+	}
+	return nil
+}
+
+// formatKey formats key in hex, truncated to a readable length.
+func formatKey(key []byte) string {
+	const max = 32
+	if len(key) > max {
+		return hex.EncodeToString(key[:max]) + "..."
+	}
+	return hex.EncodeToString(key)
+}
+
+var pageFlagNames = []struct {
+	flag uint16
+	name string
+}{
+	{lmdbfile.PageBranch, "branch"},
+	{lmdbfile.PageLeaf, "leaf"},
+	{lmdbfile.PageOverflow, "overflow"},
+	{lmdbfile.PageMeta, "meta"},
+	{lmdbfile.PageLeaf2, "leaf2"},
+	{lmdbfile.PageSubp, "subp"},
+}
+
+var nodeFlagNames = []struct {
+	flag uint16
+	name string
+}{
+	{lmdbfile.NodeBigData, "bigdata"},
+	{lmdbfile.NodeSubData, "subdata"},
+	{lmdbfile.NodeDupData, "dupdata"},
+}
+
+func printPage(w io.Writer, f *lmdbfile.File, pgno uint64) error {
+	p, err := f.Page(pgno)
+	if err != nil {
+		return err
+	}
+	var flags []string
+	for _, fl := range pageFlagNames {
+		if p.Flags&fl.flag != 0 {
+			flags = append(flags, fl.name)
+		}
+	}
+	fmt.Fprintf(w, "Page %d: flags %#x (%s)\n", p.Pgno, p.Flags, strings.Join(flags, "|"))
+	raw := p.Raw
+	switch {
+	case p.Flags&lmdbfile.PageOverflow != 0:
+		fmt.Fprintf(w, "  Overflow pages: %d\n", p.Overflow)
+		raw = raw[:f.PageSize()]
+	case p.Flags&lmdbfile.PageMeta == 0:
+		fmt.Fprintf(w, "  Lower: %d, upper: %d, free: %d bytes\n", p.Lower, p.Upper, p.Free())
+		if p.Flags&lmdbfile.PageLeaf2 != 0 {
+			fmt.Fprintf(w, "  Key size: %d\n", p.Pad)
+		}
+		fmt.Fprintf(w, "  Keys: %d\n", len(p.Nodes))
+	}
+
+	for i, n := range p.Nodes {
+		fmt.Fprintf(w, "  %4d: offset %-5d ksize %-5d", i, n.Offset, len(n.Key))
+		switch {
+		case p.Flags&lmdbfile.PageBranch != 0:
+			fmt.Fprintf(w, " child %-10d", n.Child)
+		case p.Flags&lmdbfile.PageLeaf2 != 0:
+		default:
+			var nflags []string
+			for _, fl := range nodeFlagNames {
+				if n.Flags&fl.flag != 0 {
+					nflags = append(nflags, fl.name)
+				}
+			}
+			fmt.Fprintf(w, " dsize %-8d", n.Size)
+			if n.Flags&lmdbfile.NodeBigData != 0 {
+				fmt.Fprintf(w, " overflow %d", n.Overflow)
+			}
+			if len(nflags) > 0 {
+				fmt.Fprintf(w, " [%s]", strings.Join(nflags, "|"))
+			}
+		}
+		fmt.Fprintf(w, " key %s\n", formatKey(n.Key))
+	}
+	fmt.Fprintln(w)
+	_, err = io.WriteString(w, hex.Dump(raw))
+	return err
+}
@@ -0,0 +1,97 @@
+/*
+Command lmdb_server serves an LMDB environment to clients speaking a subset of
+the Redis protocol (RESP).  It is intended for debugging and for clients
+written in languages without LMDB bindings.
+
+	lmdb_server [-addr host:port] [-maxdbs n] [-mapsize bytes] path
+
+Supported commands are GET, SET, DEL, EXISTS, MGET, MSET, SCAN, SELECT, INFO,
+PING, ECHO, and QUIT.  SET accepts no options.
+
+SELECT changes the database used by the connection.  The main database is
+named "0" and any other name refers to a named database, which is created if
+it does not exist.
+
+SCAN cursors are opaque strings.  The MATCH option of SCAN only supports
+prefix patterns such as "user:*".
+
+INFO reports the environment information and the statistics of the selected
+database.
+
+For information about command line flags run lmdb_server with the -h flag.
+
+	lmdb_server -h
+*/
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbcmd"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+func main() {
+	opt := &Options{}
+	flag.StringVar(&opt.Addr, "addr", "127.0.0.1:6380", "The address on which to listen for clients.")
+	flag.IntVar(&opt.MaxDBs, "maxdbs", 64, "The maximum number of named databases.")
+	flag.Int64Var(&opt.MapSize, "mapsize", 0, "The size of the memory map in bytes, if non-zero.")
+	flag.Parse()
+
+	lmdbcmd.PrintVersion()
+
+	if flag.NArg() != 1 {
+		log.Fatalf("exactly one argument must be specified")
+	}
+	opt.Path = flag.Arg(0)
+
+	err := doMain(opt)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Options contains the command line options for an lmdb_server command.
+type Options struct {
+	Addr    string
+	MaxDBs  int
+	MapSize int64
+	Path    string
+}
+
+func doMain(opt *Options) error {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+	err = env.SetMaxDBs(opt.MaxDBs)
+	if err != nil {
+		return err
+	}
+	if opt.MapSize != 0 {
+		err = env.SetMapSize(opt.MapSize)
+		if err != nil {
+			return err
+		}
+	}
+	err = env.Open(opt.Path, lmdbcmd.OpenFlag(), 0644)
+	if err != nil {
+		return err
+	}
+
+	s, err := NewServer(env)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ln, err := net.Listen("tcp", opt.Addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening on %s", ln.Addr())
+	return s.Serve(ln)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxBulk bounds the size of a bulk string read from a client.
+const maxBulk = 512 << 20
+
+// maxArgs bounds the number of arguments of a command read from a client.
+const maxArgs = 1 << 20
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads a command from r.  Commands are arrays of bulk strings,
+// as sent by clients, or inline commands with space separated arguments.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, errProtocol
+	}
+	// A null or empty array is ignored, as by Redis.  Memory for the
+	// arguments is allocated as their data arrives rather than from the
+	// sizes claimed by the client.
+	var args [][]byte
+	for i := 0; i < n; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, errProtocol
+		}
+		var buf bytes.Buffer
+		_, err = io.CopyN(&buf, r, int64(size)+2)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		arg := buf.Bytes()
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	return line, nil
+}
+
+// replyWriter writes RESP replies.  Write errors are retained and reported
+// by Flush.
+type replyWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *replyWriter) printf(format string, v ...interface{}) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, v...)
+	}
+}
+
+func (w *replyWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *replyWriter) Status(s string) {
+	w.printf("+%s\r\n", s)
+}
+
+func (w *replyWriter) Error(s string) {
+	w.printf("-%s\r\n", s)
+}
+
+func (w *replyWriter) Int(n int64) {
+	w.printf(":%d\r\n", n)
+}
+
+// Bulk writes b as a bulk string, or a null bulk string if b is nil.
+func (w *replyWriter) Bulk(b []byte) {
+	if b == nil {
+		w.printf("$-1\r\n")
+		return
+	}
+	w.printf("$%d\r\n", len(b))
+	w.write(b)
+	w.write([]byte("\r\n"))
+}
+
+func (w *replyWriter) Array(n int) {
+	w.printf("*%d\r\n", n)
+}
+
+func (w *replyWriter) Flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
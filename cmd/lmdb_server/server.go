@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ledgerwatch/lmdb-go/exp/lmdbpool"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// rootName is the name SELECT uses for the main database of the environment.
+const rootName = "0"
+
+// maxBatch bounds the number of write requests committed together.
+const maxBatch = 128
+
+// defaultScanCount is the number of keys examined by SCAN without COUNT.
+const defaultScanCount = 10
+
+var errClosed = errors.New("server closed")
+
+// Server serves RESP clients from an LMDB environment.  Read commands execute
+// in transactions from an lmdbpool.TxnPool.  Write commands are sent to a
+// single writer goroutine which commits pending writes together, each in its
+// own subtransaction.
+type Server struct {
+	env  *lmdb.Env
+	pool *lmdbpool.TxnPool
+
+	writes chan *writeReq
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex
+	dbis   map[string]lmdb.DBI
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+type writeReq struct {
+	fn   lmdb.TxnOp
+	errc chan error
+}
+
+// NewServer returns a Server for env and starts its writer goroutine.
+func NewServer(env *lmdb.Env) (*Server, error) {
+	s := &Server{
+		env:    env,
+		pool:   lmdbpool.NewTxnPool(env),
+		writes: make(chan *writeReq),
+		done:   make(chan struct{}),
+		dbis:   make(map[string]lmdb.DBI),
+		conns:  make(map[net.Conn]bool),
+	}
+	s.pool.UpdateHandling = lmdbpool.HandleIdle
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		s.dbis[rootName], err = txn.OpenRoot(0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.writer()
+	return s, nil
+}
+
+// Close stops the writer goroutine, closes client connections, and releases
+// pooled transactions.  Close does not close the environment.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosed
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	close(s.done)
+	s.wg.Wait()
+	s.pool.Close()
+	return nil
+}
+
+// Serve accepts connections on ln and serves each in its own goroutine until
+// ln is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return errClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// writer executes write requests on a goroutine locked to its thread.
+func (s *Server) writer() {
+	defer s.wg.Done()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	for {
+		var batch []*writeReq
+		select {
+		case <-s.done:
+			return
+		case req := <-s.writes:
+			batch = append(batch, req)
+		}
+	fill:
+		for len(batch) < maxBatch {
+			select {
+			case req := <-s.writes:
+				batch = append(batch, req)
+			default:
+				break fill
+			}
+		}
+
+		errs := make([]error, len(batch))
+		err := s.pool.Update(func(txn *lmdb.Txn) error {
+			for i, req := range batch {
+				errs[i] = txn.Sub(req.fn)
+			}
+			return nil
+		})
+		for i, req := range batch {
+			if err != nil {
+				req.errc <- err
+			} else {
+				req.errc <- errs[i]
+			}
+		}
+	}
+}
+
+// update executes fn in the writer goroutine and returns once it has been
+// committed.
+func (s *Server) update(fn lmdb.TxnOp) error {
+	req := &writeReq{fn: fn, errc: make(chan error, 1)}
+	select {
+	case s.writes <- req:
+	case <-s.done:
+		return errClosed
+	}
+	return <-req.errc
+}
+
+// dbi returns the handle for the named database, creating the database if
+// necessary.
+func (s *Server) dbi(name string) (lmdb.DBI, error) {
+	s.mu.RLock()
+	dbi, ok := s.dbis[name]
+	s.mu.RUnlock()
+	if ok {
+		return dbi, nil
+	}
+	err := s.update(func(txn *lmdb.Txn) (err error) {
+		dbi, err = txn.OpenDBI(name, lmdb.Create)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.dbis[name] = dbi
+	s.mu.Unlock()
+	return dbi, nil
+}
+
+// client is the state of a connection.
+type client struct {
+	s      *Server
+	w      *replyWriter
+	dbName string
+	dbi    lmdb.DBI
+	quit   bool
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	root, _ := s.dbi(rootName)
+	c := &client{
+		s:      s,
+		w:      &replyWriter{w: bufio.NewWriter(conn)},
+		dbName: rootName,
+		dbi:    root,
+	}
+	for !c.quit {
+		args, err := readCommand(r)
+		if err != nil {
+			if err == errProtocol {
+				c.w.Error("ERR Protocol error")
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		c.exec(args)
+		// Replies to pipelined commands are flushed together.
+		if r.Buffered() == 0 || c.quit {
+			if c.w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+type command struct {
+	fn    func(c *client, args [][]byte)
+	arity int // The minimum number of arguments, including the name.
+	even  bool
+	odd   bool
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"ping":    {fn: (*client).ping, arity: 1},
+		"echo":    {fn: (*client).echo, arity: 2},
+		"quit":    {fn: (*client).quitCmd, arity: 1},
+		"command": {fn: (*client).commandCmd, arity: 1},
+		"select":  {fn: (*client).selectCmd, arity: 2},
+		"get":     {fn: (*client).get, arity: 2},
+		"mget":    {fn: (*client).mget, arity: 2},
+		"exists":  {fn: (*client).exists, arity: 2},
+		"set":     {fn: (*client).set, arity: 3},
+		"mset":    {fn: (*client).mset, arity: 3, odd: true},
+		"del":     {fn: (*client).del, arity: 2},
+		"scan":    {fn: (*client).scan, arity: 2, even: true},
+		"info":    {fn: (*client).info, arity: 1},
+	}
+}
+
+func (c *client) exec(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.w.Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if len(args) < cmd.arity || (cmd.even && len(args)%2 != 0) || (cmd.odd && len(args)%2 != 1) {
+		c.w.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	cmd.fn(c, args)
+}
+
+func (c *client) replyErr(err error) {
+	c.w.Error("ERR " + err.Error())
+}
+
+func (c *client) ping(args [][]byte) {
+	if len(args) > 1 {
+		c.w.Bulk(args[1])
+		return
+	}
+	c.w.Status("PONG")
+}
+
+func (c *client) echo(args [][]byte) {
+	c.w.Bulk(args[1])
+}
+
+func (c *client) quitCmd(args [][]byte) {
+	c.w.Status("OK")
+	c.quit = true
+}
+
+// commandCmd replies with an empty list so that clients which query command
+// metadata on connect may proceed.
+func (c *client) commandCmd(args [][]byte) {
+	c.w.Array(0)
+}
+
+// selectCmd changes the database of the connection.  The main database is
+// named "0" and other names refer to named databases.
+func (c *client) selectCmd(args [][]byte) {
+	name := string(args[1])
+	dbi, err := c.s.dbi(name)
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	c.dbName = name
+	c.dbi = dbi
+	c.w.Status("OK")
+}
+
+func (c *client) get(args [][]byte) {
+	var val []byte
+	err := c.s.pool.View(func(txn *lmdb.Txn) (err error) {
+		val, err = txn.Get(c.dbi, args[1])
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	c.w.Bulk(val)
+}
+
+func (c *client) mget(args [][]byte) {
+	vals := make([][]byte, len(args)-1)
+	err := c.s.pool.View(func(txn *lmdb.Txn) (err error) {
+		for i, key := range args[1:] {
+			vals[i], err = txn.Get(c.dbi, key)
+			if lmdb.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	c.w.Array(len(vals))
+	for _, v := range vals {
+		c.w.Bulk(v)
+	}
+}
+
+func (c *client) exists(args [][]byte) {
+	var n int64
+	err := c.s.pool.View(func(txn *lmdb.Txn) (err error) {
+		for _, key := range args[1:] {
+			_, err = txn.Get(c.dbi, key)
+			if lmdb.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	c.w.Int(n)
+}
+
+func (c *client) set(args [][]byte) {
+	if len(args) != 3 {
+		c.w.Error("ERR syntax error")
+		return
+	}
+	err := c.s.update(func(txn *lmdb.Txn) error {
+		return txn.Put(c.dbi, args[1], args[2], 0)
+	})
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	c.w.Status("OK")
+}
+
+func (c *client) mset(args [][]byte) {
+	err := c.s.update(func(txn *lmdb.Txn) (err error) {
+		for i := 1; i < len(args); i += 2 {
+			err = txn.Put(c.dbi, args[i], args[i+1], 0)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	c.w.Status("OK")
+}
+
+func (c *client) del(args [][]byte) {
+	var n int64
+	err := c.s.update(func(txn *lmdb.Txn) (err error) {
+		n = 0
+		for _, key := range args[1:] {
+			err = txn.Del(c.dbi, key, nil)
+			if lmdb.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	c.w.Int(n)
+}
+
+// scan implements SCAN.  Cursors are the hex encoding of the next key to
+// examine, or "0".  Only patterns of the form "prefix*" are supported.
+func (c *client) scan(args [][]byte) {
+	var start []byte
+	if string(args[1]) != "0" {
+		var err error
+		start, err = hex.DecodeString(string(args[1]))
+		if err != nil || len(start) == 0 {
+			c.w.Error("ERR invalid cursor")
+			return
+		}
+	}
+	var prefix []byte
+	var exact bool
+	count := defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			prefix = bytes.TrimSuffix(args[i+1], []byte("*"))
+			exact = len(prefix) == len(args[i+1])
+			if bytes.ContainsAny(prefix, `*?[\`) {
+				c.w.Error("ERR only prefix patterns are supported")
+				return
+			}
+		case "count":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n <= 0 {
+				c.w.Error("ERR value is not an integer or out of range")
+				return
+			}
+			count = n
+		default:
+			c.w.Error("ERR syntax error")
+			return
+		}
+	}
+
+	var keys [][]byte
+	var next []byte
+	err := c.s.pool.View(func(txn *lmdb.Txn) (err error) {
+		cur, err := txn.OpenCursor(c.dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+		if len(prefix) > 0 && (start == nil || bytes.Compare(start, prefix) < 0) {
+			start = prefix
+		}
+		var k []byte
+		if start == nil {
+			k, _, err = cur.Get(nil, nil, lmdb.First)
+		} else {
+			k, _, err = cur.Get(start, nil, lmdb.SetRange)
+		}
+		for n := 0; err == nil; n++ {
+			if !bytes.HasPrefix(k, prefix) {
+				return nil
+			}
+			if n == count {
+				next = k
+				return nil
+			}
+			if !exact || bytes.Equal(k, prefix) {
+				keys = append(keys, k)
+			}
+			k, _, err = cur.Get(nil, nil, lmdb.NextNoDup)
+		}
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	c.w.Array(2)
+	if next == nil {
+		c.w.Bulk([]byte("0"))
+	} else {
+		c.w.Bulk([]byte(hex.EncodeToString(next)))
+	}
+	c.w.Array(len(keys))
+	for _, k := range keys {
+		c.w.Bulk(k)
+	}
+}
+
+// info describes the environment and the connection's database.
+func (c *client) info(args [][]byte) {
+	info, err := c.s.env.Info()
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	var stat *lmdb.Stat
+	err = c.s.pool.View(func(txn *lmdb.Txn) (err error) {
+		stat, err = txn.Stat(c.dbi)
+		return err
+	})
+	if err != nil {
+		c.replyErr(err)
+		return
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Environment\r\n")
+	fmt.Fprintf(&b, "lmdb_version:%s\r\n", lmdb.VersionString())
+	fmt.Fprintf(&b, "map_size:%d\r\n", info.MapSize)
+	fmt.Fprintf(&b, "last_pgno:%d\r\n", info.LastPNO)
+	fmt.Fprintf(&b, "last_txnid:%d\r\n", info.LastTxnID)
+	fmt.Fprintf(&b, "max_readers:%d\r\n", info.MaxReaders)
+	fmt.Fprintf(&b, "num_readers:%d\r\n", info.NumReaders)
+	fmt.Fprintf(&b, "\r\n# Database\r\n")
+	fmt.Fprintf(&b, "name:%s\r\n", c.dbName)
+	fmt.Fprintf(&b, "page_size:%d\r\n", stat.PSize)
+	fmt.Fprintf(&b, "depth:%d\r\n", stat.Depth)
+	fmt.Fprintf(&b, "branch_pages:%d\r\n", stat.BranchPages)
+	fmt.Fprintf(&b, "leaf_pages:%d\r\n", stat.LeafPages)
+	fmt.Fprintf(&b, "overflow_pages:%d\r\n", stat.OverflowPages)
+	fmt.Fprintf(&b, "entries:%d\r\n", stat.Entries)
+	c.w.Bulk(b.Bytes())
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+)
+
+// testClient is a minimal RESP client.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *testClient) send(args ...string) {
+	fmt.Fprintf(c.conn, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.conn, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// do sends a command and returns its reply.  Status replies are returned as
+// strings, errors as error values, integers as int64, bulk strings as []byte
+// (nil for a null reply), and arrays as []interface{}.
+func (c *testClient) do(args ...string) interface{} {
+	c.send(args...)
+	return c.read()
+}
+
+func (c *testClient) read() interface{} {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return n
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if n < 0 {
+			return []byte(nil)
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, b)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return b[:n]
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		v := make([]interface{}, n)
+		for i := range v {
+			v[i] = c.read()
+		}
+		return v
+	}
+	c.t.Fatalf("unexpected reply: %q", line)
+	return nil
+}
+
+func bulks(v interface{}) []string {
+	var s []string
+	for _, b := range v.([]interface{}) {
+		s = append(s, string(b.([]byte)))
+	}
+	return s
+}
+
+func TestReadCommand(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		args []string
+		err  error
+	}{
+		{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n", []string{"GET", "a"}, nil},
+		{"PING\r\n", []string{"PING"}, nil},
+		{"*-1\r\n", nil, nil},
+		{"*0\r\n", nil, nil},
+		{"*1\r\n$-1\r\n", nil, errProtocol},
+		{"*1\r\n$1\r\nab\r\n", nil, errProtocol},
+		{fmt.Sprintf("*1\r\n$%d\r\n", maxBulk+1), nil, errProtocol},
+		{fmt.Sprintf("*%d\r\n", maxArgs+1), nil, errProtocol},
+		// Sizes claimed by the client are not allocated before the data
+		// arrives.
+		{fmt.Sprintf("*1\r\n$%d\r\nab", maxBulk), nil, io.ErrUnexpectedEOF},
+		{fmt.Sprintf("*%d\r\n", maxArgs), nil, io.EOF},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		args, err := readCommand(bufio.NewReader(strings.NewReader(test.in)))
+		runtime.ReadMemStats(&after)
+		if err != test.err {
+			t.Errorf("%q: unexpected error: %v", test.in, err)
+		}
+		var s []string
+		for _, arg := range args {
+			s = append(s, string(arg))
+		}
+		if !reflect.DeepEqual(s, test.args) {
+			t.Errorf("%q: %q (!= %q)", test.in, s, test.args)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("%q: allocated %d bytes", test.in, n)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	s, err := NewServer(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	defer func() {
+		ln.Close()
+		<-done
+		s.Close()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	expect := func(v interface{}, args ...string) {
+		t.Helper()
+		got := c.do(args...)
+		if err, ok := got.(error); ok {
+			got = "-" + err.Error()
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("%q: %#v (!= %#v)", args, got, v)
+		}
+	}
+
+	expect("PONG", "PING")
+	expect("OK", "SET", "a", "1")
+	expect([]byte("1"), "GET", "a")
+	expect([]byte(nil), "GET", "missing")
+	expect("OK", "MSET", "b", "2", "c", "3", "user:1", "x", "user:2", "y")
+	expect(int64(2), "EXISTS", "a", "b", "missing")
+	expect(int64(1), "DEL", "a", "missing")
+	expect([]interface{}{[]byte(nil), []byte("2")}, "MGET", "a", "b")
+	expect("-ERR wrong number of arguments for 'mset' command", "MSET", "a")
+	expect("-ERR unknown command 'FLUSHALL'", "FLUSHALL")
+
+	var keys []string
+	cursor := "0"
+	for {
+		v := c.do("SCAN", cursor, "COUNT", "2").([]interface{})
+		cursor = string(v[0].([]byte))
+		keys = append(keys, bulks(v[1])...)
+		if cursor == "0" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(keys, []string{"b", "c", "user:1", "user:2"}) {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+	v := c.do("SCAN", "0", "MATCH", "user:*").([]interface{})
+	if keys := bulks(v[1]); !reflect.DeepEqual(keys, []string{"user:1", "user:2"}) {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+	expect("-ERR only prefix patterns are supported", "SCAN", "0", "MATCH", "*:1")
+
+	expect("OK", "SELECT", "other")
+	expect([]byte(nil), "GET", "b")
+	expect("OK", "SET", "b", "other")
+	expect([]byte("other"), "GET", "b")
+	info := string(c.do("INFO").([]byte))
+	if !strings.Contains(info, "name:other\r\n") || !strings.Contains(info, "entries:1\r\n") {
+		t.Errorf("unexpected info: %q", info)
+	}
+	expect("OK", "SELECT", "0")
+	expect([]byte("2"), "GET", "b")
+
+	// Pipelined commands are answered in order.
+	c.send("SET", "p", "1")
+	c.send("GET", "p")
+	if v := c.read(); v != "OK" {
+		t.Errorf("unexpected reply: %#v", v)
+	}
+	if v := c.read(); !reflect.DeepEqual(v, []byte("1")) {
+		t.Errorf("unexpected reply: %#v", v)
+	}
+
+	// A null command is ignored.
+	fmt.Fprintf(conn, "*-1\r\n")
+	expect("PONG", "PING")
+
+	expect("OK", "QUIT")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
@@ -6,6 +6,16 @@ Command line flags mirror the flags for the original program.  For information
 about, run lmdb_stat with the -h flag.
 
 	lmdb_stat -h
+
+In addition to the flags of mdb_stat, the -m flag displays both meta pages of
+the environment, which is useful when checking a backup or a map size change
+made by another process.  The -space flag reports how the pages of each
+database displayed are used, including the pages holding the duplicates of
+DupSort databases, and lists the largest values stored.  Reading every page of
+a database is much slower than reading its status.  With the -json flag the
+report is written as a JSON document in which keys are hex encoded.
+
+	lmdb_stat -a -space -top 20 -json /path/to/env
 */
 package main
 
@@ -13,6 +23,8 @@ import "C"
 
 import (
 	"bufio"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -30,6 +42,7 @@ import (
 func main() {
 	opt := &Options{}
 	flag.BoolVar(&opt.PrintInfo, "e", false, "Display information about the database environment")
+	flag.BoolVar(&opt.PrintMeta, "m", false, "Display the contents of both meta pages")
 	flag.BoolVar(&opt.PrintFree, "f", false, "Display freelist information")
 	flag.BoolVar(&opt.PrintFreeSummary, "ff", false, "Display freelist information")
 	flag.BoolVar(&opt.PrintFreeFull, "fff", false, "Display freelist information")
@@ -44,6 +57,9 @@ func main() {
 	}, "  "))
 	flag.BoolVar(&opt.PrintStatAll, "a", false, "Display the status of all databases in the environment")
 	flag.StringVar(&opt.PrintStatSub, "s", "", "Display the status of a specific subdatabase.")
+	flag.BoolVar(&opt.PrintSpace, "space", false, "Display the space used by each database and its largest values")
+	flag.IntVar(&opt.SpaceTop, "top", 10, "The number of largest values to display with -space")
+	flag.BoolVar(&opt.JSON, "json", false, "Display the status and space of databases as JSON.  Implies -space.")
 	flag.BoolVar(&opt.Debug, "D", false, "print debug information")
 	flag.Parse()
 
@@ -52,6 +68,12 @@ func main() {
 	if opt.PrintStatAll && opt.PrintStatSub != "" {
 		log.Fatal("only one of -a and -s may be provided")
 	}
+	if opt.JSON && (opt.PrintInfo || opt.PrintMeta || opt.PrintFree || opt.PrintFreeSummary || opt.PrintFreeFull || opt.PrintReaders || opt.PrintReadersCheck) {
+		log.Fatal("-json may only be combined with -a, -s, and -top")
+	}
+	if opt.SpaceTop < 0 {
+		log.Fatal("-top must not be negative")
+	}
 
 	if flag.NArg() > 1 {
 		log.Fatalf("too many argument provided")
@@ -86,15 +108,19 @@ func main() {
 // command line arguments.
 type Options struct {
 	PrintInfo         bool
+	PrintMeta         bool
 	PrintReaders      bool
 	PrintReadersCheck bool
 	PrintFree         bool
 	PrintFreeSummary  bool
 	PrintFreeFull     bool
 	PrintStatAll      bool
+	PrintSpace        bool
+	JSON              bool
 	Debug             bool
 
 	PrintStatSub string
+	SpaceTop     int
 	Path         string
 }
 
@@ -115,6 +141,10 @@ func doMain(opt *Options) error {
 		return err
 	}
 
+	if opt.JSON {
+		return doPrintJSON(env, opt)
+	}
+
 	if opt.PrintInfo {
 		err = doPrintInfo(env, opt)
 		if err != nil {
@@ -122,6 +152,13 @@ func doMain(opt *Options) error {
 		}
 	}
 
+	if opt.PrintMeta {
+		err = doPrintMeta(env, opt)
+		if err != nil {
+			return err
+		}
+	}
+
 	if opt.PrintReaders || opt.PrintReadersCheck {
 		err = doPrintReaders(env, opt)
 		if err != nil {
@@ -177,6 +214,42 @@ func doPrintInfo(env *lmdb.Env, opt *Options) error {
 	return nil
 }
 
+func doPrintMeta(env *lmdb.Env, opt *Options) error {
+	meta, err := env.Meta()
+	if err != nil {
+		return err
+	}
+
+	// An empty database has no root page.
+	root := func(db lmdb.MetaDB) string {
+		if db.Depth == 0 {
+			return "none"
+		}
+		return fmt.Sprint(db.Root)
+	}
+
+	fmt.Println("Meta Pages")
+	for _, m := range meta {
+		if m.Current {
+			fmt.Printf("  Meta page %d (current)\n", m.Page)
+		} else {
+			fmt.Printf("  Meta page %d\n", m.Page)
+		}
+		fmt.Println("    Transaction ID:", m.TxnID)
+		fmt.Println("    Map size:", m.MapSize)
+		fmt.Println("    Page size:", m.PSize)
+		fmt.Println("    Last page:", m.LastPNO)
+		fmt.Printf("    Flags: %#x\n", m.Flags)
+		fmt.Println("    Free DB root:", root(m.Free))
+		fmt.Println("    Free DB entries:", m.Free.Entries)
+		fmt.Println("    Main DB root:", root(m.Main))
+		fmt.Println("    Main DB depth:", m.Main.Depth)
+		fmt.Println("    Main DB entries:", m.Main.Entries)
+	}
+
+	return nil
+}
+
 func doPrintReaders(env *lmdb.Env, opt *Options) error {
 	fmt.Println("Reader Table Status")
 	w := bufio.NewWriter(os.Stdout)
@@ -304,6 +377,16 @@ func doPrintStatRoot(env *lmdb.Env, opt *Options) error {
 	fmt.Println("  Overflow pages:", stat.OverflowPages)
 	fmt.Println("  Entries:", stat.Entries)
 
+	if opt.PrintSpace {
+		return env.View(func(txn *lmdb.Txn) (err error) {
+			dbi, err := txn.OpenRoot(0)
+			if err != nil {
+				return err
+			}
+			return printSpaceDB(txn, dbi, opt)
+		})
+	}
+
 	return nil
 }
 
@@ -330,7 +413,15 @@ func printStatDB(env *lmdb.Env, txn *lmdb.Txn, db string, opt *Options) error {
 	}
 
 	fmt.Println("Status of", db)
-	return printStat(stat, opt)
+	err = printStat(stat, opt)
+	if err != nil {
+		return err
+	}
+
+	if opt.PrintSpace {
+		return printSpaceDB(txn, dbi, opt)
+	}
+	return nil
 }
 
 func printStat(stat *lmdb.Stat, opt *Options) error {
@@ -343,27 +434,201 @@ func printStat(stat *lmdb.Stat, opt *Options) error {
 	return nil
 }
 
+func printSpaceDB(txn *lmdb.Txn, dbi lmdb.DBI, opt *Options) error {
+	space, err := txn.Space(dbi, opt.SpaceTop)
+	if err != nil {
+		return err
+	}
+
+	pages := func(name string, s lmdb.PageSpace) {
+		fmt.Printf("  %s: %d (%d bytes, %.1f%% used)\n", name, s.Pages, s.Bytes, 100*s.Fill())
+	}
+	fmt.Println("  Space")
+	pages("  Branch pages", space.Branch)
+	pages("  Leaf pages", space.Leaf)
+	pages("  Overflow pages", space.Overflow)
+	if space.DupBranch.Pages > 0 || space.DupLeaf.Pages > 0 || space.SubPages > 0 {
+		pages("  Duplicate branch pages", space.DupBranch)
+		pages("  Duplicate leaf pages", space.DupLeaf)
+		fmt.Printf("    Duplicate sub-pages: %d (%d bytes)\n", space.SubPages, space.SubPageBytes)
+	}
+	pages("  Total", space.Total())
+	fmt.Println("    Key bytes:", space.KeyBytes)
+	fmt.Println("    Value bytes:", space.ValueBytes)
+	if len(space.Largest) > 0 {
+		fmt.Println("    Largest values:")
+		for _, v := range space.Largest {
+			fmt.Printf("      %x: %d bytes", v.Key, v.Size)
+			if v.OverflowPages > 0 {
+				fmt.Printf(", %d overflow pages", v.OverflowPages)
+			}
+			fmt.Println()
+		}
+	}
+
+	return nil
+}
+
 func doPrintStatAll(env *lmdb.Env, opt *Options) error {
 	return env.View(func(txn *lmdb.Txn) (err error) {
-		dbi, err := txn.OpenRoot(0)
+		return scanDBs(txn, func(name string) error {
+			return printStatDB(env, txn, name, opt)
+		})
+	})
+}
+
+// scanDBs calls fn with the name of each key in the root database.  Keys
+// which do not name a database are skipped.
+func scanDBs(txn *lmdb.Txn, fn func(name string) error) error {
+	dbi, err := txn.OpenRoot(0)
+	if err != nil {
+		return err
+	}
+
+	s := lmdbscan.New(txn, dbi)
+	defer s.Close()
+	for s.Scan() {
+		err = fn(string(s.Key()))
+		if e, ok := err.(*lmdb.OpError); ok {
+			if e.Op == "mdb_dbi_open" {
+				continue
+			}
+		}
 		if err != nil {
-			return err
+			return fmt.Errorf("%v (%s)", err, s.Key())
 		}
-		defer env.CloseDBI(dbi)
+	}
+	return s.Err()
+}
 
-		s := lmdbscan.New(txn, dbi)
-		defer s.Close()
-		for s.Scan() {
-			err = printStatDB(env, txn, string(s.Key()), opt)
-			if e, ok := err.(*lmdb.OpError); ok {
-				if e.Op == "mdb_dbi_open" {
-					continue
-				}
+// jsonReport is the document written with the -json flag.
+type jsonReport struct {
+	Path      string   `json:"path"`
+	Databases []jsonDB `json:"databases"`
+}
+
+// jsonDB is the status and space of a database.  The main database has an
+// empty name.
+type jsonDB struct {
+	Name          string      `json:"name"`
+	PageSize      uint        `json:"page_size"`
+	Depth         uint        `json:"depth"`
+	Entries       uint64      `json:"entries"`
+	Branch        jsonPages   `json:"branch"`
+	Leaf          jsonPages   `json:"leaf"`
+	Overflow      jsonPages   `json:"overflow"`
+	DupBranch     jsonPages   `json:"dup_branch"`
+	DupLeaf       jsonPages   `json:"dup_leaf"`
+	SubPages      uint64      `json:"sub_pages"`
+	SubPageBytes  uint64      `json:"sub_page_bytes"`
+	KeyBytes      uint64      `json:"key_bytes"`
+	ValueBytes    uint64      `json:"value_bytes"`
+	Total         jsonPages   `json:"total"`
+	LargestValues []jsonValue `json:"largest_values"`
+}
+
+type jsonPages struct {
+	Pages uint64  `json:"pages"`
+	Bytes uint64  `json:"bytes"`
+	Used  uint64  `json:"used"`
+	Fill  float64 `json:"fill"`
+}
+
+type jsonValue struct {
+	Key           string `json:"key"`
+	Size          uint64 `json:"size"`
+	OverflowPages uint64 `json:"overflow_pages"`
+}
+
+func newJSONPages(s lmdb.PageSpace) jsonPages {
+	return jsonPages{Pages: s.Pages, Bytes: s.Bytes, Used: s.Used, Fill: s.Fill()}
+}
+
+func doPrintJSON(env *lmdb.Env, opt *Options) error {
+	report := &jsonReport{Path: opt.Path, Databases: []jsonDB{}}
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		add := func(name string, dbi lmdb.DBI) error {
+			db, err := getJSONDB(txn, dbi, opt)
+			if err != nil {
+				return err
+			}
+			db.Name = name
+			report.Databases = append(report.Databases, *db)
+			return nil
+		}
+		open := func(name string) error {
+			dbi, err := txn.OpenDBI(name, 0)
+			if err != nil {
+				return err
 			}
+			defer env.CloseDBI(dbi)
+			return add(name, dbi)
+		}
+
+		root, err := txn.OpenRoot(0)
+		if err != nil {
+			return err
+		}
+		err = add("", root)
+		if err != nil {
+			return err
+		}
+		if opt.PrintStatAll {
+			return scanDBs(txn, open)
+		}
+		if opt.PrintStatSub != "" {
+			err = open(opt.PrintStatSub)
 			if err != nil {
-				return fmt.Errorf("%v (%s)", err, s.Key())
+				return fmt.Errorf("%v (%s)", err, opt.PrintStatSub)
 			}
 		}
-		return s.Err()
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func getJSONDB(txn *lmdb.Txn, dbi lmdb.DBI, opt *Options) (*jsonDB, error) {
+	stat, err := txn.Stat(dbi)
+	if err != nil {
+		return nil, err
+	}
+	space, err := txn.Space(dbi, opt.SpaceTop)
+	if err != nil {
+		return nil, err
+	}
+	db := &jsonDB{
+		PageSize:      stat.PSize,
+		Depth:         stat.Depth,
+		Entries:       stat.Entries,
+		Branch:        newJSONPages(space.Branch),
+		Leaf:          newJSONPages(space.Leaf),
+		Overflow:      newJSONPages(space.Overflow),
+		DupBranch:     newJSONPages(space.DupBranch),
+		DupLeaf:       newJSONPages(space.DupLeaf),
+		SubPages:      space.SubPages,
+		SubPageBytes:  space.SubPageBytes,
+		KeyBytes:      space.KeyBytes,
+		ValueBytes:    space.ValueBytes,
+		Total:         newJSONPages(space.Total()),
+		LargestValues: make([]jsonValue, len(space.Largest)),
+	}
+	for i, v := range space.Largest {
+		db.LargestValues[i] = jsonValue{
+			Key:           hex.EncodeToString(v.Key),
+			Size:          v.Size,
+			OverflowPages: v.OverflowPages,
+		}
+	}
+	return db, nil
 }
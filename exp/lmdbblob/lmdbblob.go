@@ -0,0 +1,507 @@
+/*
+Package lmdbblob stores large values in an LMDB database as sequences of
+fixed-size chunks.
+
+Storing a value of many megabytes as a single item requires a run of
+contiguous overflow pages, which fragments the freelist once the value is
+deleted or replaced (the problem lmdb.Env.SetMaxFreelistReuse works around).
+A Store instead splits each blob into chunks of Store.ChunkSize bytes, each
+of which fits in a short run of pages.
+
+	blobs := lmdbblob.New(dbi, 0)
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		w, err := blobs.Create(txn, []byte("backup.tar"))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	})
+
+Blobs are read with an io.ReadSeeker inside any transaction.
+
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		r, err := blobs.Open(txn, []byte("backup.tar"))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, r)
+		return err
+	})
+
+The chunks of a blob are stored under keys made of the blob name, the
+big-endian 32-bit chunk index and the 16-bit length of the name, so that the
+keys of different blobs never collide.  A final item under the index
+0xffffffff describes the blob's size, chunk size and SHA-256 hash.  A Store
+should have a database to itself.
+*/
+package lmdbblob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// DefaultChunkSize is the chunk size used by a Store with a ChunkSize of 0.
+const DefaultChunkSize = 64 << 10
+
+// MaxNameLen is the maximum length of a blob name.  Names must also leave room
+// for a 6 byte suffix within the maximum key size of the environment.
+const MaxNameLen = math.MaxUint16
+
+const (
+	infoIndex = math.MaxUint32
+	suffixLen = 4 + 2
+	infoLen   = 8 + 4 + sha256.Size
+)
+
+// ErrCorrupt is returned (possibly wrapped) when a blob's items are missing or
+// inconsistent.
+var ErrCorrupt = errors.New("lmdbblob: corrupt blob")
+
+// errClosed is returned when using a closed Writer.
+var errClosed = errors.New("lmdbblob: writer is closed")
+
+// Store holds blobs in a database.
+type Store struct {
+	DBI lmdb.DBI
+
+	// ChunkSize is the size of the chunks of newly created blobs.  Existing
+	// blobs keep the chunk size they were written with.
+	ChunkSize int
+}
+
+// New returns a Store for dbi which writes chunks of chunkSize bytes.  If
+// chunkSize is 0 DefaultChunkSize is used.
+func New(dbi lmdb.DBI, chunkSize int) *Store {
+	return &Store{
+		DBI:       dbi,
+		ChunkSize: chunkSize,
+	}
+}
+
+func (s *Store) chunkSize() int {
+	if s.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return s.ChunkSize
+}
+
+// Info describes a blob.
+type Info struct {
+	Size      int64
+	ChunkSize int
+	Hash      [sha256.Size]byte // SHA-256 hash of the content.
+}
+
+// Chunks returns the number of chunks holding the blob.
+func (info *Info) Chunks() int {
+	return int((info.Size + int64(info.ChunkSize) - 1) / int64(info.ChunkSize))
+}
+
+func chunkKey(buf, name []byte, i uint32) []byte {
+	var suffix [suffixLen]byte
+	binary.BigEndian.PutUint32(suffix[:], i)
+	binary.BigEndian.PutUint16(suffix[4:], uint16(len(name)))
+	buf = append(buf[:0], name...)
+	return append(buf, suffix[:]...)
+}
+
+func checkName(name []byte) error {
+	if len(name) == 0 || len(name) > MaxNameLen {
+		return fmt.Errorf("lmdbblob: invalid name length %d", len(name))
+	}
+	return nil
+}
+
+// Stat returns information about the named blob.  Stat returns an error
+// satisfying lmdb.IsNotFound if the blob does not exist.
+func (s *Store) Stat(txn *lmdb.Txn, name []byte) (*Info, error) {
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	v, err := txn.Get(s.DBI, chunkKey(nil, name, infoIndex))
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != infoLen {
+		return nil, fmt.Errorf("%w: %q: invalid info", ErrCorrupt, name)
+	}
+	info := &Info{
+		Size:      int64(binary.BigEndian.Uint64(v)),
+		ChunkSize: int(binary.BigEndian.Uint32(v[8:])),
+	}
+	copy(info.Hash[:], v[12:])
+	if info.Size < 0 || info.ChunkSize <= 0 || info.Chunks() >= infoIndex {
+		return nil, fmt.Errorf("%w: %q: invalid info", ErrCorrupt, name)
+	}
+	return info, nil
+}
+
+// Delete removes the named blob.  Delete returns an error satisfying
+// lmdb.IsNotFound if the blob does not exist.
+func (s *Store) Delete(txn *lmdb.Txn, name []byte) error {
+	info, err := s.Stat(txn, name)
+	if err != nil {
+		return err
+	}
+	var key []byte
+	for i := 0; i < info.Chunks(); i++ {
+		key = chunkKey(key, name, uint32(i))
+		err = txn.Del(s.DBI, key, nil)
+		if lmdb.IsNotFound(err) {
+			return fmt.Errorf("%w: %q: missing chunk %d", ErrCorrupt, name, i)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Del(s.DBI, chunkKey(key, name, infoIndex), nil)
+}
+
+// deleteChunks deletes the chunks of the named blob from the first until one
+// is missing.  Chunks are written in order, so this removes every chunk
+// written by a Writer which was not closed.
+func (s *Store) deleteChunks(txn *lmdb.Txn, name []byte) error {
+	var key []byte
+	for i := uint32(0); i < infoIndex; i++ {
+		key = chunkKey(key, name, i)
+		err := txn.Del(s.DBI, key, nil)
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify reads the named blob and checks its content against the hash stored
+// when it was written.
+func (s *Store) Verify(txn *lmdb.Txn, name []byte) error {
+	r, err := s.Open(txn, name)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), r.info.Hash[:]) {
+		return fmt.Errorf("%w: %q: hash mismatch", ErrCorrupt, name)
+	}
+	return nil
+}
+
+// Writer writes a blob.  The blob is not visible to Open and Stat until the
+// Writer is closed, which must happen before txn is committed.
+type Writer struct {
+	s      *Store
+	txn    *lmdb.Txn
+	name   []byte
+	key    []byte
+	chunk  int
+	size   int64
+	n      uint32 // chunks written
+	buf    []byte // partial chunk
+	hash   hash.Hash
+	closed bool
+}
+
+// Create returns a Writer for the named blob, replacing any existing blob with
+// that name.  Create also removes chunks left under the name by a Writer which
+// was not closed before its transaction committed.
+func (s *Store) Create(txn *lmdb.Txn, name []byte) (*Writer, error) {
+	err := s.Delete(txn, name)
+	if err != nil && !lmdb.IsNotFound(err) {
+		return nil, err
+	}
+	err = s.deleteChunks(txn, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		s:     s,
+		txn:   txn,
+		name:  append([]byte(nil), name...),
+		chunk: s.chunkSize(),
+		hash:  sha256.New(),
+	}, nil
+}
+
+// reserve allocates space for the next chunk in the database.
+func (w *Writer) reserve(n int) ([]byte, error) {
+	if w.n == infoIndex {
+		return nil, fmt.Errorf("lmdbblob: %q: too many chunks", w.name)
+	}
+	w.key = chunkKey(w.key, w.name, w.n)
+	b, err := w.txn.PutReserve(w.s.DBI, w.key, n, 0)
+	if err != nil {
+		return nil, err
+	}
+	w.n++
+	return b, nil
+}
+
+// Write appends p to the blob.  Whole chunks are copied from p directly into
+// space reserved in the database.  If Write fails the returned count includes
+// only the bytes of p which were stored or buffered.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errClosed
+	}
+	n := 0
+	if len(w.buf) > 0 {
+		k := w.chunk - len(w.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		w.buf = append(w.buf, p[:k]...)
+		if len(w.buf) == w.chunk {
+			err := w.writeChunk(w.buf)
+			if err != nil {
+				w.buf = w.buf[:len(w.buf)-k]
+				return 0, err
+			}
+			w.buf = w.buf[:0]
+		}
+		w.add(p[:k])
+		n = k
+	}
+	for len(p)-n >= w.chunk {
+		err := w.writeChunk(p[n : n+w.chunk])
+		if err != nil {
+			return n, err
+		}
+		w.add(p[n : n+w.chunk])
+		n += w.chunk
+	}
+	w.buf = append(w.buf, p[n:]...)
+	w.add(p[n:])
+	return len(p), nil
+}
+
+// add includes data accepted by the Writer in the blob's size and hash.
+func (w *Writer) add(p []byte) {
+	w.hash.Write(p)
+	w.size += int64(len(p))
+}
+
+func (w *Writer) writeChunk(p []byte) error {
+	b, err := w.reserve(len(p))
+	if err != nil {
+		return err
+	}
+	copy(b, p)
+	return nil
+}
+
+// ReadFrom appends the data read from r to the blob.  Data is read directly
+// into space reserved in the database, avoiding a copy for all but the final
+// chunk.  ReadFrom is used by io.Copy.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.closed {
+		return 0, errClosed
+	}
+	var total int64
+	if len(w.buf) > 0 {
+		// Complete the partial chunk from previous writes.
+		k := len(w.buf)
+		w.buf = append(w.buf, make([]byte, w.chunk-k)...)
+		n, err := io.ReadFull(r, w.buf[k:])
+		w.buf = w.buf[:k+n]
+		w.add(w.buf[k:])
+		total += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		err = w.writeChunk(w.buf)
+		if err != nil {
+			return total, err
+		}
+		w.buf = w.buf[:0]
+	}
+	for {
+		b, err := w.reserve(w.chunk)
+		if err != nil {
+			return total, err
+		}
+		n, err := io.ReadFull(r, b)
+		w.add(b[:n])
+		total += int64(n)
+		if err == nil {
+			continue
+		}
+
+		// The reserved chunk was not filled.  Its data is kept as a
+		// partial chunk and written by a later call or by Close.
+		w.n--
+		w.buf = append(w.buf[:0], b[:n]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		derr := w.txn.Del(w.s.DBI, w.key, nil)
+		if err == nil {
+			err = derr
+		}
+		return total, err
+	}
+}
+
+// Close writes the final partial chunk and the blob's info.  Close does not
+// commit the transaction.
+func (w *Writer) Close() error {
+	if w.closed {
+		return errClosed
+	}
+	w.closed = true
+	if len(w.buf) > 0 {
+		err := w.writeChunk(w.buf)
+		if err != nil {
+			return err
+		}
+	}
+	w.key = chunkKey(w.key, w.name, infoIndex)
+	info, err := w.txn.PutReserve(w.s.DBI, w.key, infoLen, 0)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(info, uint64(w.size))
+	binary.BigEndian.PutUint32(info[8:], uint32(w.chunk))
+	w.hash.Sum(info[12:12])
+	return nil
+}
+
+// Reader reads a blob.  A Reader is only valid until its transaction
+// terminates.
+type Reader struct {
+	s     *Store
+	txn   *lmdb.Txn
+	name  []byte
+	key   []byte
+	info  *Info
+	off   int64
+	index int    // index of cur
+	cur   []byte // current chunk
+}
+
+// Open returns a Reader for the named blob.  Open returns an error satisfying
+// lmdb.IsNotFound if the blob does not exist.
+func (s *Store) Open(txn *lmdb.Txn, name []byte) (*Reader, error) {
+	info, err := s.Stat(txn, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		s:     s,
+		txn:   txn,
+		name:  append([]byte(nil), name...),
+		info:  info,
+		index: -1,
+	}, nil
+}
+
+// Info returns information about the blob being read.
+func (r *Reader) Info() *Info {
+	return r.info
+}
+
+// Size returns the size of the blob.
+func (r *Reader) Size() int64 {
+	return r.info.Size
+}
+
+// chunk returns the chunk with index i.
+func (r *Reader) chunk(i int) ([]byte, error) {
+	if i == r.index {
+		return r.cur, nil
+	}
+	r.key = chunkKey(r.key, r.name, uint32(i))
+	b, err := r.txn.Get(r.s.DBI, r.key)
+	if lmdb.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: %q: missing chunk %d", ErrCorrupt, r.name, i)
+	}
+	if err != nil {
+		return nil, err
+	}
+	want := int64(r.info.ChunkSize)
+	if rem := r.info.Size - int64(i)*want; rem < want {
+		want = rem
+	}
+	if int64(len(b)) != want {
+		return nil, fmt.Errorf("%w: %q: chunk %d has %d bytes (expected %d)", ErrCorrupt, r.name, i, len(b), want)
+	}
+	r.index, r.cur = i, b
+	return b, nil
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.off >= r.info.Size {
+		return 0, io.EOF
+	}
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("lmdbblob: negative offset")
+	}
+	var n int
+	for len(p) > 0 {
+		if off >= r.info.Size {
+			return n, io.EOF
+		}
+		i := int(off / int64(r.info.ChunkSize))
+		b, err := r.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		k := copy(p, b[off-int64(i)*int64(r.info.ChunkSize):])
+		p = p[k:]
+		off += int64(k)
+		n += k
+	}
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.info.Size
+	default:
+		return r.off, fmt.Errorf("lmdbblob: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return r.off, fmt.Errorf("lmdbblob: negative offset")
+	}
+	r.off = offset
+	return offset, nil
+}
@@ -0,0 +1,333 @@
+package lmdbblob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+const testChunkSize = 1000
+
+func TestStore(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(dbi, testChunkSize)
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, size := range []int{0, 1, testChunkSize - 1, testChunkSize, 3*testChunkSize + 5} {
+		data := make([]byte, size)
+		rnd.Read(data)
+		for _, method := range []string{"write", "readfrom", "mixed"} {
+			name := []byte(fmt.Sprintf("%s-%d", method, size))
+			err = env.Update(func(txn *lmdb.Txn) (err error) {
+				w, err := s.Create(txn, name)
+				if err != nil {
+					return err
+				}
+				switch method {
+				case "write":
+					for p := data; len(p) > 0; {
+						n := 1 + rnd.Intn(2*testChunkSize)
+						if n > len(p) {
+							n = len(p)
+						}
+						_, err = w.Write(p[:n])
+						if err != nil {
+							return err
+						}
+						p = p[n:]
+					}
+				case "readfrom":
+					_, err = io.Copy(w, bytes.NewReader(data))
+				case "mixed":
+					k := len(data) / 3
+					_, err = w.Write(data[:k])
+					if err == nil {
+						_, err = w.ReadFrom(iotest.HalfReader(bytes.NewReader(data[k:])))
+					}
+				}
+				if err != nil {
+					return err
+				}
+				return w.Close()
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			err = env.View(func(txn *lmdb.Txn) (err error) {
+				r, err := s.Open(txn, name)
+				if err != nil {
+					return err
+				}
+				if r.Size() != int64(size) || r.Info().Hash != sha256.Sum256(data) {
+					t.Errorf("%s: unexpected info: %+v", name, r.Info())
+				}
+				if r.Info().Chunks() != (size+testChunkSize-1)/testChunkSize {
+					t.Errorf("%s: %d chunks", name, r.Info().Chunks())
+				}
+				got, err := io.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("%s: unexpected content", name)
+				}
+				if size > 10 {
+					off, err := r.Seek(-10, io.SeekEnd)
+					if err != nil {
+						return err
+					}
+					got, err = io.ReadAll(r)
+					if err != nil {
+						return err
+					}
+					if !bytes.Equal(got, data[off:]) {
+						t.Errorf("%s: unexpected content after seek", name)
+					}
+				}
+				return s.Verify(txn, name)
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+	}
+
+	// Only chunks and info items are stored.
+	stat, err := env.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Entries != 3*(0+1+1+1+4+5) {
+		t.Errorf("%d entries", stat.Entries)
+	}
+
+	// Replacing and deleting blobs removes their chunks.
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		w, err := s.Create(txn, []byte("write-3005"))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte("short"))
+		if err != nil {
+			return err
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+		err = s.Delete(txn, []byte("readfrom-3005"))
+		if err != nil {
+			return err
+		}
+		err = s.Delete(txn, []byte("readfrom-3005"))
+		if !lmdb.IsNotFound(err) {
+			t.Errorf("delete: unexpected error: %v", err)
+		}
+		_, err = s.Open(txn, []byte("readfrom-3005"))
+		if !lmdb.IsNotFound(err) {
+			t.Errorf("open: unexpected error: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err = env.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Entries != 3*(0+1+1+1+4+5)-3-5 {
+		t.Errorf("%d entries", stat.Entries)
+	}
+}
+
+func TestWriter_abandoned(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(dbi, testChunkSize)
+
+	entries := func() uint64 {
+		stat, err := env.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.Entries
+	}
+
+	// The transaction commits without closing the Writer.
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		w, err := s.Create(txn, []byte("blob"))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(make([]byte, 2500))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := entries(); n != 2 {
+		t.Errorf("%d entries", n)
+	}
+
+	// Creating the blob again removes the abandoned chunks.
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		w, err := s.Create(txn, []byte("blob"))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte("short"))
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := entries(); n != 2 {
+		t.Errorf("%d entries", n)
+	}
+}
+
+var errAbort = errors.New("abort")
+
+func TestWriter_Write_mapFull(t *testing.T) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MapSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(dbi, testChunkSize)
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		w, err := s.Create(txn, []byte("blob"))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte("partial"))
+		if err != nil {
+			return err
+		}
+		p := make([]byte, 4<<20)
+		n, err := w.Write(p)
+		if !lmdb.IsMapFull(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// Only the stored chunks are counted.
+		if n == 0 || n >= len(p) || (n+len("partial"))%testChunkSize != 0 {
+			t.Errorf("wrote %d bytes", n)
+		}
+		if w.size != int64(n+len("partial")) || len(w.buf) != 0 {
+			t.Errorf("size %d, buffered %d", w.size, len(w.buf))
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_corrupt(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(dbi, testChunkSize)
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		w, err := s.Create(txn, []byte("blob"))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(make([]byte, 2500))
+		if err != nil {
+			return err
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+		err = w.Close()
+		if err == nil {
+			t.Errorf("closed twice")
+		}
+
+		// Modified content fails verification.
+		err = txn.Put(dbi, chunkKey(nil, []byte("blob"), 1), bytes.Repeat([]byte{1}, 1000), 0)
+		if err != nil {
+			return err
+		}
+		err = s.Verify(txn, []byte("blob"))
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("verify: unexpected error: %v", err)
+		}
+
+		err = txn.Put(dbi, chunkKey(nil, []byte("blob"), 2), make([]byte, 499), 0)
+		if err != nil {
+			return err
+		}
+		r, err := s.Open(txn, []byte("blob"))
+		if err != nil {
+			return err
+		}
+		_, err = r.ReadAt(make([]byte, 1), 2000)
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("short chunk: unexpected error: %v", err)
+		}
+
+		err = txn.Del(dbi, chunkKey(nil, []byte("blob"), 0), nil)
+		if err != nil {
+			return err
+		}
+		_, err = s.Open(txn, []byte("blob"))
+		if err != nil {
+			return err
+		}
+		_, err = r.ReadAt(make([]byte, 1), 0)
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("missing chunk: unexpected error: %v", err)
+		}
+		err = s.Delete(txn, []byte("blob"))
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("delete: unexpected error: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,117 @@
+package lmdbcdc
+
+import (
+	"context"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// DefaultPollInterval is the interval at which a Consumer checks for new
+// commits when Consumer.PollInterval is zero.
+const DefaultPollInterval = 100 * time.Millisecond
+
+// Consumer tails a Log from a Position.  A Consumer is not safe for
+// concurrent use by multiple goroutines.
+//
+// The consumer does not persist its position.  Applications that need to
+// resume after a restart should store Consumer.Pos (e.g. using Position.Key)
+// once they have processed the changes returned by Next.
+type Consumer struct {
+	// PollInterval is the time waited between checks for new commits.
+	PollInterval time.Duration
+
+	// MaxChanges, if non-zero, limits the number of changes returned by a
+	// single call to Next.
+	MaxChanges int
+
+	env  *lmdb.Env
+	log  *Log
+	pos  Position
+	seen int64
+}
+
+// NewConsumer returns a Consumer that reads entries of log following pos.
+// Use Log.First to obtain a position from which the entire log is read.
+func NewConsumer(env *lmdb.Env, log *Log, pos Position) *Consumer {
+	return &Consumer{
+		env:  env,
+		log:  log,
+		pos:  pos,
+		seen: -1,
+	}
+}
+
+// Pos returns the position of the last change returned by Next.
+func (c *Consumer) Pos() Position {
+	return c.pos
+}
+
+// Next blocks until at least one change follows the consumer's position and
+// returns the changes available.  Next returns early with the context's error
+// if ctx is done.
+func (c *Consumer) Next(ctx context.Context) ([]*Change, error) {
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	var timer *time.Timer
+	for {
+		info, err := c.env.Info()
+		if err != nil {
+			return nil, err
+		}
+		if info.LastTxnID != c.seen {
+			changes, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			if len(changes) > 0 {
+				return changes, nil
+			}
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(interval)
+			defer timer.Stop()
+		} else {
+			timer.Reset(interval)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// errLimit stops Log.Read once MaxChanges have been read.
+type errLimit struct{}
+
+func (errLimit) Error() string { return "limit reached" }
+
+func (c *Consumer) read() ([]*Change, error) {
+	var changes []*Change
+	err := c.env.View(func(txn *lmdb.Txn) (err error) {
+		pos, err := c.log.Read(txn, c.pos, func(ch *Change) error {
+			changes = append(changes, ch)
+			if c.MaxChanges > 0 && len(changes) >= c.MaxChanges {
+				return errLimit{}
+			}
+			return nil
+		})
+		if _, ok := err.(errLimit); ok {
+			pos, err = changes[len(changes)-1].Pos, nil
+		}
+		if err != nil {
+			return err
+		}
+		c.pos = pos
+		if c.MaxChanges == 0 || len(changes) < c.MaxChanges {
+			// Everything committed as of this snapshot has been read.
+			c.seen = int64(txn.ID())
+		}
+		return nil
+	})
+	return changes, err
+}
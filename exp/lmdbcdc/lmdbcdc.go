@@ -0,0 +1,438 @@
+/*
+Package lmdbcdc records changes made to selected databases in a log database
+so that downstream consumers can observe every change in commit order.
+
+Writes are recorded by a Writer, which proxies Put and Del for a write
+transaction and appends a log entry for each change made to a tracked
+database.  Entries are written in the same transaction as the change they
+describe so the log is exactly as durable as the data.
+
+	cdc, err := lmdbcdc.Open(txn, "changelog")
+	cdc.Track(accounts, "accounts")
+	// ...
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		w := cdc.Writer(txn)
+		return w.Put(accounts, key, val, 0)
+	})
+
+Log keys are the identifier of the writing transaction followed by a sequence
+number within the transaction, both big-endian, so the log is ordered by
+commit.  A Position identifies an entry in the log.
+
+A Consumer tails the log from a Position.  Consumers in other processes may
+open the same log by name; they detect new commits by polling
+lmdb.EnvInfo.LastTxnID, which is cheap compared to a read transaction.
+
+The log grows without bound unless it is truncated, either explicitly with
+Log.Truncate or automatically by setting Log.KeepTxns.
+*/
+package lmdbcdc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+// Op is the kind of change recorded in a log entry.
+type Op byte
+
+// Operations recorded in the log.
+const (
+	OpPut Op = 1 + iota // An item was stored with Put.
+	OpDel               // An item was deleted with Del.
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpPut:
+		return "put"
+	case OpDel:
+		return "del"
+	}
+	return fmt.Sprintf("op(%d)", byte(op))
+}
+
+// hasOld is set in the flags byte of an entry that includes the old value.
+const hasOld = 1
+
+// truncateBatch bounds the number of entries removed by automatic truncation
+// in a single transaction so that large backlogs are cleared incrementally.
+const truncateBatch = 1024
+
+// Position identifies an entry in the log.  The zero Position precedes every
+// entry.
+type Position struct {
+	TxnID uint64
+	Seq   uint32
+}
+
+// Key returns the log key for p.
+func (p Position) Key() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, p.TxnID)
+	binary.BigEndian.PutUint32(b[8:], p.Seq)
+	return b
+}
+
+// ParsePosition parses a log key returned by Position.Key.
+func ParsePosition(b []byte) (Position, error) {
+	if len(b) != 12 {
+		return Position{}, fmt.Errorf("lmdbcdc: invalid position length %d", len(b))
+	}
+	return Position{
+		TxnID: binary.BigEndian.Uint64(b),
+		Seq:   binary.BigEndian.Uint32(b[8:]),
+	}, nil
+}
+
+// Less returns true if p precedes q in the log.
+func (p Position) Less(q Position) bool {
+	return p.TxnID < q.TxnID || (p.TxnID == q.TxnID && p.Seq < q.Seq)
+}
+
+// Change is a decoded log entry.
+type Change struct {
+	Pos Position
+	Op  Op
+	DB  string
+	Key []byte
+
+	// Old is the value replaced or deleted by the change.  Old is only
+	// recorded when Log.RecordOld is set and the key existed.
+	Old []byte
+
+	// Val is the value stored by a Put.  For a Del in a database with the
+	// lmdb.DupSort flag Val holds the duplicate that was deleted, if one was
+	// given.
+	Val []byte
+}
+
+// Log is a change log stored in a database of an environment.
+type Log struct {
+	// DBI is the handle of the log database.
+	DBI lmdb.DBI
+
+	// RecordOld causes Writers to include the previous value of changed keys
+	// in log entries at the cost of an additional read per change.
+	RecordOld bool
+
+	// KeepTxns, if non-zero, causes Writers to remove entries for
+	// transactions more than KeepTxns transactions older than the one being
+	// written.  Removal is incremental and bounded per transaction.
+	KeepTxns uint64
+
+	mu    sync.RWMutex
+	names map[lmdb.DBI]string
+}
+
+// Open opens the log database name in txn, creating it if txn is an update
+// transaction.
+func Open(txn *lmdb.Txn, name string) (*Log, error) {
+	dbi, err := txn.OpenDBI(name, lmdb.Create)
+	if lmdb.IsErrnoSys(err, syscall.EACCES) {
+		dbi, err = txn.OpenDBI(name, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Log{
+		DBI:   dbi,
+		names: make(map[lmdb.DBI]string),
+	}, nil
+}
+
+// Track causes changes to dbi made through a Writer to be recorded under the
+// given database name.
+func (l *Log) Track(dbi lmdb.DBI, name string) {
+	l.mu.Lock()
+	l.names[dbi] = name
+	l.mu.Unlock()
+}
+
+func (l *Log) name(dbi lmdb.DBI) (string, bool) {
+	l.mu.RLock()
+	name, ok := l.names[dbi]
+	l.mu.RUnlock()
+	return name, ok
+}
+
+// Writer returns a Writer that records changes made in txn.  Writers are
+// cheap and may be created for each transaction.
+func (l *Log) Writer(txn *lmdb.Txn) *Writer {
+	return &Writer{log: l, txn: txn}
+}
+
+// Writer applies changes in a write transaction and records those made to
+// tracked databases.  A Writer must only be used in the transaction it was
+// created for, and only one Writer may be used at a time in a transaction
+// (though a transaction may use several Writers in succession).
+type Writer struct {
+	log  *Log
+	txn  *lmdb.Txn
+	seq  uint32
+	init bool
+}
+
+// Put stores an item with txn.Put and records the change if dbi is tracked.
+func (w *Writer) Put(dbi lmdb.DBI, key, val []byte, flags uint) error {
+	name, ok := w.log.name(dbi)
+	if !ok {
+		return w.txn.Put(dbi, key, val, flags)
+	}
+	old, err := w.old(dbi, key)
+	if err != nil {
+		return err
+	}
+	err = w.txn.Put(dbi, key, val, flags)
+	if err != nil {
+		return err
+	}
+	return w.record(OpPut, name, key, old, val)
+}
+
+// Del deletes an item with txn.Del and records the change if dbi is tracked.
+func (w *Writer) Del(dbi lmdb.DBI, key, val []byte) error {
+	name, ok := w.log.name(dbi)
+	if !ok {
+		return w.txn.Del(dbi, key, val)
+	}
+	old, err := w.old(dbi, key)
+	if err != nil {
+		return err
+	}
+	err = w.txn.Del(dbi, key, val)
+	if err != nil {
+		return err
+	}
+	return w.record(OpDel, name, key, old, val)
+}
+
+func (w *Writer) old(dbi lmdb.DBI, key []byte) ([]byte, error) {
+	if !w.log.RecordOld {
+		return nil, nil
+	}
+	old, err := w.txn.Get(dbi, key)
+	if lmdb.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w.txn.RawRead {
+		// The value must survive the write that follows.
+		old = append([]byte{}, old...)
+	}
+	return old, nil
+}
+
+func (w *Writer) record(op Op, name string, key, old, val []byte) error {
+	if !w.init {
+		err := w.start()
+		if err != nil {
+			return err
+		}
+	}
+	pos := Position{TxnID: uint64(w.txn.ID()), Seq: w.seq}
+	err := w.txn.Put(w.log.DBI, pos.Key(), encodeEntry(op, name, key, old, val), lmdb.Append)
+	if err != nil {
+		return err
+	}
+	w.seq++
+	return nil
+}
+
+// start determines the next sequence number for the transaction, which may
+// already have entries written by another Writer, and applies automatic
+// truncation.
+func (w *Writer) start() error {
+	id := uint64(w.txn.ID())
+	cur, err := w.txn.OpenCursor(w.log.DBI)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	k, _, err := cur.Get(nil, nil, lmdb.Last)
+	switch {
+	case lmdb.IsNotFound(err):
+	case err != nil:
+		return err
+	default:
+		last, err := ParsePosition(k)
+		if err != nil {
+			return err
+		}
+		if last.TxnID == id {
+			w.seq = last.Seq + 1
+		}
+	}
+	w.init = true
+
+	if w.log.KeepTxns > 0 && id > w.log.KeepTxns {
+		_, err = w.log.truncate(w.txn, Position{TxnID: id - w.log.KeepTxns}, truncateBatch)
+		return err
+	}
+	return nil
+}
+
+// Truncate removes all entries preceding pos and returns the number of
+// entries removed.
+func (l *Log) Truncate(txn *lmdb.Txn, pos Position) (int, error) {
+	return l.truncate(txn, pos, 0)
+}
+
+func (l *Log) truncate(txn *lmdb.Txn, pos Position, limit int) (int, error) {
+	end := pos.Key()
+	cur, err := txn.OpenCursor(l.DBI)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close()
+	n := 0
+	for limit == 0 || n < limit {
+		k, _, err := cur.Get(nil, nil, lmdb.First)
+		if lmdb.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if txn.Cmp(l.DBI, k, end) >= 0 {
+			break
+		}
+		err = cur.Del(0)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Read calls fn for each entry following pos, in order, and returns the
+// position of the last entry read.  If fn returns an error Read stops and
+// returns it.  When txn has RawRead set the slices in each Change reference
+// the memory map and are only valid during the call to fn.
+func (l *Log) Read(txn *lmdb.Txn, pos Position, fn func(*Change) error) (Position, error) {
+	s := lmdbscan.New(txn, l.DBI)
+	defer s.Close()
+	start := pos
+	if start.Seq == ^uint32(0) {
+		start = Position{TxnID: start.TxnID + 1}
+	} else {
+		start.Seq++
+	}
+	s.SetNext(start.Key(), nil, lmdb.SetRange, lmdb.Next)
+	for s.Scan() {
+		c, err := decodeEntry(s.Key(), s.Val())
+		if err != nil {
+			return pos, err
+		}
+		err = fn(c)
+		if err != nil {
+			return pos, err
+		}
+		pos = c.Pos
+	}
+	return pos, s.Err()
+}
+
+// First returns the position preceding the oldest entry in the log, which is
+// where a new consumer reading the entire log should begin.
+func (l *Log) First(txn *lmdb.Txn) (Position, error) {
+	cur, err := txn.OpenCursor(l.DBI)
+	if err != nil {
+		return Position{}, err
+	}
+	defer cur.Close()
+	k, _, err := cur.Get(nil, nil, lmdb.First)
+	if lmdb.IsNotFound(err) {
+		return Position{}, nil
+	}
+	if err != nil {
+		return Position{}, err
+	}
+	p, err := ParsePosition(k)
+	if err != nil {
+		return Position{}, err
+	}
+	if p.Seq > 0 {
+		p.Seq--
+	} else {
+		p = Position{TxnID: p.TxnID - 1, Seq: ^uint32(0)}
+	}
+	return p, nil
+}
+
+func encodeEntry(op Op, name string, key, old, val []byte) []byte {
+	n := 2 + 4*binary.MaxVarintLen64 + len(name) + len(key) + len(old) + len(val)
+	b := make([]byte, 2, n)
+	b[0] = byte(op)
+	if old != nil {
+		b[1] |= hasOld
+	}
+	b = appendField(b, []byte(name))
+	b = appendField(b, key)
+	if old != nil {
+		b = appendField(b, old)
+	}
+	return appendField(b, val)
+}
+
+func appendField(b, p []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(p)))
+	b = append(b, buf[:n]...)
+	return append(b, p...)
+}
+
+var errEntry = fmt.Errorf("lmdbcdc: malformed log entry")
+
+func decodeEntry(k, v []byte) (*Change, error) {
+	pos, err := ParsePosition(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) < 2 {
+		return nil, errEntry
+	}
+	c := &Change{Pos: pos, Op: Op(v[0])}
+	flags := v[1]
+	v = v[2:]
+	var name []byte
+	name, v, err = readField(v)
+	if err != nil {
+		return nil, err
+	}
+	c.DB = string(name)
+	c.Key, v, err = readField(v)
+	if err != nil {
+		return nil, err
+	}
+	if flags&hasOld != 0 {
+		c.Old, v, err = readField(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.Val, v, err = readField(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != 0 {
+		return nil, errEntry
+	}
+	return c, nil
+}
+
+func readField(b []byte) ([]byte, []byte, error) {
+	n, k := binary.Uvarint(b)
+	if k <= 0 || uint64(len(b)-k) < n {
+		return nil, nil, errEntry
+	}
+	return b[k : k+int(n) : k+int(n)], b[k+int(n):], nil
+}
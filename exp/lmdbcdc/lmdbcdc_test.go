@@ -0,0 +1,201 @@
+package lmdbcdc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+func setup(t *testing.T) (*lmdb.Env, *Log, lmdb.DBI, lmdb.DBI) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log *Log
+	var tracked, untracked lmdb.DBI
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		log, err = Open(txn, "log")
+		if err != nil {
+			return err
+		}
+		tracked, err = txn.OpenDBI("tracked", lmdb.Create)
+		if err != nil {
+			return err
+		}
+		untracked, err = txn.OpenDBI("untracked", lmdb.Create)
+		return err
+	})
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	log.Track(tracked, "tracked")
+	return env, log, tracked, untracked
+}
+
+func TestWriter(t *testing.T) {
+	env, log, tracked, untracked := setup(t)
+	defer lmdbtest.Destroy(env)
+	log.RecordOld = true
+
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		err := env.Update(func(txn *lmdb.Txn) (err error) {
+			ids = append(ids, uint64(txn.ID()))
+			w := log.Writer(txn)
+			err = w.Put(tracked, []byte("a"), []byte(fmt.Sprint(i)), 0)
+			if err != nil {
+				return err
+			}
+			err = w.Put(untracked, []byte("b"), []byte("x"), 0)
+			if err != nil {
+				return err
+			}
+			// A second writer in the same transaction continues the sequence.
+			w = log.Writer(txn)
+			return w.Put(tracked, []byte("c"), []byte("y"), 0)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		return log.Writer(txn).Del(tracked, []byte("a"), nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []*Change
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		first, err := log.First(txn)
+		if err != nil {
+			return err
+		}
+		_, err = log.Read(txn, first, func(c *Change) error {
+			changes = append(changes, c)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		fmt.Sprintf("%d.0 put tracked a <nil> 0", ids[0]),
+		fmt.Sprintf("%d.1 put tracked c <nil> y", ids[0]),
+		fmt.Sprintf("%d.0 put tracked a 0 1", ids[1]),
+		fmt.Sprintf("%d.1 put tracked c y y", ids[1]),
+		fmt.Sprintf("%d.0 del tracked a 1 ", ids[1]+1),
+	}
+	if len(changes) != len(expect) {
+		t.Fatalf("unexpected number of changes: %d (!= %d)", len(changes), len(expect))
+	}
+	for i, c := range changes {
+		old := "<nil>"
+		if c.Old != nil {
+			old = string(c.Old)
+		}
+		s := fmt.Sprintf("%d.%d %v %s %s %s %s", c.Pos.TxnID, c.Pos.Seq, c.Op, c.DB, c.Key, old, c.Val)
+		if s != expect[i] {
+			t.Errorf("change %d: %q (!= %q)", i, s, expect[i])
+		}
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		n, err := log.Truncate(txn, Position{TxnID: ids[1]})
+		if n != 2 {
+			t.Errorf("unexpected number truncated: %d", n)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriter_keepTxns(t *testing.T) {
+	env, log, tracked, _ := setup(t)
+	defer lmdbtest.Destroy(env)
+	log.KeepTxns = 2
+
+	for i := 0; i < 5; i++ {
+		err := env.Update(func(txn *lmdb.Txn) (err error) {
+			return log.Writer(txn).Put(tracked, []byte("k"), []byte("v"), 0)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		stat, err := txn.Stat(log.DBI)
+		if err != nil {
+			return err
+		}
+		if stat.Entries != 3 {
+			t.Errorf("unexpected log size: %d", stat.Entries)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	env, log, tracked, _ := setup(t)
+	defer lmdbtest.Destroy(env)
+
+	c := NewConsumer(env, log, Position{})
+	c.PollInterval = time.Millisecond
+	c.MaxChanges = 2
+
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			err := env.Update(func(txn *lmdb.Txn) (err error) {
+				return log.Writer(txn).Put(tracked, []byte{byte(i)}, nil, 0)
+			})
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var keys []byte
+	for len(keys) < 3 {
+		changes, err := c.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) > 2 {
+			t.Errorf("too many changes: %d", len(changes))
+		}
+		for _, ch := range changes {
+			keys = append(keys, ch.Key...)
+		}
+	}
+	if string(keys) != "\x00\x01\x02" {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.Next(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
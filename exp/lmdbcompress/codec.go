@@ -0,0 +1,112 @@
+package lmdbcompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses values for storage.  Each Codec has an ID which is stored
+// in the header of every value it compresses, so IDs must not change once
+// values have been written.  ID 0 is reserved for uncompressed values.
+//
+// Codec methods may be called concurrently from multiple transactions.
+type Codec interface {
+	ID() byte
+
+	// Compress appends the compressed form of src to dst and returns the
+	// extended slice.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress decodes src into dst.  The length of dst is exactly the
+	// length of the value that was compressed.
+	Decompress(dst, src []byte) error
+}
+
+// FlateID is the ID of Codecs returned by Flate.
+const FlateID byte = 1
+
+// Flate returns a Codec that compresses values with compress/flate at the
+// given level.  Values written at any level are decompressed by any Codec
+// returned by Flate.  Flate panics if level is not a valid compress/flate
+// level.
+func Flate(level int) Codec {
+	c := &flateCodec{level: level}
+	_, err := flate.NewWriter(nil, level)
+	if err != nil {
+		panic(err)
+	}
+	c.w.New = func() interface{} {
+		w, _ := flate.NewWriter(nil, c.level)
+		return w
+	}
+	return c
+}
+
+type flateCodec struct {
+	level int
+	w     sync.Pool // *flate.Writer
+	r     sync.Pool // *flateReader
+}
+
+type flateReader struct {
+	src bytes.Reader
+	r   io.ReadCloser
+	b   [1]byte
+}
+
+// appendWriter is an io.Writer that appends to a slice.
+type appendWriter []byte
+
+func (w *appendWriter) Write(b []byte) (int, error) {
+	*w = append(*w, b...)
+	return len(b), nil
+}
+
+func (c *flateCodec) ID() byte { return FlateID }
+
+func (c *flateCodec) Compress(dst, src []byte) ([]byte, error) {
+	w := c.w.Get().(*flate.Writer)
+	defer c.w.Put(w)
+	buf := appendWriter(dst)
+	w.Reset(&buf)
+	_, err := w.Write(src)
+	if err != nil {
+		return dst, err
+	}
+	err = w.Close()
+	if err != nil {
+		return dst, err
+	}
+	return buf, nil
+}
+
+func (c *flateCodec) Decompress(dst, src []byte) error {
+	fr, _ := c.r.Get().(*flateReader)
+	if fr == nil {
+		fr = &flateReader{}
+		fr.src.Reset(src)
+		fr.r = flate.NewReader(&fr.src)
+	} else {
+		fr.src.Reset(src)
+		err := fr.r.(flate.Resetter).Reset(&fr.src, nil)
+		if err != nil {
+			return err
+		}
+	}
+	defer c.r.Put(fr)
+	_, err := io.ReadFull(fr.r, dst)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: flate stream is shorter than its header", ErrCorrupt)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	n, err := fr.r.Read(fr.b[:])
+	if n != 0 || err != io.EOF {
+		return fmt.Errorf("%w: flate stream is longer than its header", ErrCorrupt)
+	}
+	return nil
+}
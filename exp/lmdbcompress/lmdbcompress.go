@@ -0,0 +1,434 @@
+/*
+Package lmdbcompress stores compressed values in an LMDB database.
+
+A DB wraps a database and compresses values at least Threshold bytes long
+with its Codec.  Every stored value begins with a header byte holding the ID
+of the Codec that compressed it, or 0 for values stored verbatim, so small
+values and values which do not compress cost a single byte.  Compressed values
+follow the header with the uncompressed length as a uvarint.
+
+	db := lmdbcompress.New(dbi, lmdbcompress.Flate(flate.DefaultCompression), 128)
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		return db.Put(txn, key, blob, 0)
+	})
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		blob, err := db.Get(txn, key)
+		...
+	})
+
+Databases written through a DB must only be read through a DB, or through
+DB.Decode, because their values carry the header.  Scanners from package
+lmdbscan are supported by wrapping them with DB.Scanner, which decodes the
+value at each position.
+
+	s := db.Scanner(lmdbscan.New(txn, db.DBI))
+	defer s.Close()
+	for s.Scan() {
+		log.Printf("%s: %s", s.Key(), s.Val())
+	}
+	return s.Err()
+
+Values are compressed individually and the stored bytes do not sort like the
+original values, so a DB must not wrap a database opened with lmdb.DupSort.
+
+Values stored verbatim are returned without a copy and, like values returned
+by lmdb.Txn.Get, must not be used after the transaction terminates.
+Decompressed values are allocated on the Go heap.
+*/
+package lmdbcompress
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+// ErrCorrupt is returned (possibly wrapped) when a stored value cannot be
+// decoded.
+var ErrCorrupt = errors.New("lmdbcompress: corrupt value")
+
+// none is the header of values stored verbatim.
+const none byte = 0
+
+// DB is a database whose values are compressed.  The fields of a DB must not
+// be modified while it is in use, but its methods may be called concurrently
+// from multiple transactions.
+type DB struct {
+	DBI lmdb.DBI
+
+	// Codec compresses values written through the DB.  If Codec is nil
+	// values are always stored verbatim.
+	Codec Codec
+
+	// Threshold is the size, in bytes, below which values are stored
+	// verbatim.
+	Threshold int
+
+	// Codecs holds additional codecs used to decode values which were
+	// written with a different Codec, allowing Codec to be changed without
+	// rewriting existing values.
+	Codecs []Codec
+
+	// MaxSize bounds the size of decompressed values, so that a corrupt
+	// header cannot cause a huge allocation.  Values longer than MaxSize are
+	// stored verbatim, and compressed values whose header claims a larger
+	// size are reported as ErrCorrupt.  If MaxSize is zero DefaultMaxSize is
+	// used.
+	MaxSize int
+
+	stats stats
+}
+
+// DefaultMaxSize is the MaxSize of a DB which does not set it.
+const DefaultMaxSize = 64 << 20
+
+func (db *DB) maxSize() int {
+	if db.MaxSize > 0 {
+		return db.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+// New returns a DB for dbi that compresses values of at least threshold bytes
+// with codec.
+func New(dbi lmdb.DBI, codec Codec, threshold int) *DB {
+	return &DB{
+		DBI:       dbi,
+		Codec:     codec,
+		Threshold: threshold,
+	}
+}
+
+// Stats describes the values written to a database.
+type Stats struct {
+	Values      uint64 // Number of values.
+	Compressed  uint64 // Number of values stored compressed.
+	RawBytes    uint64 // Total size of the values before compression.
+	StoredBytes uint64 // Total size of the values as stored, including headers.
+}
+
+// Ratio returns StoredBytes divided by RawBytes.  Values less than 1 indicate
+// a saving.  Ratio returns 1 if s describes no data.
+func (s Stats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.StoredBytes) / float64(s.RawBytes)
+}
+
+type stats struct {
+	values      uint64
+	compressed  uint64
+	rawBytes    uint64
+	storedBytes uint64
+}
+
+// Stats returns statistics for the values written through db since it was
+// created.  Values written in transactions which were later aborted are
+// included.
+func (db *DB) Stats() Stats {
+	return Stats{
+		Values:      atomic.LoadUint64(&db.stats.values),
+		Compressed:  atomic.LoadUint64(&db.stats.compressed),
+		RawBytes:    atomic.LoadUint64(&db.stats.rawBytes),
+		StoredBytes: atomic.LoadUint64(&db.stats.storedBytes),
+	}
+}
+
+func (db *DB) count(raw, stored int, compressed bool) {
+	atomic.AddUint64(&db.stats.values, 1)
+	if compressed {
+		atomic.AddUint64(&db.stats.compressed, 1)
+	}
+	atomic.AddUint64(&db.stats.rawBytes, uint64(raw))
+	atomic.AddUint64(&db.stats.storedBytes, uint64(stored))
+}
+
+// Measure scans the database and returns statistics for the values stored
+// in it.  Measure reads the uncompressed size of values from their headers and
+// does not decompress them.
+func (db *DB) Measure(txn *lmdb.Txn) (Stats, error) {
+	var st Stats
+	s := lmdbscan.New(txn, db.DBI)
+	defer s.Close()
+	for s.Scan() {
+		n, compressed, err := rawSize(s.Val())
+		if err != nil {
+			return st, fmt.Errorf("%w: key %q", err, s.Key())
+		}
+		st.Values++
+		if compressed {
+			st.Compressed++
+		}
+		st.RawBytes += uint64(n)
+		st.StoredBytes += uint64(len(s.Val()))
+	}
+	return st, s.Err()
+}
+
+// rawSize returns the uncompressed size of the stored value v.
+func rawSize(v []byte) (n int, compressed bool, err error) {
+	if len(v) == 0 {
+		return 0, false, errHeader
+	}
+	if v[0] == none {
+		return len(v) - 1, false, nil
+	}
+	size, k := binary.Uvarint(v[1:])
+	if k <= 0 || size > uint64(maxSize) {
+		return 0, false, errHeader
+	}
+	return int(size), true, nil
+}
+
+const maxSize = int(^uint(0) >> 1)
+
+var errHeader = fmt.Errorf("%w: invalid header", ErrCorrupt)
+
+// Get returns the decoded value stored under key.  Get returns an error
+// satisfying lmdb.IsNotFound if key is not present.
+func (db *DB) Get(txn *lmdb.Txn, key []byte) ([]byte, error) {
+	v, err := txn.Get(db.DBI, key)
+	if err != nil {
+		return nil, err
+	}
+	return db.Decode(v)
+}
+
+// Put compresses val if necessary and stores it under key.  The flags are
+// passed to lmdb.Txn.Put and must not include lmdb.Reserve.
+func (db *DB) Put(txn *lmdb.Txn, key, val []byte, flags uint) error {
+	return db.put(val, func(b []byte) error {
+		return txn.Put(db.DBI, key, b, flags)
+	}, func(n int) ([]byte, error) {
+		return txn.PutReserve(db.DBI, key, n, flags)
+	})
+}
+
+// Del deletes the value stored under key.
+func (db *DB) Del(txn *lmdb.Txn, key []byte) error {
+	return txn.Del(db.DBI, key, nil)
+}
+
+// put stores val using either store, with the encoded value, or reserve, which
+// allocates space for a value stored verbatim.
+func (db *DB) put(val []byte, store func([]byte) error, reserve func(int) ([]byte, error)) error {
+	if db.compressible(val) {
+		bufp := bufPool.Get().(*[]byte)
+		defer bufPool.Put(bufp)
+		b, ok, err := db.compress((*bufp)[:0], val)
+		*bufp = b
+		if err != nil {
+			return err
+		}
+		if ok {
+			err = store(b)
+			if err == nil {
+				db.count(len(val), len(b), true)
+			}
+			return err
+		}
+	}
+	b, err := reserve(len(val) + 1)
+	if err != nil {
+		return err
+	}
+	b[0] = none
+	copy(b[1:], val)
+	db.count(len(val), len(b), false)
+	return nil
+}
+
+var bufPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+func (db *DB) compressible(val []byte) bool {
+	return db.Codec != nil && len(val) >= db.Threshold && len(val) <= db.maxSize()
+}
+
+// compress appends the header and compressed form of val to dst.  If the
+// result would not be smaller than storing val verbatim compress returns
+// false.
+func (db *DB) compress(dst, val []byte) ([]byte, bool, error) {
+	var size [binary.MaxVarintLen64]byte
+	id := db.Codec.ID()
+	if id == none {
+		return dst, false, fmt.Errorf("lmdbcompress: codec ID %d is reserved", none)
+	}
+	dst = append(dst, id)
+	dst = append(dst, size[:binary.PutUvarint(size[:], uint64(len(val)))]...)
+	dst, err := db.Codec.Compress(dst, val)
+	if err != nil {
+		return dst, false, err
+	}
+	return dst, len(dst) < len(val)+1, nil
+}
+
+// Encode returns val in the form stored by db.Put, for use with functions
+// that write to the database directly.
+func (db *DB) Encode(val []byte) ([]byte, error) {
+	if db.compressible(val) {
+		b, ok, err := db.compress(nil, val)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			db.count(len(val), len(b), true)
+			return b, nil
+		}
+	}
+	b := make([]byte, len(val)+1)
+	b[0] = none
+	copy(b[1:], val)
+	db.count(len(val), len(b), false)
+	return b, nil
+}
+
+// Decode returns the original value for the stored value v.  Values stored
+// verbatim are returned as a slice of v.
+func (db *DB) Decode(v []byte) ([]byte, error) {
+	n, compressed, err := rawSize(v)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return v[1:], nil
+	}
+	codec := db.codec(v[0])
+	if codec == nil {
+		return nil, fmt.Errorf("%w: unknown codec %d", ErrCorrupt, v[0])
+	}
+	if n > db.maxSize() {
+		return nil, fmt.Errorf("%w: size %d exceeds MaxSize", ErrCorrupt, n)
+	}
+	_, k := binary.Uvarint(v[1:])
+	b := make([]byte, n)
+	err = codec.Decompress(b, v[1+k:])
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (db *DB) codec(id byte) Codec {
+	if db.Codec != nil && db.Codec.ID() == id {
+		return db.Codec
+	}
+	for _, c := range db.Codecs {
+		if c.ID() == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Cursor is an lmdb.Cursor for a DB which decodes values as they are read.
+type Cursor struct {
+	db  *DB
+	cur *lmdb.Cursor
+}
+
+// OpenCursor opens a Cursor for db in txn.  The Cursor must be closed when it
+// is no longer needed.
+func (db *DB) OpenCursor(txn *lmdb.Txn) (*Cursor, error) {
+	cur, err := txn.OpenCursor(db.DBI)
+	if err != nil {
+		return nil, err
+	}
+	return &Cursor{db: db, cur: cur}, nil
+}
+
+// Cursor returns the underlying lmdb.Cursor, which reads values as stored.
+func (c *Cursor) Cursor() *lmdb.Cursor {
+	return c.cur
+}
+
+// Get moves the cursor like lmdb.Cursor.Get and returns the key and decoded
+// value at its new position.  Operations which take a value (lmdb.GetBoth,
+// lmdb.GetBothRange) are not supported because stored values are encoded.
+func (c *Cursor) Get(setkey []byte, op uint) (key, val []byte, err error) {
+	key, val, err = c.cur.Get(setkey, nil, op)
+	if err != nil {
+		return nil, nil, err
+	}
+	val, err = c.db.Decode(val)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, val, nil
+}
+
+// Put compresses val if necessary and stores it under key with
+// lmdb.Cursor.Put.  The flags must not include lmdb.Reserve.
+func (c *Cursor) Put(key, val []byte, flags uint) error {
+	return c.db.put(val, func(b []byte) error {
+		return c.cur.Put(key, b, flags)
+	}, func(n int) ([]byte, error) {
+		return c.cur.PutReserve(key, n, flags)
+	})
+}
+
+// Del deletes the item at the cursor position.
+func (c *Cursor) Del(flags uint) error {
+	return c.cur.Del(flags)
+}
+
+// Close closes the underlying lmdb.Cursor.
+func (c *Cursor) Close() {
+	c.cur.Close()
+}
+
+// Scanner wraps an lmdbscan.Scanner so that Val returns decoded values.
+type Scanner struct {
+	*lmdbscan.Scanner
+	db  *DB
+	val []byte
+	err error
+}
+
+// Scanner returns a Scanner which decodes the values read by s.  The value
+// found by SetNext is decoded by the following call to Scan.
+func (db *DB) Scanner(s *lmdbscan.Scanner) *Scanner {
+	return &Scanner{Scanner: s, db: db}
+}
+
+// Scan advances the underlying Scanner and decodes the value read.  Scan
+// returns false if the value cannot be decoded.
+func (s *Scanner) Scan() bool {
+	if s.err != nil || !s.Scanner.Scan() {
+		return false
+	}
+	s.val, s.err = s.db.Decode(s.Scanner.Val())
+	return s.err == nil
+}
+
+// Set moves the underlying Scanner with lmdbscan.Scanner.Set and decodes the
+// value read.  As with Cursor.Get, operations which take a value are not
+// supported.
+func (s *Scanner) Set(k, v []byte, opset uint) bool {
+	if s.err != nil || !s.Scanner.Set(k, v, opset) {
+		return false
+	}
+	s.val, s.err = s.db.Decode(s.Scanner.Val())
+	return s.err == nil
+}
+
+// Val returns the decoded value read by the last call to Scan.
+func (s *Scanner) Val() []byte {
+	return s.val
+}
+
+// Err returns the error which terminated the scan, including errors decoding
+// values.
+func (s *Scanner) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.Scanner.Err()
+}
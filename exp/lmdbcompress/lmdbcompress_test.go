@@ -0,0 +1,276 @@
+package lmdbcompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+func testValues() map[string][]byte {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string][]byte{
+		"empty":  {},
+		"small":  []byte(`{"a":1}`),
+		"json":   bytes.Repeat([]byte(`{"name":"alice","balance":100},`), 200),
+		"random": random,
+	}
+}
+
+func TestDB(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := New(dbi, Flate(flate.BestSpeed), 64)
+	values := testValues()
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		for k, v := range values {
+			err = db.Put(txn, []byte(k), v, 0)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		for k, v := range values {
+			got, err := db.Get(txn, []byte(k))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, v) {
+				t.Errorf("%s: unexpected value (%d bytes)", k, len(got))
+			}
+		}
+
+		// Only the JSON value is stored compressed.
+		for k, v := range values {
+			raw, err := txn.Get(dbi, []byte(k))
+			if err != nil {
+				return err
+			}
+			switch {
+			case k == "json" && (raw[0] != FlateID || len(raw) >= len(v)/10):
+				t.Errorf("%s: not compressed (%d bytes)", k, len(raw))
+			case k != "json" && (raw[0] != 0 || len(raw) != len(v)+1):
+				t.Errorf("%s: unexpected header %d (%d bytes)", k, raw[0], len(raw))
+			}
+		}
+
+		st, err := db.Measure(txn)
+		if err != nil {
+			return err
+		}
+		if st != db.Stats() {
+			t.Errorf("measured %+v (!= %+v)", st, db.Stats())
+		}
+		if st.Values != 4 || st.Compressed != 1 {
+			t.Errorf("unexpected stats: %+v", st)
+		}
+		if r := st.Ratio(); r <= 0 || r >= 0.5 {
+			t.Errorf("unexpected ratio: %g", r)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDB_Scanner(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := New(dbi, Flate(flate.DefaultCompression), 0)
+	values := testValues()
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		cur, err := db.OpenCursor(txn)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+		for k, v := range values {
+			err = cur.Put([]byte(k), v, 0)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		s := db.Scanner(lmdbscan.New(txn, dbi))
+		defer s.Close()
+		n := 0
+		for s.Scan() {
+			n++
+			if !bytes.Equal(s.Val(), values[string(s.Key())]) {
+				t.Errorf("%s: unexpected value", s.Key())
+			}
+		}
+		if n != len(values) {
+			t.Errorf("scanned %d values", n)
+		}
+		if !s.Set([]byte("json"), nil, lmdb.SetKey) {
+			return s.Err()
+		}
+		if !bytes.Equal(s.Val(), values["json"]) {
+			t.Errorf("set: unexpected value")
+		}
+
+		cur, err := db.OpenCursor(txn)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+		k, v, err := cur.Get([]byte("j"), lmdb.SetRange)
+		if err != nil {
+			return err
+		}
+		if string(k) != "json" || !bytes.Equal(v, values["json"]) {
+			t.Errorf("cursor: unexpected item %q", k)
+		}
+		return s.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pairCodec stores every other byte, which is lossless for values made of
+// repeated pairs.
+type pairCodec byte
+
+func (c pairCodec) ID() byte { return byte(c) }
+
+func (c pairCodec) Compress(dst, src []byte) ([]byte, error) {
+	for i := 0; i < len(src); i += 2 {
+		dst = append(dst, src[i])
+	}
+	return dst, nil
+}
+
+func (c pairCodec) Decompress(dst, src []byte) error {
+	if len(src) != (len(dst)+1)/2 {
+		return ErrCorrupt
+	}
+	for i := range dst {
+		dst[i] = src[i/2]
+	}
+	return nil
+}
+
+func TestDB_Codecs(t *testing.T) {
+	db := New(0, pairCodec(7), 0)
+	v, err := db.Encode([]byte("aabbcc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, []byte{7, 6, 'a', 'b', 'c'}) {
+		t.Fatalf("encoded %q", v)
+	}
+
+	db2 := New(0, Flate(flate.BestSpeed), 0)
+	_, err = db2.Decode(v)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	db2.Codecs = []Codec{pairCodec(7)}
+	dec, err := db2.Decode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != "aabbcc" {
+		t.Errorf("decoded %q", dec)
+	}
+
+	for _, v := range [][]byte{
+		{},
+		{7},
+		{7, 0x80},
+		{7, 8, 'a'},
+		{FlateID, 10, 0xff, 0xff},
+		// Sizes beyond MaxSize are not allocated.
+		{FlateID, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 0},
+		{FlateID, 0x81, 0x80, 0x80, 0x20, 0},
+	} {
+		_, err := db2.Decode(v)
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%x: unexpected error: %v", v, err)
+		}
+	}
+
+	// Values longer than MaxSize are stored verbatim.
+	db.MaxSize = 4
+	_, err = db.Decode(v)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("decode beyond MaxSize: unexpected error: %v", err)
+	}
+	v, err = db.Encode([]byte("aabbcc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, []byte("\x00aabbcc")) {
+		t.Errorf("encoded %q", v)
+	}
+}
+
+func TestFlate(t *testing.T) {
+	c := Flate(flate.BestCompression)
+	for _, n := range []int{0, 1, 100, 100000} {
+		src := bytes.Repeat([]byte(fmt.Sprint(n)), n)
+		b, err := c.Compress([]byte("x"), src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != 'x' {
+			t.Errorf("%d: prefix overwritten", n)
+		}
+		dst := make([]byte, len(src))
+		err = c.Decompress(dst, b[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dst, src) {
+			t.Errorf("%d: unexpected value", n)
+		}
+		if len(src) > 0 {
+			err = c.Decompress(dst[1:], b[1:])
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("%d: short: unexpected error: %v", n, err)
+			}
+		}
+		err = c.Decompress(append(dst, 0), b[1:])
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%d: long: unexpected error: %v", n, err)
+		}
+	}
+}
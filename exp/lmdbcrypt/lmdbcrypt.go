@@ -0,0 +1,371 @@
+/*
+Package lmdbcrypt encrypts the values of an LMDB database with AES-GCM.
+
+A DB wraps a database and seals every value written through it with the
+current key of its KeyProvider.  The database key of each item is bound to the
+sealed value as additional authenticated data, so values cannot be moved to
+another key without detection.  Keys are not encrypted.
+
+	keys := &lmdbcrypt.Keyring{Current: 1, Keys: map[uint32][]byte{1: key}}
+	db := lmdbcrypt.New(dbi, keys)
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		return db.Put(txn, []byte("alice"), record, 0)
+	})
+
+Each stored value begins with a header holding a format version and the ID of
+the key that sealed it, followed by a random nonce, the ciphertext and the
+authentication tag.  A stored value is 33 bytes larger than its plaintext.
+
+	version  key ID    nonce      ciphertext  tag
+	1 byte   4 bytes   12 bytes   n bytes     16 bytes
+
+Keys are rotated by making a new key current in the KeyProvider.  Values
+sealed with earlier keys remain readable as long as the KeyProvider returns
+those keys, and DB.Reencrypt rewrites them with the current key so that old
+keys can eventually be retired.
+
+Decrypted values are allocated on the Go heap and remain valid after the
+transaction terminates.
+*/
+package lmdbcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+// Errors returned (possibly wrapped) when a stored value cannot be opened.
+var (
+	// ErrCorrupt indicates a value whose header is malformed.
+	ErrCorrupt = errors.New("lmdbcrypt: corrupt value")
+
+	// ErrAuth indicates a value which failed authentication, because it was
+	// modified, sealed for a different database key, or sealed with a
+	// different key than the one returned by the KeyProvider.
+	ErrAuth = errors.New("lmdbcrypt: message authentication failed")
+)
+
+const (
+	version   = 1
+	headerLen = 1 + 4
+	nonceLen  = 12
+	tagLen    = 16
+
+	// Overhead is the number of bytes a stored value adds to its plaintext.
+	Overhead = headerLen + nonceLen + tagLen
+)
+
+// KeyProvider supplies AES keys, which must be 16, 24 or 32 bytes long.  The
+// key for an ID must never change once values have been sealed with it.
+// KeyProvider methods may be called concurrently from multiple transactions.
+type KeyProvider interface {
+	// CurrentKey returns the ID of the key used to seal new values.
+	CurrentKey() (uint32, error)
+
+	// Key returns the key with the given ID.
+	Key(id uint32) ([]byte, error)
+}
+
+// Keyring is a KeyProvider holding keys in memory.  A Keyring must not be
+// modified while it is in use.
+type Keyring struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+// CurrentKey implements KeyProvider.
+func (r *Keyring) CurrentKey() (uint32, error) {
+	return r.Current, nil
+}
+
+// Key implements KeyProvider.
+func (r *Keyring) Key(id uint32) ([]byte, error) {
+	key, ok := r.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("lmdbcrypt: unknown key %d", id)
+	}
+	return key, nil
+}
+
+// DB is a database whose values are encrypted.  The fields of a DB must not
+// be modified while it is in use, but its methods may be called concurrently
+// from multiple transactions.
+type DB struct {
+	DBI  lmdb.DBI
+	Keys KeyProvider
+
+	aeads sync.Map // uint32 -> cipher.AEAD
+}
+
+// New returns a DB for dbi that seals values with keys from keys.
+func New(dbi lmdb.DBI, keys KeyProvider) *DB {
+	return &DB{
+		DBI:  dbi,
+		Keys: keys,
+	}
+}
+
+func (db *DB) aead(id uint32) (cipher.AEAD, error) {
+	if aead, ok := db.aeads.Load(id); ok {
+		return aead.(cipher.AEAD), nil
+	}
+	key, err := db.Keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("lmdbcrypt: key %d: %v", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	db.aeads.Store(id, aead)
+	return aead, nil
+}
+
+// additionalData returns the data authenticated along with a value: its
+// header and the database key.
+func additionalData(header, key []byte) []byte {
+	ad := make([]byte, 0, headerLen+len(key))
+	ad = append(ad, header[:headerLen]...)
+	return append(ad, key...)
+}
+
+// current returns the ID and cipher of the key used to seal new values.
+func (db *DB) current() (uint32, cipher.AEAD, error) {
+	id, err := db.Keys.CurrentKey()
+	if err != nil {
+		return 0, nil, err
+	}
+	aead, err := db.aead(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, aead, nil
+}
+
+// seal encrypts val for key into b, which must have length len(val)+Overhead.
+func seal(b []byte, id uint32, aead cipher.AEAD, key, val []byte) error {
+	b[0] = version
+	binary.BigEndian.PutUint32(b[1:], id)
+	nonce := b[headerLen : headerLen+nonceLen]
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	aead.Seal(b[headerLen+nonceLen:headerLen+nonceLen], nonce, val, additionalData(b, key))
+	return nil
+}
+
+// Seal returns val in the form stored under key by db.Put, for use with
+// functions that write to the database directly.
+func (db *DB) Seal(key, val []byte) ([]byte, error) {
+	id, aead, err := db.current()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, len(val)+Overhead)
+	err = seal(b, id, aead, key, val)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Open authenticates and decrypts v, the value stored under key.
+func (db *DB) Open(key, v []byte) ([]byte, error) {
+	id, err := KeyID(v)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := db.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := v[headerLen : headerLen+nonceLen]
+	val, err := aead.Open(nil, nonce, v[headerLen+nonceLen:], additionalData(v, key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q", ErrAuth, key)
+	}
+	if val == nil {
+		val = []byte{}
+	}
+	return val, nil
+}
+
+// KeyID returns the ID of the key that sealed the stored value v.
+func KeyID(v []byte) (uint32, error) {
+	if len(v) < Overhead || v[0] != version {
+		return 0, ErrCorrupt
+	}
+	return binary.BigEndian.Uint32(v[1:]), nil
+}
+
+// Get returns the decrypted value stored under key.  Get returns an error
+// satisfying lmdb.IsNotFound if key is not present.
+func (db *DB) Get(txn *lmdb.Txn, key []byte) ([]byte, error) {
+	v, err := txn.Get(db.DBI, key)
+	if err != nil {
+		return nil, err
+	}
+	return db.Open(key, v)
+}
+
+// Put seals val with the current key and stores it under key.  The flags are
+// passed to lmdb.Txn.PutReserve and the value is encrypted directly into the
+// reserved space.
+func (db *DB) Put(txn *lmdb.Txn, key, val []byte, flags uint) error {
+	id, aead, err := db.current()
+	if err != nil {
+		return err
+	}
+	b, err := txn.PutReserve(db.DBI, key, len(val)+Overhead, flags)
+	if err != nil {
+		return err
+	}
+	return seal(b, id, aead, key, val)
+}
+
+// Del deletes the value stored under key.
+func (db *DB) Del(txn *lmdb.Txn, key []byte) error {
+	return txn.Del(db.DBI, key, nil)
+}
+
+// Scanner wraps an lmdbscan.Scanner so that Val returns decrypted values.
+type Scanner struct {
+	*lmdbscan.Scanner
+	db  *DB
+	val []byte
+	err error
+}
+
+// Scanner returns a Scanner which decrypts the values read by s.  The value
+// found by SetNext is decrypted by the following call to Scan.
+func (db *DB) Scanner(s *lmdbscan.Scanner) *Scanner {
+	return &Scanner{Scanner: s, db: db}
+}
+
+// Scan advances the underlying Scanner and decrypts the value read.  Scan
+// returns false if the value cannot be opened.
+func (s *Scanner) Scan() bool {
+	if s.err != nil || !s.Scanner.Scan() {
+		return false
+	}
+	s.val, s.err = s.db.Open(s.Key(), s.Scanner.Val())
+	return s.err == nil
+}
+
+// Set moves the underlying Scanner with lmdbscan.Scanner.Set and decrypts the
+// value read.  Operations which match a value, like lmdb.GetBoth, are not
+// supported because the stored values are sealed.
+func (s *Scanner) Set(k, v []byte, opset uint) bool {
+	if s.err != nil || !s.Scanner.Set(k, v, opset) {
+		return false
+	}
+	s.val, s.err = s.db.Open(s.Key(), s.Scanner.Val())
+	return s.err == nil
+}
+
+// Val returns the decrypted value read by the last call to Scan or Set.
+func (s *Scanner) Val() []byte {
+	return s.val
+}
+
+// Err returns the error which terminated the scan, including errors opening
+// values.
+func (s *Scanner) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.Scanner.Err()
+}
+
+// Reencrypt rewrites the values in the database which were not sealed with
+// the current key of db.Keys.  The database is processed in a sequence of
+// Update transactions which each visit at most batch items, so that readers
+// are not pinned to a snapshot and the write lock is released regularly.
+// Reencrypt checks ctx between transactions.
+//
+// Reencrypt returns the number of values rewritten.  If the current key
+// changes during the run some values may remain sealed with the old key and
+// Reencrypt should be run again.
+func (db *DB) Reencrypt(ctx context.Context, env *lmdb.Env, batch int) (n int, err error) {
+	if batch <= 0 {
+		return 0, fmt.Errorf("lmdbcrypt: invalid batch size %d", batch)
+	}
+	var next []byte
+	for done := false; !done; {
+		err = ctx.Err()
+		if err != nil {
+			return n, err
+		}
+		err = env.Update(func(txn *lmdb.Txn) (err error) {
+			var rewritten int
+			next, rewritten, err = db.reencrypt(txn, next, batch)
+			if err == nil {
+				n += rewritten
+			}
+			return err
+		})
+		if err != nil {
+			return n, err
+		}
+		done = next == nil
+	}
+	return n, nil
+}
+
+// reencrypt rewrites values starting at the key start.  It returns the key at
+// which to continue, or nil if the end of the database was reached.
+func (db *DB) reencrypt(txn *lmdb.Txn, start []byte, batch int) (next []byte, n int, err error) {
+	current, aead, err := db.current()
+	if err != nil {
+		return nil, 0, err
+	}
+	var key []byte
+	s := lmdbscan.New(txn, db.DBI)
+	defer s.Close()
+	if start != nil {
+		s.SetNext(start, nil, lmdb.SetRange, lmdb.Next)
+	}
+	for i := 0; s.Scan(); i++ {
+		if i == batch {
+			return append([]byte(nil), s.Key()...), n, nil
+		}
+		id, err := KeyID(s.Val())
+		if err != nil {
+			return nil, n, fmt.Errorf("%w: key %q", err, s.Key())
+		}
+		if id == current {
+			continue
+		}
+		// The key is copied because it refers to the page being replaced.
+		key = append(key[:0], s.Key()...)
+		val, err := db.Open(key, s.Val())
+		if err != nil {
+			return nil, n, err
+		}
+		b, err := s.Cursor().PutReserve(key, len(val)+Overhead, lmdb.Current)
+		if err != nil {
+			return nil, n, err
+		}
+		err = seal(b, current, aead, key, val)
+		if err != nil {
+			return nil, n, err
+		}
+		n++
+	}
+	return nil, n, s.Err()
+}
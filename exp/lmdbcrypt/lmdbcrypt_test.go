@@ -0,0 +1,208 @@
+package lmdbcrypt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+func testKeyring() *Keyring {
+	return &Keyring{
+		Current: 1,
+		Keys: map[uint32][]byte{
+			1: bytes.Repeat([]byte{1}, 16),
+			2: bytes.Repeat([]byte{2}, 32),
+		},
+	}
+}
+
+func TestDB(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := New(dbi, testKeyring())
+	values := map[string][]byte{
+		"alice": []byte("alice@example.com"),
+		"bob":   {},
+	}
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		for k, v := range values {
+			err = db.Put(txn, []byte(k), v, 0)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		for k, v := range values {
+			got, err := db.Get(txn, []byte(k))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, v) {
+				t.Errorf("%s: unexpected value %q", k, got)
+			}
+			raw, err := txn.Get(dbi, []byte(k))
+			if err != nil {
+				return err
+			}
+			if len(raw) != len(v)+Overhead {
+				t.Errorf("%s: stored %d bytes", k, len(raw))
+			}
+			if bytes.Contains(raw, v) && len(v) > 0 {
+				t.Errorf("%s: plaintext stored", k)
+			}
+		}
+
+		sealed, err := txn.Get(dbi, []byte("alice"))
+		if err != nil {
+			return err
+		}
+		sealed = append([]byte(nil), sealed...)
+
+		// A value moved to another key fails authentication.
+		err = txn.Put(dbi, []byte("mallory"), sealed, 0)
+		if err != nil {
+			return err
+		}
+		_, err = db.Get(txn, []byte("mallory"))
+		if !errors.Is(err, ErrAuth) {
+			t.Errorf("moved: unexpected error: %v", err)
+		}
+
+		// So does a modified value.
+		sealed[len(sealed)-20] ^= 1
+		_, err = db.Open([]byte("alice"), sealed)
+		if !errors.Is(err, ErrAuth) {
+			t.Errorf("modified: unexpected error: %v", err)
+		}
+
+		// And a modified key ID.
+		sealed[len(sealed)-20] ^= 1
+		sealed[4] = 2
+		_, err = db.Open([]byte("alice"), sealed)
+		if !errors.Is(err, ErrAuth) {
+			t.Errorf("key ID: unexpected error: %v", err)
+		}
+		sealed[4] = 3
+		_, err = db.Open([]byte("alice"), sealed)
+		if err == nil || errors.Is(err, ErrAuth) {
+			t.Errorf("unknown key: unexpected error: %v", err)
+		}
+
+		for _, v := range [][]byte{nil, sealed[:Overhead-1], append([]byte{2}, sealed[1:]...)} {
+			_, err = db.Open([]byte("alice"), v)
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("corrupt: unexpected error: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDB_Reencrypt(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testKeyring()
+	db := New(dbi, keys)
+	const n = 50
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		for i := 0; i < n; i++ {
+			if i == 10 {
+				keys.Current = 2
+			}
+			err = db.Put(txn, []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(i)), 0)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.Reencrypt(ctx, env, 7)
+	if err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Retire key 1.
+	keys.Current = 2
+	count, err := db.Reencrypt(context.Background(), env, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Errorf("reencrypted %d values (!= 10)", count)
+	}
+	delete(keys.Keys, 1)
+	db = New(dbi, keys)
+
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		s := db.Scanner(lmdbscan.New(txn, dbi))
+		defer s.Close()
+		i := 0
+		for ; s.Scan(); i++ {
+			if string(s.Key()) != fmt.Sprintf("key%03d", i) || string(s.Val()) != fmt.Sprint(i) {
+				t.Errorf("unexpected item %q %q", s.Key(), s.Val())
+			}
+			id, err := KeyID(s.Scanner.Val())
+			if err != nil {
+				return err
+			}
+			if id != 2 {
+				t.Errorf("%s: key %d", s.Key(), id)
+			}
+		}
+		if i != n {
+			t.Errorf("scanned %d items", i)
+		}
+		if !s.Set([]byte("key004"), nil, lmdb.SetKey) {
+			return s.Err()
+		}
+		if string(s.Val()) != "4" {
+			t.Errorf("set: unexpected value %q", s.Val())
+		}
+		return s.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err = db.Reencrypt(context.Background(), env, 7)
+	if err != nil || count != 0 {
+		t.Errorf("second run: %d %v", count, err)
+	}
+}
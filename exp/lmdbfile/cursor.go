@@ -0,0 +1,486 @@
+package lmdbfile
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Cursor iterates the items of a DB in order.  For a DupSort database each
+// duplicate is an item.  The methods of Cursor mirror the lmdb.Cursor
+// operations of the same name and return ErrNotFound when there is no item
+// to move to, in which case the position of the cursor is unchanged, except
+// that a failed Seek leaves the cursor past the last item as lmdb.SetRange
+// does.  The returned slices reference the file and must not be modified.
+type Cursor struct {
+	db       *DB
+	c        treeCursor
+	dup      treeCursor
+	dupOK    bool // the current item has duplicates in dup
+	dupCount uint64
+	init     bool
+	eof      bool // a failed Seek moved past the last item
+}
+
+// Cursor returns a new cursor on db.  The cursor is not positioned until one
+// of its methods is called.
+func (db *DB) Cursor() *Cursor {
+	c := &Cursor{db: db}
+	c.c.reset(db.f, db.info.root, int(db.info.depth), nil, 0, db.cmp)
+	return c
+}
+
+// First moves to the first item in the database.
+func (c *Cursor) First() (key, val []byte, err error) {
+	return c.result(c.c.first(), false)
+}
+
+// Last moves to the last item in the database.
+func (c *Cursor) Last() (key, val []byte, err error) {
+	return c.result(c.c.last(), true)
+}
+
+// Next moves to the next item.  An unpositioned cursor moves to the first
+// item.
+func (c *Cursor) Next() (key, val []byte, err error) {
+	if c.eof {
+		return nil, nil, ErrNotFound
+	}
+	if !c.init {
+		return c.First()
+	}
+	if c.dupOK {
+		err = c.dup.next()
+		if err != ErrNotFound {
+			return c.current(err)
+		}
+	}
+	return c.result(c.c.next(), false)
+}
+
+// Prev moves to the previous item.  An unpositioned cursor moves to the last
+// item.
+func (c *Cursor) Prev() (key, val []byte, err error) {
+	if !c.init {
+		return c.Last()
+	}
+	if c.dupOK {
+		err = c.dup.prev()
+		if err != ErrNotFound {
+			return c.current(err)
+		}
+	}
+	return c.result(c.c.prev(), true)
+}
+
+// NextDup moves to the next duplicate of the current key.
+func (c *Cursor) NextDup() (key, val []byte, err error) {
+	if !c.init || !c.dupOK {
+		return nil, nil, ErrNotFound
+	}
+	return c.current(c.dup.next())
+}
+
+// PrevDup moves to the previous duplicate of the current key.  As with lmdb, a
+// cursor past the last item moves to the last item.
+func (c *Cursor) PrevDup() (key, val []byte, err error) {
+	if c.eof {
+		return c.Last()
+	}
+	if !c.init || !c.dupOK {
+		return nil, nil, ErrNotFound
+	}
+	return c.current(c.dup.prev())
+}
+
+// NextNoDup moves to the first item of the next key.
+func (c *Cursor) NextNoDup() (key, val []byte, err error) {
+	if c.eof {
+		return nil, nil, ErrNotFound
+	}
+	if !c.init {
+		return c.First()
+	}
+	return c.result(c.c.next(), false)
+}
+
+// PrevNoDup moves to the last item of the previous key.
+func (c *Cursor) PrevNoDup() (key, val []byte, err error) {
+	if !c.init {
+		return c.Last()
+	}
+	return c.result(c.c.prev(), true)
+}
+
+// Seek moves to the first item of the first key greater than or equal to key,
+// as the lmdb.SetRange operation.  If there is no such item the cursor is past
+// the last item: Next, NextDup and NextNoDup return ErrNotFound, and Prev,
+// PrevDup and PrevNoDup move to the last item.
+func (c *Cursor) Seek(key []byte) (k, val []byte, err error) {
+	err = c.c.seek(key)
+	if err != nil {
+		return nil, nil, c.unset(err)
+	}
+	return c.result(nil, false)
+}
+
+// Count returns the number of duplicates of the current key, which is 1 for a
+// database without the DupSort flag.
+func (c *Cursor) Count() (uint64, error) {
+	if !c.init {
+		return 0, ErrNotFound
+	}
+	if c.dupOK {
+		return c.dupCount, nil
+	}
+	return 1, nil
+}
+
+// seek positions c at the first key greater than or equal to key and returns
+// the key found.
+func (c *Cursor) seek(key []byte) ([]byte, error) {
+	err := c.c.seek(key)
+	if err != nil {
+		return nil, c.unset(err)
+	}
+	c.init, c.eof = true, false
+	n, err := c.c.node()
+	if err != nil {
+		return nil, err
+	}
+	return n.key, nil
+}
+
+func (c *Cursor) result(err error, last bool) ([]byte, []byte, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	c.init, c.eof = true, false
+	return c.fetch(last)
+}
+
+// unset records that a failed seek has moved the tree cursor off the current
+// item and returns err.
+func (c *Cursor) unset(err error) error {
+	c.init, c.dupOK = false, false
+	c.eof = err == ErrNotFound
+	return err
+}
+
+// fetch returns the item at the current position, moving to the first or
+// last duplicate of a key with duplicates.
+func (c *Cursor) fetch(last bool) ([]byte, []byte, error) {
+	n, err := c.c.node()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.dupOK = false
+	if n.flags&fDupData == 0 {
+		v, err := c.c.value(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		return n.key, v, nil
+	}
+
+	pgno := c.c.top().p.pgno
+	if n.size() > len(n.data) {
+		return nil, nil, corrupt(pgno, "node data out of range")
+	}
+	data := n.data[:n.size()]
+	if n.flags&fSubData != 0 {
+		if len(data) != dbInfoSize {
+			return nil, nil, corrupt(pgno, "bad duplicate database record")
+		}
+		info := parseDBInfo(data)
+		c.dup.reset(c.db.f, info.root, int(info.depth), nil, pgno, c.db.dcmp)
+		c.dupCount = info.entries
+	} else {
+		c.dup.reset(c.db.f, 0, 1, data, pgno, c.db.dcmp)
+	}
+	if last {
+		err = c.dup.last()
+	} else {
+		err = c.dup.first()
+	}
+	if err == ErrNotFound {
+		err = corrupt(pgno, "empty duplicates")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if n.flags&fSubData == 0 {
+		c.dupCount = uint64(c.dup.stack[0].p.numKeys())
+	}
+	c.dupOK = true
+	v, err := c.dup.key()
+	if err != nil {
+		return nil, nil, err
+	}
+	return n.key, v, nil
+}
+
+// current returns the item at the current position after the duplicate
+// cursor has moved with the given result.
+func (c *Cursor) current(err error) ([]byte, []byte, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := c.c.node()
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := c.dup.key()
+	if err != nil {
+		return nil, nil, err
+	}
+	return n.key, v, nil
+}
+
+// treeCursor is a position in a B-tree.  The tree is either rooted at a page
+// in the file or is a DupSort sub-page embedded in a leaf node.
+type treeCursor struct {
+	f       *File
+	root    uint64
+	depth   int // expected depth, which bounds traversal of a corrupt file
+	sub     []byte
+	subPgno uint64 // page containing sub, for errors
+	cmp     func(a, b []byte) int
+	stack   []frame
+}
+
+type frame struct {
+	p page
+	i int
+}
+
+func (c *treeCursor) reset(f *File, root uint64, depth int, sub []byte, subPgno uint64, cmp func(a, b []byte) int) {
+	c.f = f
+	c.root = root
+	c.depth = depth
+	c.sub = sub
+	c.subPgno = subPgno
+	c.cmp = cmp
+	c.stack = c.stack[:0]
+}
+
+func (c *treeCursor) top() *frame {
+	return &c.stack[len(c.stack)-1]
+}
+
+// rootPage returns the root page of the tree, or ErrNotFound if the tree is
+// empty.
+func (c *treeCursor) rootPage() (page, error) {
+	if c.sub != nil {
+		p := page{b: c.sub, pgno: c.subPgno}
+		err := p.check()
+		if err != nil {
+			return page{}, err
+		}
+		if p.flags()&(pLeaf|pSubp) != pLeaf|pSubp {
+			return page{}, corrupt(c.subPgno, "bad sub-page")
+		}
+		return p, nil
+	}
+	if c.root == InvalidPage {
+		return page{}, ErrNotFound
+	}
+	return c.f.page(c.root)
+}
+
+func (c *treeCursor) push(p page, i int) error {
+	if len(c.stack) >= c.depth || p.isLeaf() != (len(c.stack) == c.depth-1) {
+		return corrupt(p.pgno, "unexpected tree depth")
+	}
+	c.stack = append(c.stack, frame{p, i})
+	return nil
+}
+
+// child returns the page referenced by node i of the branch page p.
+func (c *treeCursor) child(p page, i int) (page, error) {
+	n, err := p.node(i)
+	if err != nil {
+		return page{}, err
+	}
+	return c.f.page(n.pgno())
+}
+
+// descend pushes pages from p down to the leftmost or rightmost leaf.
+func (c *treeCursor) descend(p page, last bool) error {
+	for {
+		n := p.numKeys()
+		i := 0
+		if last {
+			i = n - 1
+		}
+		if p.isLeaf() {
+			if n == 0 {
+				return ErrNotFound
+			}
+			return c.push(p, i)
+		}
+		if !p.isBranch() || n == 0 {
+			return corrupt(p.pgno, "bad branch page")
+		}
+		err := c.push(p, i)
+		if err != nil {
+			return err
+		}
+		p, err = c.child(p, i)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *treeCursor) first() error {
+	c.stack = c.stack[:0]
+	p, err := c.rootPage()
+	if err != nil {
+		return err
+	}
+	return c.descend(p, false)
+}
+
+func (c *treeCursor) last() error {
+	c.stack = c.stack[:0]
+	p, err := c.rootPage()
+	if err != nil {
+		return err
+	}
+	return c.descend(p, true)
+}
+
+func (c *treeCursor) next() error {
+	for d := len(c.stack) - 1; d >= 0; d-- {
+		fr := &c.stack[d]
+		if fr.i+1 >= fr.p.numKeys() {
+			continue
+		}
+		fr.i++
+		c.stack = c.stack[:d+1]
+		if fr.p.isLeaf() {
+			return nil
+		}
+		p, err := c.child(fr.p, fr.i)
+		if err != nil {
+			return err
+		}
+		return c.descend(p, false)
+	}
+	return ErrNotFound
+}
+
+func (c *treeCursor) prev() error {
+	for d := len(c.stack) - 1; d >= 0; d-- {
+		fr := &c.stack[d]
+		if fr.i == 0 {
+			continue
+		}
+		fr.i--
+		c.stack = c.stack[:d+1]
+		if fr.p.isLeaf() {
+			return nil
+		}
+		p, err := c.child(fr.p, fr.i)
+		if err != nil {
+			return err
+		}
+		return c.descend(p, true)
+	}
+	return ErrNotFound
+}
+
+// seek moves to the first key greater than or equal to key.
+func (c *treeCursor) seek(key []byte) error {
+	c.stack = c.stack[:0]
+	p, err := c.rootPage()
+	if err != nil {
+		return err
+	}
+	var keyErr error
+	search := func(n int, fn func(i int) bool) int {
+		return sort.Search(n, func(i int) bool {
+			return keyErr == nil && fn(i)
+		})
+	}
+	for {
+		n := p.numKeys()
+		if p.isLeaf() {
+			if n == 0 {
+				return ErrNotFound
+			}
+			i := search(n, func(i int) bool {
+				k, err := p.key(i)
+				if err != nil {
+					keyErr = err
+					return true
+				}
+				return c.cmp(k, key) >= 0
+			})
+			if keyErr != nil {
+				return keyErr
+			}
+			if i < n {
+				return c.push(p, i)
+			}
+			err = c.push(p, n-1)
+			if err != nil {
+				return err
+			}
+			return c.next()
+		}
+		if !p.isBranch() || n == 0 {
+			return corrupt(p.pgno, "bad branch page")
+		}
+		// The key of the first node in a branch page is ignored.  Choose
+		// the last child whose key is less than or equal to key.
+		i := search(n-1, func(i int) bool {
+			k, err := p.key(i + 1)
+			if err != nil {
+				keyErr = err
+				return true
+			}
+			return c.cmp(k, key) > 0
+		})
+		if keyErr != nil {
+			return keyErr
+		}
+		err = c.push(p, i)
+		if err != nil {
+			return err
+		}
+		p, err = c.child(p, i)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// key returns the key at the current position.
+func (c *treeCursor) key() ([]byte, error) {
+	fr := c.top()
+	return fr.p.key(fr.i)
+}
+
+// node returns the leaf node at the current position.
+func (c *treeCursor) node() (node, error) {
+	fr := c.top()
+	if fr.p.isLeaf2() {
+		return node{}, corrupt(fr.p.pgno, "unexpected LEAF2 page")
+	}
+	return fr.p.node(fr.i)
+}
+
+// value returns the data of the leaf node n.
+func (c *treeCursor) value(n node) ([]byte, error) {
+	if n.flags&fBigData != 0 {
+		if len(n.data) < 8 {
+			return nil, corrupt(c.top().p.pgno, "node data out of range")
+		}
+		return c.f.overflow(binary.LittleEndian.Uint64(n.data), n.size())
+	}
+	if n.size() > len(n.data) {
+		return nil, corrupt(c.top().p.pgno, "node data out of range")
+	}
+	return n.data[:n.size()], nil
+}
@@ -0,0 +1,164 @@
+package lmdbfile
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Stat holds statistics about a database, as lmdb.Stat.
+type Stat struct {
+	PSize         uint   // Size of a database page.
+	Depth         uint   // Depth (height) of the B-tree
+	BranchPages   uint64 // Number of internal (non-leaf) pages
+	LeafPages     uint64 // Number of leaf pages
+	OverflowPages uint64 // Number of overflow pages
+	Entries       uint64 // Number of data items
+}
+
+// DB is a database in a File.
+type DB struct {
+	f    *File
+	info dbInfo
+	cmp  func(a, b []byte) int
+	dcmp func(a, b []byte) int
+}
+
+// Root returns the root (unnamed) database of f.
+func (f *File) Root() *DB {
+	return f.newDB(f.main)
+}
+
+// FreeDB returns the database of free pages.  Its keys are the IDs of the
+// transactions which freed pages and its values are lists of page numbers,
+// each a native unsigned integer preceded by the number of pages.
+func (f *File) FreeDB() *DB {
+	return f.newDB(f.free)
+}
+
+// OpenDB returns the named database in f.  OpenDB returns ErrNotFound if the
+// database does not exist.
+func (f *File) OpenDB(name string) (*DB, error) {
+	c := f.Root().Cursor()
+	k, err := c.seek([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(k, []byte(name)) {
+		return nil, ErrNotFound
+	}
+	n, err := c.c.node()
+	if err != nil {
+		return nil, err
+	}
+	if n.flags&(fSubData|fDupData) != fSubData {
+		return nil, ErrIncompatible
+	}
+	if n.size() != dbInfoSize || len(n.data) < dbInfoSize {
+		return nil, corrupt(c.c.top().p.pgno, "bad database record")
+	}
+	return f.newDB(parseDBInfo(n.data)), nil
+}
+
+func (f *File) newDB(info dbInfo) *DB {
+	db := &DB{f: f, info: info}
+	switch {
+	case info.flags&ReverseKey != 0:
+		db.cmp = cmpReverse
+	case info.flags&IntegerKey != 0:
+		db.cmp = cmpInt
+	default:
+		db.cmp = bytes.Compare
+	}
+	switch {
+	case info.flags&IntegerDup != 0:
+		db.dcmp = cmpInt
+	case info.flags&ReverseDup != 0:
+		db.dcmp = cmpReverse
+	default:
+		db.dcmp = bytes.Compare
+	}
+	return db
+}
+
+// Flags returns the flags the database was created with.
+func (db *DB) Flags() uint {
+	return uint(db.info.flags)
+}
+
+// Record returns the description of the database's B-tree.
+func (db *DB) Record() Record {
+	return db.info.record()
+}
+
+// Stat returns statistics about the database.
+func (db *DB) Stat() *Stat {
+	return &Stat{
+		PSize:         uint(db.f.meta.PageSize),
+		Depth:         uint(db.info.depth),
+		BranchPages:   db.info.branch,
+		LeafPages:     db.info.leaf,
+		OverflowPages: db.info.overflow,
+		Entries:       db.info.entries,
+	}
+}
+
+// Get returns the value stored for key.  For a DupSort database the first
+// duplicate is returned.  Get returns ErrNotFound if key is not in the
+// database.  The returned slice references the file and must not be
+// modified.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	c := db.Cursor()
+	k, err := c.seek(key)
+	if err != nil {
+		return nil, err
+	}
+	if db.cmp(k, key) != 0 {
+		return nil, ErrNotFound
+	}
+	_, v, err := c.fetch(false)
+	return v, err
+}
+
+// cmpReverse compares a and b byte-wise starting from their ends, as
+// mdb_cmp_memnr.
+func cmpReverse(a, b []byte) int {
+	i, j := len(a), len(b)
+	for i > 0 && j > 0 {
+		i--
+		j--
+		if a[i] != b[j] {
+			return int(a[i]) - int(b[j])
+		}
+	}
+	return len(a) - len(b)
+}
+
+// cmpInt compares native unsigned integers of equal size, as mdb_cmp_cint.
+func cmpInt(a, b []byte) int {
+	if len(a) != len(b) {
+		return bytes.Compare(a, b)
+	}
+	switch len(a) {
+	case 4:
+		x, y := binary.LittleEndian.Uint32(a), binary.LittleEndian.Uint32(b)
+		return cmpUint(uint64(x), uint64(y))
+	case 8:
+		return cmpUint(binary.LittleEndian.Uint64(a), binary.LittleEndian.Uint64(b))
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		if a[i] != b[i] {
+			return int(a[i]) - int(b[i])
+		}
+	}
+	return 0
+}
+
+func cmpUint(x, y uint64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
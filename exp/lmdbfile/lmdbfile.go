@@ -0,0 +1,308 @@
+/*
+Package lmdbfile reads LMDB data files without cgo.  It is intended for
+analysis tools which need to read a data.mdb file on platforms or in builds
+where the lmdb package is unavailable.
+
+	f, err := lmdbfile.Open("/path/to/env")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	db, err := f.OpenDB("accounts")
+	if err != nil {
+		return err
+	}
+	cur := db.Cursor()
+	for k, v, err := cur.First(); err == nil; k, v, err = cur.Next() {
+		fmt.Printf("%x %x\n", k, v)
+	}
+
+For diagnostics the pages of a file can be decoded individually with
+File.Page, or visited tree by tree with DB.Walk.  The command lmdb_pages
+prints summaries of them.
+
+The file is read as of its newest valid meta page.  The reader takes no locks
+and does not register in the lock file, so the file must not be written while
+it is open.  Pages freed by a concurrent writer may be reused, which the
+reader reports as ErrCorrupt at best.
+
+Only files written by this repository's mdb.c on a 64-bit little-endian host
+are supported.  Databases using custom comparison functions (see
+lmdb.Txn.SetCmp) cannot be searched correctly, although iterating them with a
+Cursor visits items in their stored order.
+*/
+package lmdbfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Database flags stored in the file.  These have the same values as the
+// corresponding flags in the lmdb package.
+const (
+	ReverseKey = 0x02 // Keys are compared in reverse order.
+	DupSort    = 0x04 // Duplicate keys may be used in the database.
+	IntegerKey = 0x08 // Keys are native unsigned integers.
+	DupFixed   = 0x10 // Duplicate items have a fixed size (DupSort).
+	IntegerDup = 0x20 // Duplicate items are native unsigned integers (DupSort).
+	ReverseDup = 0x40 // Duplicate items are compared in reverse order (DupSort).
+)
+
+var (
+	// ErrNotFound is returned when a key or database does not exist, or when
+	// a cursor moves past the first or last item.
+	ErrNotFound = errors.New("lmdbfile: not found")
+
+	// ErrInvalid is returned when a file is not an LMDB data file.
+	ErrInvalid = errors.New("lmdbfile: not an LMDB file")
+
+	// ErrVersion is returned when a file was written with an unsupported
+	// data format version.
+	ErrVersion = errors.New("lmdbfile: unsupported version")
+
+	// ErrIncompatible is returned by File.OpenDB when the named key in the
+	// root database is not a named database.
+	ErrIncompatible = errors.New("lmdbfile: not a named database")
+
+	// ErrCorrupt is returned, possibly wrapped, when a page is malformed.
+	ErrCorrupt = errors.New("lmdbfile: corrupt page")
+)
+
+const (
+	magic       = 0xBEEFC0DE
+	dataVersion = 1
+	numMetas    = 2
+
+	// metaSize is the size of the meta structure following a meta page's
+	// header.
+	metaSize = 136
+
+	minPageSize = 256
+	maxPageSize = 1 << 16
+)
+
+// InvalidPage is the root page number of an empty database.
+const InvalidPage = ^uint64(0)
+
+// Meta describes a meta page.
+type Meta struct {
+	Page     int    // Meta page number, 0 or 1.
+	PageSize int    // Size of a database page.
+	Flags    uint   // Persistent environment flags.
+	MapSize  uint64 // Size of the memory map when the file was written.
+	LastPage uint64 // Last page number in use.
+	TxnID    uint64 // ID of the transaction which wrote the meta page.
+	Free     Record // The free page database.
+	Main     Record // The root database.
+}
+
+// Record describes the B-tree of a database, as stored in a meta page or in
+// the root database.
+type Record struct {
+	Flags         uint   // Database flags.
+	Depth         uint   // Depth (height) of the B-tree
+	BranchPages   uint64 // Number of internal (non-leaf) pages
+	LeafPages     uint64 // Number of leaf pages
+	OverflowPages uint64 // Number of overflow pages
+	Entries       uint64 // Number of data items
+	Root          uint64 // Root page, or InvalidPage if the database is empty
+}
+
+// File is an open LMDB data file.
+type File struct {
+	data  []byte
+	unmap func([]byte) error
+	meta  Meta
+	main  dbInfo
+	free  dbInfo
+}
+
+// Open opens the LMDB data file at path for reading.  If path is a directory
+// the file data.mdb within it is opened, as for an environment opened without
+// lmdb.NoSubdir.  Where supported the file is memory-mapped, otherwise it is
+// read into memory.
+func Open(path string) (*File, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		path = filepath.Join(path, "data.mdb")
+	}
+	osf, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer osf.Close()
+	fi, err = osf.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < minPageSize {
+		return nil, ErrInvalid
+	}
+	data, unmap, err := mmapFile(osf, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	f, err := NewFile(data)
+	if err != nil {
+		unmap(data)
+		return nil, err
+	}
+	f.unmap = unmap
+	return f, nil
+}
+
+// NewFile returns a File reading the contents of an LMDB data file held in
+// data.  The caller must not modify data while the File is in use.
+func NewFile(data []byte) (*File, error) {
+	f := &File{data: data}
+	err := f.readMeta()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close releases the memory used by f.  Slices returned by f and its cursors
+// must not be used after Close.
+func (f *File) Close() error {
+	var err error
+	if f.unmap != nil {
+		err = f.unmap(f.data)
+		f.unmap = nil
+	}
+	f.data = nil
+	return err
+}
+
+// Meta returns the meta page from which f is read.
+func (f *File) Meta() Meta {
+	return f.meta
+}
+
+// PageSize returns the size of the pages in f.
+func (f *File) PageSize() int {
+	return f.meta.PageSize
+}
+
+// TxnID returns the ID of the last transaction committed to f.
+func (f *File) TxnID() uint64 {
+	return f.meta.TxnID
+}
+
+// ReadMeta returns meta page n, which is 0 or 1, whether or not it is the
+// one from which f is read.
+func (f *File) ReadMeta(n int) (Meta, error) {
+	if n < 0 || n >= numMetas {
+		return Meta{}, ErrNotFound
+	}
+	m, _, _, err := f.parseMeta(n)
+	return m, err
+}
+
+// readMeta selects the newest valid meta page.  The page size is stored in
+// both meta pages but, as in mdb.c, the one in the first page is used to
+// locate the second.
+func (f *File) readMeta() error {
+	var found bool
+	for i := 0; i < numMetas; i++ {
+		m, free, main, err := f.parseMeta(i)
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			continue
+		}
+		if i == 0 {
+			f.meta.PageSize = m.PageSize
+		}
+		if !found || m.TxnID > f.meta.TxnID {
+			f.meta, f.free, f.main = m, free, main
+			found = true
+		}
+	}
+	if !found {
+		return ErrInvalid
+	}
+	return nil
+}
+
+func (f *File) parseMeta(n int) (Meta, dbInfo, dbInfo, error) {
+	var m Meta
+	off := n * f.meta.PageSize
+	if n > 0 && f.meta.PageSize == 0 || off+pageHeaderSize+metaSize > len(f.data) {
+		return m, dbInfo{}, dbInfo{}, ErrInvalid
+	}
+	p := page{b: f.data[off : off+pageHeaderSize+metaSize], pgno: uint64(n)}
+	b := p.b[pageHeaderSize:]
+	if binary.LittleEndian.Uint32(b) != magic || p.flags()&pMeta == 0 {
+		return m, dbInfo{}, dbInfo{}, ErrInvalid
+	}
+	if binary.LittleEndian.Uint32(b[4:]) != dataVersion {
+		return m, dbInfo{}, dbInfo{}, ErrVersion
+	}
+	free := parseDBInfo(b[24:])
+	main := parseDBInfo(b[24+dbInfoSize:])
+	m = Meta{
+		Page:     n,
+		PageSize: int(free.pad),
+		Flags:    uint(free.flags),
+		MapSize:  binary.LittleEndian.Uint64(b[16:]),
+		LastPage: binary.LittleEndian.Uint64(b[120:]),
+		TxnID:    binary.LittleEndian.Uint64(b[128:]),
+	}
+	// The flags of the free page database are shared with the environment
+	// flags.  The database itself always uses integer keys.
+	free.flags = IntegerKey
+	m.Free = free.record()
+	m.Main = main.record()
+	if m.PageSize < minPageSize || m.PageSize > maxPageSize || m.PageSize&(m.PageSize-1) != 0 {
+		return m, free, main, ErrInvalid
+	}
+	return m, free, main, nil
+}
+
+// page returns the page numbered pgno.
+func (f *File) page(pgno uint64) (page, error) {
+	psize := uint64(f.meta.PageSize)
+	if pgno >= uint64(len(f.data))/psize {
+		return page{}, corrupt(pgno, "page out of range")
+	}
+	p := page{b: f.data[pgno*psize : (pgno+1)*psize], pgno: pgno}
+	err := p.check()
+	if err != nil {
+		return page{}, err
+	}
+	if p.number() != pgno {
+		return page{}, corrupt(pgno, "page number mismatch")
+	}
+	return p, nil
+}
+
+// overflow returns the size bytes of data stored on the overflow pages
+// starting at pgno.
+func (f *File) overflow(pgno uint64, size int) ([]byte, error) {
+	p, err := f.page(pgno)
+	if err != nil {
+		return nil, err
+	}
+	if p.flags()&pOverflow == 0 {
+		return nil, corrupt(pgno, "not an overflow page")
+	}
+	start := pgno*uint64(f.meta.PageSize) + pageHeaderSize
+	end := start + uint64(size)
+	if uint64(pageHeaderSize+size) > uint64(p.overflowPages())*uint64(f.meta.PageSize) || end > uint64(len(f.data)) {
+		return nil, corrupt(pgno, "overflow data out of range")
+	}
+	return f.data[start:end], nil
+}
+
+func corrupt(pgno uint64, reason string) error {
+	return fmt.Errorf("%w: page %d: %s", ErrCorrupt, pgno, reason)
+}
@@ -0,0 +1,651 @@
+package lmdbfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// fixture describes a named database generated for the tests.
+type fixture struct {
+	name  string
+	flags uint
+	key   func(r *rand.Rand, i int) []byte
+	val   func(r *rand.Rand) []byte
+	keys  int
+	dups  func(r *rand.Rand, i int) int
+}
+
+func randBytes(r *rand.Rand, min, max int) []byte {
+	b := make([]byte, min+r.Intn(max-min+1))
+	r.Read(b)
+	return b
+}
+
+func uint64Key(r *rand.Rand, i int) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, r.Uint64())
+	return b
+}
+
+var fixtures = []fixture{
+	{
+		name: "plain",
+		key:  func(r *rand.Rand, i int) []byte { return randBytes(r, 1, 40) },
+		val: func(r *rand.Rand) []byte {
+			if r.Intn(20) == 0 {
+				return randBytes(r, 4000, 20000)
+			}
+			return randBytes(r, 0, 100)
+		},
+		keys: 3000,
+	},
+	{
+		name:  "dupsort",
+		flags: lmdb.DupSort,
+		key:   func(r *rand.Rand, i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) },
+		val:   func(r *rand.Rand) []byte { return randBytes(r, 1, 30) },
+		keys:  400,
+		dups: func(r *rand.Rand, i int) int {
+			if i%50 == 0 {
+				return 500 // stored in a sub-database
+			}
+			return 1 + r.Intn(5) // stored in a sub-page
+		},
+	},
+	{
+		name:  "dupfixed",
+		flags: lmdb.DupSort | lmdb.DupFixed,
+		key:   func(r *rand.Rand, i int) []byte { return randBytes(r, 1, 10) },
+		val:   func(r *rand.Rand) []byte { return randBytes(r, 8, 8) },
+		keys:  300,
+		dups: func(r *rand.Rand, i int) int {
+			if i%30 == 0 {
+				return 1000
+			}
+			return 1 + r.Intn(10)
+		},
+	},
+	{
+		name:  "integer",
+		flags: IntegerKey,
+		key:   uint64Key,
+		val:   func(r *rand.Rand) []byte { return randBytes(r, 0, 50) },
+		keys:  2000,
+	},
+	{
+		name:  "integerdup",
+		flags: IntegerKey | lmdb.DupSort | lmdb.DupFixed | IntegerDup,
+		key:   uint64Key,
+		val: func(r *rand.Rand) []byte {
+			b := make([]byte, 4)
+			binary.LittleEndian.PutUint32(b, r.Uint32())
+			return b
+		},
+		keys: 200,
+		dups: func(r *rand.Rand, i int) int {
+			if i%20 == 0 {
+				return 2000
+			}
+			return 1 + r.Intn(8)
+		},
+	},
+	{
+		name:  "reverse",
+		flags: lmdb.ReverseKey | lmdb.DupSort | lmdb.ReverseDup,
+		key:   func(r *rand.Rand, i int) []byte { return randBytes(r, 1, 20) },
+		val:   func(r *rand.Rand) []byte { return randBytes(r, 1, 20) },
+		keys:  1000,
+		dups: func(r *rand.Rand, i int) int {
+			if i%100 == 0 {
+				return 300
+			}
+			return 1 + r.Intn(3)
+		},
+	},
+	{
+		name: "empty",
+	},
+}
+
+// generate writes the fixtures to env over several transactions, deleting
+// some items so that freed pages are reused.
+func generate(t *testing.T, env *lmdb.Env) {
+	r := rand.New(rand.NewSource(1))
+	for _, fx := range fixtures {
+		err := env.Update(func(txn *lmdb.Txn) error {
+			dbi, err := txn.OpenDBI(fx.name, lmdb.Create|fx.flags)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < fx.keys; i++ {
+				k := fx.key(r, i)
+				n := 1
+				if fx.dups != nil {
+					n = fx.dups(r, i)
+				}
+				for j := 0; j < n; j++ {
+					err = txn.Put(dbi, k, fx.val(r), 0)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", fx.name, err)
+		}
+		err = env.Update(func(txn *lmdb.Txn) error {
+			dbi, err := txn.OpenDBI(fx.name, 0)
+			if err != nil {
+				return err
+			}
+			cur, err := txn.OpenCursor(dbi)
+			if err != nil {
+				return err
+			}
+			defer cur.Close()
+			for _, _, err = cur.Get(nil, nil, lmdb.First); err == nil; _, _, err = cur.Get(nil, nil, lmdb.Next) {
+				if r.Intn(10) == 0 {
+					err = cur.Del(0)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", fx.name, err)
+		}
+	}
+}
+
+func openFixtures(t *testing.T) (*lmdb.Env, *File) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: len(fixtures), MapSize: 256 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generate(t, env)
+	path, err := env.Path()
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	f, err := Open(path)
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	return env, f
+}
+
+// item is the result of a cursor operation.
+type item struct {
+	k, v  []byte
+	count uint64
+	err   error
+}
+
+func (it item) String() string {
+	if it.err != nil {
+		return it.err.Error()
+	}
+	return fmt.Sprintf("%x=%x (%d)", it.k, it.v, it.count)
+}
+
+func (it item) equal(other item) bool {
+	if (it.err == nil) != (other.err == nil) {
+		return false
+	}
+	return bytes.Equal(it.k, other.k) && bytes.Equal(it.v, other.v) && it.count == other.count
+}
+
+// checker compares the results of an lmdb.Cursor and a Cursor.
+type checker struct {
+	t       *testing.T
+	name    string
+	dupsort bool
+	lc      *lmdb.Cursor
+	c       *Cursor
+}
+
+func (ch *checker) cgo(setkey []byte, op uint) item {
+	k, v, err := ch.lc.Get(setkey, nil, op)
+	if lmdb.IsNotFound(err) {
+		return item{err: ErrNotFound}
+	}
+	if err != nil {
+		ch.t.Fatalf("%s: %v", ch.name, err)
+	}
+	it := item{k: k, v: v, count: 1}
+	if !ch.dupsort {
+		return it
+	}
+	it.count, err = ch.lc.Count()
+	if err != nil {
+		ch.t.Fatalf("%s: %v", ch.name, err)
+	}
+	return it
+}
+
+func (ch *checker) pure(k, v []byte, err error) item {
+	if err == ErrNotFound {
+		return item{err: err}
+	}
+	if err != nil {
+		ch.t.Fatalf("%s: %v", ch.name, err)
+	}
+	it := item{k: k, v: v}
+	it.count, err = ch.c.Count()
+	if err != nil {
+		ch.t.Fatalf("%s: %v", ch.name, err)
+	}
+	return it
+}
+
+// step performs the same operation on both cursors and reports whether an
+// item was found.
+func (ch *checker) step(desc string, a, b item) bool {
+	ch.t.Helper()
+	if !a.equal(b) {
+		ch.t.Fatalf("%s: %s: %v (!= %v)", ch.name, desc, b, a)
+	}
+	return a.err == nil
+}
+
+// move moves the pure Go cursor with the operation corresponding to op.
+func (ch *checker) move(op uint) ([]byte, []byte, error) {
+	switch op {
+	case lmdb.Next:
+		return ch.c.Next()
+	case lmdb.Prev:
+		return ch.c.Prev()
+	case lmdb.NextDup:
+		return ch.c.NextDup()
+	case lmdb.PrevDup:
+		return ch.c.PrevDup()
+	case lmdb.NextNoDup:
+		return ch.c.NextNoDup()
+	case lmdb.PrevNoDup:
+		return ch.c.PrevNoDup()
+	}
+	ch.t.Fatalf("%s: unexpected op %d", ch.name, op)
+	return nil, nil, nil
+}
+
+// iterate walks both cursors with the given operations until the end of the
+// database and returns the keys visited.
+func (ch *checker) iterate(desc string, op uint, move func() ([]byte, []byte, error)) [][]byte {
+	var keys [][]byte
+	for ch.step(desc, ch.cgo(nil, op), ch.pure(move())) {
+		k, _, _ := ch.lc.Get(nil, nil, lmdb.GetCurrent)
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestFile(t *testing.T) {
+	env, f := openFixtures(t)
+	defer lmdbtest.Destroy(env)
+	defer f.Close()
+
+	var info *lmdb.EnvInfo
+	info, err := env.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.TxnID() != uint64(info.LastTxnID) {
+		t.Errorf("txnid: %d (!= %d)", f.TxnID(), info.LastTxnID)
+	}
+
+	r := rand.New(rand.NewSource(2))
+	err = env.View(func(txn *lmdb.Txn) error {
+		txn.RawRead = true
+		names := []string{""}
+		for _, fx := range fixtures {
+			names = append(names, fx.name)
+		}
+		for _, name := range names {
+			var dbi lmdb.DBI
+			var db *DB
+			if name == "" {
+				dbi, err = txn.OpenRoot(0)
+				db = f.Root()
+			} else {
+				dbi, err = txn.OpenDBI(name, 0)
+				if err != nil {
+					return err
+				}
+				db, err = f.OpenDB(name)
+			}
+			if err != nil {
+				return err
+			}
+			checkDB(t, r, txn, dbi, db, name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.OpenDB("missing")
+	if err != ErrNotFound {
+		t.Errorf("missing database: %v", err)
+	}
+}
+
+func checkDB(t *testing.T, r *rand.Rand, txn *lmdb.Txn, dbi lmdb.DBI, db *DB, name string) {
+	stat, err := txn.Stat(dbi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *db.Stat() != (Stat)(*stat) {
+		t.Errorf("%s: stat: %+v (!= %+v)", name, *db.Stat(), *stat)
+	}
+	flags, err := txn.Flags(dbi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Flags() != flags {
+		t.Errorf("%s: flags: %#x (!= %#x)", name, db.Flags(), flags)
+	}
+
+	// Each checker starts with unpositioned cursors.
+	var cursors []*lmdb.Cursor
+	defer func() {
+		for _, lc := range cursors {
+			lc.Close()
+		}
+	}()
+	newChecker := func() *checker {
+		lc, err := txn.OpenCursor(dbi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursors = append(cursors, lc)
+		return &checker{t: t, name: name, dupsort: flags&lmdb.DupSort != 0, lc: lc, c: db.Cursor()}
+	}
+
+	ch := newChecker()
+	keys := ch.iterate("next", lmdb.Next, ch.c.Next)
+	if uint64(len(keys)) != stat.Entries {
+		t.Errorf("%s: iterated %d items (!= %d)", name, len(keys), stat.Entries)
+	}
+	ch = newChecker()
+	ch.iterate("prev", lmdb.Prev, ch.c.Prev)
+	ch = newChecker()
+	nodup := ch.iterate("next nodup", lmdb.NextNoDup, ch.c.NextNoDup)
+	ch = newChecker()
+	ch.iterate("prev nodup", lmdb.PrevNoDup, ch.c.PrevNoDup)
+
+	// Walk the duplicates of each key in both directions.  For a database
+	// without duplicates lmdb treats NextDup as Next.
+	for _, k := range nodup {
+		if !ch.dupsort {
+			break
+		}
+		ch.step("seek", ch.cgo(k, lmdb.SetRange), ch.pure(ch.c.Seek(k)))
+		for ch.step("next dup", ch.cgo(nil, lmdb.NextDup), ch.pure(ch.c.NextDup())) {
+		}
+		for ch.step("prev dup", ch.cgo(nil, lmdb.PrevDup), ch.pure(ch.c.PrevDup())) {
+		}
+	}
+
+	for _, k := range nodup {
+		v, err := txn.Get(dbi, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v2, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("%s: get %x: %v", name, k, err)
+		}
+		if !bytes.Equal(v, v2) {
+			t.Fatalf("%s: get %x: %x (!= %x)", name, k, v2, v)
+		}
+	}
+
+	// Seek keys which are mostly absent, derived from present keys.
+	for i := 0; i < 500; i++ {
+		var k []byte
+		if len(nodup) > 0 && i%2 == 0 {
+			k = append([]byte{}, nodup[r.Intn(len(nodup))]...)
+			k[r.Intn(len(k))] ^= byte(1 + r.Intn(255))
+		} else if db.Flags()&IntegerKey != 0 {
+			k = uint64Key(r, i)
+		} else {
+			k = randBytes(r, 1, 20)
+		}
+		ch.step(fmt.Sprintf("seek %x", k), ch.cgo(k, lmdb.SetRange), ch.pure(ch.c.Seek(k)))
+		_, err := txn.Get(dbi, k)
+		_, err2 := db.Get(k)
+		if lmdb.IsNotFound(err) != (err2 == ErrNotFound) {
+			t.Fatalf("%s: get %x: %v (!= %v)", name, k, err2, err)
+		}
+	}
+
+	// A Seek past the last key moves away from the current item, which is a
+	// duplicate where possible.
+	if len(nodup) == 0 {
+		return
+	}
+	past := bytes.Repeat([]byte{0xff}, 64)
+	if db.Flags()&IntegerKey != 0 {
+		past = past[:len(nodup[0])]
+	}
+	for _, op := range []uint{lmdb.Next, lmdb.Prev, lmdb.NextDup, lmdb.PrevDup, lmdb.NextNoDup, lmdb.PrevNoDup} {
+		if (op == lmdb.NextDup || op == lmdb.PrevDup) && flags&lmdb.DupSort == 0 {
+			continue
+		}
+		ch = newChecker()
+		k := nodup[len(nodup)/2]
+		ch.step("seek", ch.cgo(k, lmdb.SetRange), ch.pure(ch.c.Seek(k)))
+		ch.step("next", ch.cgo(nil, lmdb.Next), ch.pure(ch.c.Next()))
+		if ch.step("seek past end", ch.cgo(past, lmdb.SetRange), ch.pure(ch.c.Seek(past))) {
+			t.Fatalf("%s: seek %x: found", name, past)
+		}
+		for i := 0; i < 2; i++ {
+			ch.step(fmt.Sprintf("op %d after seek past end", op), ch.cgo(nil, op), ch.pure(ch.move(op)))
+		}
+	}
+}
+
+func TestFile_meta(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	path, err := env.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each commit writes the older of the two meta pages.
+	for i := 0; i < 3; i++ {
+		err = env.Update(func(txn *lmdb.Txn) error {
+			dbi, err := txn.OpenRoot(0)
+			if err != nil {
+				return err
+			}
+			return txn.Put(dbi, []byte("k"), []byte{byte(i)}, 0)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := Open(filepath.Join(path, "data.mdb"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := f.Root().Get([]byte("k"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, []byte{byte(i)}) {
+			t.Errorf("commit %d: value %x", i, v)
+		}
+		m := f.Meta()
+		if m.Page != int(m.TxnID%2) {
+			t.Errorf("commit %d: meta page %d for txnid %d", i, m.Page, m.TxnID)
+		}
+		f.Close()
+	}
+}
+
+func TestFile_invalid(t *testing.T) {
+	_, err := NewFile(make([]byte, 8192))
+	if err != ErrInvalid {
+		t.Errorf("zeroed file: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "lmdbfile-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "data.mdb"), []byte("short"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(dir)
+	if err != ErrInvalid {
+		t.Errorf("short file: %v", err)
+	}
+}
+
+func TestFile_corrupt(t *testing.T) {
+	env, f := openFixtures(t)
+	defer lmdbtest.Destroy(env)
+	data := append([]byte{}, f.data...)
+	f.Close()
+
+	// Truncated and scribbled copies of the file must produce errors rather
+	// than panics.
+	r := rand.New(rand.NewSource(3))
+	psize := f.PageSize()
+	for i := 0; i < 50; i++ {
+		b := append([]byte{}, data...)
+		if i%2 == 0 {
+			b = b[:2*psize+r.Intn(len(b)-2*psize)]
+		} else {
+			for j := 0; j < 100; j++ {
+				b[2*psize+r.Intn(len(b)-2*psize)] = byte(r.Intn(256))
+			}
+		}
+		cf, err := NewFile(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		walk := func(db *DB) error {
+			c := db.Cursor()
+			var err error
+			for _, _, err = c.First(); err == nil; _, _, err = c.Next() {
+			}
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			return db.Walk(func(p *Page, level int, dup bool) error { return nil })
+		}
+		err = walk(cf.Root())
+		for _, fx := range fixtures {
+			db, err := cf.OpenDB(fx.name)
+			if err == nil {
+				err = walk(db)
+			}
+			if err != nil && err != ErrNotFound && !errors.Is(err, ErrCorrupt) && err != ErrIncompatible {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		if err != nil && err != ErrNotFound && !errors.Is(err, ErrCorrupt) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestDB_Walk(t *testing.T) {
+	env, f := openFixtures(t)
+	defer lmdbtest.Destroy(env)
+	defer f.Close()
+
+	for _, fx := range fixtures {
+		db, err := f.OpenDB(fx.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var branch, leaf, overflow, entries uint64
+		var subPages int
+		err = db.Walk(func(p *Page, level int, dup bool) error {
+			if p.Flags&PageSubp != 0 {
+				subPages++
+			}
+			switch {
+			case p.Flags&PageOverflow != 0:
+				if !dup {
+					overflow += uint64(p.Overflow)
+				}
+				return nil
+			case p.Flags&PageBranch != 0:
+				if !dup {
+					branch++
+				}
+				return nil
+			}
+			if !dup {
+				leaf++
+			}
+			for _, n := range p.Nodes {
+				if n.Flags&NodeDupData == 0 {
+					entries++
+				}
+			}
+			if p.Flags&PageSubp == 0 {
+				dp, err := f.Page(p.Pgno)
+				if err != nil {
+					return err
+				}
+				if len(dp.Nodes) != len(p.Nodes) || dp.Used() != p.Used() {
+					t.Errorf("%s: page %d decoded differently", fx.name, p.Pgno)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", fx.name, err)
+		}
+		rec := db.Record()
+		if branch != rec.BranchPages || leaf != rec.LeafPages || overflow != rec.OverflowPages || entries != rec.Entries {
+			t.Errorf("%s: walked branch=%d leaf=%d overflow=%d entries=%d (!= %+v)", fx.name, branch, leaf, overflow, entries, rec)
+		}
+		if fx.flags&lmdb.DupSort != 0 && subPages == 0 {
+			t.Errorf("%s: no sub-pages", fx.name)
+		}
+	}
+
+	for n := 0; n < 2; n++ {
+		m, err := f.ReadMeta(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Page != n || m.PageSize != f.PageSize() {
+			t.Errorf("meta %d: %+v", n, m)
+		}
+		if m.TxnID == f.TxnID() && m != f.Meta() {
+			t.Errorf("meta %d: %+v (!= %+v)", n, m, f.Meta())
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package lmdbfile
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads the file into memory on platforms without syscall.Mmap.
+func mmapFile(f *os.File, size int64) ([]byte, func([]byte) error, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(f, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func([]byte) error { return nil }, nil
+}
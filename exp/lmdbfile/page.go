@@ -0,0 +1,170 @@
+package lmdbfile
+
+import "encoding/binary"
+
+// The layout of pages and nodes follows MDB_page, MDB_node and MDB_db in
+// mdb.c.
+const (
+	pageHeaderSize = 16
+	nodeHeaderSize = 8
+	dbInfoSize     = 48
+)
+
+// Page flags.
+const (
+	pBranch   = 0x01
+	pLeaf     = 0x02
+	pOverflow = 0x04
+	pMeta     = 0x08
+	pLeaf2    = 0x20
+	pSubp     = 0x40
+)
+
+// Node flags.
+const (
+	fBigData = 0x01
+	fSubData = 0x02
+	fDupData = 0x04
+)
+
+// page is a database page, or a DupSort sub-page embedded in a leaf node.
+// Offsets within the page are relative to the start of b.
+type page struct {
+	b    []byte
+	pgno uint64
+}
+
+func (p page) number() uint64 { return binary.LittleEndian.Uint64(p.b) }
+func (p page) pad() int       { return int(binary.LittleEndian.Uint16(p.b[8:])) }
+func (p page) flags() uint16  { return binary.LittleEndian.Uint16(p.b[10:]) }
+func (p page) lower() int     { return int(binary.LittleEndian.Uint16(p.b[12:])) }
+func (p page) upper() int     { return int(binary.LittleEndian.Uint16(p.b[14:])) }
+
+func (p page) overflowPages() uint32 { return binary.LittleEndian.Uint32(p.b[12:]) }
+
+func (p page) isLeaf() bool   { return p.flags()&pLeaf != 0 }
+func (p page) isBranch() bool { return p.flags()&pBranch != 0 }
+func (p page) isLeaf2() bool  { return p.flags()&pLeaf2 != 0 }
+
+// numKeys returns the number of nodes or keys in a branch or leaf page.
+func (p page) numKeys() int {
+	return (p.lower() - pageHeaderSize) >> 1
+}
+
+// check validates the header of p.  Overflow pages only need a header.
+func (p page) check() error {
+	if len(p.b) < pageHeaderSize {
+		return corrupt(p.pgno, "short page")
+	}
+	if p.flags()&(pOverflow|pMeta) != 0 {
+		return nil
+	}
+	if p.lower() < pageHeaderSize || p.lower() > p.upper() || p.upper() > len(p.b) {
+		return corrupt(p.pgno, "bad free space bounds")
+	}
+	if p.isLeaf2() && p.pad() == 0 {
+		return corrupt(p.pgno, "bad LEAF2 key size")
+	}
+	return nil
+}
+
+// node is a node in a branch or leaf page.
+type node struct {
+	lo, hi uint16
+	flags  uint16
+	key    []byte
+	data   []byte // remainder of the page after the key
+}
+
+// pgno returns the child page of a branch node.
+func (n node) pgno() uint64 {
+	return uint64(n.lo) | uint64(n.hi)<<16 | uint64(n.flags)<<32
+}
+
+// size returns the size of a leaf node's data.
+func (n node) size() int {
+	return int(n.lo) | int(n.hi)<<16
+}
+
+// node returns the node at index i in a branch or leaf page.
+func (p page) node(i int) (node, error) {
+	if i < 0 || i >= p.numKeys() {
+		return node{}, corrupt(p.pgno, "node index out of range")
+	}
+	off := int(binary.LittleEndian.Uint16(p.b[pageHeaderSize+2*i:]))
+	if off < p.upper() || off+nodeHeaderSize > len(p.b) {
+		return node{}, corrupt(p.pgno, "node offset out of range")
+	}
+	b := p.b[off:]
+	n := node{
+		lo:    binary.LittleEndian.Uint16(b),
+		hi:    binary.LittleEndian.Uint16(b[2:]),
+		flags: binary.LittleEndian.Uint16(b[4:]),
+	}
+	ksize := int(binary.LittleEndian.Uint16(b[6:]))
+	if nodeHeaderSize+ksize > len(b) {
+		return node{}, corrupt(p.pgno, "node key out of range")
+	}
+	n.key = b[nodeHeaderSize : nodeHeaderSize+ksize]
+	n.data = b[nodeHeaderSize+ksize:]
+	return n, nil
+}
+
+// leaf2Key returns the key at index i in a LEAF2 page.
+func (p page) leaf2Key(i int) ([]byte, error) {
+	ksize := p.pad()
+	off := pageHeaderSize + i*ksize
+	if i < 0 || i >= p.numKeys() || off+ksize > len(p.b) {
+		return nil, corrupt(p.pgno, "key index out of range")
+	}
+	return p.b[off : off+ksize], nil
+}
+
+// key returns the key at index i in a branch or leaf page.
+func (p page) key(i int) ([]byte, error) {
+	if p.isLeaf2() {
+		return p.leaf2Key(i)
+	}
+	n, err := p.node(i)
+	if err != nil {
+		return nil, err
+	}
+	return n.key, nil
+}
+
+// dbInfo is the persistent description of a B-tree.
+type dbInfo struct {
+	pad      uint32
+	flags    uint16
+	depth    uint16
+	branch   uint64
+	leaf     uint64
+	overflow uint64
+	entries  uint64
+	root     uint64
+}
+
+func parseDBInfo(b []byte) dbInfo {
+	return dbInfo{
+		pad:      binary.LittleEndian.Uint32(b),
+		flags:    binary.LittleEndian.Uint16(b[4:]),
+		depth:    binary.LittleEndian.Uint16(b[6:]),
+		branch:   binary.LittleEndian.Uint64(b[8:]),
+		leaf:     binary.LittleEndian.Uint64(b[16:]),
+		overflow: binary.LittleEndian.Uint64(b[24:]),
+		entries:  binary.LittleEndian.Uint64(b[32:]),
+		root:     binary.LittleEndian.Uint64(b[40:]),
+	}
+}
+
+func (i dbInfo) record() Record {
+	return Record{
+		Flags:         uint(i.flags),
+		Depth:         uint(i.depth),
+		BranchPages:   i.branch,
+		LeafPages:     i.leaf,
+		OverflowPages: i.overflow,
+		Entries:       i.entries,
+		Root:          i.root,
+	}
+}
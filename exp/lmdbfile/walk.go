@@ -0,0 +1,225 @@
+package lmdbfile
+
+import "encoding/binary"
+
+// Page flags reported in Page.Flags.
+const (
+	PageBranch   = pBranch   // A branch page.
+	PageLeaf     = pLeaf     // A leaf page.
+	PageOverflow = pOverflow // The first page of an overflow page chain.
+	PageMeta     = pMeta     // A meta page.
+	PageLeaf2    = pLeaf2    // A leaf page of fixed size keys (DupFixed).
+	PageSubp     = pSubp     // A sub-page embedded in a leaf node (DupSort).
+)
+
+// Node flags reported in Node.Flags.
+const (
+	NodeBigData = fBigData // The data is stored in overflow pages.
+	NodeSubData = fSubData // The data is a named or duplicate database Record.
+	NodeDupData = fDupData // The data holds the duplicates of the key.
+)
+
+// Page is a decoded page.
+type Page struct {
+	Pgno     uint64 // Page number.  For a sub-page, the page containing it.
+	Flags    uint16 // Page flags.
+	Lower    int    // Offset of the start of free space.
+	Upper    int    // Offset of the end of free space.
+	Pad      int    // Key size of a LEAF2 page.
+	Overflow int    // Number of pages in an overflow page chain.
+	Nodes    []Node // Nodes of a branch or leaf page.
+	Raw      []byte // Contents of the page, or of every page in an overflow chain.
+}
+
+// Node is a decoded node of a branch or leaf page, or a key of a LEAF2 page.
+type Node struct {
+	Offset   int    // Offset of the node within the page.
+	Flags    uint16 // Node flags, zero in a branch page.
+	Key      []byte // Key of the node.
+	Size     int    // Size of the data of a leaf node.
+	Child    uint64 // Child page of a branch node.
+	Overflow uint64 // First overflow page of a leaf node with NodeBigData.
+	Data     []byte // Data stored in a leaf node, unless NodeBigData is set.
+}
+
+// Free returns the number of unused bytes in a branch or leaf page.
+func (p *Page) Free() int {
+	if p.Flags&(PageBranch|PageLeaf) == 0 {
+		return 0
+	}
+	return p.Upper - p.Lower
+}
+
+// Used returns the number of bytes used in a page, including its header.
+// An overflow page chain is used in its entirety.
+func (p *Page) Used() int {
+	return len(p.Raw) - p.Free()
+}
+
+// Page returns the decoded page numbered pgno.  The nodes of meta pages are
+// not decoded.
+func (f *File) Page(pgno uint64) (*Page, error) {
+	p, err := f.page(pgno)
+	if err != nil {
+		return nil, err
+	}
+	return f.decode(p)
+}
+
+func (f *File) decode(p page) (*Page, error) {
+	dp := &Page{
+		Pgno:  p.pgno,
+		Flags: p.flags(),
+		Pad:   p.pad(),
+		Raw:   p.b,
+	}
+	switch {
+	case dp.Flags&pOverflow != 0:
+		dp.Overflow = int(p.overflowPages())
+		psize := uint64(f.meta.PageSize)
+		end := (p.pgno + uint64(dp.Overflow)) * psize
+		if dp.Overflow == 0 || end > uint64(len(f.data)) {
+			return nil, corrupt(p.pgno, "overflow pages out of range")
+		}
+		dp.Raw = f.data[p.pgno*psize : end]
+		return dp, nil
+	case dp.Flags&pMeta != 0:
+		return dp, nil
+	}
+	dp.Lower = p.lower()
+	dp.Upper = p.upper()
+	n := p.numKeys()
+	dp.Nodes = make([]Node, n)
+	for i := range dp.Nodes {
+		dn := &dp.Nodes[i]
+		if p.isLeaf2() {
+			k, err := p.leaf2Key(i)
+			if err != nil {
+				return nil, err
+			}
+			dn.Offset = pageHeaderSize + i*p.pad()
+			dn.Key = k
+			continue
+		}
+		nd, err := p.node(i)
+		if err != nil {
+			return nil, err
+		}
+		dn.Offset = int(binary.LittleEndian.Uint16(p.b[pageHeaderSize+2*i:]))
+		dn.Key = nd.key
+		switch {
+		case p.isBranch():
+			dn.Child = nd.pgno()
+		case nd.flags&fBigData != 0:
+			if len(nd.data) < 8 {
+				return nil, corrupt(p.pgno, "node data out of range")
+			}
+			dn.Flags = nd.flags
+			dn.Size = nd.size()
+			dn.Overflow = binary.LittleEndian.Uint64(nd.data)
+		default:
+			if nd.size() > len(nd.data) {
+				return nil, corrupt(p.pgno, "node data out of range")
+			}
+			dn.Flags = nd.flags
+			dn.Size = nd.size()
+			dn.Data = nd.data[:nd.size()]
+		}
+	}
+	return dp, nil
+}
+
+// WalkFunc is called by DB.Walk for each page of a database.  Level is the
+// distance of the page from the root of the database.  Dup is true for the
+// pages and sub-pages which hold duplicates of a DupSort database.  If a
+// WalkFunc returns an error the walk stops and returns it.
+type WalkFunc func(p *Page, level int, dup bool) error
+
+// Walk calls fn for each page of db in depth-first order, starting with the
+// root.  The pages of a node's overflow chain or duplicates are visited after
+// its leaf page.  The named databases in the root database are not visited.
+func (db *DB) Walk(fn WalkFunc) error {
+	w := &walker{f: db.f, fn: fn}
+	return w.tree(db.info, 0, false)
+}
+
+type walker struct {
+	f  *File
+	fn WalkFunc
+}
+
+func (w *walker) tree(info dbInfo, level int, dup bool) error {
+	if info.root == InvalidPage {
+		return nil
+	}
+	return w.page(info.root, level, level+int(info.depth), dup)
+}
+
+// page visits the page pgno of a tree whose leaves are at level leaf-1.
+func (w *walker) page(pgno uint64, level, leaf int, dup bool) error {
+	p, err := w.f.page(pgno)
+	if err != nil {
+		return err
+	}
+	if p.isLeaf() != (level == leaf-1) || !p.isLeaf() && !p.isBranch() {
+		return corrupt(pgno, "unexpected tree depth")
+	}
+	dp, err := w.f.decode(p)
+	if err != nil {
+		return err
+	}
+	err = w.fn(dp, level, dup)
+	if err != nil {
+		return err
+	}
+	for _, n := range dp.Nodes {
+		switch {
+		case p.isBranch():
+			err = w.page(n.Child, level+1, leaf, dup)
+		case n.Flags&fBigData != 0:
+			err = w.overflow(n.Overflow, level+1, dup)
+		case n.Flags&(fDupData|fSubData) == fDupData|fSubData:
+			if len(n.Data) != dbInfoSize {
+				return corrupt(pgno, "bad duplicate database record")
+			}
+			err = w.tree(parseDBInfo(n.Data), level+1, true)
+		case n.Flags&fDupData != 0:
+			err = w.subPage(pgno, n.Data, level+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walker) overflow(pgno uint64, level int, dup bool) error {
+	p, err := w.f.page(pgno)
+	if err != nil {
+		return err
+	}
+	if p.flags()&pOverflow == 0 {
+		return corrupt(pgno, "not an overflow page")
+	}
+	dp, err := w.f.decode(p)
+	if err != nil {
+		return err
+	}
+	return w.fn(dp, level, dup)
+}
+
+func (w *walker) subPage(pgno uint64, b []byte, level int) error {
+	p := page{b: b, pgno: pgno}
+	err := p.check()
+	if err != nil {
+		return err
+	}
+	if p.flags()&(pLeaf|pSubp) != pLeaf|pSubp {
+		return corrupt(pgno, "bad sub-page")
+	}
+	dp, err := w.f.decode(p)
+	if err != nil {
+		return err
+	}
+	return w.fn(dp, level, true)
+}
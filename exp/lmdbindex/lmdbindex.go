@@ -0,0 +1,422 @@
+/*
+Package lmdbindex maintains secondary indexes for an LMDB database.
+
+A Primary wraps a database of records and a set of Index values.  Each Index
+computes zero or more index keys from a record and stores them in a database
+opened with the lmdb.DupSort flag, mapping every index key to the primary keys
+of the records that produced it.  Writing records through the Primary updates
+all of its indexes in the same transaction so they cannot drift from the
+records they describe.
+
+	byEmail := &lmdbindex.Index{
+		Name: "email",
+		DBI:  emailDBI, // opened with lmdb.DupSort
+		Fn: func(key, val []byte) ([][]byte, error) {
+			return [][]byte{emailOf(val)}, nil
+		},
+	}
+	users := lmdbindex.New(userDBI, byEmail)
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		return users.Put(txn, id, record, 0)
+	})
+
+Index-backed reads return the primary records for matching index keys.
+
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		it := users.Lookup(txn, byEmail, []byte("alice@example.com"))
+		defer it.Close()
+		for it.Next() {
+			log.Printf("%x: %s", it.Key(), it.Val())
+		}
+		return it.Err()
+	})
+
+Writes to the primary database that bypass the Primary leave indexes stale.
+Verify detects such inconsistencies and Rebuild recomputes an index from
+scratch.
+*/
+package lmdbindex
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+// IndexFunc returns the index keys for the record with the given key and
+// value.  The returned keys must not be empty and must not reference val,
+// which may be modified by LMDB after the function returns.
+type IndexFunc func(key, val []byte) ([][]byte, error)
+
+// Index is a secondary index stored in a database with the lmdb.DupSort flag.
+type Index struct {
+	Name string
+	DBI  lmdb.DBI
+	Fn   IndexFunc
+}
+
+// keys returns the sorted, de-duplicated index keys for a record.
+func (idx *Index) keys(key, val []byte) ([][]byte, error) {
+	ks, err := idx.Fn(key, val)
+	if err != nil {
+		return nil, fmt.Errorf("lmdbindex: index %s: %v", idx.Name, err)
+	}
+	sort.Slice(ks, func(i, j int) bool { return bytes.Compare(ks[i], ks[j]) < 0 })
+	out := ks[:0]
+	for i, k := range ks {
+		if len(k) == 0 {
+			return nil, fmt.Errorf("lmdbindex: index %s: empty index key", idx.Name)
+		}
+		if i > 0 && bytes.Equal(k, ks[i-1]) {
+			continue
+		}
+		out = append(out, k)
+	}
+	return out, nil
+}
+
+// Primary is a database of records and the indexes maintained over it.  The
+// primary database must not have the lmdb.DupSort flag.
+type Primary struct {
+	DBI     lmdb.DBI
+	Indexes []*Index
+}
+
+// New returns a Primary for dbi which maintains the given indexes.
+func New(dbi lmdb.DBI, indexes ...*Index) *Primary {
+	return &Primary{
+		DBI:     dbi,
+		Indexes: indexes,
+	}
+}
+
+// Get returns the record stored under key.
+func (p *Primary) Get(txn *lmdb.Txn, key []byte) ([]byte, error) {
+	return txn.Get(p.DBI, key)
+}
+
+// Put stores val under key and updates every index to reflect the change.
+// The flags are passed to lmdb.Txn.Put for the primary database.
+func (p *Primary) Put(txn *lmdb.Txn, key, val []byte, flags uint) error {
+	old, err := txn.Get(p.DBI, key)
+	switch {
+	case err == nil:
+		if flags&lmdb.NoOverwrite != 0 {
+			return &lmdb.OpError{Op: "mdb_put", Errno: lmdb.KeyExist}
+		}
+	case lmdb.IsNotFound(err):
+		old = nil
+	default:
+		return err
+	}
+
+	// Store the record first so that the indexes are untouched if the put
+	// fails.  The put may overwrite the page holding old.
+	if old != nil {
+		old = append([]byte{}, old...)
+	}
+	err = txn.Put(p.DBI, key, val, flags)
+	if err != nil {
+		return err
+	}
+	for _, idx := range p.Indexes {
+		err = p.reindex(txn, idx, key, old, val)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the record stored under key along with its index entries.
+// Delete returns an error satisfying lmdb.IsNotFound if key is not present.
+func (p *Primary) Delete(txn *lmdb.Txn, key []byte) error {
+	old, err := txn.Get(p.DBI, key)
+	if err != nil {
+		return err
+	}
+
+	// As in Put, the record is deleted first.
+	old = append([]byte{}, old...)
+	err = txn.Del(p.DBI, key, nil)
+	if err != nil {
+		return err
+	}
+	for _, idx := range p.Indexes {
+		err = p.reindex(txn, idx, key, old, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindex replaces the entries derived from old with those derived from val.
+// A nil old or val means that the record does not exist before or after the
+// change.
+func (p *Primary) reindex(txn *lmdb.Txn, idx *Index, key, old, val []byte) error {
+	var prev, next [][]byte
+	var err error
+	if old != nil {
+		prev, err = idx.keys(key, old)
+		if err != nil {
+			return err
+		}
+	}
+	if val != nil {
+		next, err = idx.keys(key, val)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Both lists are sorted so their difference is found with a merge.
+	i, j := 0, 0
+	for i < len(prev) || j < len(next) {
+		var c int
+		switch {
+		case i == len(prev):
+			c = 1
+		case j == len(next):
+			c = -1
+		default:
+			c = bytes.Compare(prev[i], next[j])
+		}
+		switch {
+		case c < 0:
+			err = txn.Del(idx.DBI, prev[i], key)
+			if lmdb.IsNotFound(err) {
+				err = nil
+			}
+			i++
+		case c > 0:
+			err = txn.Put(idx.DBI, next[j], key, lmdb.NoDupData)
+			if lmdb.IsKeyExists(err) {
+				err = nil
+			}
+			j++
+		default:
+			i++
+			j++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup returns an Iter over the records with index key ikey in idx.
+func (p *Primary) Lookup(txn *lmdb.Txn, idx *Index, ikey []byte) *Iter {
+	it := p.iter(txn, idx)
+	it.exact = true
+	it.s.SetNext(ikey, nil, lmdb.Set, lmdb.NextDup)
+	return it
+}
+
+// Range returns an Iter over the records with index keys in the half-open
+// interval [start, end) of idx.  If end is nil the interval is unbounded.
+func (p *Primary) Range(txn *lmdb.Txn, idx *Index, start, end []byte) *Iter {
+	it := p.iter(txn, idx)
+	it.end = end
+	if len(start) == 0 {
+		it.s.SetNext(nil, nil, lmdb.First, lmdb.Next)
+	} else {
+		it.s.SetNext(start, nil, lmdb.SetRange, lmdb.Next)
+	}
+	return it
+}
+
+func (p *Primary) iter(txn *lmdb.Txn, idx *Index) *Iter {
+	return &Iter{
+		p:   p,
+		idx: idx,
+		txn: txn,
+		s:   lmdbscan.New(txn, idx.DBI),
+	}
+}
+
+// Iter scans index entries and retrieves the primary records they refer to.
+// An Iter must be closed when it is no longer needed.
+type Iter struct {
+	p     *Primary
+	idx   *Index
+	txn   *lmdb.Txn
+	s     *lmdbscan.Scanner
+	exact bool
+	end   []byte
+	val   []byte
+	err   error
+}
+
+// Next advances to the next record.  Next returns false when the matching
+// index entries are exhausted or an error is encountered.
+func (it *Iter) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.s.Scan() {
+		it.err = it.s.Err()
+		return false
+	}
+	if !it.exact && it.end != nil && it.txn.Cmp(it.idx.DBI, it.s.Key(), it.end) >= 0 {
+		return false
+	}
+	it.val, it.err = it.txn.Get(it.p.DBI, it.s.Val())
+	if lmdb.IsNotFound(it.err) {
+		it.err = fmt.Errorf("lmdbindex: index %s: entry %q refers to missing record %q", it.idx.Name, it.s.Key(), it.s.Val())
+	}
+	return it.err == nil
+}
+
+// IndexKey returns the index key of the current record.
+func (it *Iter) IndexKey() []byte {
+	return it.s.Key()
+}
+
+// Key returns the primary key of the current record.
+func (it *Iter) Key() []byte {
+	return it.s.Val()
+}
+
+// Val returns the current record.
+func (it *Iter) Val() []byte {
+	return it.val
+}
+
+// Err returns the error that terminated iteration, if any.
+func (it *Iter) Err() error {
+	return it.err
+}
+
+// Close releases the cursor used by it.
+func (it *Iter) Close() {
+	it.s.Close()
+}
+
+// Rebuild clears idx and recomputes its entries from every record in the
+// primary database.  Rebuild writes the entire index in txn, so very large
+// databases may require an environment with a generous map size.
+func (p *Primary) Rebuild(txn *lmdb.Txn, idx *Index) error {
+	err := txn.Drop(idx.DBI, false)
+	if err != nil {
+		return err
+	}
+	s := lmdbscan.New(txn, p.DBI)
+	defer s.Close()
+	for s.Scan() {
+		keys, err := idx.keys(s.Key(), s.Val())
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			err = txn.Put(idx.DBI, k, s.Key(), lmdb.NoDupData)
+			if err != nil && !lmdb.IsKeyExists(err) {
+				return err
+			}
+		}
+	}
+	return s.Err()
+}
+
+// Inconsistency describes an index entry which is missing or does not
+// correspond to a record.
+type Inconsistency struct {
+	Index    string
+	IndexKey []byte
+	Key      []byte
+
+	// Missing is true if the record produces the entry but it is not present
+	// in the index.  Otherwise the entry is present in the index but no
+	// record produces it.
+	Missing bool
+}
+
+func (inc *Inconsistency) String() string {
+	if inc.Missing {
+		return fmt.Sprintf("index %s: missing entry %q -> %q", inc.Index, inc.IndexKey, inc.Key)
+	}
+	return fmt.Sprintf("index %s: stale entry %q -> %q", inc.Index, inc.IndexKey, inc.Key)
+}
+
+// Verify compares idx with the entries computed from the records in the
+// primary database and returns any inconsistencies found.
+func (p *Primary) Verify(txn *lmdb.Txn, idx *Index) ([]*Inconsistency, error) {
+	var found []*Inconsistency
+
+	cur, err := txn.OpenCursor(idx.DBI)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	// Look up every expected entry in the index.
+	s := lmdbscan.New(txn, p.DBI)
+	defer s.Close()
+	for s.Scan() {
+		keys, err := idx.keys(s.Key(), s.Val())
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			_, _, err = cur.Get(k, s.Key(), lmdb.GetBoth)
+			if lmdb.IsNotFound(err) {
+				found = append(found, &Inconsistency{
+					Index:    idx.Name,
+					IndexKey: k,
+					Key:      copyBytes(s.Key()),
+					Missing:  true,
+				})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+
+	// Check that every index entry is produced by the record it refers to.
+	is := lmdbscan.New(txn, idx.DBI)
+	defer is.Close()
+	for is.Scan() {
+		ok, err := p.produces(txn, idx, is.Key(), is.Val())
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			found = append(found, &Inconsistency{
+				Index:    idx.Name,
+				IndexKey: copyBytes(is.Key()),
+				Key:      copyBytes(is.Val()),
+			})
+		}
+	}
+	return found, is.Err()
+}
+
+// produces returns true if the record with key produces ikey in idx.
+func (p *Primary) produces(txn *lmdb.Txn, idx *Index, ikey, key []byte) (bool, error) {
+	val, err := txn.Get(p.DBI, key)
+	if lmdb.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	keys, err := idx.keys(key, val)
+	if err != nil {
+		return false, err
+	}
+	i := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], ikey) >= 0 })
+	return i < len(keys) && bytes.Equal(keys[i], ikey), nil
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,191 @@
+package lmdbindex
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// splitWords indexes a record by each space separated word in its value.
+func splitWords(key, val []byte) ([][]byte, error) {
+	var keys [][]byte
+	for _, w := range bytes.Fields(val) {
+		keys = append(keys, copyBytes(w))
+	}
+	return keys, nil
+}
+
+func setup(t *testing.T) (*lmdb.Env, *Primary, *Index) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p *Primary
+	var idx *Index
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		dbi, err := txn.OpenDBI("records", lmdb.Create)
+		if err != nil {
+			return err
+		}
+		idbi, err := txn.OpenDBI("words", lmdb.Create|lmdb.DupSort)
+		if err != nil {
+			return err
+		}
+		idx = &Index{Name: "words", DBI: idbi, Fn: splitWords}
+		p = New(dbi, idx)
+		return nil
+	})
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	return env, p, idx
+}
+
+func lookup(t *testing.T, env *lmdb.Env, p *Primary, idx *Index, word string) []string {
+	var keys []string
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		it := p.Lookup(txn, idx, []byte(word))
+		defer it.Close()
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		return it.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestPrimary(t *testing.T) {
+	env, p, idx := setup(t)
+	defer lmdbtest.Destroy(env)
+
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		for _, r := range [][2]string{
+			{"1", "red green"},
+			{"2", "green blue"},
+			{"3", "red red"},
+		} {
+			err = p.Put(txn, []byte(r[0]), []byte(r[1]), 0)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := lookup(t, env, p, idx, "red"); !reflect.DeepEqual(keys, []string{"1", "3"}) {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+	if keys := lookup(t, env, p, idx, "green"); !reflect.DeepEqual(keys, []string{"1", "2"}) {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		err = p.Put(txn, []byte("1"), []byte("blue"), 0)
+		if err != nil {
+			return err
+		}
+		err = p.Put(txn, []byte("2"), []byte("x"), lmdb.NoOverwrite)
+		if !lmdb.IsKeyExists(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		// Appending a key out of order fails in lmdb.Txn.Put.
+		err = p.Put(txn, []byte("0"), []byte("x"), lmdb.Append)
+		if !lmdb.IsKeyExists(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return p.Delete(txn, []byte("3"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := lookup(t, env, p, idx, "x"); len(keys) != 0 {
+		t.Errorf("failed puts indexed: %q", keys)
+	}
+	if keys := lookup(t, env, p, idx, "red"); len(keys) != 0 {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+	if keys := lookup(t, env, p, idx, "blue"); !reflect.DeepEqual(keys, []string{"1", "2"}) {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+
+	var ranged []string
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		it := p.Range(txn, idx, []byte("b"), []byte("h"))
+		defer it.Close()
+		for it.Next() {
+			ranged = append(ranged, string(it.IndexKey())+"="+string(it.Val()))
+		}
+		return it.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"blue=blue", "blue=green blue", "green=green blue"}
+	if !reflect.DeepEqual(ranged, expect) {
+		t.Errorf("unexpected range: %q (!= %q)", ranged, expect)
+	}
+}
+
+func TestPrimary_VerifyRebuild(t *testing.T) {
+	env, p, idx := setup(t)
+	defer lmdbtest.Destroy(env)
+
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		err = p.Put(txn, []byte("1"), []byte("a b"), 0)
+		if err != nil {
+			return err
+		}
+		// Bypass the index layer to create drift.
+		err = txn.Put(p.DBI, []byte("2"), []byte("c"), 0)
+		if err != nil {
+			return err
+		}
+		return txn.Put(p.DBI, []byte("1"), []byte("a"), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var problems []*Inconsistency
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		problems, err = p.Verify(txn, idx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	if !problems[0].Missing || string(problems[0].IndexKey) != "c" {
+		t.Errorf("unexpected problem: %v", problems[0])
+	}
+	if problems[1].Missing || string(problems[1].IndexKey) != "b" {
+		t.Errorf("unexpected problem: %v", problems[1])
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		err = p.Rebuild(txn, idx)
+		if err != nil {
+			return err
+		}
+		problems, err = p.Verify(txn, idx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems after rebuild: %v", problems)
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Package lmdbmerkle compares the contents of databases in two environments
+using hash trees over their key ranges.
+
+A Tree divides a database into leaves, contiguous key ranges holding a fixed
+number of keys, and hashes the items in each leaf.  Leaf hashes are combined
+pairwise into a tree whose root summarizes the entire database.  All
+duplicates of a key in a database with the lmdb.DupSort flag belong to the
+same leaf.
+
+Trees can only be compared when their leaves have the same boundaries.  To
+compare databases A and B build a tree over A with Build and build a tree over
+B using the boundaries of A's tree with BuildBounds.  Diff then descends both
+trees and returns the key ranges whose contents differ.
+
+	ta, err := lmdbmerkle.Build(txnA, dbiA, 1024)
+	tb, err := lmdbmerkle.BuildBounds(txnB, dbiB, ta.Bounds())
+	ranges, err := lmdbmerkle.Diff(ta, tb)
+
+Because only the leaf boundaries and hashes are needed, trees may be computed
+in different processes or on different hosts and compared without
+transferring the databases themselves.
+
+Key boundaries are compared with lmdb.Txn.Cmp, so databases using a custom
+comparator are divided consistently.  Both databases must use the same
+comparator.
+*/
+package lmdbmerkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+// HashSize is the size of the hashes in a Tree.
+const HashSize = sha256.Size
+
+// Prefixes which separate the hashes of leaves from interior nodes.
+const (
+	prefixLeaf = 0
+	prefixNode = 1
+)
+
+// ErrBounds is returned by Diff when the trees do not share leaf boundaries.
+var ErrBounds = errors.New("lmdbmerkle: trees have different leaf boundaries")
+
+// Leaf is a range of keys in a Tree.  A leaf contains the keys from Start up
+// to, but not including, the Start of the following leaf.
+type Leaf struct {
+	// Start is the first key of the leaf's range.  Start is nil for the
+	// first leaf, which begins at the first key of the database.
+	Start []byte
+
+	// Keys is the number of distinct keys in the leaf.
+	Keys int
+
+	// Items is the number of items in the leaf, including duplicates.
+	Items int
+
+	// Hash is the hash of the items in the leaf.
+	Hash [HashSize]byte
+}
+
+// Range is a half-open range of keys [Start, End).  A nil Start is the
+// beginning of the database and a nil End is its end.
+type Range struct {
+	Start []byte
+	End   []byte
+}
+
+// Tree is a hash tree over the items of a database.
+type Tree struct {
+	Leaves []*Leaf
+
+	// levels holds the hashes of each level of the tree from the leaves to
+	// the root.
+	levels [][][HashSize]byte
+}
+
+// Build returns a Tree over dbi with leaves containing n keys.  The last leaf
+// may contain fewer keys.  Build panics if n is not positive.
+func Build(txn *lmdb.Txn, dbi lmdb.DBI, n int) (*Tree, error) {
+	if n <= 0 {
+		panic("lmdbmerkle: non-positive leaf size")
+	}
+	b := newBuilder()
+	err := scanItems(txn, dbi, func(k, v []byte, newKey bool) {
+		if newKey && b.leaf.Keys >= n {
+			b.next(copyBytes(k))
+		}
+		b.add(k, v, newKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.finish(), nil
+}
+
+// BuildBounds returns a Tree over dbi with leaves beginning at the given
+// bounds, typically obtained from Tree.Bounds.  The returned tree has
+// len(bounds)+1 leaves, some of which may be empty.  Bounds must be sorted
+// according to txn.Cmp.
+func BuildBounds(txn *lmdb.Txn, dbi lmdb.DBI, bounds [][]byte) (*Tree, error) {
+	b := newBuilder()
+	i := 0
+	err := scanItems(txn, dbi, func(k, v []byte, newKey bool) {
+		for newKey && i < len(bounds) && txn.Cmp(dbi, k, bounds[i]) >= 0 {
+			b.next(bounds[i])
+			i++
+		}
+		b.add(k, v, newKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for ; i < len(bounds); i++ {
+		b.next(bounds[i])
+	}
+	return b.finish(), nil
+}
+
+// Bounds returns the Start keys of all leaves of t except the first.
+func (t *Tree) Bounds() [][]byte {
+	bounds := make([][]byte, 0, len(t.Leaves)-1)
+	for _, leaf := range t.Leaves[1:] {
+		bounds = append(bounds, leaf.Start)
+	}
+	return bounds
+}
+
+// Root returns the root hash of t.
+func (t *Tree) Root() [HashSize]byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// LeafRange returns the range of keys covered by leaf i.
+func (t *Tree) LeafRange(i int) Range {
+	r := Range{Start: t.Leaves[i].Start}
+	if i+1 < len(t.Leaves) {
+		r.End = t.Leaves[i+1].Start
+	}
+	return r
+}
+
+// Diff returns the ranges of keys whose contents differ between a and b.
+// Adjacent ranges are merged.  Diff returns ErrBounds if a and b do not have
+// the same leaf boundaries.
+func Diff(a, b *Tree) ([]Range, error) {
+	if len(a.Leaves) != len(b.Leaves) {
+		return nil, ErrBounds
+	}
+	for i := range a.Leaves {
+		if !bytes.Equal(a.Leaves[i].Start, b.Leaves[i].Start) {
+			return nil, ErrBounds
+		}
+	}
+	var leaves []int
+	diffNode(a, b, len(a.levels)-1, 0, &leaves)
+
+	var ranges []Range
+	for j, i := range leaves {
+		r := a.LeafRange(i)
+		if j > 0 && leaves[j-1] == i-1 {
+			ranges[len(ranges)-1].End = r.End
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// diffNode appends the indices of leaves below node i of the given level
+// which differ between a and b.
+func diffNode(a, b *Tree, level, i int, leaves *[]int) {
+	if a.levels[level][i] == b.levels[level][i] {
+		return
+	}
+	if level == 0 {
+		*leaves = append(*leaves, i)
+		return
+	}
+	diffNode(a, b, level-1, 2*i, leaves)
+	if 2*i+1 < len(a.levels[level-1]) {
+		diffNode(a, b, level-1, 2*i+1, leaves)
+	}
+}
+
+// Compare builds trees over dbiA and dbiB with leaves of n keys and returns
+// the ranges which differ.
+func Compare(txnA *lmdb.Txn, dbiA lmdb.DBI, txnB *lmdb.Txn, dbiB lmdb.DBI, n int) ([]Range, error) {
+	ta, err := Build(txnA, dbiA, n)
+	if err != nil {
+		return nil, err
+	}
+	tb, err := BuildBounds(txnB, dbiB, ta.Bounds())
+	if err != nil {
+		return nil, err
+	}
+	return Diff(ta, tb)
+}
+
+type builder struct {
+	leaves []*Leaf
+	leaf   *Leaf
+	h      hash.Hash
+	buf    [binary.MaxVarintLen64]byte
+}
+
+func newBuilder() *builder {
+	b := &builder{h: sha256.New()}
+	b.leaf = &Leaf{}
+	b.h.Write([]byte{prefixLeaf})
+	return b
+}
+
+// next finishes the current leaf and begins a leaf at start.
+func (b *builder) next(start []byte) {
+	b.h.Sum(b.leaf.Hash[:0])
+	b.leaves = append(b.leaves, b.leaf)
+	b.leaf = &Leaf{Start: start}
+	b.h.Reset()
+	b.h.Write([]byte{prefixLeaf})
+}
+
+func (b *builder) add(k, v []byte, newKey bool) {
+	if newKey {
+		b.leaf.Keys++
+	}
+	b.leaf.Items++
+	b.writeField(k)
+	b.writeField(v)
+}
+
+func (b *builder) writeField(p []byte) {
+	n := binary.PutUvarint(b.buf[:], uint64(len(p)))
+	b.h.Write(b.buf[:n])
+	b.h.Write(p)
+}
+
+func (b *builder) finish() *Tree {
+	b.next(nil)
+	t := &Tree{Leaves: b.leaves}
+	level := make([][HashSize]byte, len(t.Leaves))
+	for i, leaf := range t.Leaves {
+		level[i] = leaf.Hash
+	}
+	t.levels = append(t.levels, level)
+	for len(level) > 1 {
+		parent := make([][HashSize]byte, (len(level)+1)/2)
+		for i := range parent {
+			if 2*i+1 == len(level) {
+				parent[i] = level[2*i]
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{prefixNode})
+			h.Write(level[2*i][:])
+			h.Write(level[2*i+1][:])
+			h.Sum(parent[i][:0])
+		}
+		t.levels = append(t.levels, parent)
+		level = parent
+	}
+	return t
+}
+
+// scanItems calls fn for every item in dbi.  The newKey argument is true for
+// the first item with a given key.
+func scanItems(txn *lmdb.Txn, dbi lmdb.DBI, fn func(k, v []byte, newKey bool)) error {
+	s := lmdbscan.New(txn, dbi)
+	defer s.Close()
+	var prev []byte
+	first := true
+	for s.Scan() {
+		k := s.Key()
+		newKey := first || !bytes.Equal(k, prev)
+		first = false
+		if newKey {
+			prev = append(prev[:0], k...)
+		}
+		fn(k, s.Val(), newKey)
+	}
+	return s.Err()
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,229 @@
+package lmdbmerkle
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+func setup(t *testing.T, flags uint) (*lmdb.Env, lmdb.DBI, lmdb.DBI) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b lmdb.DBI
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		a, err = txn.OpenDBI("a", lmdb.Create|flags)
+		if err != nil {
+			return err
+		}
+		b, err = txn.OpenDBI("b", lmdb.Create|flags)
+		return err
+	})
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	return env, a, b
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("k%04d", i))
+}
+
+func fill(t *testing.T, env *lmdb.Env, n, dups int, dbis ...lmdb.DBI) {
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		for _, dbi := range dbis {
+			for i := 0; i < n; i++ {
+				for j := 0; j < dups; j++ {
+					err = txn.Put(dbi, key(i), []byte(fmt.Sprint(j)), 0)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func compare(t *testing.T, env *lmdb.Env, a, b lmdb.DBI, n int) []Range {
+	var ranges []Range
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		ranges, err = Compare(txn, a, txn, b, n)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ranges
+}
+
+func TestCompare(t *testing.T) {
+	env, a, b := setup(t, 0)
+	defer lmdbtest.Destroy(env)
+	fill(t, env, 100, 1, a, b)
+
+	if ranges := compare(t, env, a, b, 10); len(ranges) != 0 {
+		t.Errorf("unexpected ranges: %q", ranges)
+	}
+
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		err = txn.Put(b, key(15), []byte("x"), 0)
+		if err != nil {
+			return err
+		}
+		err = txn.Put(b, key(16), []byte("x"), 0)
+		if err != nil {
+			return err
+		}
+		err = txn.Del(b, key(55), nil)
+		if err != nil {
+			return err
+		}
+		return txn.Put(b, []byte("k9999"), []byte("x"), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranges := compare(t, env, a, b, 10)
+	expect := []string{"[k0010,k0020)", "[k0050,k0060)", "[k0090,)"}
+	if len(ranges) != len(expect) {
+		t.Fatalf("unexpected ranges: %q", ranges)
+	}
+	for i, r := range ranges {
+		s := fmt.Sprintf("[%s,%s)", r.Start, r.End)
+		if s != expect[i] {
+			t.Errorf("range %d: %s (!= %s)", i, s, expect[i])
+		}
+	}
+
+	var diffs []string
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		for _, r := range ranges {
+			err = DiffRange(txn, a, txn, b, r, func(d *ItemDiff) error {
+				diffs = append(diffs, fmt.Sprintf("%s:%q:%q", d.Key, d.A, d.B))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDiffs := []string{
+		`k0015:"0":"x"`,
+		`k0016:"0":"x"`,
+		`k0055:"0":""`,
+		`k9999:"":"x"`,
+	}
+	if fmt.Sprint(diffs) != fmt.Sprint(expectDiffs) {
+		t.Errorf("unexpected diffs: %q", diffs)
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		n, err := Repair(txn, a, txn, b, ranges)
+		if n != 4 {
+			t.Errorf("unexpected repairs: %d", n)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranges := compare(t, env, a, b, 10); len(ranges) != 0 {
+		t.Errorf("unexpected ranges after repair: %q", ranges)
+	}
+}
+
+func TestCompare_dupSort(t *testing.T) {
+	env, a, b := setup(t, lmdb.DupSort)
+	defer lmdbtest.Destroy(env)
+	fill(t, env, 50, 5, a, b)
+
+	var ta *Tree
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		ta, err = Build(txn, a, 8)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ta.Leaves) != 7 {
+		t.Errorf("unexpected leaves: %d", len(ta.Leaves))
+	}
+	for i, leaf := range ta.Leaves[:6] {
+		if leaf.Keys != 8 || leaf.Items != 40 {
+			t.Errorf("leaf %d: keys=%d items=%d", i, leaf.Keys, leaf.Items)
+		}
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		err = txn.Put(b, key(20), []byte("9"), 0)
+		if err != nil {
+			return err
+		}
+		return txn.Del(b, key(20), []byte("0"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := compare(t, env, a, b, 8)
+	if len(ranges) != 1 || string(ranges[0].Start) != "k0016" || string(ranges[0].End) != "k0024" {
+		t.Fatalf("unexpected ranges: %q", ranges)
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		n, err := Repair(txn, a, txn, b, ranges)
+		if n != 2 {
+			t.Errorf("unexpected repairs: %d", n)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranges := compare(t, env, a, b, 8); len(ranges) != 0 {
+		t.Errorf("unexpected ranges after repair: %q", ranges)
+	}
+}
+
+func TestCompare_reverseKey(t *testing.T) {
+	env, a, b := setup(t, lmdb.ReverseKey)
+	defer lmdbtest.Destroy(env)
+	fill(t, env, 30, 1, a, b)
+
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		return txn.Del(b, key(3), nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := compare(t, env, a, b, 5)
+	if len(ranges) != 1 {
+		t.Fatalf("unexpected ranges: %q", ranges)
+	}
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		var keys []string
+		err = DiffRange(txn, a, txn, b, ranges[0], func(d *ItemDiff) error {
+			keys = append(keys, string(d.Key))
+			return nil
+		})
+		if len(keys) != 1 || keys[0] != "k0003" {
+			t.Errorf("unexpected keys: %q", keys)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
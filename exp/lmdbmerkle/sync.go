@@ -0,0 +1,196 @@
+package lmdbmerkle
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// ErrFlags is returned when the databases being compared item by item do not
+// have the same lmdb.DupSort setting.
+var ErrFlags = errors.New("lmdbmerkle: databases have different flags")
+
+// ItemDiff is an item which differs between two databases.  A is the value in
+// the first database and B the value in the second.  A nil value means the
+// item is absent.  For a database with the lmdb.DupSort flag each duplicate
+// is an item, so exactly one of A and B is non-nil.
+type ItemDiff struct {
+	Key []byte
+	A   []byte
+	B   []byte
+}
+
+// DiffRange calls fn with each item in r which differs between dbiA and dbiB.
+// The slices passed to fn are only valid until fn returns.  If fn returns an
+// error DiffRange stops and returns it.
+func DiffRange(txnA *lmdb.Txn, dbiA lmdb.DBI, txnB *lmdb.Txn, dbiB lmdb.DBI, r Range, fn func(d *ItemDiff) error) error {
+	dupsort, err := sameDupSort(txnA, dbiA, txnB, dbiB)
+	if err != nil {
+		return err
+	}
+	a, err := newRangeCursor(txnA, dbiA, r)
+	if err != nil {
+		return err
+	}
+	defer a.cur.Close()
+	b, err := newRangeCursor(txnB, dbiB, r)
+	if err != nil {
+		return err
+	}
+	defer b.cur.Close()
+
+	d := &ItemDiff{}
+	for a.ok || b.ok {
+		c := 0
+		switch {
+		case !b.ok:
+			c = -1
+		case !a.ok:
+			c = 1
+		default:
+			c = txnA.Cmp(dbiA, a.k, b.k)
+			if c == 0 && dupsort {
+				c = txnA.DCmp(dbiA, a.v, b.v)
+			}
+		}
+		*d = ItemDiff{}
+		switch {
+		case c < 0:
+			*d = ItemDiff{Key: a.k, A: a.v}
+		case c > 0:
+			*d = ItemDiff{Key: b.k, B: b.v}
+		case !bytes.Equal(a.v, b.v):
+			*d = ItemDiff{Key: a.k, A: a.v, B: b.v}
+		}
+		if d.Key != nil {
+			err = fn(d)
+			if err != nil {
+				return err
+			}
+		}
+		if c <= 0 {
+			err = a.next()
+			if err != nil {
+				return err
+			}
+		}
+		if c >= 0 {
+			err = b.next()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Repair makes the ranges of dst equal to those of src by writing the items
+// which differ in dst.  The ranges are typically those returned by Diff or
+// Compare.  Repair returns the number of items written or deleted.
+func Repair(src *lmdb.Txn, srcDBI lmdb.DBI, dst *lmdb.Txn, dstDBI lmdb.DBI, ranges []Range) (int, error) {
+	dupsort, err := sameDupSort(src, srcDBI, dst, dstDBI)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, r := range ranges {
+		// Differences are collected before writing so that the cursor on dst
+		// is not disturbed.
+		var diffs []ItemDiff
+		err := DiffRange(src, srcDBI, dst, dstDBI, r, func(d *ItemDiff) error {
+			diffs = append(diffs, ItemDiff{
+				Key: copyBytes(d.Key),
+				A:   copyNil(d.A),
+				B:   copyNil(d.B),
+			})
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		for _, d := range diffs {
+			switch {
+			case d.A != nil:
+				err = dst.Put(dstDBI, d.Key, d.A, 0)
+			case dupsort:
+				err = dst.Del(dstDBI, d.Key, d.B)
+			default:
+				err = dst.Del(dstDBI, d.Key, nil)
+			}
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func sameDupSort(txnA *lmdb.Txn, dbiA lmdb.DBI, txnB *lmdb.Txn, dbiB lmdb.DBI) (bool, error) {
+	fa, err := txnA.Flags(dbiA)
+	if err != nil {
+		return false, err
+	}
+	fb, err := txnB.Flags(dbiB)
+	if err != nil {
+		return false, err
+	}
+	if fa&lmdb.DupSort != fb&lmdb.DupSort {
+		return false, ErrFlags
+	}
+	return fa&lmdb.DupSort != 0, nil
+}
+
+// rangeCursor iterates the items of a Range.
+type rangeCursor struct {
+	txn  *lmdb.Txn
+	dbi  lmdb.DBI
+	cur  *lmdb.Cursor
+	end  []byte
+	k, v []byte
+	ok   bool
+}
+
+func newRangeCursor(txn *lmdb.Txn, dbi lmdb.DBI, r Range) (*rangeCursor, error) {
+	cur, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return nil, err
+	}
+	c := &rangeCursor{txn: txn, dbi: dbi, cur: cur, end: r.End}
+	if r.Start == nil {
+		err = c.get(nil, lmdb.First)
+	} else {
+		err = c.get(r.Start, lmdb.SetRange)
+	}
+	if err != nil {
+		cur.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *rangeCursor) next() error {
+	return c.get(nil, lmdb.Next)
+}
+
+func (c *rangeCursor) get(setkey []byte, op uint) error {
+	k, v, err := c.cur.Get(setkey, nil, op)
+	if lmdb.IsNotFound(err) {
+		c.ok = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.k, c.v = k, v
+	c.ok = c.end == nil || c.txn.Cmp(c.dbi, k, c.end) < 0
+	return nil
+}
+
+func copyNil(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return copyBytes(b)
+}
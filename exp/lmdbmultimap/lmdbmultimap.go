@@ -0,0 +1,353 @@
+/*
+Package lmdbmultimap treats a database opened with the lmdb.DupSort flag as a
+map from keys to sorted sets of members.
+
+A Multimap hides the cursor operations needed to work with duplicate values.
+Members are kept in the order of the database's duplicate comparator and each
+member is stored at most once per key.
+
+	tags := lmdbmultimap.New(dbi) // opened with lmdb.DupSort
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		_, err = tags.Add(txn, []byte("post:1"), []byte("go"))
+		return err
+	})
+
+Members of a key are read with an Iter.  When the database also has the
+lmdb.DupFixed flag the Iter reads a page of members at a time using the
+lmdb.GetMultiple and lmdb.NextMultiple ops.
+
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		it := tags.Members(txn, []byte("post:1"))
+		defer it.Close()
+		for it.Next() {
+			log.Printf("%s", it.Member())
+		}
+		return it.Err()
+	})
+
+Intersect and Union merge the members of two keys in a single transaction
+without materializing either set.
+*/
+package lmdbmultimap
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+var errNotDupSort = errors.New("lmdbmultimap: database does not have the DupSort flag")
+
+// Multimap is a set of members for each key of a database with the
+// lmdb.DupSort flag.
+type Multimap struct {
+	DBI lmdb.DBI
+}
+
+// New returns a Multimap backed by dbi, which must have been opened with the
+// lmdb.DupSort flag.
+func New(dbi lmdb.DBI) *Multimap {
+	return &Multimap{DBI: dbi}
+}
+
+// Add adds member to the set for key.  Add returns false if member was
+// already present.
+func (m *Multimap) Add(txn *lmdb.Txn, key, member []byte) (bool, error) {
+	err := txn.Put(m.DBI, key, member, lmdb.NoDupData)
+	if lmdb.IsKeyExists(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Remove removes member from the set for key.  Remove returns false if member
+// was not present.
+func (m *Multimap) Remove(txn *lmdb.Txn, key, member []byte) (bool, error) {
+	err := txn.Del(m.DBI, key, member)
+	if lmdb.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Clear removes every member of the set for key.  Clear returns false if the
+// set was already empty.
+func (m *Multimap) Clear(txn *lmdb.Txn, key []byte) (bool, error) {
+	cur, err := txn.OpenCursor(m.DBI)
+	if err != nil {
+		return false, err
+	}
+	defer cur.Close()
+	_, _, err = cur.Get(key, nil, lmdb.Set)
+	if lmdb.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = cur.Del(lmdb.NoDupData)
+	return err == nil, err
+}
+
+// Contains reports whether member is in the set for key.
+func (m *Multimap) Contains(txn *lmdb.Txn, key, member []byte) (bool, error) {
+	cur, err := txn.OpenCursor(m.DBI)
+	if err != nil {
+		return false, err
+	}
+	defer cur.Close()
+	_, _, err = cur.Get(key, member, lmdb.GetBoth)
+	if lmdb.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Cardinality returns the number of members in the set for key.
+func (m *Multimap) Cardinality(txn *lmdb.Txn, key []byte) (uint64, error) {
+	cur, err := txn.OpenCursor(m.DBI)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close()
+	_, _, err = cur.Get(key, nil, lmdb.Set)
+	if lmdb.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cur.Count()
+}
+
+// Members returns an iterator over the members of the set for key in
+// ascending order.  The caller must call Close on the returned Iter.
+func (m *Multimap) Members(txn *lmdb.Txn, key []byte) *Iter {
+	it := &Iter{txn: txn, dbi: m.DBI, key: key, op: lmdb.Set}
+	flags, err := txn.Flags(m.DBI)
+	if err != nil {
+		it.err = err
+		return it
+	}
+	if flags&lmdb.DupSort == 0 {
+		it.err = errNotDupSort
+		return it
+	}
+	it.fixed = flags&lmdb.DupFixed != 0
+	it.cur, it.err = txn.OpenCursor(m.DBI)
+	return it
+}
+
+// Intersect calls fn for each member present in the sets of both a and b, in
+// ascending order.  If fn returns an error Intersect stops and returns it.  The
+// member passed to fn is only valid until fn returns, and fn must not modify
+// the database.
+//
+// Intersect skips over runs of members missing from the other set with the
+// lmdb.GetBothRange op, so intersecting a small set with a large one reads
+// little of the large set.
+func (m *Multimap) Intersect(txn *lmdb.Txn, a, b []byte, fn func(member []byte) error) error {
+	ia := m.Members(txn, a)
+	defer ia.Close()
+	ib := m.Members(txn, b)
+	defer ib.Close()
+
+	ok := ia.Next() && ib.Next()
+	for ok {
+		c := txn.DCmp(m.DBI, ia.member, ib.member)
+		switch {
+		case c == 0:
+			err := fn(ia.member)
+			if err != nil {
+				return err
+			}
+			ok = ia.Next() && ib.Next()
+		case c < 0:
+			ok = ia.seek(ib.member)
+		default:
+			ok = ib.seek(ia.member)
+		}
+	}
+	if ia.err != nil {
+		return ia.err
+	}
+	return ib.err
+}
+
+// Union calls fn for each member present in the set of a or of b, in ascending
+// order.  Members of both sets are passed to fn once.  If fn returns an error
+// Union stops and returns it.  The member passed to fn is only valid until fn
+// returns, and fn must not modify the database.
+func (m *Multimap) Union(txn *lmdb.Txn, a, b []byte, fn func(member []byte) error) error {
+	ia := m.Members(txn, a)
+	defer ia.Close()
+	ib := m.Members(txn, b)
+	defer ib.Close()
+
+	oka, okb := ia.Next(), ib.Next()
+	for oka || okb {
+		var err error
+		var c int
+		switch {
+		case !okb:
+			c = -1
+		case !oka:
+			c = 1
+		default:
+			c = txn.DCmp(m.DBI, ia.member, ib.member)
+		}
+		switch {
+		case c == 0:
+			err = fn(ia.member)
+			oka, okb = ia.Next(), ib.Next()
+		case c < 0:
+			err = fn(ia.member)
+			oka = ia.Next()
+		default:
+			err = fn(ib.member)
+			okb = ib.Next()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if ia.err != nil {
+		return ia.err
+	}
+	return ib.err
+}
+
+// Iter iterates over the members of a set.
+type Iter struct {
+	txn    *lmdb.Txn
+	dbi    lmdb.DBI
+	cur    *lmdb.Cursor
+	key    []byte
+	fixed  bool
+	op     uint
+	stride int
+	page   []byte // unread members of the current page (DupFixed)
+	member []byte
+	done   bool
+	err    error
+}
+
+// Next advances to the next member.  Next returns false when the members are
+// exhausted or an error is encountered.
+func (it *Iter) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.page) > 0 {
+		it.member, it.page = it.page[:it.stride], it.page[it.stride:]
+		return true
+	}
+	if it.done {
+		return false
+	}
+
+	var v []byte
+	var err error
+	switch it.op {
+	case lmdb.Set:
+		_, v, err = it.cur.Get(it.key, nil, lmdb.Set)
+		if len(v) == 0 {
+			// Pages of empty members cannot be split.
+			it.fixed = false
+		}
+		if err == nil && it.fixed {
+			it.stride = len(v)
+			err = it.loadPage(v)
+		}
+		it.op = lmdb.NextDup
+		if it.fixed {
+			it.op = lmdb.NextMultiple
+		}
+	case lmdb.NextMultiple:
+		_, v, err = it.cur.Get(nil, nil, lmdb.NextMultiple)
+		if err == nil {
+			v, it.page = v[:it.stride], v[it.stride:]
+		}
+	default:
+		_, v, err = it.cur.Get(nil, nil, lmdb.NextDup)
+	}
+	return it.set(v, err)
+}
+
+// seek advances it to the first member not less than target.  The iterator
+// must be positioned on a member.
+func (it *Iter) seek(target []byte) bool {
+	if it.txn.DCmp(it.dbi, it.member, target) >= 0 {
+		return true
+	}
+	var n int
+	if it.fixed {
+		n = len(it.page) / it.stride
+	}
+	if n > 0 && it.txn.DCmp(it.dbi, it.page[(n-1)*it.stride:], target) >= 0 {
+		i := sort.Search(n, func(i int) bool {
+			return it.txn.DCmp(it.dbi, it.page[i*it.stride:(i+1)*it.stride], target) >= 0
+		})
+		it.page = it.page[i*it.stride:]
+		return it.Next()
+	}
+	if it.err != nil || it.done {
+		return false
+	}
+
+	it.page = nil
+	_, v, err := it.cur.Get(it.key, target, lmdb.GetBothRange)
+	if err == nil && it.fixed {
+		err = it.loadPage(v)
+	}
+	return it.set(v, err)
+}
+
+// loadPage reads the page of DupFixed members holding the current member v
+// and keeps the members which follow it.
+func (it *Iter) loadPage(v []byte) error {
+	_, page, err := it.cur.Get(nil, nil, lmdb.GetMultiple)
+	if err != nil {
+		return err
+	}
+	// A key with a single member has no page of duplicates.
+	n := len(page) / it.stride
+	i := sort.Search(n, func(i int) bool {
+		return it.txn.DCmp(it.dbi, page[i*it.stride:(i+1)*it.stride], v) > 0
+	})
+	it.page = page[i*it.stride:]
+	return nil
+}
+
+func (it *Iter) set(v []byte, err error) bool {
+	if lmdb.IsNotFound(err) {
+		it.done = true
+		return false
+	}
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.member = v
+	return true
+}
+
+// Member returns the current member.  The returned slice is only valid until
+// the next call to Next.
+func (it *Iter) Member() []byte {
+	return it.member
+}
+
+// Err returns the error that terminated iteration, if any.
+func (it *Iter) Err() error {
+	return it.err
+}
+
+// Close releases the cursor used by it.
+func (it *Iter) Close() {
+	if it.cur != nil {
+		it.cur.Close()
+		it.cur = nil
+	}
+}
@@ -0,0 +1,253 @@
+package lmdbmultimap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+var testFlags = []uint{lmdb.DupSort, lmdb.DupSort | lmdb.DupFixed}
+
+func newTestMultimap(t *testing.T, flags uint) (*lmdb.Env, *Multimap) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbi, err := lmdbtest.OpenDBI(env, "multimap", lmdb.Create|flags)
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	return env, New(dbi)
+}
+
+func member(i int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return b
+}
+
+// addRange adds the members start, start+step, ... below end to key.
+func addRange(t *testing.T, env *lmdb.Env, m *Multimap, key string, start, end, step int) {
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		for i := start; i < end; i += step {
+			_, err = m.Add(txn, []byte(key), member(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func members(t *testing.T, env *lmdb.Env, fn func(txn *lmdb.Txn, emit func([]byte) error) error) []int {
+	var ms []int
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		return fn(txn, func(b []byte) error {
+			ms = append(ms, int(binary.BigEndian.Uint64(b)))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+func checkRange(t *testing.T, name string, ms []int, start, end, step int) {
+	t.Helper()
+	var expect []int
+	for i := start; i < end; i += step {
+		expect = append(expect, i)
+	}
+	if fmt.Sprint(ms) != fmt.Sprint(expect) {
+		t.Errorf("%s: %d members %v (expected %d)", name, len(ms), ms, len(expect))
+	}
+}
+
+func TestMultimap(t *testing.T) {
+	for _, flags := range testFlags {
+		t.Run(fmt.Sprintf("flags=%#x", flags), func(t *testing.T) {
+			env, m := newTestMultimap(t, flags)
+			defer lmdbtest.Destroy(env)
+
+			addRange(t, env, m, "big", 0, 3000, 1)
+			addRange(t, env, m, "one", 7, 8, 1)
+			err := env.Update(func(txn *lmdb.Txn) (err error) {
+				ok, err := m.Add(txn, []byte("big"), member(10))
+				if ok || err != nil {
+					t.Errorf("add existing: %v %v", ok, err)
+				}
+				ok, err = m.Remove(txn, []byte("big"), member(2999))
+				if !ok || err != nil {
+					t.Errorf("remove: %v %v", ok, err)
+				}
+				ok, err = m.Remove(txn, []byte("big"), member(2999))
+				if ok || err != nil {
+					t.Errorf("remove missing: %v %v", ok, err)
+				}
+				for _, k := range []string{"big", "one", "none"} {
+					ok, err = m.Contains(txn, []byte(k), member(7))
+					if err != nil {
+						return err
+					}
+					if ok != (k != "none") {
+						t.Errorf("contains %s: %v", k, ok)
+					}
+				}
+				ok, err = m.Contains(txn, []byte("big"), member(2999))
+				if ok || err != nil {
+					t.Errorf("contains removed: %v %v", ok, err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = env.View(func(txn *lmdb.Txn) (err error) {
+				for k, n := range map[string]uint64{"big": 2999, "one": 1, "none": 0} {
+					c, err := m.Cardinality(txn, []byte(k))
+					if err != nil {
+						return err
+					}
+					if c != n {
+						t.Errorf("cardinality %s: %d (!= %d)", k, c, n)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, test := range []struct {
+				key              string
+				start, end, step int
+			}{
+				{"big", 0, 2999, 1},
+				{"one", 7, 8, 1},
+				{"none", 0, 0, 1},
+			} {
+				ms := members(t, env, func(txn *lmdb.Txn, emit func([]byte) error) error {
+					it := m.Members(txn, []byte(test.key))
+					defer it.Close()
+					for it.Next() {
+						emit(it.Member())
+					}
+					return it.Err()
+				})
+				checkRange(t, test.key, ms, test.start, test.end, test.step)
+			}
+
+			err = env.Update(func(txn *lmdb.Txn) (err error) {
+				ok, err := m.Clear(txn, []byte("big"))
+				if !ok || err != nil {
+					t.Errorf("clear: %v %v", ok, err)
+				}
+				ok, err = m.Clear(txn, []byte("big"))
+				if ok || err != nil {
+					t.Errorf("clear empty: %v %v", ok, err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMultimap_setOps(t *testing.T) {
+	for _, flags := range testFlags {
+		t.Run(fmt.Sprintf("flags=%#x", flags), func(t *testing.T) {
+			env, m := newTestMultimap(t, flags)
+			defer lmdbtest.Destroy(env)
+
+			addRange(t, env, m, "evens", 0, 4000, 2)
+			addRange(t, env, m, "threes", 0, 4000, 3)
+			addRange(t, env, m, "sparse", 1000, 4000, 1000)
+			addRange(t, env, m, "one", 3000, 3001, 1)
+
+			for _, test := range []struct {
+				a, b             string
+				start, end, step int
+			}{
+				{"evens", "threes", 0, 4000, 6},
+				{"threes", "evens", 0, 4000, 6},
+				{"sparse", "evens", 1000, 4000, 1000},
+				{"evens", "sparse", 1000, 4000, 1000},
+				{"one", "threes", 3000, 3001, 1},
+				{"threes", "one", 3000, 3001, 1},
+				{"one", "sparse", 3000, 3001, 1},
+				{"evens", "none", 0, 0, 1},
+			} {
+				ms := members(t, env, func(txn *lmdb.Txn, emit func([]byte) error) error {
+					return m.Intersect(txn, []byte(test.a), []byte(test.b), emit)
+				})
+				checkRange(t, test.a+"&"+test.b, ms, test.start, test.end, test.step)
+			}
+
+			for _, test := range []struct {
+				a, b string
+				fn   func(i int) bool
+			}{
+				{"evens", "threes", func(i int) bool { return i%2 == 0 || i%3 == 0 }},
+				{"sparse", "one", func(i int) bool { return i%1000 == 0 && i > 0 }},
+				{"none", "sparse", func(i int) bool { return i%1000 == 0 && i > 0 }},
+			} {
+				ms := members(t, env, func(txn *lmdb.Txn, emit func([]byte) error) error {
+					return m.Union(txn, []byte(test.a), []byte(test.b), emit)
+				})
+				var expect []int
+				for i := 0; i < 4000; i++ {
+					if test.fn(i) {
+						expect = append(expect, i)
+					}
+				}
+				if fmt.Sprint(ms) != fmt.Sprint(expect) {
+					t.Errorf("%s|%s: %d members (expected %d)", test.a, test.b, len(ms), len(expect))
+				}
+			}
+
+			stop := errors.New("stop")
+			var n int
+			err := env.View(func(txn *lmdb.Txn) (err error) {
+				return m.Union(txn, []byte("evens"), []byte("threes"), func([]byte) error {
+					n++
+					if n == 3 {
+						return stop
+					}
+					return nil
+				})
+			})
+			if err != stop || n != 3 {
+				t.Errorf("union: %d %v", n, err)
+			}
+		})
+	}
+}
+
+func TestMultimap_notDupSort(t *testing.T) {
+	env, m := newTestMultimap(t, 0)
+	defer lmdbtest.Destroy(env)
+
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		it := m.Members(txn, []byte("k"))
+		defer it.Close()
+		if it.Next() {
+			t.Errorf("next")
+		}
+		return it.Err()
+	})
+	if err != errNotDupSort {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package lmdbnotify
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// fileWatcher sends on C when the environment's data file is modified.
+type fileWatcher struct {
+	C    chan struct{}
+	file *os.File
+}
+
+// dataPath returns the path of the data file of env.
+func dataPath(env *lmdb.Env) (string, error) {
+	path, err := env.Path()
+	if err != nil {
+		return "", err
+	}
+	flags, err := env.Flags()
+	if err != nil {
+		return "", err
+	}
+	if flags&lmdb.NoSubdir != 0 {
+		return path, nil
+	}
+	return filepath.Join(path, "data.mdb"), nil
+}
+
+func newFileWatcher(env *lmdb.Env) (*fileWatcher, error) {
+	path, err := dataPath(env)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	_, err = syscall.InotifyAddWatch(fd, path, syscall.IN_MODIFY)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+
+	// A non-blocking descriptor is managed by the runtime poller so that
+	// Close interrupts a pending Read.
+	w := &fileWatcher{
+		C:    make(chan struct{}, 1),
+		file: os.NewFile(uintptr(fd), "inotify"),
+	}
+	go w.loop()
+	return w, nil
+}
+
+func (w *fileWatcher) loop() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		_, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case w.C <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *fileWatcher) Close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package lmdbnotify
+
+import "github.com/ledgerwatch/lmdb-go/lmdb"
+
+type fileWatcher struct {
+	C chan struct{}
+}
+
+// newFileWatcher returns a nil fileWatcher because file modification events
+// are not supported on this platform.
+func newFileWatcher(env *lmdb.Env) (*fileWatcher, error) {
+	return nil, nil
+}
+
+func (w *fileWatcher) Close() error {
+	return nil
+}
@@ -0,0 +1,270 @@
+/*
+Package lmdbnotify notifies goroutines when any process commits an update
+transaction to a shared environment.
+
+LMDB provides no cross-process signal for commits.  A Notifier detects them by
+cheaply polling the ID of the last committed transaction (see
+lmdb.EnvInfo.LastTxnID).  On Linux a Notifier may additionally watch the
+environment's data file with inotify and use modification events as a hint to
+poll immediately instead of waiting for the next poll interval.  The hint is
+best effort.  Environments opened with lmdb.WriteMap, for example, may be
+modified without generating events, so polling is never disabled.
+
+Subscribers are called with the ID of the most recently observed transaction.
+Polling cannot observe every transaction, so subscribers must not assume they
+see consecutive IDs.
+
+# Backpressure
+
+Each Subscription is served by its own goroutine so a slow subscriber does not
+delay others.  How a subscriber's backlog is handled is determined by its
+Backpressure policy.  Coalesce, the default, delivers only the latest
+transaction ID once the subscriber returns.  Block causes the Notifier to stop
+polling until the subscriber has handled each observed ID.
+*/
+package lmdbnotify
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// DefaultPollInterval is the interval at which a Notifier checks for new
+// commits when Notifier.PollInterval is zero.
+const DefaultPollInterval = 50 * time.Millisecond
+
+// Backpressure determines how notifications are handled when a subscriber
+// cannot keep up with commits.
+type Backpressure int
+
+// Backpressure policies for Notifier.Subscribe.
+const (
+	// Coalesce replaces undelivered transaction IDs with the latest one.
+	Coalesce Backpressure = iota
+
+	// Block stops the Notifier from polling while the subscriber is busy.
+	Block
+)
+
+// ErrRunning is returned by Notifier.Run if the Notifier is already running.
+var ErrRunning = errors.New("lmdbnotify: notifier is already running")
+
+// Notifier polls an environment for commits and invokes subscribers with the
+// ID of the last committed transaction.  The exported fields of a Notifier
+// must not be modified after Run is called.
+type Notifier struct {
+	// PollInterval is the time waited between checks for new commits.
+	PollInterval time.Duration
+
+	// Inotify enables watching the environment's data file for modification
+	// on platforms that support it.  Inotify is ignored on other platforms.
+	Inotify bool
+
+	env *lmdb.Env
+
+	mu      sync.Mutex
+	subs    map[*Subscription]bool
+	running bool
+	last    int64
+}
+
+// New returns a Notifier for env.  Subscribers are not invoked until Run is
+// called.
+func New(env *lmdb.Env) *Notifier {
+	return &Notifier{
+		env:  env,
+		subs: make(map[*Subscription]bool),
+		last: -1,
+	}
+}
+
+// Subscription is a subscriber registered with Notifier.Subscribe.
+type Subscription struct {
+	n      *Notifier
+	fn     func(txnid int64)
+	policy Backpressure
+
+	pending chan int64
+	done    chan struct{}
+	idle    chan struct{}
+	once    sync.Once
+}
+
+// Subscribe registers fn to be called with the ID of the latest committed
+// transaction whenever a new commit is observed.  Calls to fn are made
+// serially from a goroutine dedicated to the subscription.
+func (n *Notifier) Subscribe(fn func(txnid int64), policy Backpressure) *Subscription {
+	s := &Subscription{
+		n:       n,
+		fn:      fn,
+		policy:  policy,
+		pending: make(chan int64, 1),
+		done:    make(chan struct{}),
+		idle:    make(chan struct{}),
+	}
+	n.mu.Lock()
+	n.subs[s] = true
+	n.mu.Unlock()
+	go s.loop()
+	return s
+}
+
+// Close unregisters s.  Close does not wait for a call to the subscriber
+// which is in progress.
+func (s *Subscription) Close() {
+	s.n.mu.Lock()
+	delete(s.n.subs, s)
+	s.n.mu.Unlock()
+	s.once.Do(func() { close(s.done) })
+}
+
+func (s *Subscription) loop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case id := <-s.pending:
+			s.fn(id)
+			if s.policy == Block {
+				select {
+				case s.idle <- struct{}{}:
+				case <-s.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// post delivers id to the subscriber according to its policy.  When the
+// policy is Block, post waits until the subscriber has handled id, s is
+// closed, or ctx is done.
+func (s *Subscription) post(ctx context.Context, id int64) {
+	if s.policy == Block {
+		select {
+		case s.pending <- id:
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-s.idle:
+		case <-s.done:
+		case <-ctx.Done():
+		}
+		return
+	}
+	for {
+		select {
+		case s.pending <- id:
+			return
+		default:
+		}
+		// Discard the undelivered ID so that it is replaced.
+		select {
+		case <-s.pending:
+		default:
+		}
+	}
+}
+
+// LastTxnID returns the most recent transaction ID observed by Run, or -1 if
+// Run has not yet checked the environment.
+func (n *Notifier) LastTxnID() int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.last
+}
+
+// Run polls the environment until ctx is done and returns the context's
+// error.  Run returns early if the environment cannot be inspected.  The
+// first poll establishes the current transaction ID and is not reported to
+// subscribers.
+func (n *Notifier) Run(ctx context.Context) error {
+	n.mu.Lock()
+	if n.running {
+		n.mu.Unlock()
+		return ErrRunning
+	}
+	n.running = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		n.running = false
+		n.mu.Unlock()
+	}()
+
+	var hint <-chan struct{}
+	if n.Inotify {
+		w, err := newFileWatcher(n.env)
+		if err != nil {
+			return err
+		}
+		if w != nil {
+			defer w.Close()
+			hint = w.C
+		}
+	}
+
+	interval := n.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	first := true
+	for {
+		info, err := n.env.Info()
+		if err != nil {
+			return err
+		}
+		n.mu.Lock()
+		changed := info.LastTxnID != n.last
+		n.last = info.LastTxnID
+		var subs []*Subscription
+		if changed && !first {
+			for s := range n.subs {
+				subs = append(subs, s)
+			}
+		}
+		n.mu.Unlock()
+		first = false
+		n.notify(ctx, subs, info.LastTxnID)
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(interval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		case <-hint:
+		}
+	}
+}
+
+func (n *Notifier) notify(ctx context.Context, subs []*Subscription, id int64) {
+	var wg sync.WaitGroup
+	for _, s := range subs {
+		if s.policy != Block {
+			s.post(ctx, id)
+			continue
+		}
+		wg.Add(1)
+		go func(s *Subscription) {
+			defer wg.Done()
+			s.post(ctx, id)
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,135 @@
+package lmdbnotify
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+func put(t *testing.T, env *lmdb.Env) int64 {
+	var id uintptr
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		id = txn.ID()
+		root, err := txn.OpenRoot(0)
+		if err != nil {
+			return err
+		}
+		return txn.Put(root, []byte("k"), []byte("v"), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(id)
+}
+
+func start(t *testing.T, n *Notifier) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- n.Run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for n.LastTxnID() < 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("notifier did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return func() {
+		cancel()
+		if err := <-errc; err != context.Canceled {
+			t.Errorf("run: %v", err)
+		}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+
+	n := New(env)
+	n.PollInterval = time.Millisecond
+	ids := make(chan int64, 16)
+	sub := n.Subscribe(func(id int64) { ids <- id }, Coalesce)
+	defer sub.Close()
+	defer start(t, n)()
+
+	if err := n.Run(context.Background()); err != ErrRunning {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		want := put(t, env)
+		select {
+		case id := <-ids:
+			if id != want {
+				t.Errorf("unexpected txn id: %d (!= %d)", id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for txn %d", want)
+		}
+	}
+}
+
+func TestNotifier_backpressure(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+
+	n := New(env)
+	n.PollInterval = time.Millisecond
+
+	var mu sync.Mutex
+	var coalesced, blocked []int64
+	release := make(chan struct{})
+	csub := n.Subscribe(func(id int64) {
+		<-release
+		mu.Lock()
+		coalesced = append(coalesced, id)
+		mu.Unlock()
+	}, Coalesce)
+	defer csub.Close()
+	bsub := n.Subscribe(func(id int64) {
+		<-release
+		mu.Lock()
+		blocked = append(blocked, id)
+		mu.Unlock()
+	}, Block)
+	defer bsub.Close()
+	stop := start(t, n)
+
+	first := put(t, env)
+	time.Sleep(20 * time.Millisecond)
+	// The notifier is blocked delivering first so these commits are
+	// observed together.
+	put(t, env)
+	last := put(t, env)
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := len(blocked) == 2 && len(coalesced) == 2
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, ids := range [][]int64{blocked, coalesced} {
+		if len(ids) != 2 || ids[0] != first || ids[1] != last {
+			t.Errorf("unexpected ids: %v (!= [%d %d])", ids, first, last)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Command testnotify is a utility used by the lmdbnotify tests to validate
+notification of commits made by another process.  An external command is
+required because a process is not allowed to map the same environment twice.
+
+Testnotify opens the environment at the path given by the -path flag.  For
+each line read from stdin it commits an update transaction and writes the
+transaction's ID to stdout.  Testnotify exits when stdin is closed.
+*/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+func main() {
+	path := flag.String("path", "db", "the environment directory")
+	flag.Parse()
+
+	err := run(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(path string) error {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+	err = env.Open(path, 0, 0644)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var id uintptr
+		err = env.Update(func(txn *lmdb.Txn) (err error) {
+			id = txn.ID()
+			root, err := txn.OpenRoot(0)
+			if err != nil {
+				return err
+			}
+			return txn.Put(root, []byte("line"), scanner.Bytes(), 0)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+	}
+	return scanner.Err()
+}
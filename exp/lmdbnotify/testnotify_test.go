@@ -0,0 +1,122 @@
+package lmdbnotify
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+func TestNotifier_multiprocess(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testMultiprocess(t, false)
+	})
+	t.Run("inotify", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("inotify is only supported on linux")
+		}
+		testMultiprocess(t, true)
+	})
+}
+
+func testMultiprocess(t *testing.T, inotify bool) {
+	tempdir, err := ioutil.TempDir("", "lmdbnotify_testnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	dbpath := filepath.Join(tempdir, "db")
+	err = os.Mkdir(dbpath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	err = env.Open(dbpath, 0, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin := filepath.Join(tempdir, "testnotify")
+	build := exec.Command("go", "build", "-o", bin, "./testnotify")
+	build.Stderr = os.Stderr
+	err = build.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := New(env)
+	n.Inotify = inotify
+	if inotify {
+		// Commits must be detected through the data file long before the
+		// next poll.
+		n.PollInterval = time.Hour
+	} else {
+		n.PollInterval = time.Millisecond
+	}
+	ids := make(chan int64, 16)
+	sub := n.Subscribe(func(id int64) { ids <- id }, Coalesce)
+	defer sub.Close()
+	defer start(t, n)()
+
+	cmd := exec.Command(bin, "-path", dbpath)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = stdin.Close()
+		err := cmd.Wait()
+		if err != nil {
+			t.Errorf("testnotify: %v", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintln(stdin, i)
+		if !scanner.Scan() {
+			t.Fatalf("testnotify: %v", scanner.Err())
+		}
+		want, err := strconv.ParseInt(scanner.Text(), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		for {
+			var id int64
+			select {
+			case id = <-ids:
+			case <-ctx.Done():
+				cancel()
+				t.Fatalf("timeout waiting for txn %d", want)
+			}
+			if id >= want {
+				break
+			}
+		}
+		cancel()
+	}
+}
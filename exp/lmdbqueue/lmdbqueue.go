@@ -0,0 +1,680 @@
+/*
+Package lmdbqueue implements a durable FIFO work queue in an LMDB
+environment.
+
+A Queue stores messages in a pair of databases.  Message bodies are stored in
+the items database under big-endian IDs which increase monotonically, so that
+they are written with lmdb.Append.  The schedule database indexes messages
+by state: ready messages in ID order, in-flight messages in order of the
+deadline of their lease, and dead letters.
+
+	q, err := lmdbqueue.New(env, "jobs", "jobs.schedule", &lmdbqueue.Options{
+		VisibilityTimeout: time.Minute,
+		MaxAttempts:       5,
+	})
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		_, err = q.Enqueue(txn, job)
+		return err
+	})
+
+Dequeue leases the oldest ready message to the caller until its visibility
+timeout expires.  A consumer acknowledges a message it has processed with Ack,
+which deletes it, or returns it to the queue with Nack.  Messages whose lease
+expires without an Ack are delivered again, and after Options.MaxAttempts
+deliveries they become dead letters instead.
+
+	m, err := q.DequeueWait(ctx)
+	if err != nil {
+		return err
+	}
+	process(m.Body)
+	err = env.Update(func(txn *lmdb.Txn) error {
+		return q.Ack(txn, m)
+	})
+
+All queue operations run inside a caller's lmdb.Txn so they can be combined
+atomically with other writes, and all state, including leases, is stored in
+the databases so the queue survives restarts.  Leases are measured with the
+wall clock.
+*/
+package lmdbqueue
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// DefaultVisibilityTimeout is used when Options.VisibilityTimeout is zero.
+const DefaultVisibilityTimeout = 30 * time.Second
+
+var (
+	// ErrEmpty is returned by Dequeue and Peek when no message is ready.
+	ErrEmpty = errors.New("lmdbqueue: queue is empty")
+
+	// ErrLease is returned by Ack and Nack when the caller no longer holds
+	// the lease on a message, because it expired and the message was
+	// delivered again or became a dead letter.
+	ErrLease = errors.New("lmdbqueue: lease expired")
+
+	// ErrCorrupt is returned (possibly wrapped) when the queue databases are
+	// inconsistent.
+	ErrCorrupt = errors.New("lmdbqueue: corrupt queue")
+)
+
+// Options configures a Queue.
+type Options struct {
+	// VisibilityTimeout is the duration of the lease taken by Dequeue.
+	VisibilityTimeout time.Duration
+
+	// MaxAttempts is the number of deliveries after which a message that
+	// is not acknowledged becomes a dead letter.  If MaxAttempts is zero
+	// messages are delivered until they are acknowledged.
+	MaxAttempts int
+
+	// Now returns the current time.  If Now is nil time.Now is used.
+	Now func() time.Time
+}
+
+// Message is a message in a queue.
+type Message struct {
+	ID       uint64
+	Body     []byte
+	Attempts int       // Number of times the message has been delivered.
+	Deadline time.Time // Expiry of the current lease, if any.
+}
+
+// Stats counts the messages in a queue by state.
+type Stats struct {
+	Ready    uint64
+	InFlight uint64
+	Dead     uint64
+}
+
+// Len returns the total number of messages.
+func (s *Stats) Len() uint64 {
+	return s.Ready + s.InFlight + s.Dead
+}
+
+// Message states, which are also the prefixes of schedule keys.
+const (
+	stateReady    byte = 0x00
+	stateInFlight byte = 0x01
+	stateDead     byte = 0x02
+	keyMeta       byte = 0xff
+)
+
+// Queue is a durable FIFO queue.  A Queue may be used concurrently from
+// multiple goroutines.
+type Queue struct {
+	env      *lmdb.Env
+	items    lmdb.DBI
+	schedule lmdb.DBI
+	name     string // schedule database
+	timeout  time.Duration
+	max      int
+	now      func() time.Time
+}
+
+// New returns a Queue stored in the databases named items and schedule, which
+// are created if they do not exist.  If opt is nil default options are used.
+func New(env *lmdb.Env, items, schedule string, opt *Options) (*Queue, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	if items == schedule {
+		return nil, fmt.Errorf("lmdbqueue: items and schedule databases must differ")
+	}
+	q := &Queue{
+		env:     env,
+		name:    schedule,
+		timeout: opt.VisibilityTimeout,
+		max:     opt.MaxAttempts,
+		now:     opt.Now,
+	}
+	if q.timeout <= 0 {
+		q.timeout = DefaultVisibilityTimeout
+	}
+	if q.now == nil {
+		q.now = time.Now
+	}
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		q.items, err = txn.OpenDBI(items, lmdb.Create)
+		if err != nil {
+			return err
+		}
+		q.schedule, err = txn.OpenDBI(schedule, lmdb.Create)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// meta is stored in the schedule database under keyMeta.
+type meta struct {
+	next uint64
+	Stats
+}
+
+const metaLen = 4 * 8
+
+func (q *Queue) meta(txn *lmdb.Txn) (*meta, error) {
+	v, err := txn.Get(q.schedule, []byte{keyMeta})
+	if lmdb.IsNotFound(err) {
+		return &meta{next: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != metaLen {
+		return nil, fmt.Errorf("%w: invalid metadata", ErrCorrupt)
+	}
+	return &meta{
+		next: binary.BigEndian.Uint64(v),
+		Stats: Stats{
+			Ready:    binary.BigEndian.Uint64(v[8:]),
+			InFlight: binary.BigEndian.Uint64(v[16:]),
+			Dead:     binary.BigEndian.Uint64(v[24:]),
+		},
+	}, nil
+}
+
+func (q *Queue) putMeta(txn *lmdb.Txn, m *meta) error {
+	b, err := txn.PutReserve(q.schedule, []byte{keyMeta}, metaLen, 0)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(b, m.next)
+	binary.BigEndian.PutUint64(b[8:], m.Ready)
+	binary.BigEndian.PutUint64(b[16:], m.InFlight)
+	binary.BigEndian.PutUint64(b[24:], m.Dead)
+	return nil
+}
+
+func (m *meta) count(state byte, delta int) {
+	switch state {
+	case stateReady:
+		m.Ready += uint64(delta)
+	case stateInFlight:
+		m.InFlight += uint64(delta)
+	case stateDead:
+		m.Dead += uint64(delta)
+	}
+}
+
+// item is the header stored before the body of each message.
+type item struct {
+	state    byte
+	attempts uint32
+	deadline uint64 // UnixNano; zero unless in flight
+}
+
+const itemLen = 1 + 4 + 8
+
+func idKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// scheduleKey returns the key indexing a message with the given state.
+func scheduleKey(id uint64, it *item) []byte {
+	if it.state == stateInFlight {
+		k := make([]byte, 17)
+		k[0] = stateInFlight
+		binary.BigEndian.PutUint64(k[1:], it.deadline)
+		binary.BigEndian.PutUint64(k[9:], id)
+		return k
+	}
+	k := make([]byte, 9)
+	k[0] = it.state
+	binary.BigEndian.PutUint64(k[1:], id)
+	return k
+}
+
+// get returns the header and body of a message.  The body is only valid until
+// the next write in txn.
+func (q *Queue) get(txn *lmdb.Txn, id uint64) (*item, []byte, error) {
+	v, err := txn.Get(q.items, idKey(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(v) < itemLen {
+		return nil, nil, fmt.Errorf("%w: message %d", ErrCorrupt, id)
+	}
+	it := &item{
+		state:    v[0],
+		attempts: binary.BigEndian.Uint32(v[1:]),
+		deadline: binary.BigEndian.Uint64(v[5:]),
+	}
+	return it, v[itemLen:], nil
+}
+
+// move changes the state of a message, updating its header, its schedule key
+// and the counts in m.
+func (q *Queue) move(txn *lmdb.Txn, m *meta, id uint64, it *item, state byte, deadline uint64) error {
+	err := txn.Del(q.schedule, scheduleKey(id, it), nil)
+	if err != nil {
+		return fmt.Errorf("%w: message %d: %v", ErrCorrupt, id, err)
+	}
+	m.count(it.state, -1)
+	it.state, it.deadline = state, deadline
+	m.count(it.state, 1)
+	err = txn.Put(q.schedule, scheduleKey(id, it), nil, 0)
+	if err != nil {
+		return err
+	}
+	return q.putHeader(txn, id, it)
+}
+
+// putHeader rewrites the header of a message in place.
+func (q *Queue) putHeader(txn *lmdb.Txn, id uint64, it *item) error {
+	cur, err := txn.OpenCursor(q.items)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	_, v, err := cur.Get(idKey(id), nil, lmdb.SetKey)
+	if err != nil {
+		return err
+	}
+	b, err := cur.PutReserve(idKey(id), len(v), lmdb.Current)
+	if err != nil {
+		return err
+	}
+	if len(b) < itemLen {
+		return fmt.Errorf("%w: message %d", ErrCorrupt, id)
+	}
+	// The value is rewritten in place, so only the header changes.
+	if &b[0] != &v[0] {
+		copy(b[itemLen:], v[itemLen:])
+	}
+	b[0] = it.state
+	binary.BigEndian.PutUint32(b[1:], it.attempts)
+	binary.BigEndian.PutUint64(b[5:], it.deadline)
+	return nil
+}
+
+// Enqueue appends a message with the given body to the queue and returns its
+// ID.
+func (q *Queue) Enqueue(txn *lmdb.Txn, body []byte) (uint64, error) {
+	m, err := q.meta(txn)
+	if err != nil {
+		return 0, err
+	}
+	id := m.next
+	b, err := txn.PutReserve(q.items, idKey(id), itemLen+len(body), lmdb.Append)
+	if err != nil {
+		return 0, err
+	}
+	it := &item{state: stateReady}
+	b[0] = it.state
+	binary.BigEndian.PutUint32(b[1:], 0)
+	binary.BigEndian.PutUint64(b[5:], 0)
+	copy(b[itemLen:], body)
+	err = txn.Put(q.schedule, scheduleKey(id, it), nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	m.next++
+	m.Ready++
+	return id, q.putMeta(txn, m)
+}
+
+// Reclaim returns messages whose lease has expired to the queue, or makes
+// them dead letters if they have been delivered Options.MaxAttempts times.
+// Reclaim is called by Dequeue and returns the number of messages reclaimed.
+func (q *Queue) Reclaim(txn *lmdb.Txn) (int, error) {
+	m, err := q.meta(txn)
+	if err != nil {
+		return 0, err
+	}
+	n, err := q.reclaim(txn, m, uint64(q.now().UnixNano()))
+	if err != nil || n == 0 {
+		return n, err
+	}
+	return n, q.putMeta(txn, m)
+}
+
+func (q *Queue) reclaim(txn *lmdb.Txn, m *meta, now uint64) (int, error) {
+	var n int
+	for {
+		id, deadline, err := q.firstInFlight(txn)
+		if lmdb.IsNotFound(err) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if deadline > now {
+			return n, nil
+		}
+		it, _, err := q.get(txn, id)
+		if err != nil {
+			return n, err
+		}
+		state := stateReady
+		if q.max > 0 && int(it.attempts) >= q.max {
+			state = stateDead
+		}
+		err = q.move(txn, m, id, it, state, 0)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// firstInFlight returns the in-flight message with the earliest deadline.
+func (q *Queue) firstInFlight(txn *lmdb.Txn) (id, deadline uint64, err error) {
+	k, err := q.first(txn, stateInFlight)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(k) != 17 {
+		return 0, 0, fmt.Errorf("%w: invalid schedule key %x", ErrCorrupt, k)
+	}
+	return binary.BigEndian.Uint64(k[9:]), binary.BigEndian.Uint64(k[1:]), nil
+}
+
+// first returns the first schedule key for the given state, or an error
+// satisfying lmdb.IsNotFound.
+func (q *Queue) first(txn *lmdb.Txn, state byte) ([]byte, error) {
+	cur, err := txn.OpenCursor(q.schedule)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+	k, _, err := cur.Get([]byte{state}, nil, lmdb.SetRange)
+	if err != nil {
+		return nil, err
+	}
+	if k[0] != state {
+		return nil, lmdb.NotFound
+	}
+	return k, nil
+}
+
+// firstReady returns the ID of the oldest ready message.
+func (q *Queue) firstReady(txn *lmdb.Txn) (uint64, error) {
+	k, err := q.first(txn, stateReady)
+	if lmdb.IsNotFound(err) {
+		return 0, ErrEmpty
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(k) != 9 {
+		return 0, fmt.Errorf("%w: invalid schedule key %x", ErrCorrupt, k)
+	}
+	return binary.BigEndian.Uint64(k[1:]), nil
+}
+
+// Dequeue leases the oldest ready message, after reclaiming messages whose
+// lease has expired.  Dequeue returns ErrEmpty if no message is ready.
+//
+// The lease is only taken if txn commits.  The body of the returned message is
+// a copy and remains valid after txn terminates.
+func (q *Queue) Dequeue(txn *lmdb.Txn) (*Message, error) {
+	m, err := q.meta(txn)
+	if err != nil {
+		return nil, err
+	}
+	now := q.now()
+	n, err := q.reclaim(txn, m, uint64(now.UnixNano()))
+	if err != nil {
+		return nil, err
+	}
+	id, err := q.firstReady(txn)
+	if err == ErrEmpty && n > 0 {
+		// Every reclaimed message became a dead letter.
+		err = q.putMeta(txn, m)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+	it, body, err := q.get(txn, id)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		ID:       id,
+		Body:     append([]byte(nil), body...),
+		Attempts: int(it.attempts) + 1,
+		Deadline: now.Add(q.timeout),
+	}
+	it.attempts++
+	err = q.move(txn, m, id, it, stateInFlight, uint64(msg.Deadline.UnixNano()))
+	if err != nil {
+		return nil, err
+	}
+	return msg, q.putMeta(txn, m)
+}
+
+// DequeueWait dequeues a message in its own update transaction, waiting until
+// a message is ready or ctx is done.  DequeueWait is woken by messages
+// committed through this package in the current process and by the expiry of
+// leases; messages enqueued by other processes are noticed only when a lease
+// expires.
+func (q *Queue) DequeueWait(ctx context.Context) (*Message, error) {
+	w, err := q.env.Watch(q.name, []byte{stateReady})
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		var msg *Message
+		var next time.Time
+		err = q.env.Update(func(txn *lmdb.Txn) (err error) {
+			msg, err = q.Dequeue(txn)
+			if err != ErrEmpty {
+				return err
+			}
+			_, deadline, err := q.firstInFlight(txn)
+			if err == nil {
+				next = time.Unix(0, int64(deadline))
+			}
+			if lmdb.IsNotFound(err) {
+				err = nil
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			return msg, nil
+		}
+
+		var expired <-chan time.Time
+		if !next.IsZero() {
+			d := next.Sub(q.now())
+			if timer == nil {
+				timer = time.NewTimer(d)
+			} else {
+				timer.Reset(d)
+			}
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case _, ok := <-w.C:
+			if !ok {
+				return nil, fmt.Errorf("lmdbqueue: environment closed")
+			}
+		case <-expired:
+		}
+		if timer != nil && !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// lease returns the header of msg if the caller still holds its lease.
+func (q *Queue) lease(txn *lmdb.Txn, msg *Message) (*item, error) {
+	it, _, err := q.get(txn, msg.ID)
+	if lmdb.IsNotFound(err) {
+		return nil, ErrLease
+	}
+	if err != nil {
+		return nil, err
+	}
+	if it.state != stateInFlight || int(it.attempts) != msg.Attempts {
+		return nil, ErrLease
+	}
+	return it, nil
+}
+
+// Ack deletes a message returned by Dequeue.  Ack returns ErrLease if the
+// lease on msg has expired and the message was reclaimed, even if it has not
+// yet been delivered again.
+func (q *Queue) Ack(txn *lmdb.Txn, msg *Message) error {
+	m, err := q.meta(txn)
+	if err != nil {
+		return err
+	}
+	it, err := q.lease(txn, msg)
+	if err != nil {
+		return err
+	}
+	err = txn.Del(q.schedule, scheduleKey(msg.ID, it), nil)
+	if err != nil {
+		return fmt.Errorf("%w: message %d: %v", ErrCorrupt, msg.ID, err)
+	}
+	err = txn.Del(q.items, idKey(msg.ID), nil)
+	if err != nil {
+		return err
+	}
+	m.InFlight--
+	return q.putMeta(txn, m)
+}
+
+// Nack releases the lease on a message returned by Dequeue.  If delay is zero
+// the message is immediately ready for delivery again, ahead of messages
+// enqueued after it, or becomes a dead letter if it has been delivered
+// Options.MaxAttempts times.  Otherwise the lease is extended by delay, after
+// which the message is reclaimed.  Nack returns ErrLease if the lease on msg
+// has expired.
+func (q *Queue) Nack(txn *lmdb.Txn, msg *Message, delay time.Duration) error {
+	m, err := q.meta(txn)
+	if err != nil {
+		return err
+	}
+	it, err := q.lease(txn, msg)
+	if err != nil {
+		return err
+	}
+	if delay > 0 {
+		deadline := q.now().Add(delay)
+		err = q.move(txn, m, msg.ID, it, stateInFlight, uint64(deadline.UnixNano()))
+	} else if q.max > 0 && int(it.attempts) >= q.max {
+		err = q.move(txn, m, msg.ID, it, stateDead, 0)
+	} else {
+		err = q.move(txn, m, msg.ID, it, stateReady, 0)
+	}
+	if err != nil {
+		return err
+	}
+	return q.putMeta(txn, m)
+}
+
+// Peek returns the oldest ready message without leasing it.  Peek does not
+// reclaim expired leases.  Peek returns ErrEmpty if no message is ready.
+func (q *Queue) Peek(txn *lmdb.Txn) (*Message, error) {
+	id, err := q.firstReady(txn)
+	if err != nil {
+		return nil, err
+	}
+	it, body, err := q.get(txn, id)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		ID:       id,
+		Body:     append([]byte(nil), body...),
+		Attempts: int(it.attempts),
+	}, nil
+}
+
+// Stats returns the number of messages in each state.  Messages whose lease
+// has expired are counted as in flight until they are reclaimed.
+func (q *Queue) Stats(txn *lmdb.Txn) (*Stats, error) {
+	m, err := q.meta(txn)
+	if err != nil {
+		return nil, err
+	}
+	return &m.Stats, nil
+}
+
+// ScanDead calls fn for each dead letter in ID order.  The body passed to fn
+// is only valid until fn returns.  If fn returns an error ScanDead stops and
+// returns it.
+func (q *Queue) ScanDead(txn *lmdb.Txn, fn func(msg *Message) error) error {
+	cur, err := txn.OpenCursor(q.schedule)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	k, _, err := cur.Get([]byte{stateDead}, nil, lmdb.SetRange)
+	for ; err == nil && k[0] == stateDead; k, _, err = cur.Get(nil, nil, lmdb.Next) {
+		if len(k) != 9 {
+			return fmt.Errorf("%w: invalid schedule key %x", ErrCorrupt, k)
+		}
+		id := binary.BigEndian.Uint64(k[1:])
+		it, body, err := q.get(txn, id)
+		if err != nil {
+			return err
+		}
+		err = fn(&Message{ID: id, Body: body, Attempts: int(it.attempts)})
+		if err != nil {
+			return err
+		}
+	}
+	if lmdb.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Retry returns the dead letter with the given ID to the queue and resets its
+// delivery count.
+func (q *Queue) Retry(txn *lmdb.Txn, id uint64) error {
+	m, err := q.meta(txn)
+	if err != nil {
+		return err
+	}
+	it, _, err := q.get(txn, id)
+	if err != nil {
+		return err
+	}
+	if it.state != stateDead {
+		return fmt.Errorf("lmdbqueue: message %d is not a dead letter", id)
+	}
+	it.attempts = 0
+	err = q.move(txn, m, id, it, stateReady, 0)
+	if err != nil {
+		return err
+	}
+	return q.putMeta(txn, m)
+}
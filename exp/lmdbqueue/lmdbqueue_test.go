@@ -0,0 +1,390 @@
+package lmdbqueue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// clock is a fake clock for tests.
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestQueue(t *testing.T, opt *Options) (*lmdb.Env, *Queue) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := New(env, "items", "schedule", opt)
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	return env, q
+}
+
+func enqueue(t *testing.T, env *lmdb.Env, q *Queue, bodies ...string) {
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		for _, b := range bodies {
+			_, err = q.Enqueue(txn, []byte(b))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dequeue(t *testing.T, env *lmdb.Env, q *Queue) *Message {
+	var msg *Message
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		msg, err = q.Dequeue(txn)
+		return err
+	})
+	if err == ErrEmpty {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg == nil {
+		t.Fatal("dequeue returned no message and no error")
+	}
+	return msg
+}
+
+func checkStats(t *testing.T, env *lmdb.Env, q *Queue, ready, inflight, dead uint64) {
+	t.Helper()
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		s, err := q.Stats(txn)
+		if err != nil {
+			return err
+		}
+		if *s != (Stats{Ready: ready, InFlight: inflight, Dead: dead}) {
+			t.Errorf("stats: %+v", *s)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	env, q := newTestQueue(t, nil)
+	defer lmdbtest.Destroy(env)
+
+	if dequeue(t, env, q) != nil {
+		t.Fatalf("dequeued from empty queue")
+	}
+	enqueue(t, env, q, "a", "b", "c")
+	checkStats(t, env, q, 3, 0, 0)
+
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		msg, err := q.Peek(txn)
+		if err != nil {
+			return err
+		}
+		if msg.ID != 1 || string(msg.Body) != "a" || msg.Attempts != 0 {
+			t.Errorf("peek: %+v", msg)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := dequeue(t, env, q)
+	b := dequeue(t, env, q)
+	if string(a.Body) != "a" || string(b.Body) != "b" || a.Attempts != 1 {
+		t.Fatalf("dequeued %+v %+v", a, b)
+	}
+	checkStats(t, env, q, 1, 2, 0)
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		err = q.Ack(txn, a)
+		if err != nil {
+			return err
+		}
+		// b is returned ahead of c.
+		return q.Nack(txn, b, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, env, q, 2, 0, 0)
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		return q.Ack(txn, a)
+	})
+	if err != ErrLease {
+		t.Errorf("ack twice: unexpected error: %v", err)
+	}
+
+	b = dequeue(t, env, q)
+	if string(b.Body) != "b" || b.Attempts != 2 {
+		t.Errorf("dequeued %+v", b)
+	}
+	enqueue(t, env, q, "d")
+	for _, body := range []string{"c", "d"} {
+		msg := dequeue(t, env, q)
+		if msg == nil || string(msg.Body) != body {
+			t.Fatalf("dequeued %+v (expected %q)", msg, body)
+		}
+		if body == "d" && msg.ID != 4 {
+			t.Errorf("id: %d", msg.ID)
+		}
+	}
+	checkStats(t, env, q, 0, 3, 0)
+}
+
+func TestQueue_visibilityTimeout(t *testing.T) {
+	clk := &clock{t: time.Unix(1000, 0)}
+	env, q := newTestQueue(t, &Options{
+		VisibilityTimeout: time.Minute,
+		MaxAttempts:       2,
+		Now:               clk.Now,
+	})
+	defer lmdbtest.Destroy(env)
+
+	enqueue(t, env, q, "a", "b")
+	a := dequeue(t, env, q)
+	if a.Deadline != clk.Now().Add(time.Minute) {
+		t.Errorf("deadline: %v", a.Deadline)
+	}
+	b := dequeue(t, env, q)
+	if dequeue(t, env, q) != nil {
+		t.Fatalf("dequeued leased message")
+	}
+
+	// b is delayed so only a's lease expires.
+	err := env.Update(func(txn *lmdb.Txn) error {
+		return q.Nack(txn, b, 5*time.Minute)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(2 * time.Minute)
+	a2 := dequeue(t, env, q)
+	if a2 == nil || a2.ID != a.ID || a2.Attempts != 2 {
+		t.Fatalf("redelivered %+v", a2)
+	}
+	if dequeue(t, env, q) != nil {
+		t.Fatalf("dequeued delayed message")
+	}
+	err = env.Update(func(txn *lmdb.Txn) error {
+		return q.Ack(txn, a)
+	})
+	if err != ErrLease {
+		t.Errorf("stale ack: unexpected error: %v", err)
+	}
+
+	// Both messages have now been delivered twice.
+	clk.Advance(5 * time.Minute)
+	b2 := dequeue(t, env, q)
+	if b2 == nil || b2.ID != b.ID || b2.Attempts != 2 {
+		t.Fatalf("redelivered %+v", b2)
+	}
+	err = env.Update(func(txn *lmdb.Txn) error {
+		return q.Nack(txn, b2, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(2 * time.Minute)
+	if dequeue(t, env, q) != nil {
+		t.Fatalf("dequeued dead letter")
+	}
+	checkStats(t, env, q, 0, 0, 2)
+
+	var dead []string
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		err = q.ScanDead(txn, func(msg *Message) error {
+			dead = append(dead, fmt.Sprintf("%d:%s:%d", msg.ID, msg.Body, msg.Attempts))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return q.Retry(txn, b.ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(dead) != "[1:a:2 2:b:2]" {
+		t.Errorf("dead letters: %v", dead)
+	}
+	b3 := dequeue(t, env, q)
+	if b3 == nil || b3.ID != b.ID || b3.Attempts != 1 {
+		t.Fatalf("retried %+v", b3)
+	}
+	checkStats(t, env, q, 0, 1, 1)
+}
+
+func TestQueue_reopen(t *testing.T) {
+	clk := &clock{t: time.Unix(1000, 0)}
+	opt := &Options{VisibilityTimeout: time.Minute, Now: clk.Now}
+	env, q := newTestQueue(t, opt)
+	path, err := env.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	enqueue(t, env, q, "a", "b")
+	a := dequeue(t, env, q)
+	env.Close()
+
+	env, err = lmdb.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	err = env.SetMaxDBs(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Open(path, 0, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err = New(env, "items", "schedule", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, env, q, 1, 1, 0)
+	b := dequeue(t, env, q)
+	if string(b.Body) != "b" {
+		t.Errorf("dequeued %+v", b)
+	}
+	err = env.Update(func(txn *lmdb.Txn) error {
+		return q.Ack(txn, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Hour)
+	a2 := dequeue(t, env, q)
+	if a2 == nil || a2.ID != a.ID || a2.Attempts != 2 {
+		t.Errorf("redelivered %+v", a2)
+	}
+	enqueue(t, env, q, "c")
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		msg, err := q.Peek(txn)
+		if err != nil {
+			return err
+		}
+		if msg.ID != 3 {
+			t.Errorf("id: %d", msg.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueue_DequeueWait(t *testing.T) {
+	env, q := newTestQueue(t, &Options{VisibilityTimeout: 50 * time.Millisecond})
+	defer lmdbtest.Destroy(env)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err := q.DequeueWait(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		err := env.Update(func(txn *lmdb.Txn) (err error) {
+			_, err = q.Enqueue(txn, []byte("a"))
+			return err
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	msg, err := q.DequeueWait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Body) != "a" {
+		t.Errorf("dequeued %+v", msg)
+	}
+
+	// The expiry of the lease wakes a waiting consumer.
+	start := time.Now()
+	msg, err = q.DequeueWait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Attempts != 2 || time.Since(start) < 20*time.Millisecond {
+		t.Errorf("redelivered %+v after %v", msg, time.Since(start))
+	}
+}
+
+func TestQueue_DequeueWait_deadLetter(t *testing.T) {
+	timeout := 20 * time.Millisecond
+	env, q := newTestQueue(t, &Options{VisibilityTimeout: timeout, MaxAttempts: 2})
+	defer lmdbtest.Destroy(env)
+
+	enqueue(t, env, q, "a", "b")
+	dequeue(t, env, q)
+	time.Sleep(timeout + 5*time.Millisecond)
+	a := dequeue(t, env, q)
+	if string(a.Body) != "a" || a.Attempts != 2 {
+		t.Fatalf("redelivered %+v", a)
+	}
+	b := dequeue(t, env, q)
+	err := env.Update(func(txn *lmdb.Txn) error {
+		return q.Nack(txn, b, 3*timeout)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a becomes a dead letter while b is still delayed, and b's delay wakes
+	// the waiting consumer.
+	time.Sleep(timeout + 5*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, err := q.DequeueWait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != b.ID || msg.Attempts != 2 {
+		t.Errorf("dequeued %+v", msg)
+	}
+	checkStats(t, env, q, 0, 1, 1)
+
+	time.Sleep(timeout + 5*time.Millisecond)
+	if dequeue(t, env, q) != nil {
+		t.Fatalf("dequeued dead letter")
+	}
+}
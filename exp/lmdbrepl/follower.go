@@ -0,0 +1,394 @@
+package lmdbrepl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/exp/lmdbcdc"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// DefaultRetryInterval is the time a Follower waits before reconnecting when
+// Follower.RetryInterval is zero.
+const DefaultRetryInterval = time.Second
+
+// DefaultMetaName is the name of the database in which a Follower stores its
+// position when Follower.MetaName is empty.
+const DefaultMetaName = "__repl"
+
+// DefaultMaxDBs is the number of named databases a Follower environment
+// supports when Follower.Setup is nil.
+const DefaultMaxDBs = 64
+
+var keyPosition = []byte("position")
+
+// ErrClosed is returned by Follower methods after Close has been called.
+var ErrClosed = errors.New("lmdbrepl: follower is closed")
+
+// Follower maintains a replica of a primary environment in a local directory.
+// The exported fields of a Follower must not be modified after Run is called.
+type Follower struct {
+	// Setup, if non-nil, is called to configure the environment before it is
+	// opened.  Setup must reserve a named database for the follower's
+	// position in addition to those replicated (see lmdb.Env.SetMaxDBs).
+	Setup func(env *lmdb.Env) error
+
+	// RetryInterval is the time waited before reconnecting to the primary.
+	RetryInterval time.Duration
+
+	// MetaName is the database used to store the follower's position.
+	MetaName string
+
+	path string
+	addr string
+
+	mu     sync.RWMutex
+	env    *lmdb.Env
+	meta   lmdb.DBI
+	dbis   map[string]lmdb.DBI
+	pos    lmdbcdc.Position
+	hasPos bool
+	closed bool
+}
+
+// NewFollower returns a Follower which replicates the primary at addr into
+// the environment directory path.  The directory is created if necessary.
+func NewFollower(path, addr string) *Follower {
+	return &Follower{
+		path: path,
+		addr: addr,
+	}
+}
+
+// Pos returns the position of the last transaction applied by f.  The bool
+// result is false if f has not received a snapshot.
+func (f *Follower) Pos() (lmdbcdc.Position, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.pos, f.hasPos
+}
+
+// View executes fn in a view transaction on the replica.  The replica is
+// opened if Run has not yet done so.
+func (f *Follower) View(fn lmdb.TxnOp) error {
+	err := f.open()
+	if err != nil {
+		return err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.env == nil {
+		return ErrClosed
+	}
+	return f.env.View(fn)
+}
+
+// Close closes the replica environment.  Close must not be called while Run
+// is executing.
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.env == nil {
+		return nil
+	}
+	err := f.env.Close()
+	f.env = nil
+	return err
+}
+
+// Run replicates from the primary until ctx is done, reconnecting after
+// failures.  Run returns the context's error, or an error encountered
+// opening or updating the replica environment.
+func (f *Follower) Run(ctx context.Context) error {
+	interval := f.RetryInterval
+	if interval <= 0 {
+		interval = DefaultRetryInterval
+	}
+	for {
+		err := f.open()
+		if err != nil {
+			return err
+		}
+		err = f.session(ctx)
+		if _, ok := err.(*applyError); ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// applyError is an error encountered modifying the replica.  Such errors are
+// not resolved by reconnecting.
+type applyError struct {
+	err error
+}
+
+func (e *applyError) Error() string { return e.err.Error() }
+
+func (f *Follower) session(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", f.addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	pos, hasPos := f.Pos()
+	hello := make([]byte, 1, 13)
+	if hasPos {
+		hello[0] = 1
+	}
+	hello = append(hello, pos.Key()...)
+	err = writeFrame(w, frameHello, hello)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		typ, payload, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case frameSnapshot:
+			pos, err := lmdbcdc.ParsePosition(payload)
+			if err != nil {
+				return err
+			}
+			err = f.recvSnapshot(r, pos)
+			if err != nil {
+				return err
+			}
+		case frameTxn:
+			pos, changes, err := decodeTxn(payload)
+			if err != nil {
+				return err
+			}
+			err = f.apply(pos, changes)
+			if err != nil {
+				return &applyError{err}
+			}
+		default:
+			return errProtocol
+		}
+	}
+}
+
+func (f *Follower) metaName() string {
+	if f.MetaName == "" {
+		return DefaultMetaName
+	}
+	return f.MetaName
+}
+
+func (f *Follower) open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrClosed
+	}
+	if f.env != nil {
+		return nil
+	}
+	return f.openLocked()
+}
+
+// openLocked opens the replica environment and loads the stored position.
+// The caller must hold f.mu.
+func (f *Follower) openLocked() error {
+	err := os.MkdirAll(f.path, 0755)
+	if err != nil {
+		return err
+	}
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return err
+	}
+	if f.Setup != nil {
+		err = f.Setup(env)
+	} else {
+		err = env.SetMaxDBs(DefaultMaxDBs)
+	}
+	if err == nil {
+		err = env.Open(f.path, 0, 0644)
+	}
+	if err != nil {
+		env.Close()
+		return err
+	}
+
+	var meta lmdb.DBI
+	var pos lmdbcdc.Position
+	var hasPos bool
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		meta, err = txn.OpenDBI(f.metaName(), lmdb.Create)
+		if err != nil {
+			return err
+		}
+		v, err := txn.Get(meta, keyPosition)
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pos, err = lmdbcdc.ParsePosition(v)
+		hasPos = err == nil
+		return err
+	})
+	if err != nil {
+		env.Close()
+		return err
+	}
+	f.env = env
+	f.meta = meta
+	f.dbis = make(map[string]lmdb.DBI)
+	f.pos = pos
+	f.hasPos = hasPos
+	return nil
+}
+
+// recvSnapshot replaces the replica's data file with the snapshot read from
+// r.
+func (f *Follower) recvSnapshot(r *bufio.Reader, pos lmdbcdc.Position) error {
+	tmp := filepath.Join(f.path, "data.mdb.repl")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return &applyError{err}
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+	for {
+		typ, payload, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		if typ == frameEnd {
+			break
+		}
+		if typ != frameData {
+			return errProtocol
+		}
+		_, err = file.Write(payload)
+		if err != nil {
+			return &applyError{err}
+		}
+	}
+	err = file.Sync()
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return &applyError{err}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.env != nil {
+		f.env.Close()
+		f.env = nil
+	}
+	err = os.Rename(tmp, filepath.Join(f.path, "data.mdb"))
+	if err == nil {
+		err = f.openLocked()
+	}
+	if err == nil {
+		err = f.update(func(txn *lmdb.Txn) error { return nil }, pos)
+	}
+	if err != nil {
+		return &applyError{err}
+	}
+	return nil
+}
+
+// apply applies the changes of a primary transaction.
+func (f *Follower) apply(pos lmdbcdc.Position, changes []*lmdbcdc.Change) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hasPos && !f.pos.Less(pos) {
+		// The transaction has already been applied.
+		return nil
+	}
+	return f.update(func(txn *lmdb.Txn) error {
+		for _, c := range changes {
+			dbi, err := f.dbi(txn, c.DB)
+			if err != nil {
+				return err
+			}
+			switch c.Op {
+			case lmdbcdc.OpPut:
+				err = txn.Put(dbi, c.Key, c.Val, 0)
+			case lmdbcdc.OpDel:
+				err = txn.Del(dbi, c.Key, c.Val)
+				if lmdb.IsNotFound(err) {
+					err = nil
+				}
+			default:
+				err = errProtocol
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, pos)
+}
+
+// update executes fn and stores pos in an update transaction.  The caller
+// must hold f.mu.
+func (f *Follower) update(fn lmdb.TxnOp, pos lmdbcdc.Position) error {
+	err := f.env.Update(func(txn *lmdb.Txn) error {
+		err := fn(txn)
+		if err != nil {
+			return err
+		}
+		return txn.Put(f.meta, keyPosition, pos.Key(), 0)
+	})
+	if err != nil {
+		// Handles opened in an aborted transaction are not retained.
+		f.dbis = make(map[string]lmdb.DBI)
+		return err
+	}
+	f.pos = pos
+	f.hasPos = true
+	return nil
+}
+
+func (f *Follower) dbi(txn *lmdb.Txn, name string) (lmdb.DBI, error) {
+	dbi, ok := f.dbis[name]
+	if ok {
+		return dbi, nil
+	}
+	var err error
+	if name == "" {
+		dbi, err = txn.OpenRoot(0)
+	} else {
+		dbi, err = txn.OpenDBI(name, lmdb.Create)
+	}
+	if err != nil {
+		return 0, err
+	}
+	f.dbis[name] = dbi
+	return dbi, nil
+}
@@ -0,0 +1,185 @@
+/*
+Package lmdbrepl replicates an environment from a primary process to follower
+environments over a stream connection such as TCP.
+
+The primary records changes with an lmdbcdc.Log.  A Follower connects to a
+Primary and reports the position in the log it has applied.  A follower which
+has never synchronized, or one which has fallen behind the oldest entry in the
+log, first receives a snapshot of the primary environment made with
+lmdb.Env.CopyFD.  The primary then streams the changes of each committed
+transaction and the follower applies them, in order, each in an update
+transaction that also stores the follower's position.  A follower that is
+disconnected reconnects and resumes from its stored position.
+
+Changes are applied to follower databases with the same names as those given
+to lmdbcdc.Log.Track on the primary, so tracked databases must be tracked
+under their own names.  The name "" refers to the root database.  A database
+created on the primary after a follower's snapshot is created on the follower
+without flags, so databases with flags such as lmdb.DupSort should be created
+before followers synchronize.
+
+	// primary
+	p := lmdbrepl.NewPrimary(env, cdc)
+	go p.Serve(ctx, ln)
+
+	// follower
+	f := lmdbrepl.NewFollower("/var/db/replica", "primary:4000")
+	go f.Run(ctx)
+	err = f.View(func(txn *lmdb.Txn) (err error) {
+		// ...
+	})
+
+A snapshot reflects a state of the primary at, or following, the position
+sent with it.  Changes between that position and the actual state of the copy
+are replayed by the follower.  Replaying a prefix of the log over a later
+state converges to the same final state because each change overwrites or
+deletes a single item.
+
+Followers must be treated as read-only except through the package.  A snapshot
+replaces the follower's data file, including any databases not present on the
+primary.
+*/
+package lmdbrepl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ledgerwatch/lmdb-go/exp/lmdbcdc"
+)
+
+// Frame types of the replication protocol.  Every frame is a type byte
+// followed by the uvarint length of its payload.
+const (
+	frameHello    = 'H' // follower position; a flag byte and a Position key
+	frameSnapshot = 'S' // snapshot position; a Position key
+	frameData     = 'D' // a chunk of the snapshot file
+	frameEnd      = 'E' // the end of the snapshot file
+	frameTxn      = 'T' // the changes of one transaction
+)
+
+// maxFrame bounds the payload of a frame read from a peer.
+const maxFrame = 1 << 30
+
+// snapshotChunk is the size of the data frames of a snapshot.
+const snapshotChunk = 256 << 10
+
+var errProtocol = errors.New("lmdbrepl: protocol error")
+
+func writeFrame(w *bufio.Writer, typ byte, payload []byte) error {
+	var buf [1 + binary.MaxVarintLen64]byte
+	buf[0] = typ
+	n := binary.PutUvarint(buf[1:], uint64(len(payload)))
+	_, err := w.Write(buf[:1+n])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if n > maxFrame {
+		return 0, nil, fmt.Errorf("lmdbrepl: frame too large (%d bytes)", n)
+	}
+	payload := make([]byte, n)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return typ, payload, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// encodeTxn encodes changes which share a transaction as the payload of a
+// frameTxn.
+func encodeTxn(changes []*lmdbcdc.Change) []byte {
+	last := changes[len(changes)-1].Pos
+	b := last.Key()
+	b = appendUvarint(b, uint64(len(changes)))
+	for _, c := range changes {
+		b = append(b, byte(c.Op))
+		b = appendField(b, []byte(c.DB))
+		b = appendField(b, c.Key)
+		b = appendField(b, c.Val)
+	}
+	return b
+}
+
+func decodeTxn(b []byte) (lmdbcdc.Position, []*lmdbcdc.Change, error) {
+	if len(b) < 12 {
+		return lmdbcdc.Position{}, nil, errProtocol
+	}
+	pos, err := lmdbcdc.ParsePosition(b[:12])
+	if err != nil {
+		return pos, nil, err
+	}
+	b = b[12:]
+	n, k := binary.Uvarint(b)
+	if k <= 0 || n > uint64(len(b)) {
+		return pos, nil, errProtocol
+	}
+	b = b[k:]
+	changes := make([]*lmdbcdc.Change, n)
+	for i := range changes {
+		if len(b) == 0 {
+			return pos, nil, errProtocol
+		}
+		c := &lmdbcdc.Change{Pos: pos, Op: lmdbcdc.Op(b[0])}
+		var name []byte
+		name, b, err = readField(b[1:])
+		if err != nil {
+			return pos, nil, err
+		}
+		c.DB = string(name)
+		c.Key, b, err = readField(b)
+		if err != nil {
+			return pos, nil, err
+		}
+		c.Val, b, err = readField(b)
+		if err != nil {
+			return pos, nil, err
+		}
+		changes[i] = c
+	}
+	if len(b) != 0 {
+		return pos, nil, errProtocol
+	}
+	return pos, changes, nil
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(b, buf[:n]...)
+}
+
+func appendField(b, p []byte) []byte {
+	b = appendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+func readField(b []byte) ([]byte, []byte, error) {
+	n, k := binary.Uvarint(b)
+	if k <= 0 || uint64(len(b)-k) < n {
+		return nil, nil, errProtocol
+	}
+	return b[k : k+int(n) : k+int(n)], b[k+int(n):], nil
+}
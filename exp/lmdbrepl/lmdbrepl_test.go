@@ -0,0 +1,250 @@
+package lmdbrepl
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/exp/lmdbcdc"
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+type primaryTest struct {
+	t    *testing.T
+	env  *lmdb.Env
+	log  *lmdbcdc.Log
+	dbi  lmdb.DBI
+	addr string
+
+	cancel func()
+	done   chan error
+}
+
+func newPrimaryTest(t *testing.T) *primaryTest {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &primaryTest{t: t, env: env}
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		p.log, err = lmdbcdc.Open(txn, "log")
+		if err != nil {
+			return err
+		}
+		p.dbi, err = txn.OpenDBI("items", lmdb.Create)
+		return err
+	})
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	p.log.Track(p.dbi, "items")
+	return p
+}
+
+// serve starts serving followers.  The primary listens on the same address
+// each time it is started so followers can reconnect.
+func (p *primaryTest) serve() {
+	addr := p.addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.addr = ln.Addr().String()
+	primary := NewPrimary(p.env, p.log)
+	primary.PollInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan error, 1)
+	go func() { p.done <- primary.Serve(ctx, ln) }()
+}
+
+func (p *primaryTest) stop() {
+	p.cancel()
+	if err := <-p.done; err != context.Canceled {
+		p.t.Errorf("serve: %v", err)
+	}
+}
+
+func (p *primaryTest) update(fn func(w *lmdbcdc.Writer) error) {
+	err := p.env.Update(func(txn *lmdb.Txn) (err error) {
+		return fn(p.log.Writer(txn))
+	})
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *primaryTest) put(key, val string) {
+	p.update(func(w *lmdbcdc.Writer) error {
+		return w.Put(p.dbi, []byte(key), []byte(val), 0)
+	})
+}
+
+func runFollower(t *testing.T, f *Follower) (stop func()) {
+	f.RetryInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- f.Run(ctx) }()
+	return func() {
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("run: %v", err)
+		}
+	}
+}
+
+// waitFor waits until the follower has item key with value val, or does not
+// have key if val is empty.
+func waitFor(t *testing.T, f *Follower, key, val string) {
+	deadline := time.Now().Add(10 * time.Second)
+	var got string
+	for time.Now().Before(deadline) {
+		got = ""
+		err := f.View(func(txn *lmdb.Txn) (err error) {
+			dbi, err := txn.OpenDBI("items", 0)
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			v, err := txn.Get(dbi, []byte(key))
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			got = string(v)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == val {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("follower %q=%q (!= %q)", key, got, val)
+}
+
+func TestFollower(t *testing.T) {
+	p := newPrimaryTest(t)
+	defer lmdbtest.Destroy(p.env)
+
+	// Written before any follower connects so it must arrive in the
+	// snapshot.
+	p.put("a", "1")
+	p.serve()
+
+	dir, err := ioutil.TempDir("", "lmdbrepl-follower-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := NewFollower(dir, p.addr)
+	stop := runFollower(t, f)
+
+	waitFor(t, f, "a", "1")
+	p.put("b", "2")
+	p.update(func(w *lmdbcdc.Writer) error {
+		err := w.Put(p.dbi, []byte("c"), []byte("3"), 0)
+		if err != nil {
+			return err
+		}
+		return w.Del(p.dbi, []byte("a"), nil)
+	})
+	waitFor(t, f, "c", "3")
+	waitFor(t, f, "a", "")
+	waitFor(t, f, "b", "2")
+
+	// Write a marker that a snapshot would erase.
+	err = f.View(func(txn *lmdb.Txn) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	err = f.env.Update(func(txn *lmdb.Txn) error {
+		return txn.Put(f.meta, []byte("marker"), []byte("x"), 0)
+	})
+	f.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart the primary while the follower is connected.
+	p.stop()
+	p.put("d", "4")
+	p.serve()
+	waitFor(t, f, "d", "4")
+
+	// Restart the follower from its stored position.
+	stop()
+	pos, _ := f.Pos()
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.put("e", "5")
+	f = NewFollower(dir, p.addr)
+	defer f.Close()
+	if resumed, ok := f.Pos(); ok {
+		t.Errorf("position before open: %v", resumed)
+	}
+	stop = runFollower(t, f)
+	defer stop()
+	waitFor(t, f, "e", "5")
+	if resumed, _ := f.Pos(); !pos.Less(resumed) {
+		t.Errorf("position did not advance: %v (<= %v)", resumed, pos)
+	}
+	err = f.View(func(txn *lmdb.Txn) (err error) {
+		_, err = txn.Get(f.meta, []byte("marker"))
+		return err
+	})
+	if err != nil {
+		t.Errorf("follower was unexpectedly resynchronized: %v", err)
+	}
+	p.stop()
+}
+
+func TestFollower_truncated(t *testing.T) {
+	p := newPrimaryTest(t)
+	defer lmdbtest.Destroy(p.env)
+	p.serve()
+	defer p.stop()
+
+	dir, err := ioutil.TempDir("", "lmdbrepl-follower-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := NewFollower(dir, p.addr)
+	defer f.Close()
+	stop := runFollower(t, f)
+	p.put("a", "1")
+	waitFor(t, f, "a", "1")
+	stop()
+	pos, _ := f.Pos()
+
+	// Entries the follower has not applied are removed from the log.
+	p.put("b", "2")
+	p.put("c", "3")
+	err = p.env.Update(func(txn *lmdb.Txn) (err error) {
+		_, err = p.log.Truncate(txn, lmdbcdc.Position{TxnID: pos.TxnID + 2})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop = runFollower(t, f)
+	defer stop()
+	waitFor(t, f, "b", "2")
+	waitFor(t, f, "c", "3")
+}
@@ -0,0 +1,211 @@
+package lmdbrepl
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/exp/lmdbcdc"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// Primary serves snapshots and changes recorded in a log to followers.
+type Primary struct {
+	// PollInterval is the interval at which the log is checked for new
+	// commits.  See lmdbcdc.Consumer.
+	PollInterval time.Duration
+
+	env *lmdb.Env
+	log *lmdbcdc.Log
+}
+
+// NewPrimary returns a Primary which replicates env.  Changes to the databases
+// tracked by log are streamed to followers.
+func NewPrimary(env *lmdb.Env, log *lmdbcdc.Log) *Primary {
+	return &Primary{
+		env: env,
+		log: log,
+	}
+}
+
+// Serve accepts follower connections on ln until ctx is done, serving each
+// in its own goroutine.  Serve closes ln and waits for connections to
+// terminate before returning.  Serve always returns a non-nil error, the
+// context's error if ctx is done.
+func (p *Primary) Serve(ctx context.Context, ln net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = p.ServeConn(ctx, conn)
+		}()
+	}
+}
+
+// ServeConn replicates to the follower connected by conn until ctx is done or
+// the connection fails.  ServeConn closes conn before returning.
+func (p *Primary) ServeConn(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if typ != frameHello || len(payload) != 13 {
+		return errProtocol
+	}
+	pos, err := lmdbcdc.ParsePosition(payload[1:])
+	if err != nil {
+		return err
+	}
+	snapshot := payload[0] == 0
+	if !snapshot {
+		var first lmdbcdc.Position
+		err = p.env.View(func(txn *lmdb.Txn) (err error) {
+			first, err = p.log.First(txn)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		snapshot = pos.Less(first)
+	}
+	if snapshot {
+		pos, err = p.sendSnapshot(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The follower sends nothing more.  Reading detects a closed connection
+	// while the primary is idle.
+	go func() {
+		_, _ = r.ReadByte()
+		cancel()
+	}()
+
+	c := lmdbcdc.NewConsumer(p.env, p.log, pos)
+	c.PollInterval = p.PollInterval
+	for {
+		changes, err := c.Next(ctx)
+		if err != nil {
+			return err
+		}
+		for len(changes) > 0 {
+			n := 1
+			for n < len(changes) && changes[n].Pos.TxnID == changes[0].Pos.TxnID {
+				n++
+			}
+			err = writeFrame(w, frameTxn, encodeTxn(changes[:n]))
+			if err != nil {
+				return err
+			}
+			changes = changes[n:]
+		}
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendSnapshot writes a copy of the environment to w and returns the log
+// position the follower must continue from.
+func (p *Primary) sendSnapshot(w *bufio.Writer) (lmdbcdc.Position, error) {
+	var pos lmdbcdc.Position
+	err := p.env.View(func(txn *lmdb.Txn) (err error) {
+		pos, err = lastPosition(txn, p.log)
+		return err
+	})
+	if err != nil {
+		return pos, err
+	}
+	err = writeFrame(w, frameSnapshot, pos.Key())
+	if err != nil {
+		return pos, err
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return pos, err
+	}
+	defer pr.Close()
+	copyErr := make(chan error, 1)
+	go func() {
+		err := p.env.CopyFD(pw.Fd())
+		pw.Close()
+		copyErr <- err
+	}()
+
+	buf := make([]byte, snapshotChunk)
+	for {
+		n, err := pr.Read(buf)
+		if n > 0 {
+			werr := writeFrame(w, frameData, buf[:n])
+			if werr != nil {
+				// Drain the pipe so the copy can finish.
+				_, _ = io.Copy(ioutil.Discard, pr)
+				<-copyErr
+				return pos, werr
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	err = <-copyErr
+	if err != nil {
+		return pos, err
+	}
+	err = writeFrame(w, frameEnd, nil)
+	if err != nil {
+		return pos, err
+	}
+	return pos, w.Flush()
+}
+
+// lastPosition returns the position of the last entry in log, which precedes
+// every change committed after txn.
+func lastPosition(txn *lmdb.Txn, log *lmdbcdc.Log) (lmdbcdc.Position, error) {
+	cur, err := txn.OpenCursor(log.DBI)
+	if err != nil {
+		return lmdbcdc.Position{}, err
+	}
+	defer cur.Close()
+	k, _, err := cur.Get(nil, nil, lmdb.Last)
+	if lmdb.IsNotFound(err) {
+		return lmdbcdc.Position{}, nil
+	}
+	if err != nil {
+		return lmdbcdc.Position{}, err
+	}
+	return lmdbcdc.ParsePosition(k)
+}
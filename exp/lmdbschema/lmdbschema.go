@@ -0,0 +1,320 @@
+/*
+Package lmdbschema opens the named databases of an application from a single
+declaration and keeps their contents up to date with registered migrations.
+
+A Schema lists every database an application uses along with the flags it
+must have been created with.  Schema.Open creates missing databases, fails
+fast if an existing database was created with incompatible flags, and then
+runs any migrations newer than the version recorded in the environment.
+
+	schema := &lmdbschema.Schema{
+		Tables: []lmdbschema.Table{
+			{Name: "accounts"},
+			{Name: "history", Flags: lmdb.DupSort | lmdb.DupFixed},
+			{Name: "storage", Flags: lmdb.DupSort, Cmp: (*lmdb.Txn).SetDupCmpExcludeSuffix32},
+		},
+		Migrations: []lmdbschema.Migration{
+			{Version: 1, Name: "init", Fn: initAccounts},
+			{Version: 2, Name: "backfill history", Fn: backfillHistory},
+		},
+	}
+	dbis, err := schema.Open(env)
+	if err != nil {
+		// ...
+	}
+	accounts := dbis["accounts"]
+
+Each migration runs in its own Update transaction which also records the
+migration's version in the metadata database.  A migration that fails is
+rolled back and Open returns its error, leaving the environment at the version
+of the last successful migration.  The next call to Open resumes from there.
+
+The environment must allow enough named databases (see Env.SetMaxDBs) for
+every table in the schema plus the metadata database.
+*/
+package lmdbschema
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+// DefaultMetaName is the name of the database used to store schema metadata
+// when Schema.MetaName is empty.
+const DefaultMetaName = "__schema"
+
+// flagMask contains the persistent database flags that must match between a
+// Table declaration and an existing database.
+const flagMask = lmdb.ReverseKey | lmdb.DupSort | lmdb.DupFixed | lmdb.ReverseDup
+
+// keyVersion is the key in the metadata database holding the schema version
+// as a big-endian uint64.
+var keyVersion = []byte("version")
+
+// Table declares a named database in the environment.
+type Table struct {
+	// Name is the name of the database.  Name must not be empty.
+	Name string
+
+	// Flags is the set of lmdb.DupSort, lmdb.DupFixed, lmdb.ReverseKey, and
+	// lmdb.ReverseDup flags the database is created with.  Open fails if an
+	// existing database does not have exactly these flags.  The lmdb.Create
+	// flag is implied and need not be included.
+	Flags uint
+
+	// Cmp, if not nil, is called with each newly opened handle so that a
+	// custom comparison function may be installed before the database is
+	// used, for example (*lmdb.Txn).SetDupCmpExcludeSuffix32.
+	Cmp func(txn *lmdb.Txn, dbi lmdb.DBI) error
+}
+
+// Migration is a versioned change to the contents of the environment.
+type Migration struct {
+	// Version identifies the migration.  Versions must be positive and
+	// strictly increasing in Schema.Migrations.
+	Version uint64
+
+	// Name is a description of the migration used in error messages.
+	Name string
+
+	// Fn applies the migration.  The transaction passed to Fn is managed and
+	// is committed along with the new schema version only if Fn returns nil.
+	Fn func(txn *lmdb.Txn, dbis DBIs) error
+}
+
+// DBIs maps table names to their open database handles.
+type DBIs map[string]lmdb.DBI
+
+// Schema declares the tables of an environment and the migrations applied to
+// them.
+type Schema struct {
+	Tables     []Table
+	Migrations []Migration
+
+	// MetaName is the name of the database that stores the schema version.
+	// If MetaName is empty DefaultMetaName is used.
+	MetaName string
+}
+
+// IncompatibleError is returned by Schema.Open when an existing database was
+// created with flags that differ from its declaration.
+type IncompatibleError struct {
+	Table string
+	Want  uint
+	Have  uint
+}
+
+// Error implements the error interface.
+func (err *IncompatibleError) Error() string {
+	return fmt.Sprintf("lmdbschema: table %q has flags %#x (expected %#x)", err.Table, err.Have, err.Want)
+}
+
+// VersionError is returned by Schema.Open when the environment records a
+// version newer than the latest migration in the Schema, which typically
+// means the environment was written by a newer version of the application.
+type VersionError struct {
+	Stored uint64
+	Latest uint64
+}
+
+// Error implements the error interface.
+func (err *VersionError) Error() string {
+	return fmt.Sprintf("lmdbschema: stored version %d is newer than schema version %d", err.Stored, err.Latest)
+}
+
+// MigrationError is returned by Schema.Open when a migration fails.
+type MigrationError struct {
+	Migration *Migration
+	Err       error
+}
+
+// Error implements the error interface.
+func (err *MigrationError) Error() string {
+	return fmt.Sprintf("lmdbschema: migration %d (%s): %v", err.Migration.Version, err.Migration.Name, err.Err)
+}
+
+// Unwrap returns the error returned by the migration.
+func (err *MigrationError) Unwrap() error {
+	return err.Err
+}
+
+// Version returns the latest migration version in s, or zero if s has no
+// migrations.
+func (s *Schema) Version() uint64 {
+	if len(s.Migrations) == 0 {
+		return 0
+	}
+	return s.Migrations[len(s.Migrations)-1].Version
+}
+
+func (s *Schema) metaName() string {
+	if s.MetaName == "" {
+		return DefaultMetaName
+	}
+	return s.MetaName
+}
+
+// Validate returns an error if s is not a well-formed declaration.  Validate
+// is called by Open and does not need to be called separately.
+func (s *Schema) Validate() error {
+	names := make(map[string]bool, len(s.Tables))
+	for _, t := range s.Tables {
+		if t.Name == "" {
+			return fmt.Errorf("lmdbschema: table name is empty")
+		}
+		if t.Name == s.metaName() {
+			return fmt.Errorf("lmdbschema: table %q conflicts with the metadata database", t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("lmdbschema: table %q declared more than once", t.Name)
+		}
+		names[t.Name] = true
+		if t.Flags&^(flagMask|lmdb.Create) != 0 {
+			return fmt.Errorf("lmdbschema: table %q has unsupported flags %#x", t.Name, t.Flags&^(flagMask|lmdb.Create))
+		}
+		if t.Flags&(lmdb.DupFixed|lmdb.ReverseDup) != 0 && t.Flags&lmdb.DupSort == 0 {
+			return fmt.Errorf("lmdbschema: table %q requires lmdb.DupSort", t.Name)
+		}
+	}
+	var prev uint64
+	for i := range s.Migrations {
+		m := &s.Migrations[i]
+		if m.Fn == nil {
+			return fmt.Errorf("lmdbschema: migration %d (%s) has no function", m.Version, m.Name)
+		}
+		if m.Version <= prev {
+			return fmt.Errorf("lmdbschema: migration %d (%s) is out of order", m.Version, m.Name)
+		}
+		prev = m.Version
+	}
+	return nil
+}
+
+// Open opens every table in s, creating those that do not exist, and applies
+// all migrations with a version greater than the one stored in env.  Open
+// returns the handles for all tables in s, keyed by table name.
+//
+// Open returns an *IncompatibleError if a table exists with different flags
+// and a *VersionError if env was migrated beyond the latest version known to
+// s.  A failed migration is reported as a *MigrationError.
+func (s *Schema) Open(env *lmdb.Env) (DBIs, error) {
+	err := s.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	dbis := make(DBIs, len(s.Tables))
+	var meta lmdb.DBI
+	var version uint64
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		meta, err = txn.OpenDBI(s.metaName(), lmdb.Create)
+		if err != nil {
+			return err
+		}
+		version, err = getVersion(txn, meta)
+		if err != nil {
+			return err
+		}
+		if version > s.Version() {
+			return &VersionError{Stored: version, Latest: s.Version()}
+		}
+		for _, t := range s.Tables {
+			dbis[t.Name], err = openTable(txn, &t)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range s.Migrations {
+		m := &s.Migrations[i]
+		if m.Version <= version {
+			continue
+		}
+		err = env.Update(func(txn *lmdb.Txn) (err error) {
+			err = m.Fn(txn, dbis)
+			if err != nil {
+				return &MigrationError{Migration: m, Err: err}
+			}
+			return putVersion(txn, meta, m.Version)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dbis, nil
+}
+
+// StoredVersion returns the schema version recorded in env, or zero if no
+// migration has been applied.
+func (s *Schema) StoredVersion(env *lmdb.Env) (uint64, error) {
+	var version uint64
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		meta, err := txn.OpenDBI(s.metaName(), 0)
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		version, err = getVersion(txn, meta)
+		return err
+	})
+	return version, err
+}
+
+func openTable(txn *lmdb.Txn, t *Table) (lmdb.DBI, error) {
+	dbi, err := txn.OpenDBI(t.Name, t.Flags|lmdb.Create)
+	if err != nil {
+		return 0, err
+	}
+
+	// LMDB silently adopts the flags of an existing database.  So they must be
+	// checked after the database is opened.
+	have, err := txn.Flags(dbi)
+	if err != nil {
+		return 0, err
+	}
+	if have&flagMask != t.Flags&flagMask {
+		return 0, &IncompatibleError{
+			Table: t.Name,
+			Want:  t.Flags & flagMask,
+			Have:  have & flagMask,
+		}
+	}
+
+	if t.Cmp != nil {
+		err = t.Cmp(txn, dbi)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return dbi, nil
+}
+
+func getVersion(txn *lmdb.Txn, meta lmdb.DBI) (uint64, error) {
+	v, err := txn.Get(meta, keyVersion)
+	if lmdb.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 8 {
+		return 0, fmt.Errorf("lmdbschema: malformed version (%d bytes)", len(v))
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+func putVersion(txn *lmdb.Txn, meta lmdb.DBI, version uint64) error {
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], version)
+	return txn.Put(meta, keyVersion, v[:], 0)
+}
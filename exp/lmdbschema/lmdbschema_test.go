@@ -0,0 +1,170 @@
+package lmdbschema
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+func TestSchema_Open(t *testing.T) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+
+	var calls []uint64
+	migration := func(version uint64) func(*lmdb.Txn, DBIs) error {
+		return func(txn *lmdb.Txn, dbis DBIs) error {
+			calls = append(calls, version)
+			return txn.Put(dbis["a"], []byte{byte(version)}, []byte("x"), 0)
+		}
+	}
+	schema := &Schema{
+		Tables: []Table{
+			{Name: "a"},
+			{Name: "b", Flags: lmdb.DupSort | lmdb.DupFixed},
+		},
+		Migrations: []Migration{
+			{Version: 1, Name: "one", Fn: migration(1)},
+			{Version: 2, Name: "two", Fn: migration(2)},
+		},
+	}
+	dbis, err := schema.Open(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbis) != 2 {
+		t.Errorf("unexpected dbis: %v", dbis)
+	}
+	if len(calls) != 2 || calls[0] != 1 || calls[1] != 2 {
+		t.Errorf("unexpected migrations: %v", calls)
+	}
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		flags, err := txn.Flags(dbis["b"])
+		if err != nil {
+			return err
+		}
+		if flags&flagMask != lmdb.DupSort|lmdb.DupFixed {
+			t.Errorf("unexpected flags: %#x", flags)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Opening again is a no-op and adding a migration only runs the new one.
+	calls = nil
+	schema.Migrations = append(schema.Migrations, Migration{Version: 5, Name: "five", Fn: migration(5)})
+	_, err = schema.Open(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != 5 {
+		t.Errorf("unexpected migrations: %v", calls)
+	}
+	version, err := schema.StoredVersion(env)
+	if err != nil {
+		t.Error(err)
+	}
+	if version != 5 {
+		t.Errorf("unexpected version: %d (!= 5)", version)
+	}
+
+	// A schema that knows fewer migrations than were applied must fail.
+	old := &Schema{Tables: schema.Tables, Migrations: schema.Migrations[:2]}
+	_, err = old.Open(env)
+	if _, ok := err.(*VersionError); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSchema_Open_incompatible(t *testing.T) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+
+	_, err = (&Schema{Tables: []Table{{Name: "a", Flags: lmdb.DupSort}}}).Open(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&Schema{Tables: []Table{{Name: "a"}}}).Open(env)
+	if err, ok := err.(*IncompatibleError); !ok {
+		t.Errorf("unexpected error: %v", err)
+	} else if err.Table != "a" || err.Have != lmdb.DupSort || err.Want != 0 {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestSchema_Open_migrationFailed(t *testing.T) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+
+	errFail := errors.New("fail")
+	schema := &Schema{
+		Tables: []Table{{Name: "a"}},
+		Migrations: []Migration{
+			{Version: 1, Name: "ok", Fn: func(txn *lmdb.Txn, dbis DBIs) error {
+				return txn.Put(dbis["a"], []byte("k1"), []byte("v"), 0)
+			}},
+			{Version: 2, Name: "fail", Fn: func(txn *lmdb.Txn, dbis DBIs) error {
+				err := txn.Put(dbis["a"], []byte("k2"), []byte("v"), 0)
+				if err != nil {
+					return err
+				}
+				return errFail
+			}},
+		},
+	}
+	dbis, err := schema.Open(env)
+	if !errors.Is(err, errFail) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	version, err := schema.StoredVersion(env)
+	if err != nil {
+		t.Error(err)
+	}
+	if version != 1 {
+		t.Errorf("unexpected version: %d (!= 1)", version)
+	}
+	if dbis != nil {
+		t.Errorf("unexpected dbis: %v", dbis)
+	}
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		dbi, err := txn.OpenDBI("a", 0)
+		if err != nil {
+			return err
+		}
+		_, err = txn.Get(dbi, []byte("k2"))
+		if !lmdb.IsNotFound(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchema_Validate(t *testing.T) {
+	for i, s := range []*Schema{
+		{Tables: []Table{{Name: ""}}},
+		{Tables: []Table{{Name: "a"}, {Name: "a"}}},
+		{Tables: []Table{{Name: DefaultMetaName}}},
+		{Tables: []Table{{Name: "a", Flags: lmdb.DupFixed}}},
+		{Migrations: []Migration{{Version: 0, Fn: func(*lmdb.Txn, DBIs) error { return nil }}}},
+		{Migrations: []Migration{{Version: 1}}},
+	} {
+		if s.Validate() == nil {
+			t.Errorf("schema %d: expected error", i)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Package lmdbseq provides sequences and counters stored in an LMDB database.
+
+A DB stores named Sequence and Counter values in a dedicated database.  All
+changes are made in update transactions, so they are safe across goroutines
+and across processes which share the environment.
+
+A Sequence generates unique IDs, starting at 1.  To avoid a write transaction
+for every ID, a Sequence leases a block of IDs at a time and hands them out
+from memory.
+
+	db, err := lmdbseq.New(env, "sequences")
+	ids := db.Sequence("users", 100)
+	id, err := ids.Next()
+
+IDs leased by a Sequence which are not handed out before the process exits
+are never used, so sequences may have gaps.  Processes sharing a sequence
+lease disjoint blocks, so IDs are unique but only increase within a single
+Sequence.  Reserve allocates IDs inside a caller's transaction, bypassing the
+lease, when the allocation must commit or roll back with other writes.
+
+A Counter is a signed 64-bit integer modified within a caller's transaction.
+
+	views := db.Counter("views")
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		_, err = views.Add(txn, 1)
+		return err
+	})
+*/
+package lmdbseq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+var (
+	// ErrOverflow is returned when a Sequence or Counter would overflow.
+	ErrOverflow = errors.New("lmdbseq: overflow")
+
+	// ErrCorrupt is returned (possibly wrapped) when a stored value is not
+	// a 64-bit integer.
+	ErrCorrupt = errors.New("lmdbseq: corrupt value")
+)
+
+// Key prefixes which separate sequences from counters of the same name.
+const (
+	prefixSequence byte = 's'
+	prefixCounter  byte = 'c'
+)
+
+// DB stores sequences and counters in a database.
+type DB struct {
+	env *lmdb.Env
+	dbi lmdb.DBI
+}
+
+// New returns a DB stored in the database named name, which is created if it
+// does not exist.  The database should not be used for anything else.
+func New(env *lmdb.Env, name string) (*DB, error) {
+	db := &DB{env: env}
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		db.dbi, err = txn.OpenDBI(name, lmdb.Create)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *DB) key(prefix byte, name string) []byte {
+	b := make([]byte, 1+len(name))
+	b[0] = prefix
+	copy(b[1:], name)
+	return b
+}
+
+// get returns the integer stored under key, or zero if key is not present.
+func (db *DB) get(txn *lmdb.Txn, key []byte) (uint64, error) {
+	b, err := txn.Get(db.dbi, key)
+	if lmdb.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("%w: key %q", ErrCorrupt, key[1:])
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (db *DB) put(txn *lmdb.Txn, key []byte, v uint64) error {
+	b, err := txn.PutReserve(db.dbi, key, 8, 0)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(b, v)
+	return nil
+}
+
+// Sequence generates unique IDs.  A Sequence may be used concurrently from
+// multiple goroutines.
+type Sequence struct {
+	db    *DB
+	key   []byte
+	lease uint64
+
+	mu    sync.Mutex
+	next  uint64 // next leased ID
+	limit uint64 // end of the lease
+}
+
+// Sequence returns the sequence called name, which leases lease IDs at a
+// time.  A lease less than 1 is treated as 1, in which case every ID is
+// allocated in its own transaction.
+func (db *DB) Sequence(name string, lease int) *Sequence {
+	if lease < 1 {
+		lease = 1
+	}
+	return &Sequence{
+		db:    db,
+		key:   db.key(prefixSequence, name),
+		lease: uint64(lease),
+	}
+}
+
+// Next returns the next ID.  Next makes an update transaction when the lease
+// is exhausted, so it must not be called by a goroutine which has an update
+// transaction open.
+func (s *Sequence) Next() (uint64, error) {
+	return s.NextN(1)
+}
+
+// NextN allocates n consecutive IDs and returns the first.  IDs are taken
+// from the lease if it holds enough of them.  Otherwise a new lease is taken,
+// or if n is larger than the lease the IDs are allocated directly, in an
+// update transaction.
+func (s *Sequence) NextN(n int) (uint64, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("lmdbseq: invalid number of IDs: %d", n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uint64(n) <= s.limit-s.next {
+		first := s.next
+		s.next += uint64(n)
+		return first, nil
+	}
+
+	size := uint64(n)
+	if size < s.lease {
+		size = s.lease
+	}
+	var first uint64
+	err := s.db.env.Update(func(txn *lmdb.Txn) (err error) {
+		first, err = s.Reserve(txn, size)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if size > uint64(n) {
+		s.next, s.limit = first+uint64(n), first+size
+	}
+	return first, nil
+}
+
+// Reserve allocates n consecutive IDs in txn and returns the first.  Reserve
+// does not use the lease, and the IDs are only allocated if txn commits.
+func (s *Sequence) Reserve(txn *lmdb.Txn, n uint64) (uint64, error) {
+	next, err := s.db.get(txn, s.key)
+	if err != nil {
+		return 0, err
+	}
+	if next == 0 {
+		next = 1
+	}
+	if n > math.MaxUint64-next {
+		return 0, ErrOverflow
+	}
+	err = s.db.put(txn, s.key, next+n)
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// Current returns the last ID allocated in the database, or zero if none has
+// been.  Every ID handed out so far is less than or equal to Current, though
+// IDs near it may still be held in the leases of Sequence values.
+func (s *Sequence) Current(txn *lmdb.Txn) (uint64, error) {
+	next, err := s.db.get(txn, s.key)
+	if next == 0 || err != nil {
+		return 0, err
+	}
+	return next - 1, nil
+}
+
+// Counter is a signed 64-bit integer.
+type Counter struct {
+	db  *DB
+	key []byte
+}
+
+// Counter returns the counter called name.
+func (db *DB) Counter(name string) *Counter {
+	return &Counter{db: db, key: db.key(prefixCounter, name)}
+}
+
+// Add adds delta to the counter and returns the new value.  Add returns
+// ErrOverflow if the result does not fit in an int64.
+func (c *Counter) Add(txn *lmdb.Txn, delta int64) (int64, error) {
+	v, err := c.Get(txn)
+	if err != nil {
+		return 0, err
+	}
+	if (delta > 0 && v > math.MaxInt64-delta) || (delta < 0 && v < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	v += delta
+	return v, c.db.put(txn, c.key, uint64(v))
+}
+
+// Get returns the value of the counter, which is zero if it has not been
+// modified.
+func (c *Counter) Get(txn *lmdb.Txn) (int64, error) {
+	v, err := c.db.get(txn, c.key)
+	return int64(v), err
+}
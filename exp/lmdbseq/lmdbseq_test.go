@@ -0,0 +1,292 @@
+package lmdbseq
+
+import (
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+func newTestDB(t *testing.T) (*lmdb.Env, *DB) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := New(env, "seq")
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	return env, db
+}
+
+func current(t *testing.T, env *lmdb.Env, s *Sequence) uint64 {
+	var cur uint64
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		cur, err = s.Current(txn)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cur
+}
+
+func TestSequence(t *testing.T) {
+	env, db := newTestDB(t)
+	defer lmdbtest.Destroy(env)
+
+	s := db.Sequence("ids", 10)
+	if cur := current(t, env, s); cur != 0 {
+		t.Errorf("current: %d", cur)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		id, err := s.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != i {
+			t.Errorf("id: %d (!= %d)", id, i)
+		}
+	}
+	// The first lease covers IDs 1 through 10.
+	if cur := current(t, env, s); cur != 10 {
+		t.Errorf("current: %d", cur)
+	}
+
+	for _, test := range []struct {
+		n       int
+		first   uint64
+		current uint64
+	}{
+		{5, 4, 10},   // From the lease.
+		{5, 11, 20},  // From a new lease, leaving 9 and 10 unused.
+		{25, 21, 45}, // Larger than the lease, which is kept.
+		{5, 16, 45},
+	} {
+		first, err := s.NextN(test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != test.first {
+			t.Errorf("NextN(%d): %d (!= %d)", test.n, first, test.first)
+		}
+		if cur := current(t, env, s); cur != test.current {
+			t.Errorf("NextN(%d): current %d (!= %d)", test.n, cur, test.current)
+		}
+	}
+	_, err := s.NextN(0)
+	if err == nil {
+		t.Errorf("NextN(0): expected error")
+	}
+
+	// Sequences of different names are independent.
+	id, err := db.Sequence("other", 1).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Errorf("other: %d", id)
+	}
+
+	// Reserve rolls back with its transaction.
+	rollback := errors.New("rollback")
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		first, err := s.Reserve(txn, 100)
+		if err != nil {
+			return err
+		}
+		if first != 46 {
+			t.Errorf("reserve: %d", first)
+		}
+		return rollback
+	})
+	if err != rollback {
+		t.Fatal(err)
+	}
+	if cur := current(t, env, s); cur != 45 {
+		t.Errorf("current: %d", cur)
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		err = txn.Drop(db.dbi, false)
+		if err != nil {
+			return err
+		}
+		_, err = s.Reserve(txn, math.MaxUint64-1)
+		if err != nil {
+			return err
+		}
+		_, err = s.Reserve(txn, 1)
+		if err != ErrOverflow {
+			t.Errorf("reserve: unexpected error: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSequence_concurrent(t *testing.T) {
+	env, db := newTestDB(t)
+	defer lmdbtest.Destroy(env)
+
+	// Each Sequence stands in for a separate process.
+	const n = 500
+	seqs := []*Sequence{
+		db.Sequence("ids", 7),
+		db.Sequence("ids", 7),
+		db.Sequence("ids", 1),
+	}
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 2*len(seqs); i++ {
+		s := seqs[i%len(seqs)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				id, err := s.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("duplicate id: %d", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 2*len(seqs)*n {
+		t.Errorf("%d ids", len(seen))
+	}
+}
+
+func TestSequence_reopen(t *testing.T) {
+	env, db := newTestDB(t)
+	path, err := env.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	_, err = db.Sequence("ids", 10).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Close()
+
+	env, err = lmdb.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	err = env.SetMaxDBs(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Open(path, 0, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = New(env, "seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The unused part of the first lease is skipped.
+	id, err := db.Sequence("ids", 10).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 11 {
+		t.Errorf("id: %d", id)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	env, db := newTestDB(t)
+	defer lmdbtest.Destroy(env)
+
+	c := db.Counter("hits")
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		for _, delta := range []int64{5, -7, 3} {
+			_, err = c.Add(txn, delta)
+			if err != nil {
+				return err
+			}
+		}
+		// A sequence of the same name does not share the value.
+		_, err = db.Sequence("hits", 1).Reserve(txn, 1000)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				err := env.Update(func(txn *lmdb.Txn) (err error) {
+					_, err = c.Add(txn, 1)
+					return err
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		v, err := c.Get(txn)
+		if err != nil {
+			return err
+		}
+		if v != 201 {
+			t.Errorf("value: %d", v)
+		}
+		v, err = db.Counter("none").Get(txn)
+		if v != 0 || err != nil {
+			t.Errorf("unset counter: %d %v", v, err)
+		}
+
+		_, err = c.Add(txn, math.MaxInt64-201)
+		if err != nil {
+			return err
+		}
+		_, err = c.Add(txn, 1)
+		if err != ErrOverflow {
+			t.Errorf("overflow: unexpected error: %v", err)
+		}
+		v, err = c.Add(txn, math.MinInt64)
+		if err != nil {
+			return err
+		}
+		if v != -1 {
+			t.Errorf("value: %d", v)
+		}
+		_, err = c.Add(txn, math.MinInt64)
+		if err != ErrOverflow {
+			t.Errorf("underflow: unexpected error: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
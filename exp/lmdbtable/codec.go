@@ -0,0 +1,137 @@
+package lmdbtable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec converts values of type T to and from their database representation.
+//
+// Decode may be passed memory owned by LMDB when the lmdb.Txn has RawRead
+// set.  Codecs which produce values that reference b (such as Bytes) hand that
+// memory directly to the caller, and the value is only valid until the
+// transaction terminates, as with lmdb.Txn.Get.  Codecs that build a new value
+// from b avoid a copy entirely in that case.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(b []byte) (T, error)
+}
+
+// Order-preserving codecs for integer types.  Encoded values sort in the same
+// order as the integers they represent, which makes them suitable for keys.
+// Signed integers are stored with their sign bit flipped.
+var (
+	Uint64 Codec[uint64] = uint64Codec{}
+	Uint32 Codec[uint32] = uint32Codec{}
+	Int64  Codec[int64]  = int64Codec{}
+)
+
+// String is a Codec for strings that stores their bytes verbatim.
+var String Codec[string] = stringCodec{}
+
+// Bytes is a Codec for []byte that stores values verbatim.  Decoded values
+// reference the bytes passed to Decode without a copy.
+var Bytes Codec[[]byte] = bytesCodec{}
+
+// JSON returns a Codec that stores values of type T using encoding/json.
+func JSON[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+// Gob returns a Codec that stores values of type T using encoding/gob.  Each
+// value is encoded independently so type information is repeated in every
+// database item.
+func Gob[T any]() Codec[T] {
+	return gobCodec[T]{}
+}
+
+func sizeError(name string, want, have int) error {
+	return fmt.Errorf("lmdbtable: %s value has %d bytes (expected %d)", name, have, want)
+}
+
+type uint64Codec struct{}
+
+func (uint64Codec) Encode(v uint64) ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b, nil
+}
+
+func (uint64Codec) Decode(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, sizeError("uint64", 8, len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+type uint32Codec struct{}
+
+func (uint32Codec) Encode(v uint32) ([]byte, error) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b, nil
+}
+
+func (uint32Codec) Decode(b []byte) (uint32, error) {
+	if len(b) != 4 {
+		return 0, sizeError("uint32", 4, len(b))
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+type int64Codec struct{}
+
+func (int64Codec) Encode(v int64) ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v)^1<<63)
+	return b, nil
+}
+
+func (int64Codec) Decode(b []byte) (int64, error) {
+	if len(b) != 8 {
+		return 0, sizeError("int64", 8, len(b))
+	}
+	return int64(binary.BigEndian.Uint64(b) ^ 1<<63), nil
+}
+
+type stringCodec struct{}
+
+func (stringCodec) Encode(v string) ([]byte, error) { return []byte(v), nil }
+func (stringCodec) Decode(b []byte) (string, error) { return string(b), nil }
+
+type bytesCodec struct{}
+
+func (bytesCodec) Encode(v []byte) ([]byte, error) { return v, nil }
+func (bytesCodec) Decode(b []byte) ([]byte, error) { return b, nil }
+
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+type gobCodec[T any] struct{}
+
+func (gobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
@@ -0,0 +1,200 @@
+/*
+Package lmdbtable provides a typed view of an LMDB database.  A Table
+encodes keys and values with a pair of Codecs so that callers work with Go
+values instead of raw []byte inside ordinary lmdb.Txn transactions.
+
+	accounts := lmdbtable.New(dbi, lmdbtable.Uint64, lmdbtable.JSON[Account]())
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		return accounts.Put(txn, 42, Account{Name: "alice"}, 0)
+	})
+
+Range iteration is provided by Iter, which wraps an lmdbscan.Scanner and
+decodes items as they are scanned.  Iteration order is the order of encoded
+keys so only order-preserving key codecs (Uint64, Int64, String, etc) give
+meaningful ranges.
+
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		it := accounts.Range(txn, 10, 20)
+		defer it.Close()
+		for it.Next() {
+			log.Printf("%d: %v", it.Key(), it.Val())
+		}
+		return it.Err()
+	})
+
+When the transaction has RawRead set values are decoded directly from the
+memory map without an intermediate copy.
+*/
+package lmdbtable
+
+import (
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+// Table is a database whose keys and values have types K and V.
+type Table[K, V any] struct {
+	DBI lmdb.DBI
+	Key Codec[K]
+	Val Codec[V]
+}
+
+// New returns a Table for dbi that encodes items using the given codecs.
+func New[K, V any](dbi lmdb.DBI, key Codec[K], val Codec[V]) *Table[K, V] {
+	return &Table[K, V]{
+		DBI: dbi,
+		Key: key,
+		Val: val,
+	}
+}
+
+// Get returns the value stored under k.  Get returns an error satisfying
+// lmdb.IsNotFound if k is not present.
+func (t *Table[K, V]) Get(txn *lmdb.Txn, k K) (V, error) {
+	var v V
+	kb, err := t.Key.Encode(k)
+	if err != nil {
+		return v, err
+	}
+	vb, err := txn.Get(t.DBI, kb)
+	if err != nil {
+		return v, err
+	}
+	return t.Val.Decode(vb)
+}
+
+// Has returns true if k is present in the table.
+func (t *Table[K, V]) Has(txn *lmdb.Txn, k K) (bool, error) {
+	kb, err := t.Key.Encode(k)
+	if err != nil {
+		return false, err
+	}
+	_, err = txn.Get(t.DBI, kb)
+	if lmdb.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put stores v under k.  The flags are passed to lmdb.Txn.Put.
+func (t *Table[K, V]) Put(txn *lmdb.Txn, k K, v V, flags uint) error {
+	kb, err := t.Key.Encode(k)
+	if err != nil {
+		return err
+	}
+	vb, err := t.Val.Encode(v)
+	if err != nil {
+		return err
+	}
+	return txn.Put(t.DBI, kb, vb, flags)
+}
+
+// Delete removes k from the table.  Delete returns an error satisfying
+// lmdb.IsNotFound if k is not present.
+func (t *Table[K, V]) Delete(txn *lmdb.Txn, k K) error {
+	kb, err := t.Key.Encode(k)
+	if err != nil {
+		return err
+	}
+	return txn.Del(t.DBI, kb, nil)
+}
+
+// Scan returns an Iter over every item in the table.
+func (t *Table[K, V]) Scan(txn *lmdb.Txn) *Iter[K, V] {
+	return t.iter(txn, nil, nil, false)
+}
+
+// Seek returns an Iter over the items with keys greater than or equal to
+// start.
+func (t *Table[K, V]) Seek(txn *lmdb.Txn, start K) *Iter[K, V] {
+	kb, err := t.Key.Encode(start)
+	if err != nil {
+		return &Iter[K, V]{err: err}
+	}
+	return t.iter(txn, kb, nil, false)
+}
+
+// Range returns an Iter over the items with keys in the half-open interval
+// [start, end).  Keys are compared with lmdb.Txn.Cmp so custom comparison
+// functions are respected.
+func (t *Table[K, V]) Range(txn *lmdb.Txn, start, end K) *Iter[K, V] {
+	kstart, err := t.Key.Encode(start)
+	if err != nil {
+		return &Iter[K, V]{err: err}
+	}
+	kend, err := t.Key.Encode(end)
+	if err != nil {
+		return &Iter[K, V]{err: err}
+	}
+	return t.iter(txn, kstart, kend, true)
+}
+
+func (t *Table[K, V]) iter(txn *lmdb.Txn, start, end []byte, bounded bool) *Iter[K, V] {
+	it := &Iter[K, V]{
+		t:       t,
+		txn:     txn,
+		s:       lmdbscan.New(txn, t.DBI),
+		end:     end,
+		bounded: bounded,
+	}
+	if start != nil {
+		it.s.SetNext(start, nil, lmdb.SetRange, lmdb.Next)
+	}
+	return it
+}
+
+// Iter decodes the items produced by an lmdbscan.Scanner.  An Iter must be
+// closed when it is no longer needed.
+type Iter[K, V any] struct {
+	t       *Table[K, V]
+	txn     *lmdb.Txn
+	s       *lmdbscan.Scanner
+	end     []byte
+	bounded bool
+	key     K
+	val     V
+	err     error
+}
+
+// Next advances the iterator and decodes the next item.  Next returns false
+// when the items are exhausted or when an error is encountered.
+func (it *Iter[K, V]) Next() bool {
+	if it.err != nil || it.s == nil {
+		return false
+	}
+	if !it.s.Scan() {
+		it.err = it.s.Err()
+		return false
+	}
+	if it.bounded && it.txn.Cmp(it.t.DBI, it.s.Key(), it.end) >= 0 {
+		return false
+	}
+	it.key, it.err = it.t.Key.Decode(it.s.Key())
+	if it.err != nil {
+		return false
+	}
+	it.val, it.err = it.t.Val.Decode(it.s.Val())
+	return it.err == nil
+}
+
+// Key returns the key decoded by the last call to Next.
+func (it *Iter[K, V]) Key() K {
+	return it.key
+}
+
+// Val returns the value decoded by the last call to Next.
+func (it *Iter[K, V]) Val() V {
+	return it.val
+}
+
+// Err returns the error that terminated iteration, if any.
+func (it *Iter[K, V]) Err() error {
+	return it.err
+}
+
+// Close releases the cursor used by it.
+func (it *Iter[K, V]) Close() {
+	if it.s != nil {
+		it.s.Close()
+	}
+}
@@ -0,0 +1,196 @@
+package lmdbtable
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+)
+
+type record struct {
+	Name  string
+	Score int
+}
+
+func TestTable(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := New(dbi, Int64, JSON[record]())
+	keys := []int64{-100, -1, 0, 1, 7, 100, math.MaxInt64, math.MinInt64}
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		for _, k := range keys {
+			err = table.Put(txn, k, record{Name: "r", Score: int(k % 1000)}, 0)
+			if err != nil {
+				return err
+			}
+		}
+		return table.Delete(txn, 7)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		rec, err := table.Get(txn, -100)
+		if err != nil {
+			return err
+		}
+		if rec.Score != -100 {
+			t.Errorf("unexpected record: %v", rec)
+		}
+		ok, err := table.Has(txn, 7)
+		if err != nil {
+			return err
+		}
+		if ok {
+			t.Errorf("deleted key is present")
+		}
+		_, err = table.Get(txn, 7)
+		if !lmdb.IsNotFound(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		var scanned []int64
+		it := table.Scan(txn)
+		defer it.Close()
+		for it.Next() {
+			scanned = append(scanned, it.Key())
+		}
+		if it.Err() != nil {
+			return it.Err()
+		}
+		expect := []int64{math.MinInt64, -100, -1, 0, 1, 100, math.MaxInt64}
+		if !reflect.DeepEqual(scanned, expect) {
+			t.Errorf("unexpected scan: %v (!= %v)", scanned, expect)
+		}
+
+		scanned = nil
+		rit := table.Range(txn, -1, 100)
+		defer rit.Close()
+		for rit.Next() {
+			scanned = append(scanned, rit.Key())
+		}
+		if rit.Err() != nil {
+			return rit.Err()
+		}
+		expect = []int64{-1, 0, 1}
+		if !reflect.DeepEqual(scanned, expect) {
+			t.Errorf("unexpected range: %v (!= %v)", scanned, expect)
+		}
+
+		scanned = nil
+		sit := table.Seek(txn, 2)
+		defer sit.Close()
+		for sit.Next() {
+			scanned = append(scanned, sit.Key())
+		}
+		expect = []int64{100, math.MaxInt64}
+		if !reflect.DeepEqual(scanned, expect) {
+			t.Errorf("unexpected seek: %v (!= %v)", scanned, expect)
+		}
+		return sit.Err()
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTable_rawRead(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := New(dbi, String, Bytes)
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		return table.Put(txn, "k", []byte("value"), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v1, v2 []byte
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		txn.RawRead = true
+		v1, err = table.Get(txn, "k")
+		if err != nil {
+			return err
+		}
+		v2, err = table.Get(txn, "k")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both values reference the same location in the memory map.
+	if &v1[0] != &v2[0] {
+		t.Errorf("values were copied with RawRead")
+	}
+}
+
+func TestCodec_order(t *testing.T) {
+	u64 := []uint64{0, 1, 255, 256, 1 << 32, math.MaxUint64}
+	checkOrder(t, "uint64", len(u64), func(i int) ([]byte, error) { return Uint64.Encode(u64[i]) })
+	u32 := []uint32{0, 1, 255, 256, math.MaxUint32}
+	checkOrder(t, "uint32", len(u32), func(i int) ([]byte, error) { return Uint32.Encode(u32[i]) })
+	i64 := []int64{math.MinInt64, -256, -1, 0, 1, 256, math.MaxInt64}
+	checkOrder(t, "int64", len(i64), func(i int) ([]byte, error) { return Int64.Encode(i64[i]) })
+
+	for _, v := range i64 {
+		b, _ := Int64.Encode(v)
+		w, err := Int64.Decode(b)
+		if err != nil || w != v {
+			t.Errorf("int64 round trip: %d (!= %d) %v", w, v, err)
+		}
+	}
+	_, err := Uint64.Decode([]byte{1, 2, 3})
+	if err == nil {
+		t.Errorf("expected size error")
+	}
+}
+
+func checkOrder(t *testing.T, name string, n int, enc func(i int) ([]byte, error)) {
+	var encoded [][]byte
+	for i := 0; i < n; i++ {
+		b, err := enc(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, b)
+	}
+	if !sort.SliceIsSorted(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 }) {
+		t.Errorf("%s encoding does not preserve order", name)
+	}
+}
+
+func TestCodec_gob(t *testing.T) {
+	c := Gob[record]()
+	b, err := c.Encode(record{Name: "x", Score: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "x" || r.Score != 3 {
+		t.Errorf("unexpected record: %v", r)
+	}
+}
@@ -0,0 +1,491 @@
+/*
+Package lmdbttl stores values which expire.
+
+A DB stores each value in a data database with its expiry time, and indexes
+entries which expire in a second database ordered by expiry time.  Reads made
+through the DB hide expired entries as though they had been deleted.
+
+	cache, err := lmdbttl.New(env, "cache", "cache.expiry", &lmdbttl.Options{
+		Interval: time.Minute,
+	})
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		return cache.Put(txn, key, val, time.Now().Add(time.Hour))
+	})
+
+Expired entries remain in the databases until they are swept.  Sweep deletes
+them in a series of update transactions, each deleting at most
+Options.BatchSize entries, so that sweeping a large backlog neither fails with
+lmdb.TxnFull nor holds the write lock for long.  Run sweeps periodically until
+its context is done and is typically started in its own goroutine.
+
+	go cache.Run(ctx)
+
+Expiry is measured with the wall clock.  Values read through the DB refer to
+memory owned by LMDB and, like values returned by lmdb.Txn.Get, must not be
+used after the transaction terminates.
+*/
+package lmdbttl
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+const (
+	// DefaultBatchSize is used when Options.BatchSize is zero.
+	DefaultBatchSize = 1000
+
+	// DefaultInterval is used when Options.Interval is zero.
+	DefaultInterval = time.Minute
+)
+
+// ErrCorrupt is returned (possibly wrapped) when a stored value has no
+// expiry header.
+var ErrCorrupt = errors.New("lmdbttl: corrupt value")
+
+// Options configures a DB.
+type Options struct {
+	// BatchSize is the maximum number of entries deleted in each update
+	// transaction made by Sweep.
+	BatchSize int
+
+	// Interval is the time Run waits between sweeps.
+	Interval time.Duration
+
+	// Now returns the current time.  If Now is nil time.Now is used.
+	Now func() time.Time
+}
+
+// Metrics describes the sweeping done by a DB since it was created.
+type Metrics struct {
+	Sweeps       uint64        // Completed calls to Sweep, including those made by Run.
+	Errors       uint64        // Calls to Sweep which failed.
+	Txns         uint64        // Update transactions committed by Sweep.
+	Expired      uint64        // Entries deleted by Sweep.
+	LastSweep    time.Time     // Start of the last completed sweep.
+	LastDuration time.Duration // Duration of the last completed sweep.
+	LastExpired  int           // Entries deleted by the last completed sweep.
+}
+
+// headerLen is the length of the expiry time which precedes stored values.
+const headerLen = 8
+
+// DB is a database of values which expire.  A DB may be used concurrently
+// from multiple goroutines.
+type DB struct {
+	env      *lmdb.Env
+	data     lmdb.DBI
+	expiry   lmdb.DBI
+	batch    int
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	metrics Metrics
+}
+
+// New returns a DB stored in the databases named data and expiry, which are
+// created if they do not exist.  If opt is nil default options are used.
+func New(env *lmdb.Env, data, expiry string, opt *Options) (*DB, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	if data == expiry {
+		return nil, fmt.Errorf("lmdbttl: data and expiry databases must differ")
+	}
+	db := &DB{
+		env:      env,
+		batch:    opt.BatchSize,
+		interval: opt.Interval,
+		now:      opt.Now,
+	}
+	if db.batch <= 0 {
+		db.batch = DefaultBatchSize
+	}
+	if db.interval <= 0 {
+		db.interval = DefaultInterval
+	}
+	if db.now == nil {
+		db.now = time.Now
+	}
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		db.data, err = txn.OpenDBI(data, lmdb.Create)
+		if err != nil {
+			return err
+		}
+		db.expiry, err = txn.OpenDBI(expiry, lmdb.Create)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// encodeTime returns the stored form of t.  The zero Time, meaning no expiry,
+// is stored as zero and times which cannot be represented are clamped.
+func encodeTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	n := t.UnixNano()
+	if n < 1 || t.Year() < 1970 {
+		return 1
+	}
+	if t.Year() > 2200 {
+		return 1<<63 - 1
+	}
+	return uint64(n)
+}
+
+func decodeTime(n uint64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(n))
+}
+
+func expiryKey(exp uint64, key []byte) []byte {
+	b := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(b, exp)
+	copy(b[8:], key)
+	return b
+}
+
+func decode(key, b []byte) (exp uint64, val []byte, err error) {
+	if len(b) < headerLen {
+		return 0, nil, fmt.Errorf("%w: key %q", ErrCorrupt, key)
+	}
+	return binary.BigEndian.Uint64(b), b[headerLen:], nil
+}
+
+func (db *DB) expired(exp uint64) bool {
+	return exp != 0 && exp <= encodeTime(db.now())
+}
+
+func notFound() error {
+	return &lmdb.OpError{Op: "mdb_get", Errno: lmdb.NotFound}
+}
+
+// Put stores val under key, replacing any existing value.  The entry expires
+// at the time expires, or never if expires is the zero Time.
+func (db *DB) Put(txn *lmdb.Txn, key, val []byte, expires time.Time) error {
+	exp := encodeTime(expires)
+	err := db.unindex(txn, key)
+	if err != nil {
+		return err
+	}
+	b, err := txn.PutReserve(db.data, key, headerLen+len(val), 0)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(b, exp)
+	copy(b[headerLen:], val)
+	if exp == 0 {
+		return nil
+	}
+	return txn.Put(db.expiry, expiryKey(exp, key), nil, 0)
+}
+
+// PutTTL stores val under key with an entry which expires after ttl.
+func (db *DB) PutTTL(txn *lmdb.Txn, key, val []byte, ttl time.Duration) error {
+	return db.Put(txn, key, val, db.now().Add(ttl))
+}
+
+// unindex removes the expiry index entry of the value stored under key, if
+// any.
+func (db *DB) unindex(txn *lmdb.Txn, key []byte) error {
+	b, err := txn.Get(db.data, key)
+	if lmdb.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	exp, _, err := decode(key, b)
+	if err != nil || exp == 0 {
+		return err
+	}
+	err = txn.Del(db.expiry, expiryKey(exp, key), nil)
+	if lmdb.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Get returns the value stored under key.  Get returns an error satisfying
+// lmdb.IsNotFound if key is not present or its entry has expired.
+func (db *DB) Get(txn *lmdb.Txn, key []byte) ([]byte, error) {
+	val, _, err := db.GetExpiry(txn, key)
+	return val, err
+}
+
+// GetExpiry is like Get but also returns the time at which the entry
+// expires, which is the zero Time if it does not expire.
+func (db *DB) GetExpiry(txn *lmdb.Txn, key []byte) ([]byte, time.Time, error) {
+	b, err := txn.Get(db.data, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	exp, val, err := decode(key, b)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if db.expired(exp) {
+		return nil, time.Time{}, notFound()
+	}
+	return val, decodeTime(exp), nil
+}
+
+// Expire changes the time at which the entry for key expires without
+// modifying its value.  If expires is the zero Time the entry no longer
+// expires.  Expire returns an error satisfying lmdb.IsNotFound if key is not
+// present or its entry has expired.
+func (db *DB) Expire(txn *lmdb.Txn, key []byte, expires time.Time) error {
+	val, _, err := db.GetExpiry(txn, key)
+	if err != nil {
+		return err
+	}
+	// The value is copied because it refers to the page being replaced.
+	return db.Put(txn, key, append([]byte(nil), val...), expires)
+}
+
+// Del deletes the entry for key.  Del returns an error satisfying
+// lmdb.IsNotFound if key is not present, even if its entry has expired and
+// has not yet been swept.
+func (db *DB) Del(txn *lmdb.Txn, key []byte) error {
+	err := db.unindex(txn, key)
+	if err != nil {
+		return err
+	}
+	return txn.Del(db.data, key, nil)
+}
+
+// Sweep deletes expired entries until none remain or ctx is done.  Each
+// update transaction made by Sweep deletes at most Options.BatchSize entries
+// and ctx is checked between transactions.  Sweep returns the number of
+// entries deleted.
+func (db *DB) Sweep(ctx context.Context) (int, error) {
+	start := db.now()
+	var n int
+	err := db.sweep(ctx, &n)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.metrics.Expired += uint64(n)
+	if err != nil {
+		if ctx.Err() == nil {
+			db.metrics.Errors++
+		}
+		return n, err
+	}
+	db.metrics.Sweeps++
+	db.metrics.LastSweep = start
+	db.metrics.LastDuration = db.now().Sub(start)
+	db.metrics.LastExpired = n
+	return n, nil
+}
+
+func (db *DB) sweep(ctx context.Context, n *int) error {
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		var deleted int
+		err = db.env.Update(func(txn *lmdb.Txn) (err error) {
+			deleted, err = db.sweepBatch(txn, encodeTime(db.now()))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		db.mu.Lock()
+		db.metrics.Txns++
+		db.mu.Unlock()
+		*n += deleted
+		if deleted < db.batch {
+			return nil
+		}
+	}
+}
+
+// sweepBatch deletes up to db.batch entries which expired at or before now.
+func (db *DB) sweepBatch(txn *lmdb.Txn, now uint64) (int, error) {
+	cur, err := txn.OpenCursor(db.expiry)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close()
+
+	var n int
+	for n < db.batch {
+		k, _, err := cur.Get(nil, nil, lmdb.First)
+		if lmdb.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if len(k) < 8 {
+			return n, fmt.Errorf("%w: expiry index key %q", ErrCorrupt, k)
+		}
+		exp := binary.BigEndian.Uint64(k)
+		if exp > now {
+			break
+		}
+		err = db.delExpired(txn, k[8:], exp)
+		if err != nil {
+			return n, err
+		}
+		err = cur.Del(0)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// delExpired deletes the entry for key if it expires at exp.
+func (db *DB) delExpired(txn *lmdb.Txn, key []byte, exp uint64) error {
+	b, err := txn.Get(db.data, key)
+	if lmdb.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	stored, _, err := decode(key, b)
+	if err != nil || stored != exp {
+		// The index entry is stale.
+		return err
+	}
+	return txn.Del(db.data, key, nil)
+}
+
+// Run calls Sweep every Options.Interval until ctx is done and returns the
+// context's error.  Run returns early if a sweep fails.
+func (db *DB) Run(ctx context.Context) error {
+	ticker := time.NewTicker(db.interval)
+	defer ticker.Stop()
+	for {
+		_, err := db.Sweep(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Metrics returns the sweeping metrics of db.
+func (db *DB) Metrics() Metrics {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.metrics
+}
+
+// Pending returns the number of entries which have expired and have not
+// been swept.
+func (db *DB) Pending(txn *lmdb.Txn) (int, error) {
+	now := encodeTime(db.now())
+	var n int
+	s := lmdbscan.New(txn, db.expiry)
+	defer s.Close()
+	for s.Scan() {
+		k := s.Key()
+		if len(k) < 8 {
+			return n, fmt.Errorf("%w: expiry index key %q", ErrCorrupt, k)
+		}
+		if binary.BigEndian.Uint64(k) > now {
+			break
+		}
+		n++
+	}
+	return n, s.Err()
+}
+
+// Scanner wraps an lmdbscan.Scanner over the data database so that expired
+// entries are skipped and Val returns stored values without their header.
+type Scanner struct {
+	*lmdbscan.Scanner
+	db  *DB
+	now uint64
+	exp uint64
+	val []byte
+	err error
+}
+
+// Scanner returns a Scanner which reads values with s.  Entries are
+// considered expired if they expired at or before the call to Scanner.
+func (db *DB) Scanner(s *lmdbscan.Scanner) *Scanner {
+	return &Scanner{Scanner: s, db: db, now: encodeTime(db.now())}
+}
+
+// Scan advances the underlying Scanner to the next entry which has not
+// expired.  Scan returns false if a value cannot be decoded.
+func (s *Scanner) Scan() bool {
+	for s.err == nil && s.Scanner.Scan() {
+		if s.decode() {
+			return true
+		}
+	}
+	return false
+}
+
+// Set moves the underlying Scanner with lmdbscan.Scanner.Set and decodes the
+// entry read.  Set returns false if the entry has expired, in which case a
+// following call to Scan moves on to the next entry which has not expired.
+// Operations which match a value, like lmdb.GetBoth, are not supported because
+// the stored values carry a header.
+func (s *Scanner) Set(k, v []byte, opset uint) bool {
+	if s.err != nil || !s.Scanner.Set(k, v, opset) {
+		return false
+	}
+	return s.decode()
+}
+
+// decode decodes the entry read by the underlying Scanner and reports whether
+// it can be read and has not expired.
+func (s *Scanner) decode() bool {
+	s.exp, s.val, s.err = decode(s.Scanner.Key(), s.Scanner.Val())
+	if s.err != nil {
+		return false
+	}
+	if s.exp != 0 && s.exp <= s.now {
+		s.exp, s.val = 0, nil
+		return false
+	}
+	return true
+}
+
+// Val returns the value read by the last call to Scan or Set.
+func (s *Scanner) Val() []byte {
+	return s.val
+}
+
+// Expiry returns the time at which the entry read by the last call to Scan or
+// Set expires, which is the zero Time if it does not expire.
+func (s *Scanner) Expiry() time.Time {
+	return decodeTime(s.exp)
+}
+
+// Err returns the error which terminated the scan, including errors decoding
+// values.
+func (s *Scanner) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.Scanner.Err()
+}
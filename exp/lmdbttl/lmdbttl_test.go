@@ -0,0 +1,283 @@
+package lmdbttl
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+// clock is a fake clock for tests.
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestDB(t *testing.T, opt *Options) (*lmdb.Env, *DB) {
+	env, err := lmdbtest.NewEnv(&lmdbtest.EnvOptions{MaxDBs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := New(env, "data", "expiry", opt)
+	if err != nil {
+		lmdbtest.Destroy(env)
+		t.Fatal(err)
+	}
+	return env, db
+}
+
+// visible returns the keys and values read by a Scanner.
+func visible(t *testing.T, env *lmdb.Env, db *DB) string {
+	var kvs []string
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		s := db.Scanner(lmdbscan.New(txn, db.data))
+		defer s.Close()
+		for s.Scan() {
+			kvs = append(kvs, fmt.Sprintf("%s=%s", s.Key(), s.Val()))
+		}
+		return s.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(kvs)
+}
+
+func pending(t *testing.T, env *lmdb.Env, db *DB) int {
+	var n int
+	err := env.View(func(txn *lmdb.Txn) (err error) {
+		n, err = db.Pending(txn)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDB(t *testing.T) {
+	clk := &clock{t: time.Unix(1000, 0)}
+	env, db := newTestDB(t, &Options{Now: clk.Now})
+	defer lmdbtest.Destroy(env)
+
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		err = db.PutTTL(txn, []byte("a"), []byte("1"), time.Minute)
+		if err != nil {
+			return err
+		}
+		err = db.Put(txn, []byte("b"), []byte("2"), time.Time{})
+		if err != nil {
+			return err
+		}
+		err = db.PutTTL(txn, []byte("c"), []byte("3"), time.Hour)
+		if err != nil {
+			return err
+		}
+		// Replacing c removes its first expiry from the index.
+		return db.PutTTL(txn, []byte("c"), []byte("4"), 2*time.Minute)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := visible(t, env, db); v != "[a=1 b=2 c=4]" {
+		t.Errorf("visible: %s", v)
+	}
+
+	clk.Advance(time.Minute)
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		_, err = db.Get(txn, []byte("a"))
+		if !lmdb.IsNotFound(err) {
+			t.Errorf("get expired: unexpected error: %v", err)
+		}
+		val, exp, err := db.GetExpiry(txn, []byte("c"))
+		if err != nil {
+			return err
+		}
+		if string(val) != "4" || !exp.Equal(time.Unix(1120, 0)) {
+			t.Errorf("c: %q %v", val, exp)
+		}
+		val, exp, err = db.GetExpiry(txn, []byte("b"))
+		if err != nil {
+			return err
+		}
+		if string(val) != "2" || !exp.IsZero() {
+			t.Errorf("b: %q %v", val, exp)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := visible(t, env, db); v != "[b=2 c=4]" {
+		t.Errorf("visible: %s", v)
+	}
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		s := db.Scanner(lmdbscan.New(txn, db.data))
+		defer s.Close()
+		if !s.Set([]byte("c"), nil, lmdb.SetKey) {
+			return s.Err()
+		}
+		if string(s.Val()) != "4" || !s.Expiry().Equal(time.Unix(1120, 0)) {
+			t.Errorf("set c: %q %v", s.Val(), s.Expiry())
+		}
+		if s.Set([]byte("a"), nil, lmdb.SetKey) || s.Val() != nil {
+			t.Errorf("set expired: %q", s.Val())
+		}
+		if !s.Scan() {
+			return s.Err()
+		}
+		if string(s.Key()) != "b" || string(s.Val()) != "2" {
+			t.Errorf("scan after expired: %s=%s", s.Key(), s.Val())
+		}
+		return s.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(t, env, db); n != 1 {
+		t.Errorf("pending: %d", n)
+	}
+
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		err = db.Expire(txn, []byte("a"), time.Time{})
+		if !lmdb.IsNotFound(err) {
+			t.Errorf("expire expired: unexpected error: %v", err)
+		}
+		err = db.Expire(txn, []byte("c"), time.Time{})
+		if err != nil {
+			return err
+		}
+		err = db.Expire(txn, []byte("b"), clk.Now())
+		if err != nil {
+			return err
+		}
+		return db.Del(txn, []byte("a"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Hour)
+	if v := visible(t, env, db); v != "[c=4]" {
+		t.Errorf("visible: %s", v)
+	}
+	if n := pending(t, env, db); n != 1 {
+		t.Errorf("pending: %d", n)
+	}
+
+	n, err := db.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("swept %d", n)
+	}
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		for dbi, n := range map[lmdb.DBI]uint64{db.data: 1, db.expiry: 0} {
+			stat, err := txn.Stat(dbi)
+			if err != nil {
+				return err
+			}
+			if stat.Entries != n {
+				t.Errorf("dbi %d: %d entries", dbi, stat.Entries)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDB_Sweep(t *testing.T) {
+	clk := &clock{t: time.Unix(1000, 0)}
+	env, db := newTestDB(t, &Options{BatchSize: 10, Now: clk.Now})
+	defer lmdbtest.Destroy(env)
+
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		for i := 0; i < 30; i++ {
+			ttl := time.Duration(i+1) * time.Second
+			err = db.PutTTL(txn, []byte(fmt.Sprintf("k%02d", i)), []byte("v"), ttl)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(25 * time.Second)
+	n, err := db.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 25 {
+		t.Errorf("swept %d", n)
+	}
+	m := db.Metrics()
+	if m.Sweeps != 1 || m.Txns != 3 || m.Expired != 25 || m.LastExpired != 25 || !m.LastSweep.Equal(clk.Now()) {
+		t.Errorf("metrics: %+v", m)
+	}
+	if v := visible(t, env, db); v != "[k25=v k26=v k27=v k28=v k29=v]" {
+		t.Errorf("visible: %s", v)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	clk.Advance(time.Minute)
+	n, err = db.Sweep(ctx)
+	if n != 0 || err != context.Canceled {
+		t.Errorf("canceled sweep: %d %v", n, err)
+	}
+	m = db.Metrics()
+	if m.Sweeps != 1 || m.Errors != 0 {
+		t.Errorf("metrics: %+v", m)
+	}
+}
+
+func TestDB_Run(t *testing.T) {
+	env, db := newTestDB(t, &Options{Interval: 10 * time.Millisecond})
+	defer lmdbtest.Destroy(env)
+
+	err := env.Update(func(txn *lmdb.Txn) (err error) {
+		return db.PutTTL(txn, []byte("k"), []byte("v"), 20*time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- db.Run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Metrics().Expired == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	err = <-done
+	if err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+	m := db.Metrics()
+	if m.Expired != 1 || m.Sweeps < 2 {
+		t.Errorf("metrics: %+v", m)
+	}
+}
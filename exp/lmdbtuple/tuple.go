@@ -0,0 +1,383 @@
+/*
+Package lmdbtuple encodes tuples of simple values into byte strings whose
+lexicographic (memcmp) order matches the order of the tuples themselves.  The
+encoding makes composite keys with variable length and signed components safe
+to store in databases using the default LMDB comparison function.
+
+	key := lmdbtuple.Tuple{addr, uint64(block), -1}.Pack()
+	err = txn.Put(dbi, key, val, 0)
+
+Tuples are compared element by element.  Elements of different kinds compare
+by kind in the order nil, []byte, string, Tuple, integer, float32, float64,
+bool.  Integers of all sizes, signed or unsigned, form a single kind and
+compare by numerical value.  As in the FoundationDB tuple layer, float32 and
+float64 are distinct kinds, so every float32 sorts before every float64.  A tuple sorts before every tuple it is a proper prefix of.
+
+The format is compatible with the subset of the FoundationDB tuple layer
+covering these types.
+
+# Prefix ranges
+
+A Range holds the keys for all tuples that begin with a given prefix.  Ranges
+are half-open and can be used to position an lmdbscan.Scanner or an
+lmdb.Cursor with lmdb.SetRange.
+
+	r := lmdbtuple.PrefixRange(lmdbtuple.Tuple{addr})
+	s := lmdbscan.New(txn, dbi)
+	defer s.Close()
+	r.Seek(s)
+	for s.Scan() && r.Contains(s.Key()) {
+		t, err := lmdbtuple.Unpack(s.Key())
+		// ...
+	}
+
+Ranges and the ordering guarantee only hold for databases without the
+lmdb.ReverseKey flag or a custom comparison function.
+*/
+package lmdbtuple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+// Type codes.  The numeric values define the order of element kinds.
+const (
+	codeNil      = 0x00
+	codeBytes    = 0x01
+	codeString   = 0x02
+	codeNested   = 0x05
+	codeNegInt8  = 0x0c // 8 byte negative integer
+	codeIntZero  = 0x14
+	codePosInt8  = 0x1c // 8 byte positive integer
+	codeFloat32  = 0x20
+	codeFloat64  = 0x21
+	codeFalse    = 0x26
+	codeTrue     = 0x27
+	escapeByte   = 0xff
+	terminator   = 0x00
+	maxIntLength = 8
+)
+
+// Tuple is an ordered list of elements.  Elements may be nil, bool, string,
+// []byte, any integer type, float32 or float64, or a nested Tuple.
+type Tuple []interface{}
+
+// Pack returns the encoding of t.  Pack panics if t contains an element of an
+// unsupported type.
+func (t Tuple) Pack() []byte {
+	return t.AppendPack(nil)
+}
+
+// AppendPack appends the encoding of t to b and returns the result.
+func (t Tuple) AppendPack(b []byte) []byte {
+	for _, e := range t {
+		b = appendElem(b, e, false)
+	}
+	return b
+}
+
+// Pack is shorthand for Tuple(elems).Pack().
+func Pack(elems ...interface{}) []byte {
+	return Tuple(elems).Pack()
+}
+
+func appendElem(b []byte, e interface{}, nested bool) []byte {
+	switch v := e.(type) {
+	case nil:
+		if nested {
+			return append(b, codeNil, escapeByte)
+		}
+		return append(b, codeNil)
+	case []byte:
+		return appendEscaped(append(b, codeBytes), v)
+	case string:
+		return appendEscaped(append(b, codeString), []byte(v))
+	case Tuple:
+		b = append(b, codeNested)
+		for _, e := range v {
+			b = appendElem(b, e, true)
+		}
+		return append(b, terminator)
+	case bool:
+		if v {
+			return append(b, codeTrue)
+		}
+		return append(b, codeFalse)
+	case int:
+		return appendInt(b, int64(v))
+	case int8:
+		return appendInt(b, int64(v))
+	case int16:
+		return appendInt(b, int64(v))
+	case int32:
+		return appendInt(b, int64(v))
+	case int64:
+		return appendInt(b, v)
+	case uint:
+		return appendUint(b, uint64(v))
+	case uint8:
+		return appendUint(b, uint64(v))
+	case uint16:
+		return appendUint(b, uint64(v))
+	case uint32:
+		return appendUint(b, uint64(v))
+	case uint64:
+		return appendUint(b, v)
+	case float32:
+		return appendFloat32(b, v)
+	case float64:
+		return appendFloat64(b, v)
+	}
+	panic(fmt.Sprintf("lmdbtuple: unsupported element type %T", e))
+}
+
+func appendEscaped(b, p []byte) []byte {
+	for {
+		i := bytes.IndexByte(p, 0x00)
+		if i < 0 {
+			break
+		}
+		b = append(b, p[:i+1]...)
+		b = append(b, escapeByte)
+		p = p[i+1:]
+	}
+	b = append(b, p...)
+	return append(b, terminator)
+}
+
+// intLength returns the number of bytes needed to hold u.
+func intLength(u uint64) int {
+	n := 0
+	for u != 0 {
+		n++
+		u >>= 8
+	}
+	return n
+}
+
+func appendUint(b []byte, u uint64) []byte {
+	n := intLength(u)
+	b = append(b, byte(codeIntZero+n))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], u)
+	return append(b, buf[8-n:]...)
+}
+
+func appendInt(b []byte, i int64) []byte {
+	if i >= 0 {
+		return appendUint(b, uint64(i))
+	}
+	// Negative integers are stored as the one's complement of their
+	// magnitude so that larger magnitudes sort first.
+	mag := uint64(-(i + 1)) + 1
+	n := intLength(mag)
+	b = append(b, byte(codeIntZero-n))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], ^mag)
+	return append(b, buf[8-n:]...)
+}
+
+// Floats are stored with the sign bit set if they are positive, and with all
+// bits inverted if they are negative, so that they sort numerically.
+func appendFloat32(b []byte, f float32) []byte {
+	bits := math.Float32bits(f)
+	if bits&(1<<31) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 31
+	}
+	b = append(b, codeFloat32)
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], bits)
+	return append(b, buf[:]...)
+}
+
+func appendFloat64(b []byte, f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	b = append(b, codeFloat64)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], bits)
+	return append(b, buf[:]...)
+}
+
+// Unpack decodes a packed tuple.  Integers are decoded as int64, or as uint64
+// when they do not fit in an int64.  Floats are decoded as float32 or float64,
+// as they were packed.
+func Unpack(b []byte) (Tuple, error) {
+	t, rest, err := decode(b, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("lmdbtuple: %d trailing bytes", len(rest))
+	}
+	return t, nil
+}
+
+func decode(b []byte, nested bool) (Tuple, []byte, error) {
+	t := Tuple{}
+	for len(b) > 0 {
+		if nested && b[0] == terminator {
+			if len(b) > 1 && b[1] == escapeByte {
+				t = append(t, nil)
+				b = b[2:]
+				continue
+			}
+			return t, b[1:], nil
+		}
+		var e interface{}
+		var err error
+		e, b, err = decodeElem(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		t = append(t, e)
+	}
+	if nested {
+		return nil, nil, errTruncated
+	}
+	return t, b, nil
+}
+
+var errTruncated = fmt.Errorf("lmdbtuple: truncated tuple")
+
+func decodeElem(b []byte) (interface{}, []byte, error) {
+	code := b[0]
+	b = b[1:]
+	switch {
+	case code == codeNil:
+		return nil, b, nil
+	case code == codeBytes:
+		p, rest, err := decodeEscaped(b)
+		return p, rest, err
+	case code == codeString:
+		p, rest, err := decodeEscaped(b)
+		return string(p), rest, err
+	case code == codeNested:
+		t, rest, err := decode(b, true)
+		return t, rest, err
+	case code >= codeNegInt8 && code <= codePosInt8:
+		return decodeInt(code, b)
+	case code == codeFloat32:
+		if len(b) < 4 {
+			return nil, nil, errTruncated
+		}
+		bits := binary.BigEndian.Uint32(b)
+		if bits&(1<<31) != 0 {
+			bits &^= 1 << 31
+		} else {
+			bits = ^bits
+		}
+		return math.Float32frombits(bits), b[4:], nil
+	case code == codeFloat64:
+		if len(b) < 8 {
+			return nil, nil, errTruncated
+		}
+		bits := binary.BigEndian.Uint64(b)
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), b[8:], nil
+	case code == codeFalse:
+		return false, b, nil
+	case code == codeTrue:
+		return true, b, nil
+	}
+	return nil, nil, fmt.Errorf("lmdbtuple: unknown type code %#x", code)
+}
+
+func decodeEscaped(b []byte) ([]byte, []byte, error) {
+	var p []byte
+	for {
+		i := bytes.IndexByte(b, 0x00)
+		if i < 0 {
+			return nil, nil, errTruncated
+		}
+		if i+1 < len(b) && b[i+1] == escapeByte {
+			p = append(p, b[:i+1]...)
+			b = b[i+2:]
+			continue
+		}
+		p = append(p, b[:i]...)
+		if p == nil {
+			p = []byte{}
+		}
+		return p, b[i+1:], nil
+	}
+}
+
+func decodeInt(code byte, b []byte) (interface{}, []byte, error) {
+	if code == codeIntZero {
+		return int64(0), b, nil
+	}
+	neg := code < codeIntZero
+	n := int(code) - codeIntZero
+	if neg {
+		n = -n
+	}
+	if len(b) < n {
+		return nil, nil, errTruncated
+	}
+	var buf [8]byte
+	copy(buf[8-n:], b[:n])
+	u := binary.BigEndian.Uint64(buf[:])
+	if neg {
+		// Undo the one's complement over n bytes.
+		mag := ^u
+		if n < maxIntLength {
+			mag &= 1<<(8*uint(n)) - 1
+		}
+		if mag > 1<<63 {
+			return nil, nil, fmt.Errorf("lmdbtuple: integer overflow")
+		}
+		return -int64(mag-1) - 1, b[n:], nil
+	}
+	if u > math.MaxInt64 {
+		return u, b[n:], nil
+	}
+	return int64(u), b[n:], nil
+}
+
+// Range is the half-open interval of keys [Begin, End).
+type Range struct {
+	Begin []byte
+	End   []byte
+}
+
+// PrefixRange returns the Range containing the packed form of prefix and of
+// every tuple that begins with the elements of prefix.
+func PrefixRange(prefix Tuple) Range {
+	p := prefix.Pack()
+	end := make([]byte, len(p)+1)
+	copy(end, p)
+	end[len(p)] = 0xff
+	return Range{Begin: p, End: end}
+}
+
+// Contains returns true if key is in r.
+func (r Range) Contains(key []byte) bool {
+	return bytes.Compare(key, r.Begin) >= 0 && bytes.Compare(key, r.End) < 0
+}
+
+// Seek positions s at the first key greater than or equal to r.Begin so that
+// the following call to s.Scan returns it.  Seek returns false if no such key
+// exists.
+func (r Range) Seek(s *lmdbscan.Scanner) bool {
+	if len(r.Begin) == 0 {
+		return s.SetNext(nil, nil, lmdb.First, lmdb.Next)
+	}
+	return s.SetNext(r.Begin, nil, lmdb.SetRange, lmdb.Next)
+}
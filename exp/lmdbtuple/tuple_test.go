@@ -0,0 +1,381 @@
+package lmdbtuple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/ledgerwatch/lmdb-go/internal/lmdbtest"
+	"github.com/ledgerwatch/lmdb-go/lmdb"
+	"github.com/ledgerwatch/lmdb-go/lmdbscan"
+)
+
+func TestPack_roundTrip(t *testing.T) {
+	for i, tup := range []Tuple{
+		{},
+		{nil},
+		{[]byte{}, []byte{0, 1, 0}, "", "a\x00b"},
+		{int64(0), int64(-1), int64(1), int64(math.MinInt64), int64(math.MaxInt64), uint64(math.MaxUint64)},
+		{1.5, -0.25, math.Inf(1), math.Inf(-1)},
+		{float32(1.5), float32(-0.25), float32(math.Inf(-1)), 1.5},
+		{true, false},
+		{Tuple{nil, Tuple{}, "x"}, Tuple{}},
+	} {
+		b := tup.Pack()
+		u, err := Unpack(b)
+		if err != nil {
+			t.Errorf("tuple %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(u, tup) {
+			t.Errorf("tuple %d: %#v (!= %#v)", i, u, tup)
+		}
+	}
+}
+
+func TestPack_intTypes(t *testing.T) {
+	b1 := Pack(int8(-3), uint16(7), 9)
+	b2 := Pack(int64(-3), int64(7), int64(9))
+	if !bytes.Equal(b1, b2) {
+		t.Errorf("integer types encode differently: %x (!= %x)", b1, b2)
+	}
+}
+
+// TestPack_fdb checks encodings given by the FoundationDB tuple layer.
+func TestPack_fdb(t *testing.T) {
+	for _, test := range []struct {
+		e interface{}
+		b []byte
+	}{
+		{float32(1), []byte{codeFloat32, 0xbf, 0x80, 0x00, 0x00}},
+		{float32(-1), []byte{codeFloat32, 0x40, 0x7f, 0xff, 0xff}},
+		{float64(1), []byte{codeFloat64, 0xbf, 0xf0, 0, 0, 0, 0, 0, 0}},
+		{float64(-1), []byte{codeFloat64, 0x40, 0x0f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	} {
+		b := Pack(test.e)
+		if !bytes.Equal(b, test.b) {
+			t.Errorf("%T %v: %x (!= %x)", test.e, test.e, b, test.b)
+		}
+	}
+}
+
+func TestUnpack_invalid(t *testing.T) {
+	for i, b := range [][]byte{
+		{codeString, 'a'},
+		{codeNested, codeIntZero},
+		{codeFloat32, 1, 2},
+		{codeFloat64, 1, 2},
+		{codePosInt8, 1},
+		{0x40},
+	} {
+		_, err := Unpack(b)
+		if err == nil {
+			t.Errorf("input %d: expected error", i)
+		}
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	env, err := lmdbtest.NewEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lmdbtest.Destroy(env)
+	dbi, err := lmdbtest.OpenRoot(env, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tuples := []Tuple{
+		{"a"},
+		{"ab"},
+		{"ab", int64(-1)},
+		{"ab", int64(2)},
+		{"ab", nil},
+		{"ab\x00"},
+		{"ab\x00", int64(1)},
+		{"b", int64(1)},
+	}
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		for _, tup := range tuples {
+			err = txn.Put(dbi, tup.Pack(), nil, 0)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []Tuple
+	err = env.View(func(txn *lmdb.Txn) (err error) {
+		r := PrefixRange(Tuple{"ab"})
+		s := lmdbscan.New(txn, dbi)
+		defer s.Close()
+		r.Seek(s)
+		for s.Scan() && r.Contains(s.Key()) {
+			tup, err := Unpack(s.Key())
+			if err != nil {
+				return err
+			}
+			found = append(found, tup)
+		}
+		return s.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Tuple{
+		{"ab"},
+		{"ab", nil},
+		{"ab", int64(-1)},
+		{"ab", int64(2)},
+	}
+	if !reflect.DeepEqual(found, expect) {
+		t.Errorf("unexpected range: %v (!= %v)", found, expect)
+	}
+}
+
+func TestPack_order(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		buf := make([]byte, r.Intn(64))
+		r.Read(buf)
+		a := genTuple(&fuzzSource{b: buf}, 0)
+		buf = make([]byte, r.Intn(64))
+		r.Read(buf)
+		b := genTuple(&fuzzSource{b: buf}, 0)
+		checkOrder(t, a, b)
+	}
+}
+
+func FuzzPack_order(f *testing.F) {
+	f.Add([]byte{}, []byte{1})
+	f.Add([]byte{3, 0, 0, 0, 0, 0, 0, 0, 1}, []byte{3, 0x80, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{1, 2, 'a', 0}, []byte{1, 1, 'a'})
+	f.Add([]byte{5, 1, 0, 1}, []byte{5, 0})
+	f.Fuzz(func(t *testing.T, x, y []byte) {
+		a := genTuple(&fuzzSource{b: x}, 0)
+		b := genTuple(&fuzzSource{b: y}, 0)
+		checkOrder(t, a, b)
+	})
+}
+
+func checkOrder(t *testing.T, a, b Tuple) {
+	pa, pb := a.Pack(), b.Pack()
+	want := compareTuple(a, b)
+	have := bytes.Compare(pa, pb)
+	if want != have {
+		t.Fatalf("order mismatch for %#v and %#v: %d (!= %d)", a, b, have, want)
+	}
+	ua, err := Unpack(pa)
+	if err != nil {
+		t.Fatalf("unpack %#v: %v", a, err)
+	}
+	if compareTuple(ua, a) != 0 {
+		t.Fatalf("round trip: %#v (!= %#v)", ua, a)
+	}
+}
+
+// fuzzSource deterministically derives values from fuzzer input.
+type fuzzSource struct {
+	b []byte
+}
+
+func (s *fuzzSource) byte() byte {
+	if len(s.b) == 0 {
+		return 0
+	}
+	c := s.b[0]
+	s.b = s.b[1:]
+	return c
+}
+
+func (s *fuzzSource) uint64() uint64 {
+	var buf [8]byte
+	for i := range buf {
+		buf[i] = s.byte()
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+func genTuple(s *fuzzSource, depth int) Tuple {
+	t := Tuple{}
+	for len(s.b) > 0 {
+		switch s.byte() % 10 {
+		case 0:
+			return t
+		case 1:
+			n := int(s.byte() % 4)
+			p := make([]byte, n)
+			for i := range p {
+				p[i] = s.byte() % 3
+			}
+			t = append(t, p)
+		case 2:
+			n := int(s.byte() % 4)
+			p := make([]byte, n)
+			for i := range p {
+				p[i] = s.byte() % 3
+			}
+			t = append(t, string(p))
+		case 3:
+			t = append(t, int64(s.uint64()))
+		case 4:
+			t = append(t, s.uint64())
+		case 5:
+			if depth < 3 {
+				t = append(t, genTuple(s, depth+1))
+			}
+		case 6:
+			u := s.uint64()
+			if u%2 == 0 {
+				f := math.Float32frombits(uint32(u >> 32))
+				if !math.IsNaN(float64(f)) {
+					t = append(t, f)
+				}
+			} else if f := math.Float64frombits(u); !math.IsNaN(f) {
+				t = append(t, f)
+			}
+		case 7:
+			t = append(t, s.byte()%2 == 0)
+		case 8:
+			t = append(t, nil)
+		case 9:
+			t = append(t, int64(int8(s.byte())))
+		}
+	}
+	return t
+}
+
+// compareTuple is a reference implementation of tuple order.
+func compareTuple(a, b Tuple) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		c := compareElem(a[i], b[i])
+		if c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+func kind(e interface{}) int {
+	switch e.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return 1
+	case string:
+		return 2
+	case Tuple:
+		return 3
+	case int64, uint64:
+		return 4
+	case float32:
+		return 5
+	case float64:
+		return 6
+	case bool:
+		return 7
+	}
+	panic("unexpected type")
+}
+
+func compareElem(a, b interface{}) int {
+	ka, kb := kind(a), kind(b)
+	if ka != kb {
+		return cmpInt(ka, kb)
+	}
+	switch a := a.(type) {
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	case string:
+		return bytes.Compare([]byte(a), []byte(b.(string)))
+	case Tuple:
+		return compareTuple(a, b.(Tuple))
+	case int64, uint64:
+		return compareInteger(a, b)
+	case float32:
+		return compareFloat(float64(a), float64(b.(float32)))
+	case float64:
+		return compareFloat(a, b.(float64))
+	case bool:
+		return cmpInt(boolInt(a), boolInt(b.(bool)))
+	}
+	return 0
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return cmpInt(boolInt(!math.Signbit(a)), boolInt(!math.Signbit(b)))
+}
+
+func compareInteger(a, b interface{}) int {
+	neg := func(x interface{}) bool {
+		i, ok := x.(int64)
+		return ok && i < 0
+	}
+	switch {
+	case neg(a) && !neg(b):
+		return -1
+	case !neg(a) && neg(b):
+		return 1
+	case neg(a) && neg(b):
+		return cmpInt64(a.(int64), b.(int64))
+	}
+	return cmpUint64(toUint(a), toUint(b))
+}
+
+func toUint(x interface{}) uint64 {
+	if i, ok := x.(int64); ok {
+		return uint64(i)
+	}
+	return x.(uint64)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func cmpInt(a, b int) int {
+	return cmpInt64(int64(a), int64(b))
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func cmpUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -1,8 +1,10 @@
 package lmdb
 
 import (
+	"bytes"
 	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"math/rand"
 	"sync/atomic"
 	"testing"
@@ -165,6 +167,148 @@ func BenchmarkTxn_PutReserve_writemap(b *testing.B) {
 }
 
 // repeatedly put (overwrite) keys.
+// benchRecord is a fixed-size value encoded with encoding/binary.
+type benchRecord struct {
+	ID      uint64
+	Balance [30]uint64
+	Nonce   uint64
+}
+
+var benchRecordSize = binary.Size(benchRecord{})
+
+// BenchmarkTxn_Put_binary encodes values into a reused buffer which is then
+// copied by Put.
+func BenchmarkTxn_Put_binary(b *testing.B) {
+	benchmarkTxnPutEncoded(b, 0, func(txn *Txn, dbi DBI, k []byte, rec *benchRecord, buf *bytes.Buffer) error {
+		buf.Reset()
+		err := binary.Write(buf, binary.LittleEndian, rec)
+		if err != nil {
+			return err
+		}
+		return txn.Put(dbi, k, buf.Bytes(), 0)
+	})
+}
+
+// BenchmarkTxn_PutWriter_binary encodes values directly into reserved space.
+func BenchmarkTxn_PutWriter_binary(b *testing.B) {
+	benchmarkTxnPutEncoded(b, 0, func(txn *Txn, dbi DBI, k []byte, rec *benchRecord, buf *bytes.Buffer) error {
+		w, err := txn.PutWriter(dbi, k, benchRecordSize, 0)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(w, binary.LittleEndian, rec)
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// BenchmarkTxn_Put_json encodes values with a json.Encoder into a reused
+// buffer which is then copied by Put.
+func BenchmarkTxn_Put_json(b *testing.B) {
+	benchmarkTxnPutEncoded(b, 0, func(txn *Txn, dbi DBI, k []byte, rec *benchRecord, buf *bytes.Buffer) error {
+		buf.Reset()
+		err := json.NewEncoder(buf).Encode(rec)
+		if err != nil {
+			return err
+		}
+		return txn.Put(dbi, k, buf.Bytes(), 0)
+	})
+}
+
+// BenchmarkTxn_PutWriter_json encodes values directly into space reserved
+// for the largest possible encoding, shrinking them with a second Put.
+func BenchmarkTxn_PutWriter_json(b *testing.B) {
+	benchmarkTxnPutEncoded(b, 0, func(txn *Txn, dbi DBI, k []byte, rec *benchRecord, buf *bytes.Buffer) error {
+		w, err := txn.PutWriter(dbi, k, 1024, 0)
+		if err != nil {
+			return err
+		}
+		err = json.NewEncoder(w).Encode(rec)
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// BenchmarkTxn_Put_large builds 64KB values from small writes into a reused
+// buffer which is then copied by Put.
+func BenchmarkTxn_Put_large(b *testing.B) {
+	benchmarkTxnPutEncoded(b, 16, func(txn *Txn, dbi DBI, k []byte, rec *benchRecord, buf *bytes.Buffer) error {
+		buf.Reset()
+		for buf.Len() < 64<<10 {
+			buf.WriteString(benchLargePart)
+		}
+		return txn.Put(dbi, k, buf.Bytes(), 0)
+	})
+}
+
+// BenchmarkTxn_PutWriter_large builds 64KB values from small writes directly
+// into reserved space.
+func BenchmarkTxn_PutWriter_large(b *testing.B) {
+	benchmarkTxnPutEncoded(b, 16, func(txn *Txn, dbi DBI, k []byte, rec *benchRecord, buf *bytes.Buffer) error {
+		w, err := txn.PutWriter(dbi, k, 64<<10, 0)
+		if err != nil {
+			return err
+		}
+		for w.Available() > 0 {
+			_, err = w.WriteString(benchLargePart)
+			if err != nil {
+				return err
+			}
+		}
+		return w.Close()
+	})
+}
+
+var benchLargePart = string(bytes.Repeat([]byte("0123456789abcdef"), 64))
+
+// benchmarkTxnPutEncoded calls put for b.N random keys of the benchmark
+// database in one transaction.  If nkeys is positive only the first nkeys keys
+// are written, which allows large values to be overwritten in place instead of
+// exhausting the map.
+func benchmarkTxnPutEncoded(b *testing.B, nkeys int, put func(*Txn, DBI, []byte, *benchRecord, *bytes.Buffer) error) {
+	initRandSource(b)
+	env := setup(b)
+	defer clean(env, b)
+
+	dbi := openBenchDBI(b, env)
+
+	rc := newRandSourceCursor()
+	ps, err := populateBenchmarkDB(env, dbi, &rc)
+	if err != nil {
+		b.Errorf("populate db: %v", err)
+		return
+	}
+
+	var rec benchRecord
+	var buf bytes.Buffer
+	err = env.Update(func(txn *Txn) (err error) {
+		b.ResetTimer()
+		defer b.StopTimer()
+		for i := 0; i < b.N; i++ {
+			n := len(ps) / 2
+			if nkeys > 0 {
+				n = nkeys
+			}
+			k := ps[rand.Intn(n)*2]
+			rec.ID = uint64(i)
+			rec.Balance[i%len(rec.Balance)] = rand.Uint64()
+			err := put(txn, dbi, k, &rec, &buf)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Error(err)
+		return
+	}
+}
+
 func BenchmarkTxn_Put_writemap(b *testing.B) {
 	initRandSource(b)
 	env := setupFlags(b, WriteMap)
@@ -216,6 +360,7 @@ func BenchmarkTxn_Get_ro(b *testing.B) {
 	}
 
 	err = env.View(func(txn *Txn) (err error) {
+		b.ReportAllocs()
 		b.ResetTimer()
 		defer b.StopTimer()
 		for i := 0; i < b.N; i++ {
@@ -236,6 +381,208 @@ func BenchmarkTxn_Get_ro(b *testing.B) {
 }
 
 // like BenchmarkTxnGetReadonly but txn.RawRead is set to true.
+// BenchmarkTxn_GetInto_ro reads values into a reused buffer.
+func BenchmarkTxn_GetInto_ro(b *testing.B) {
+	benchmarkTxnGet(b, func(txn *Txn, dbi DBI, k []byte, buf []byte) ([]byte, error) {
+		return txn.GetInto(dbi, k, buf[:0])
+	})
+}
+
+// BenchmarkTxn_GetFunc_ro reads values with a callback.
+func BenchmarkTxn_GetFunc_ro(b *testing.B) {
+	var n int
+	fn := func(val []byte) error {
+		n += len(val)
+		return nil
+	}
+	benchmarkTxnGet(b, func(txn *Txn, dbi DBI, k []byte, buf []byte) ([]byte, error) {
+		return buf, txn.GetFunc(dbi, k, fn)
+	})
+}
+
+func benchmarkTxnGet(b *testing.B, get func(txn *Txn, dbi DBI, k []byte, buf []byte) ([]byte, error)) {
+	initRandSource(b)
+	env := setup(b)
+	defer clean(env, b)
+
+	dbi := openBenchDBI(b, env)
+
+	rc := newRandSourceCursor()
+	ps, err := populateBenchmarkDB(env, dbi, &rc)
+	if err != nil {
+		b.Errorf("populate db: %v", err)
+		return
+	}
+
+	err = env.View(func(txn *Txn) (err error) {
+		var buf []byte
+		b.ReportAllocs()
+		b.ResetTimer()
+		defer b.StopTimer()
+		for i := 0; i < b.N; i++ {
+			// Only keys which are present are read, because the error
+			// returned for a missing key is allocated.
+			buf, err = get(txn, dbi, ps[rand.Intn(len(ps)/2)*2], buf)
+			if err != nil {
+				b.Fatalf("error getting data: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Error(err)
+	}
+}
+
+// BenchmarkCursor_Get_ro scans a database with Cursor.Get, allocating a copy
+// of each item.
+func BenchmarkCursor_Get_ro(b *testing.B) {
+	benchmarkCursorGet(b, func(cur *Cursor, op uint, kbuf, vbuf []byte) ([]byte, []byte, error) {
+		return cur.Get(nil, nil, op)
+	})
+}
+
+// BenchmarkCursor_GetInto_ro scans a database copying items into reused
+// buffers.
+func BenchmarkCursor_GetInto_ro(b *testing.B) {
+	benchmarkCursorGet(b, func(cur *Cursor, op uint, kbuf, vbuf []byte) ([]byte, []byte, error) {
+		return cur.GetInto(nil, nil, op, kbuf[:0], vbuf[:0])
+	})
+}
+
+// BenchmarkCursor_GetFunc_ro scans a database with a callback.
+func BenchmarkCursor_GetFunc_ro(b *testing.B) {
+	var n int
+	fn := func(k, v []byte) error {
+		n += len(k) + len(v)
+		return nil
+	}
+	benchmarkCursorGet(b, func(cur *Cursor, op uint, kbuf, vbuf []byte) ([]byte, []byte, error) {
+		return kbuf, vbuf, cur.GetFunc(nil, nil, op, fn)
+	})
+}
+
+func benchmarkCursorGet(b *testing.B, get func(cur *Cursor, op uint, kbuf, vbuf []byte) ([]byte, []byte, error)) {
+	env := setup(b)
+	defer clean(env, b)
+
+	dbi := openBenchDBI(b, env)
+
+	if !populateDBI(b, env, dbi, testRecordSetSized(benchmarkScanDBSize)) {
+		return
+	}
+
+	err := env.View(func(txn *Txn) (err error) {
+		cur, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		var kbuf, vbuf []byte
+		b.ReportAllocs()
+		b.ResetTimer()
+		defer b.StopTimer()
+		for i := 0; i < b.N; i++ {
+			kbuf, vbuf, err = get(cur, Next, kbuf, vbuf)
+			if IsNotFound(err) {
+				kbuf, vbuf, err = get(cur, First, kbuf, vbuf)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Error(err)
+	}
+}
+
+// BenchmarkTxn_Commit measures small write transactions, including the time
+// spent flushing dirty pages.  Compare with BenchmarkTxn_Commit_checksum for
+// the overhead of PageChecksum.
+func BenchmarkTxn_Commit(b *testing.B) {
+	benchmarkTxnCommit(b, NoSync)
+}
+
+func BenchmarkTxn_Commit_checksum(b *testing.B) {
+	benchmarkTxnCommit(b, NoSync|PageChecksum)
+}
+
+func BenchmarkTxn_Commit_checksum_writemap(b *testing.B) {
+	benchmarkTxnCommit(b, NoSync|WriteMap|PageChecksum)
+}
+
+func benchmarkTxnCommit(b *testing.B, flags uint) {
+	initRandSource(b)
+	env := setupFlags(b, flags)
+	defer clean(env, b)
+
+	dbi := openBenchDBI(b, env)
+
+	rc := newRandSourceCursor()
+	ps, err := populateBenchmarkDB(env, dbi, &rc)
+	if err != nil {
+		b.Errorf("populate db: %v", err)
+		return
+	}
+
+	b.ResetTimer()
+	defer b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		err = env.Update(func(txn *Txn) (err error) {
+			for j := 0; j < 100; j++ {
+				k := ps[rand.Intn(len(ps)/2)*2]
+				v := makeBenchDBVal(&rc)
+				err := txn.Put(dbi, k, v, 0)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+	}
+}
+
+func BenchmarkTxn_Get_ro_checksum(b *testing.B) {
+	initRandSource(b)
+	env := setupFlags(b, PageChecksum)
+	defer clean(env, b)
+
+	dbi := openBenchDBI(b, env)
+
+	rc := newRandSourceCursor()
+	ps, err := populateBenchmarkDB(env, dbi, &rc)
+	if err != nil {
+		b.Errorf("populate db: %v", err)
+		return
+	}
+
+	err = env.View(func(txn *Txn) (err error) {
+		b.ResetTimer()
+		defer b.StopTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := txn.Get(dbi, ps[rand.Intn(len(ps))])
+			if IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				b.Fatalf("error getting data: %v", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		b.Error(err)
+	}
+}
+
 func BenchmarkTxn_Get_raw_ro(b *testing.B) {
 	initRandSource(b)
 	env := setup(b)
@@ -252,6 +599,7 @@ func BenchmarkTxn_Get_raw_ro(b *testing.B) {
 
 	err = env.View(func(txn *Txn) (err error) {
 		txn.RawRead = true
+		b.ReportAllocs()
 		b.ResetTimer()
 		defer b.StopTimer()
 		for i := 0; i < b.N; i++ {
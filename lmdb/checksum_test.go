@@ -0,0 +1,307 @@
+package lmdb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnv_PageChecksum(t *testing.T) {
+	for _, flags := range []uint{PageChecksum, PageChecksum | WriteMap} {
+		t.Run(fmt.Sprintf("%#x", flags), func(t *testing.T) {
+			env := setupFlags(t, flags)
+			defer clean(env, t)
+			populateChecksumEnv(t, env)
+
+			err := env.View(func(txn *Txn) error { return txn.Verify() })
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+
+			// The flag is stored in the environment.
+			path, err := env.Path()
+			if err != nil {
+				t.Fatal(err)
+			}
+			env2, err := NewEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer env2.Close()
+			err = env2.SetMaxDBs(64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = env2.Open(path, Readonly, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			envFlags, err := env2.Flags()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if envFlags&PageChecksum == 0 {
+				t.Errorf("flags: %#x", envFlags)
+			}
+			err = env2.View(func(txn *Txn) error { return txn.Verify() })
+			if err != nil {
+				t.Errorf("verify: %v", err)
+			}
+		})
+	}
+}
+
+// Verify must handle an unnamed database with DupSort, which cannot contain
+// named databases but does contain sub-pages and sub-databases.
+func TestTxn_Verify_dupSortRoot(t *testing.T) {
+	for _, flags := range []uint{0, PageChecksum} {
+		t.Run(fmt.Sprintf("%#x", flags), func(t *testing.T) {
+			env := setupFlags(t, flags)
+			defer clean(env, t)
+
+			err := env.Update(func(txn *Txn) (err error) {
+				dbi, err := txn.OpenRoot(DupSort)
+				if err != nil {
+					return err
+				}
+				for i := 0; i < 10; i++ {
+					// Key 0 has enough values for a sub-database.
+					n := 3
+					if i == 0 {
+						n = 1000
+					}
+					for j := 0; j < n; j++ {
+						err = txn.Put(dbi, []byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%04d", j)), 0)
+						if err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = env.View(func(txn *Txn) error { return txn.Verify() })
+			if err != nil {
+				t.Errorf("verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestEnv_PageChecksum_incompatible(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+	path, err := env.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env2, err := NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env2.Close()
+	err = env2.Open(path, PageChecksum, 0644)
+	if !IsErrno(err, Incompatible) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEnv_PageChecksum_corrupt(t *testing.T) {
+	env := setupFlags(t, PageChecksum)
+	path, err := env.Path()
+	if err != nil {
+		clean(env, t)
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	// The root is a leaf page and the large value is stored on the last
+	// pages of the file.
+	large := bytes.Repeat([]byte("large"), 2000)
+	err = env.Update(func(txn *Txn) (err error) {
+		dbi, err := txn.OpenRoot(0)
+		if err != nil {
+			return err
+		}
+		err = txn.Put(dbi, []byte("key"), []byte("value"), 0)
+		if err != nil {
+			return err
+		}
+		return txn.Put(dbi, []byte("large"), large, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := env.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := env.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Close()
+	cur := meta[0]
+	if !cur.Current {
+		cur = meta[1]
+	}
+	if stat.Depth != 1 || stat.OverflowPages == 0 || cur.Main.Root > uint64(cur.LastPNO)-stat.OverflowPages {
+		t.Fatalf("unexpected layout: %+v %+v", stat, cur)
+	}
+
+	for _, test := range []struct {
+		name string
+		pgno uint64
+		key  string
+	}{
+		{"leaf", cur.Main.Root, "key"},
+		{"overflow", uint64(cur.LastPNO), "large"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mdb_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			data, err := ioutil.ReadFile(filepath.Join(path, "data.mdb"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Flip a bit in the last byte of the page, which is in use in
+			// both kinds of page.
+			data[(test.pgno+1)*uint64(cur.PSize)-1] ^= 0x10
+			err = ioutil.WriteFile(filepath.Join(dir, "data.mdb"), data, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env, err := NewEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer env.Close()
+			err = env.Open(dir, 0, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = env.View(func(txn *Txn) (err error) {
+				dbi, err := txn.OpenRoot(0)
+				if err != nil {
+					return err
+				}
+				_, err = txn.Get(dbi, []byte(test.key))
+				return err
+			})
+			if !IsErrno(err, BadChecksum) {
+				t.Errorf("get: unexpected error: %v", err)
+			}
+			if err, ok := err.(*OpError); !ok || err.Op != "mdb_get" {
+				t.Errorf("get: unexpected error: %#v", err)
+			}
+			err = env.View(func(txn *Txn) error { return txn.Verify() })
+			if !IsErrno(err, BadChecksum) {
+				t.Errorf("verify: unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestEnv_PageChecksum_copy(t *testing.T) {
+	env := setupFlags(t, PageChecksum)
+	defer clean(env, t)
+	populateChecksumEnv(t, env)
+
+	for _, flags := range []uint{0, CopyCompact} {
+		dir, err := ioutil.TempDir("", "mdb_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		err = env.CopyFlag(dir, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		envcp, err := NewEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = envcp.Open(dir, Readonly, 0644)
+		if err != nil {
+			envcp.Close()
+			t.Fatal(err)
+		}
+		err = envcp.View(func(txn *Txn) error { return txn.Verify() })
+		if err != nil {
+			t.Errorf("copy %#x: verify: %v", flags, err)
+		}
+		envcp.Close()
+	}
+}
+
+// populateChecksumEnv writes databases using each kind of page.
+func populateChecksumEnv(t *testing.T, env *Env) {
+	err := env.Update(func(txn *Txn) (err error) {
+		plain, err := txn.OpenDBI("plain", Create)
+		if err != nil {
+			return err
+		}
+		dups, err := txn.OpenDBI("dups", Create|DupSort)
+		if err != nil {
+			return err
+		}
+		fixed, err := txn.OpenDBI("fixed", Create|DupSort|DupFixed)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2000; i++ {
+			k := []byte(fmt.Sprintf("key%05d", i))
+			v := bytes.Repeat(k, 1+i%20)
+			if i%100 == 0 {
+				v = bytes.Repeat(k, 1000)
+			}
+			err = txn.Put(plain, k, v, 0)
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 1+i%10*50; j++ {
+				v := []byte(fmt.Sprintf("%08d", j))
+				err = txn.Put(dups, k[:6], v, 0)
+				if err != nil {
+					return err
+				}
+				err = txn.Put(fixed, k[:6], v, 0)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Free some pages.
+	err = env.Update(func(txn *Txn) (err error) {
+		plain, err := txn.OpenDBI("plain", 0)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2000; i += 3 {
+			err = txn.Del(plain, []byte(fmt.Sprintf("key%05d", i)), nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -144,17 +144,8 @@ func (c *Cursor) DBI() DBI {
 //
 // See mdb_cursor_get.
 func (c *Cursor) Get(setkey, setval []byte, op uint) (key, val []byte, err error) {
-	switch {
-	case len(setkey) == 0:
-		err = c.getVal0(op)
-	case len(setval) == 0:
-		err = c.getVal1(setkey, op)
-	default:
-		err = c.getVal2(setkey, setval, op)
-	}
+	err = c.get(setkey, setval, op)
 	if err != nil {
-		*c.txn.key = C.MDB_val{}
-		*c.txn.val = C.MDB_val{}
 		return nil, nil, err
 	}
 
@@ -183,6 +174,67 @@ func (c *Cursor) Get(setkey, setval []byte, op uint) (key, val []byte, err error
 	return key, val, nil
 }
 
+// GetInto moves the cursor like Get but appends the key and value to kdst and
+// vdst, returning the extended slices, so that buffers can be reused across
+// calls without allocation regardless of c.Txn().RawRead.  On error kdst and
+// vdst are returned unmodified.
+//
+// See mdb_cursor_get.
+func (c *Cursor) GetInto(setkey, setval []byte, op uint, kdst, vdst []byte) (key, val []byte, err error) {
+	err = c.get(setkey, setval, op)
+	if err != nil {
+		return kdst, vdst, err
+	}
+	if op == Set {
+		key = append(kdst, setkey...)
+	} else {
+		key = append(kdst, getBytes(c.txn.key)...)
+	}
+	val = append(vdst, getBytes(c.txn.val)...)
+	*c.txn.key = C.MDB_val{}
+	*c.txn.val = C.MDB_val{}
+	return key, val, nil
+}
+
+// GetFunc moves the cursor like Get and calls fn with the key and value at its
+// new position.  The key and value reference readonly sections of memory, as
+// if c.Txn().RawRead were true, and must not be retained or accessed after fn
+// returns.  GetFunc returns the error returned by fn.
+//
+// See mdb_cursor_get.
+func (c *Cursor) GetFunc(setkey, setval []byte, op uint, fn func(key, val []byte) error) error {
+	err := c.get(setkey, setval, op)
+	if err != nil {
+		return err
+	}
+	key := setkey
+	if op != Set {
+		key = getBytes(c.txn.key)
+	}
+	val := getBytes(c.txn.val)
+	*c.txn.key = C.MDB_val{}
+	*c.txn.val = C.MDB_val{}
+	return fn(key, val)
+}
+
+// get calls mdb_cursor_get, leaving the key and value in c.txn.key and
+// c.txn.val on success.
+func (c *Cursor) get(setkey, setval []byte, op uint) (err error) {
+	switch {
+	case len(setkey) == 0:
+		err = c.getVal0(op)
+	case len(setval) == 0:
+		err = c.getVal1(setkey, op)
+	default:
+		err = c.getVal2(setkey, setval, op)
+	}
+	if err != nil {
+		*c.txn.key = C.MDB_val{}
+		*c.txn.val = C.MDB_val{}
+	}
+	return err
+}
+
 // getVal0 retrieves items from the database without using given key or value
 // data for reference (Next, First, Last, etc).
 //
@@ -243,6 +295,9 @@ func (c *Cursor) Put(key, val []byte, flags uint) error {
 		(*C.char)(unsafe.Pointer(&val[0])), C.size_t(len(val)),
 		C.uint(flags),
 	)
+	if ret == success && c.txn.watch != nil {
+		c.txn.watch.add(c.DBI(), key)
+	}
 	return operrno("mdb_cursor_put", ret)
 }
 
@@ -266,6 +321,9 @@ func (c *Cursor) PutReserve(key []byte, n int, flags uint) ([]byte, error) {
 		*c.txn.val = C.MDB_val{}
 		return nil, err
 	}
+	if c.txn.watch != nil {
+		c.txn.watch.add(c.DBI(), key)
+	}
 	b := getBytes(c.txn.val)
 	*c.txn.val = C.MDB_val{}
 	return b, nil
@@ -291,6 +349,9 @@ func (c *Cursor) PutMulti(key []byte, page []byte, stride int, flags uint) error
 		(*C.char)(unsafe.Pointer(&page[0])), C.size_t(vn), C.size_t(stride),
 		C.uint(flags|C.MDB_MULTIPLE),
 	)
+	if ret == success && c.txn.watch != nil {
+		c.txn.watch.add(c.DBI(), key)
+	}
 	return operrno("mdb_cursor_put", ret)
 }
 
@@ -298,10 +359,31 @@ func (c *Cursor) PutMulti(key []byte, page []byte, stride int, flags uint) error
 //
 // See mdb_cursor_del.
 func (c *Cursor) Del(flags uint) error {
+	if c.txn.watch != nil {
+		return c.delWatch(flags)
+	}
 	ret := C.mdb_cursor_del(c._c, C.uint(flags))
 	return operrno("mdb_cursor_del", ret)
 }
 
+// delWatch deletes the current item and records its key for watchers.
+func (c *Cursor) delWatch(flags uint) error {
+	ret := C.mdb_cursor_get(c._c, c.txn.key, c.txn.val, C.MDB_GET_CURRENT)
+	if ret != success {
+		*c.txn.key = C.MDB_val{}
+		*c.txn.val = C.MDB_val{}
+		return operrno("mdb_cursor_del", ret)
+	}
+	key := getBytesCopy(c.txn.key)
+	*c.txn.key = C.MDB_val{}
+	*c.txn.val = C.MDB_val{}
+	ret = C.mdb_cursor_del(c._c, C.uint(flags))
+	if ret == success {
+		c.txn.watch.add(c.DBI(), key)
+	}
+	return operrno("mdb_cursor_del", ret)
+}
+
 // Count returns the number of duplicates for the current key.
 //
 // See mdb_cursor_count.
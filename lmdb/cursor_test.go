@@ -270,6 +270,94 @@ func FromHex(in string) []byte {
 	return out
 }
 
+func TestCursor_GetInto(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var db DBI
+	err := env.Update(func(txn *Txn) (err error) {
+		db, err = txn.OpenDBI("testing", Create)
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"a", "b", "c"} {
+			err = txn.Put(db, []byte(k), []byte(k+k), 0)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.View(func(txn *Txn) (err error) {
+		cur, err := txn.OpenCursor(db)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		var keys, vals []byte
+		for {
+			keys, vals, err = cur.GetInto(nil, nil, Next, keys, vals)
+			if IsNotFound(err) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if string(keys) != "abc" || string(vals) != "aabbcc" {
+			t.Errorf("scanned %q %q", keys, vals)
+		}
+
+		setkey := []byte("b")
+		k, v, err := cur.GetInto(setkey, nil, Set, nil, nil)
+		if err != nil {
+			return err
+		}
+		if string(k) != "b" || string(v) != "bb" {
+			t.Errorf("set: %q %q", k, v)
+		}
+		if &k[0] == &setkey[0] {
+			t.Errorf("set: key shares memory with setkey")
+		}
+
+		allocs := testing.AllocsPerRun(100, func() {
+			keys, vals, err = cur.GetInto(nil, nil, First, keys[:0], vals[:0])
+		})
+		if err != nil {
+			return err
+		}
+		if allocs != 0 {
+			t.Errorf("allocs: %g", allocs)
+		}
+
+		err = cur.GetFunc([]byte("bb"), nil, SetRange, func(k, v []byte) error {
+			if string(k) != "c" || string(v) != "cc" {
+				t.Errorf("set range: %q %q", k, v)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = cur.GetFunc(nil, nil, Next, func(k, v []byte) error {
+			t.Errorf("called at end of database")
+			return nil
+		})
+		if !IsNotFound(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestDupCmpExcludeSuffix32(t *testing.T) {
 	hash32Bytes := FromHex("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
 	env := setup(t)
@@ -40,6 +40,21 @@ const (
 	NoLock      = C.MDB_NOLOCK     // Danger zone. LMDB does not use any locks.
 	NoReadahead = C.MDB_NORDAHEAD  // Disable readahead. Requires OS support.
 	NoMemInit   = C.MDB_NOMEMINIT  // Disable LMDB memory initialization.
+
+	// Write a checksum in each page and verify it when the page is read.
+	// The flag is stored in the environment, so it takes effect only when
+	// the environment is created and is always in effect afterwards.
+	// Opening an existing environment created without it with PageChecksum
+	// fails with Incompatible.  Pages of DupFixed duplicates are not
+	// checksummed.  Other builds of LMDB ignore the flag and write pages
+	// without checksums, which are then rejected with BadChecksum, so once
+	// the flag is set only this package may write to the environment.
+	PageChecksum = C.MDB_PAGECKSUM
+
+	// Open the previous snapshot rather than the latest one, losing the last
+	// committed transaction.  The environment must not be in use by another
+	// process.  The flag is reset once a write transaction commits.
+	PrevSnapshot = C.MDB_PREVSNAPSHOT
 )
 
 // These flags are exclusively used in the Env.CopyFlags and Env.CopyFDFlags
@@ -70,6 +85,16 @@ type Env struct {
 
 	ckey *C.MDB_val
 	cval *C.MDB_val
+
+	// watchMu protects the watcher registry and the names of open databases
+	// used to match writes with watchers.  numWatchers is read atomically
+	// when update transactions begin.  watchClosed is set when the
+	// environment starts closing.
+	watchMu     sync.RWMutex
+	watchers    map[*Watcher]bool
+	dbiNames    map[DBI]string
+	numWatchers int32
+	watchClosed bool
 }
 
 // NewEnv allocates and initializes a new Env.
@@ -167,6 +192,8 @@ func (env *Env) close() bool {
 		return false
 	}
 
+	env.closeWatchers()
+
 	env.closeLock.Lock()
 	C.mdb_env_close(env._env)
 	env._env = nil
@@ -287,6 +314,78 @@ func (env *Env) Info() (*EnvInfo, error) {
 	return &info, nil
 }
 
+// invalidPage is the root page number of an empty database (P_INVALID).
+const invalidPage = ^uint64(0)
+
+// MetaDB describes a database as recorded in a meta page.
+//
+// See MDB_metadb.
+type MetaDB struct {
+	Flags         uint   // Database flags
+	Depth         uint   // Depth (height) of the B-tree
+	BranchPages   uint64 // Number of internal (non-leaf) pages
+	LeafPages     uint64 // Number of leaf pages
+	OverflowPages uint64 // Number of overflow pages
+	Entries       uint64 // Number of data items
+	Root          uint64 // Root page, or P_INVALID if the database is empty
+}
+
+// MetaPage holds the contents of a meta page.
+//
+// See MDB_metainfo.
+type MetaPage struct {
+	Page    int    // Meta page number, 0 or 1
+	Current bool   // The page is the one in use by the environment
+	TxnID   int64  // ID of the transaction which wrote the page
+	MapSize int64  // Size of the data memory map
+	LastPNO int64  // ID of the last used page
+	PSize   uint   // Size of a database page
+	Flags   uint   // Persistent environment flags
+	Free    MetaDB // The free page database
+	Main    MetaDB // The main database
+}
+
+// Meta returns the contents of both meta pages of the environment.  The
+// environment writes the pages alternately, so the page which is not current
+// holds the previous snapshot (see PrevSnapshot).  The pages are read without
+// locking and may be inconsistent if a transaction is committing.
+//
+// See mdb_env_meta.
+func (env *Env) Meta() ([]MetaPage, error) {
+	pages := make([]MetaPage, 2)
+	for i := range pages {
+		var _meta C.MDB_metainfo
+		ret := C.mdb_env_meta(env._env, C.uint(i), &_meta)
+		if ret != success {
+			return nil, operrno("mdb_env_meta", ret)
+		}
+		pages[i] = MetaPage{
+			Page:    i,
+			Current: _meta.mmi_current != 0,
+			TxnID:   int64(_meta.mmi_txnid),
+			MapSize: int64(_meta.mmi_mapsize),
+			LastPNO: int64(_meta.mmi_last_pgno),
+			PSize:   uint(_meta.mmi_psize),
+			Flags:   uint(_meta.mmi_flags),
+			Free:    metaDB(&_meta.mmi_free),
+			Main:    metaDB(&_meta.mmi_main),
+		}
+	}
+	return pages, nil
+}
+
+func metaDB(_db *C.MDB_metadb) MetaDB {
+	return MetaDB{
+		Flags:         uint(_db.mmd_flags),
+		Depth:         uint(_db.mmd_depth),
+		BranchPages:   uint64(_db.mmd_branch_pages),
+		LeafPages:     uint64(_db.mmd_leaf_pages),
+		OverflowPages: uint64(_db.mmd_overflow_pages),
+		Entries:       uint64(_db.mmd_entries),
+		Root:          uint64(_db.mmd_root),
+	}
+}
+
 // Sync flushes buffers to disk.  If force is true a synchronous flush occurs
 // and ignores any NoSync or MapAsync flag on the environment.
 //
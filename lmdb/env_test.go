@@ -644,3 +644,273 @@ func TestEnv_CloseDBI(t *testing.T) {
 		t.Errorf("unexpected entries: %d (not %d)", stat.Entries, numdb)
 	}
 }
+
+func TestEnv_Open_prevSnapshot(t *testing.T) {
+	env := setup(t)
+	path, err := env.Path()
+	if err != nil {
+		clean(env, t)
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	put := func(env *Env, k, v string) {
+		err := env.Update(func(txn *Txn) (err error) {
+			dbi, err := txn.OpenRoot(0)
+			if err != nil {
+				return err
+			}
+			return txn.Put(dbi, []byte(k), []byte(v), 0)
+		})
+		if err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	get := func(env *Env, k string) string {
+		var v []byte
+		err := env.View(func(txn *Txn) (err error) {
+			dbi, err := txn.OpenRoot(0)
+			if err != nil {
+				return err
+			}
+			v, err = txn.Get(dbi, []byte(k))
+			return err
+		})
+		if IsNotFound(err) {
+			return ""
+		}
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		return string(v)
+	}
+	reopen := func(flags uint) *Env {
+		env, err := NewEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.Open(path, flags, 0664)
+		if err != nil {
+			env.Close()
+			t.Fatalf("open: %v", err)
+		}
+		return env
+	}
+
+	put(env, "k", "v1")
+	put(env, "k", "v2")
+	info, err := env.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Close()
+
+	env = reopen(PrevSnapshot | Readonly)
+	if v := get(env, "k"); v != "v1" {
+		t.Errorf("previous snapshot: %q (!= %q)", v, "v1")
+	}
+	prev, err := env.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev.LastTxnID >= info.LastTxnID {
+		t.Errorf("previous snapshot txnid: %d (latest %d)", prev.LastTxnID, info.LastTxnID)
+	}
+	env.Close()
+
+	// The latest snapshot is untouched by reading the previous one.
+	env = reopen(0)
+	if v := get(env, "k"); v != "v2" {
+		t.Errorf("latest snapshot: %q (!= %q)", v, "v2")
+	}
+	env.Close()
+
+	// Committing from the previous snapshot discards the latest one.
+	env = reopen(PrevSnapshot)
+	put(env, "k2", "v3")
+	flags, err := env.Flags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&PrevSnapshot != 0 {
+		t.Errorf("PrevSnapshot not reset after commit")
+	}
+	put(env, "k3", "v4")
+	env.Close()
+
+	env = reopen(0)
+	defer env.Close()
+	for k, want := range map[string]string{"k": "v1", "k2": "v3", "k3": "v4"} {
+		if v := get(env, k); v != want {
+			t.Errorf("%s: %q (!= %q)", k, v, want)
+		}
+	}
+}
+
+func TestEnv_Copy_prevSnapshot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("env funcs not supported on windows")
+	}
+	for _, flags := range []uint{0, CopyCompact} {
+		env := setup(t)
+		path, err := env.Path()
+		if err != nil {
+			clean(env, t)
+			t.Fatal(err)
+		}
+		for _, v := range []string{"v1", "v2"} {
+			err = env.Update(func(txn *Txn) (err error) {
+				dbi, err := txn.OpenRoot(0)
+				if err != nil {
+					return err
+				}
+				// Grow the database so the latest snapshot uses pages the
+				// previous one does not.
+				err = txn.Put(dbi, []byte(v), make([]byte, 1<<16), 0)
+				if err != nil {
+					return err
+				}
+				return txn.Put(dbi, []byte("k"), []byte(v), 0)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		env.Close()
+
+		env, err = NewEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.Open(path, PrevSnapshot|Readonly, 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dircp, err := ioutil.TempDir("", "test-env-copy-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.CopyFlag(dircp, flags)
+		clean(env, t)
+		if err != nil {
+			os.RemoveAll(dircp)
+			t.Fatalf("copy: %v", err)
+		}
+
+		envcp, err := NewEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = envcp.Open(dircp, 0, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = envcp.View(func(txn *Txn) (err error) {
+			dbi, err := txn.OpenRoot(0)
+			if err != nil {
+				return err
+			}
+			v, err := txn.Get(dbi, []byte("k"))
+			if err != nil {
+				return err
+			}
+			if string(v) != "v1" {
+				t.Errorf("copy %#x: %q (!= %q)", flags, v, "v1")
+			}
+			_, err = txn.Get(dbi, []byte("v2"))
+			if !IsNotFound(err) {
+				t.Errorf("copy %#x: latest snapshot copied: %v", flags, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		clean(envcp, t)
+	}
+}
+
+func TestEnv_Meta(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	meta, err := env.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range meta {
+		if m.Main.Root != invalidPage || m.Main.Entries != 0 {
+			t.Errorf("meta %d: empty environment: %+v", m.Page, m.Main)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		err = env.Update(func(txn *Txn) (err error) {
+			dbi, err := txn.OpenRoot(0)
+			if err != nil {
+				return err
+			}
+			return txn.Put(dbi, []byte(fmt.Sprint("k", i)), []byte("v"), 0)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meta, err = env.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta) != 2 {
+		t.Fatalf("meta pages: %d", len(meta))
+	}
+	if meta[0].Current == meta[1].Current {
+		t.Fatalf("current: %v %v", meta[0].Current, meta[1].Current)
+	}
+	cur, prev := meta[0], meta[1]
+	if !cur.Current {
+		cur, prev = prev, cur
+	}
+	info, err := env.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := env.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.TxnID != info.LastTxnID {
+		t.Errorf("txnid: %d (!= %d)", cur.TxnID, info.LastTxnID)
+	}
+	if prev.TxnID != cur.TxnID-1 {
+		t.Errorf("previous txnid: %d (current %d)", prev.TxnID, cur.TxnID)
+	}
+	if cur.LastPNO != info.LastPNO {
+		t.Errorf("last page: %d (!= %d)", cur.LastPNO, info.LastPNO)
+	}
+	if cur.MapSize != info.MapSize {
+		t.Errorf("map size: %d (!= %d)", cur.MapSize, info.MapSize)
+	}
+	if cur.PSize != stat.PSize {
+		t.Errorf("page size: %d (!= %d)", cur.PSize, stat.PSize)
+	}
+	if cur.Main.Entries != 2 || prev.Main.Entries != 1 {
+		t.Errorf("entries: %d %d", cur.Main.Entries, prev.Main.Entries)
+	}
+	if cur.Main.Root == invalidPage || int64(cur.Main.Root) > cur.LastPNO {
+		t.Errorf("root: %d", cur.Main.Root)
+	}
+}
+
+func TestEnv_Meta_notOpen(t *testing.T) {
+	env, err := NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	_, err = env.Meta()
+	if !IsErrnoSys(err, syscall.EINVAL) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -53,6 +53,7 @@ const (
 	BadTxn          Errno = C.MDB_BAD_TXN
 	BadValSize      Errno = C.MDB_BAD_VALSIZE
 	BadDBI          Errno = C.MDB_BAD_DBI
+	BadChecksum     Errno = C.MDB_BAD_CHECKSUM
 )
 
 // Errno is an error type that represents the (unique) errno values defined by
@@ -283,6 +283,8 @@ typedef void (MDB_rel_func)(MDB_val *item, void *oldptr, void *newptr, void *rel
  */
 	/** mmap at a fixed address (experimental) */
 #define MDB_FIXEDMAP	0x01
+	/** write and verify page checksums */
+#define MDB_PAGECKSUM	0x1000
 	/** no environment directory */
 #define MDB_NOSUBDIR	0x4000
 	/** don't fsync after commit */
@@ -303,6 +305,8 @@ typedef void (MDB_rel_func)(MDB_val *item, void *oldptr, void *newptr, void *rel
 #define MDB_NORDAHEAD	0x800000
 	/** don't initialize malloc'd memory before writing to datafile */
 #define MDB_NOMEMINIT	0x1000000
+	/** use the previous snapshot rather than the latest one */
+#define MDB_PREVSNAPSHOT	0x2000000
 /** @} */
 
 /**	@defgroup	mdb_dbi_open	Database Flags
@@ -448,8 +452,10 @@ typedef enum MDB_cursor_op {
 #define MDB_BAD_VALSIZE		(-30781)
 	/** The specified DBI was changed unexpectedly */
 #define MDB_BAD_DBI		(-30780)
+	/** Page checksum mismatch, see #MDB_PAGECKSUM */
+#define MDB_BAD_CHECKSUM	(-30779)
 	/** The last defined error code */
-#define MDB_LAST_ERRCODE	MDB_BAD_DBI
+#define MDB_LAST_ERRCODE	MDB_BAD_CHECKSUM
 /** @} */
 
 /** @brief Statistics for a database in the environment */
@@ -463,6 +469,43 @@ typedef struct MDB_stat {
 	size_t		ms_entries;			/**< Number of data items */
 } MDB_stat;
 
+/** @brief A large value found by #mdb_dbi_space() */
+typedef struct MDB_space_item {
+	MDB_val		msi_key;			/**< Key of the value. The data is valid only
+											until the next update operation or the
+											end of the transaction. */
+	size_t		msi_size;			/**< Size of the value */
+	size_t		msi_overflow_pages;	/**< Number of overflow pages holding the value,
+											or 0 if it is stored in its leaf page */
+} MDB_space_item;
+
+/** @brief Space used by the pages of a database
+ *
+ * Byte counts in use include page and node headers. Pages holding the
+ * duplicates of a #MDB_DUPSORT database are counted separately from the
+ * pages of its main tree.
+ */
+typedef struct MDB_space {
+	size_t		ms_branch_pages;		/**< Number of branch pages */
+	size_t		ms_branch_used;			/**< Bytes in use in branch pages */
+	size_t		ms_leaf_pages;			/**< Number of leaf pages */
+	size_t		ms_leaf_used;			/**< Bytes in use in leaf pages */
+	size_t		ms_overflow_pages;		/**< Number of overflow pages */
+	size_t		ms_overflow_used;		/**< Bytes in use in overflow pages */
+	size_t		ms_dup_branch_pages;	/**< Number of branch pages of duplicates */
+	size_t		ms_dup_branch_used;		/**< Bytes in use in branch pages of duplicates */
+	size_t		ms_dup_leaf_pages;		/**< Number of leaf pages of duplicates */
+	size_t		ms_dup_leaf_used;		/**< Bytes in use in leaf pages of duplicates */
+	size_t		ms_subpages;			/**< Number of duplicate sub-pages in leaf nodes */
+	size_t		ms_subpage_bytes;		/**< Size of duplicate sub-pages */
+	size_t		ms_key_bytes;			/**< Size of the keys stored */
+	size_t		ms_value_bytes;			/**< Size of the values stored, including each duplicate */
+	MDB_space_item	*ms_largest;		/**< Caller supplied array which is filled
+											with the largest values, largest first */
+	unsigned int	ms_nlargest_max;	/**< Number of entries in ms_largest */
+	unsigned int	ms_nlargest;		/**< Number of entries filled in ms_largest */
+} MDB_space;
+
 /** @brief Information about the environment */
 typedef struct MDB_envinfo {
 	void	*me_mapaddr;			/**< Address of map, if fixed */
@@ -473,6 +516,29 @@ typedef struct MDB_envinfo {
 	unsigned int me_numreaders;		/**< max reader slots used in the environment */
 } MDB_envinfo;
 
+/** @brief A database as recorded in a meta page */
+typedef struct MDB_metadb {
+	unsigned int	mmd_flags;			/**< Database flags */
+	unsigned int	mmd_depth;			/**< Depth (height) of the B-tree */
+	size_t		mmd_branch_pages;	/**< Number of internal (non-leaf) pages */
+	size_t		mmd_leaf_pages;		/**< Number of leaf pages */
+	size_t		mmd_overflow_pages;	/**< Number of overflow pages */
+	size_t		mmd_entries;		/**< Number of data items */
+	size_t		mmd_root;			/**< Root page, or ~0 if the database is empty */
+} MDB_metadb;
+
+/** @brief Contents of a meta page, as returned by #mdb_env_meta() */
+typedef struct MDB_metainfo {
+	size_t		mmi_txnid;			/**< ID of the transaction which wrote the page */
+	size_t		mmi_mapsize;		/**< Size of the data memory map */
+	size_t		mmi_last_pgno;		/**< ID of the last used page */
+	unsigned int	mmi_psize;			/**< Size of a database page */
+	unsigned int	mmi_flags;			/**< Persistent environment flags */
+	int		mmi_current;		/**< Non-zero if the page is in use by the environment */
+	MDB_metadb	mmi_free;			/**< The free page database */
+	MDB_metadb	mmi_main;			/**< The main database */
+} MDB_metainfo;
+
 	/** @brief Return the LMDB library version information.
 	 *
 	 * @param[out] major if non-NULL, the library major version number is copied here
@@ -614,6 +680,29 @@ int  mdb_env_create(MDB_env **env);
 	 *		caller is expected to overwrite all of the memory that was
 	 *		reserved in that case.
 	 *		This flag may be changed at any time using #mdb_env_set_flags().
+	 *	<li>#MDB_PREVSNAPSHOT
+	 *		Open the environment with the previous snapshot rather than the latest
+	 *		one. This loses the latest transaction, but may help work around some
+	 *		types of corruption. If opened with write access, this must be the
+	 *		only process using the environment. This flag is automatically reset
+	 *		after a write transaction is successfully committed.
+	 *	<li>#MDB_PAGECKSUM
+	 *		Store a checksum in each branch, leaf and overflow page when it is
+	 *		written, and verify it whenever the page is read from the map.
+	 *		A mismatch is reported as #MDB_BAD_CHECKSUM. The checksum is 16
+	 *		bits and is kept in the page header. Pages of #MDB_DUPFIXED
+	 *		databases which hold only fixed size items, and meta pages, are
+	 *		not checksummed. Verifying pages slows down reads, see
+	 *		#mdb_txn_verify() for verifying every page. This flag is
+	 *		persistent: it can only be set when the environment is created,
+	 *		and it is always in effect afterwards. Setting it on an existing
+	 *		environment created without it returns #MDB_INCOMPATIBLE.
+	 *		Other builds of LMDB, including the stock library and the tools
+	 *		built from it such as mdb_copy and mdb_load, ignore the flag and
+	 *		write pages without checksums, which this build then rejects
+	 *		with #MDB_BAD_CHECKSUM.
+	 *		Once the flag is set, only this library may write to the
+	 *		environment.
 	 * </ul>
 	 * @param[in] mode The UNIX permissions to set on created files and semaphores.
 	 * This parameter is ignored on Windows.
@@ -721,6 +810,25 @@ int  mdb_env_stat(MDB_env *env, MDB_stat *stat);
 	 */
 int  mdb_env_info(MDB_env *env, MDB_envinfo *stat);
 
+	/** @brief Return the contents of a meta page of the LMDB environment.
+	 *
+	 * The environment keeps two meta pages and writes them alternately.
+	 * The current page is the newer one, or the older one if the
+	 * environment was opened with #MDB_PREVSNAPSHOT. The page is read
+	 * without locking, so it may be torn by a concurrent commit.
+	 * @param[in] env An environment handle returned by #mdb_env_create()
+	 * and opened by #mdb_env_open()
+	 * @param[in] n The meta page to read, 0 or 1
+	 * @param[out] info The address of an #MDB_metainfo structure
+	 * 	where the information will be copied
+	 * @return A non-zero error value on failure and 0 on success. Some possible
+	 * errors are:
+	 * <ul>
+	 *	<li>EINVAL - an invalid parameter was specified, or the environment is not open.
+	 * </ul>
+	 */
+int  mdb_env_meta(MDB_env *env, unsigned int n, MDB_metainfo *info);
+
 	/** @brief Flush the data buffers to disk.
 	 *
 	 * Data is always written to disk when #mdb_txn_commit() is called,
@@ -1170,6 +1278,43 @@ int  mdb_dbi_open(MDB_txn *txn, const char *name, unsigned int flags, MDB_dbi *d
 	 */
 int  mdb_stat(MDB_txn *txn, MDB_dbi dbi, MDB_stat *stat);
 
+	/** @brief Measure the space used by a database.
+	 *
+	 * Every page of the database is visited, so this is much slower
+	 * than #mdb_stat().
+	 * @param[in] txn A transaction handle returned by #mdb_txn_begin()
+	 * @param[in] dbi A database handle returned by #mdb_dbi_open()
+	 * @param[in,out] space The address of an #MDB_space structure.
+	 * 	The caller sets ms_largest and ms_nlargest_max; all other
+	 * 	fields are set by this function.
+	 * @return A non-zero error value on failure and 0 on success. Some possible
+	 * errors are:
+	 * <ul>
+	 *	<li>EINVAL - an invalid parameter was specified.
+	 *	<li>#MDB_CORRUPTED - an unexpected page was found.
+	 * </ul>
+	 */
+int  mdb_dbi_space(MDB_txn *txn, MDB_dbi dbi, MDB_space *space);
+
+	/** @brief Read every page of the databases in a transaction's snapshot.
+	 *
+	 * The pages of the free page database, the main database and each
+	 * named database are visited, including overflow pages and the pages
+	 * of duplicates. In an environment opened with #MDB_PAGECKSUM the
+	 * checksum of each page is verified. Named databases are read as
+	 * recorded in the main database, so changes made by a write
+	 * transaction to a named database are not visited until it commits.
+	 * @param[in] txn A transaction handle returned by #mdb_txn_begin()
+	 * @return A non-zero error value on failure and 0 on success. Some possible
+	 * errors are:
+	 * <ul>
+	 *	<li>EINVAL - an invalid parameter was specified.
+	 *	<li>#MDB_BAD_CHECKSUM - a page checksum did not match.
+	 *	<li>#MDB_CORRUPTED - an unexpected page was found.
+	 * </ul>
+	 */
+int  mdb_txn_verify(MDB_txn *txn);
+
 	/** @brief Retrieve the DB flags for a database handle.
 	 *
 	 * @param[in] txn A transaction handle returned by #mdb_txn_begin()
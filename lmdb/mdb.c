@@ -1380,9 +1380,10 @@ static int	mdb_page_merge(MDB_cursor *csrc, MDB_cursor *cdst);
 static int	mdb_page_split(MDB_cursor *mc, MDB_val *newkey, MDB_val *newdata,
 				pgno_t newpgno, unsigned int nflags);
 
-static int  mdb_env_read_header(MDB_env *env, MDB_meta *meta);
+static int  mdb_env_read_header(MDB_env *env, int prev, MDB_meta *meta);
 static MDB_meta *mdb_env_pick_meta(const MDB_env *env);
 static int  mdb_env_write_meta(MDB_txn *txn);
+static int  mdb_env_share_locks(MDB_env *env, int *excl);
 #if defined(MDB_USE_POSIX_MUTEX) && !defined(MDB_ROBUST_SUPPORTED) /* Drop unused excl arg */
 # define mdb_env_close0(env, excl) mdb_env_close1(env)
 #endif
@@ -1475,6 +1476,7 @@ static char *const mdb_errstr[] = {
 	"MDB_BAD_TXN: Transaction must abort, has a child, or is invalid",
 	"MDB_BAD_VALSIZE: Unsupported size of key/DB name/data, or wrong DUPFIXED size",
 	"MDB_BAD_DBI: The specified DBI handle was closed/changed unexpectedly",
+	"MDB_BAD_CHECKSUM: Page checksum mismatch",
 };
 
 char *
@@ -3309,6 +3311,92 @@ mdb_freelist_save(MDB_txn *txn)
 	return rc;
 }
 
+/** Compute the checksum of a page for #MDB_PAGECKSUM.
+ * The checksum covers the page header except mp_pad, where it is
+ * stored, and the rest of the page or of all pages of an overflow page.
+ * @param[in] mp the page.
+ * @param[in] pgno the page number, which is checked rather than mp_pgno
+ * so that a page written to the wrong place is detected.
+ * @param[in] size the size of the page(s), a multiple of 8.
+ * @return the checksum.
+ */
+static uint16_t
+mdb_page_cksum(const MDB_page *mp, pgno_t pgno, size_t size)
+{
+	const uint64_t *w = (const uint64_t *)((const char *)mp + PAGEHDRSZ);
+	const uint64_t *end = (const uint64_t *)((const char *)mp + size);
+	uint64_t h = 0x9e3779b97f4a7c15ULL, h1 = 1, h2 = 2, h3 = 3;
+
+#define CKSUM_MIX(h, x)	((h) = ((h) ^ (x)) * 0xff51afd7ed558ccdULL, (h) ^= (h) >> 32)
+	CKSUM_MIX(h, (uint64_t)pgno);
+	CKSUM_MIX(h, (uint64_t)mp->mp_flags | (uint64_t)mp->mp_pages << 16);
+	/* Four independent lanes, so the multiplies can overlap */
+	for (; end - w >= 4; w += 4) {
+		CKSUM_MIX(h, w[0]);
+		CKSUM_MIX(h1, w[1]);
+		CKSUM_MIX(h2, w[2]);
+		CKSUM_MIX(h3, w[3]);
+	}
+	for (; w < end; w++)
+		CKSUM_MIX(h, *w);
+	CKSUM_MIX(h, h1);
+	CKSUM_MIX(h, h2);
+	CKSUM_MIX(h, h3);
+#undef CKSUM_MIX
+	/* Final avalanche, as MurmurHash3's fmix64 */
+	h ^= h >> 33;
+	h *= 0xc4ceb9fe1a85ec53ULL;
+	h ^= h >> 33;
+	return (uint16_t)(h ^ h >> 16 ^ h >> 32 ^ h >> 48);
+}
+
+/** Whether a page carries a checksum. LEAF2 pages keep their key
+ * size in mp_pad and meta pages are written separately.
+ */
+#define HAS_CKSUM(p)	(!((p)->mp_flags & (P_LEAF2|P_META)))
+
+/** Store the checksum of a page which is about to be written.
+ * @param[in] env the environment handle.
+ * @param[in] mp the page.
+ */
+static void
+mdb_page_setcksum(MDB_env *env, MDB_page *mp)
+{
+	size_t size = env->me_psize;
+
+	if (!HAS_CKSUM(mp))
+		return;
+	if (IS_OVERFLOW(mp))
+		size *= mp->mp_pages;
+	mp->mp_pad = mdb_page_cksum(mp, mp->mp_pgno, size);
+}
+
+/** Verify the checksum of a page read from the map.
+ * @param[in] txn the transaction reading the page.
+ * @param[in] mp the page.
+ * @param[in] pgno the number of the page.
+ * @return 0 on success, #MDB_BAD_CHECKSUM on failure.
+ */
+static int
+mdb_page_chkcksum(MDB_txn *txn, MDB_page *mp, pgno_t pgno)
+{
+	size_t size = txn->mt_env->me_psize;
+
+	if (!HAS_CKSUM(mp))
+		return MDB_SUCCESS;
+	if (IS_OVERFLOW(mp)) {
+		/* Don't trust the page count until the checksum matches */
+		if (mp->mp_pages == 0 || mp->mp_pages > txn->mt_next_pgno - pgno)
+			return MDB_BAD_CHECKSUM;
+		size *= mp->mp_pages;
+	}
+	if (mp->mp_pad != mdb_page_cksum(mp, pgno, size)) {
+		DPRINTF(("page %"Z"u checksum mismatch", pgno));
+		return MDB_BAD_CHECKSUM;
+	}
+	return MDB_SUCCESS;
+}
+
 /** Flush (some) dirty pages to the map, after clearing their dirty flag.
  * @param[in] txn the transaction that's being committed
  * @param[in] keep number of initial pages in dirty_list to keep dirty.
@@ -3346,6 +3434,8 @@ mdb_page_flush(MDB_txn *txn, int keep)
 				continue;
 			}
 			dp->mp_flags &= ~P_DIRTY;
+			if (env->me_flags & MDB_PAGECKSUM)
+				mdb_page_setcksum(env, dp);
 		}
 		goto done;
 	}
@@ -3363,6 +3453,8 @@ mdb_page_flush(MDB_txn *txn, int keep)
 			pgno = dl[i].mid;
 			/* clear dirty flag */
 			dp->mp_flags &= ~P_DIRTY;
+			if (env->me_flags & MDB_PAGECKSUM)
+				mdb_page_setcksum(env, dp);
 			pos = pgno * psize;
 			size = psize;
 			if (IS_OVERFLOW(dp)) size *= dp->mp_pages;
@@ -3680,6 +3772,20 @@ mdb_txn_commit(MDB_txn *txn)
 		(rc = mdb_env_write_meta(txn)))
 		goto fail;
 	end_mode = MDB_END_COMMITTED|MDB_END_UPDATE;
+	if (env->me_flags & MDB_PREVSNAPSHOT) {
+		/* The latest snapshot has been overwritten, other
+		 * processes may now use the environment.
+		 */
+		env->me_flags ^= MDB_PREVSNAPSHOT;
+		if (env->me_txns) {
+			int excl;
+			rc = mdb_env_share_locks(env, &excl);
+			if (rc) {
+				mdb_txn_end(txn, end_mode);
+				return rc;
+			}
+		}
+	}
 
 done:
 	mdb_txn_end(txn, end_mode);
@@ -3693,11 +3799,12 @@ fail:
 /** Read the environment parameters of a DB environment before
  * mapping it into memory.
  * @param[in] env the environment handle
+ * @param[in] prev whether to read the backup meta page
  * @param[out] meta address of where to store the meta information
  * @return 0 on success, non-zero on failure.
  */
 static int ESECT
-mdb_env_read_header(MDB_env *env, MDB_meta *meta)
+mdb_env_read_header(MDB_env *env, int prev, MDB_meta *meta)
 {
 	MDB_metabuf	pbuf;
 	MDB_page	*p;
@@ -3748,7 +3855,7 @@ mdb_env_read_header(MDB_env *env, MDB_meta *meta)
 			return MDB_VERSION_MISMATCH;
 		}
 
-		if (off == 0 || m->mm_txnid > meta->mm_txnid)
+		if (off == 0 || (prev ? m->mm_txnid < meta->mm_txnid : m->mm_txnid > meta->mm_txnid))
 			*meta = *m;
 	}
 	return 0;
@@ -3955,13 +4062,15 @@ done:
 
 /** Check both meta pages to see which one is newer.
  * @param[in] env the environment handle
- * @return newest #MDB_meta.
+ * @return newest #MDB_meta, or the older one if #MDB_PREVSNAPSHOT
+ * is in effect.
  */
 static MDB_meta *
 mdb_env_pick_meta(const MDB_env *env)
 {
 	MDB_meta *const *metas = env->me_metas;
-	return metas[ metas[0]->mm_txnid < metas[1]->mm_txnid ];
+	return metas[ (metas[0]->mm_txnid < metas[1]->mm_txnid) ^
+		((env->me_flags & MDB_PREVSNAPSHOT) != 0) ];
 }
 
 int ESECT
@@ -4431,7 +4540,7 @@ mdb_env_open2(MDB_env *env)
 	}
 #endif
 
-	if ((i = mdb_env_read_header(env, &meta)) != 0) {
+	if ((i = mdb_env_read_header(env, flags & MDB_PREVSNAPSHOT, &meta)) != 0) {
 		if (i != ENOENT)
 			return i;
 		DPUTS("new mdbenv");
@@ -4444,6 +4553,11 @@ mdb_env_open2(MDB_env *env)
 		meta.mm_mapsize = DEFAULT_MAPSIZE;
 	} else {
 		env->me_psize = meta.mm_psize;
+		/* Page checksums are set when the environment is created */
+		if (meta.mm_flags & MDB_PAGECKSUM)
+			env->me_flags |= MDB_PAGECKSUM;
+		else if (flags & MDB_PAGECKSUM)
+			return MDB_INCOMPATIBLE;
 	}
 
 	/* Was a mapsize configured? */
@@ -4988,7 +5102,8 @@ fail:
 	 */
 #define	CHANGEABLE	(MDB_NOSYNC|MDB_NOMETASYNC|MDB_MAPASYNC|MDB_NOMEMINIT)
 #define	CHANGELESS	(MDB_FIXEDMAP|MDB_NOSUBDIR|MDB_RDONLY| \
-	MDB_WRITEMAP|MDB_NOTLS|MDB_NOLOCK|MDB_NORDAHEAD)
+	MDB_WRITEMAP|MDB_NOTLS|MDB_NOLOCK|MDB_NORDAHEAD|MDB_PREVSNAPSHOT| \
+	MDB_PAGECKSUM)
 
 #if VALID_FLAGS & PERSISTENT_FLAGS & (CHANGEABLE|CHANGELESS)
 # error "Persistent DB flags & env flags overlap, but both go in mm_flags"
@@ -5050,6 +5165,14 @@ mdb_env_open(MDB_env *env, const char *path, unsigned int flags, mdb_mode_t mode
 			goto leave;
 	}
 
+	/* The previous snapshot may only be used while no other process
+	 * can see the latest one.
+	 */
+	if ((flags & MDB_PREVSNAPSHOT) && !excl) {
+		rc = EAGAIN;
+		goto leave;
+	}
+
 	if ((rc = mdb_env_open2(env)) == MDB_SUCCESS) {
 		if (!(flags & (MDB_RDONLY|MDB_WRITEMAP))) {
 			/* Synchronous fd for meta writes. Needed even with
@@ -5061,9 +5184,14 @@ mdb_env_open(MDB_env *env, const char *path, unsigned int flags, mdb_mode_t mode
 		}
 		DPRINTF(("opened dbenv %p", (void *) env));
 		if (excl > 0) {
-			rc = mdb_env_share_locks(env, &excl);
-			if (rc)
-				goto leave;
+			if (flags & MDB_PREVSNAPSHOT) {
+				/* Keep the exclusive lock until the first commit */
+				env->me_txns->mti_txnid = mdb_env_pick_meta(env)->mm_txnid;
+			} else {
+				rc = mdb_env_share_locks(env, &excl);
+				if (rc)
+					goto leave;
+			}
 		}
 		if (!(flags & MDB_RDONLY)) {
 			MDB_txn *txn;
@@ -5515,6 +5643,15 @@ mdb_page_get(MDB_cursor *mc, pgno_t pgno, MDB_page **ret, int *lvl)
 	if (pgno < txn->mt_next_pgno) {
 		level = 0;
 		p = (MDB_page *)(env->me_map + env->me_psize * pgno);
+		/* With MDB_WRITEMAP our own dirty pages are in the map too */
+		if ((env->me_flags & MDB_PAGECKSUM) &&
+			!((txn->mt_flags & MDB_TXN_WRITEMAP) && (p->mp_flags & P_DIRTY))) {
+			int rc = mdb_page_chkcksum(txn, p, pgno);
+			if (rc) {
+				txn->mt_flags |= MDB_TXN_ERROR;
+				return rc;
+			}
+		}
 	} else {
 		DPRINTF(("page %"Z"u not found", pgno));
 		txn->mt_flags |= MDB_TXN_ERROR;
@@ -9286,6 +9423,10 @@ mdb_env_cwalk(mdb_copy *my, pgno_t *pg, int flags)
 						mo = (MDB_page *)(my->mc_wbuf[toggle] + my->mc_wlen[toggle]);
 						memcpy(mo, omp, my->mc_env->me_psize);
 						mo->mp_pgno = my->mc_next_pgno;
+						/* The rest of the pages are written from the map */
+						if (my->mc_env->me_flags & MDB_PAGECKSUM)
+							mo->mp_pad = mdb_page_cksum(omp, mo->mp_pgno,
+								(size_t)my->mc_env->me_psize * omp->mp_pages);
 						my->mc_next_pgno += omp->mp_pages;
 						my->mc_wlen[toggle] += my->mc_env->me_psize;
 						if (omp->mp_pages > 1) {
@@ -9350,6 +9491,8 @@ again:
 		mo = (MDB_page *)(my->mc_wbuf[toggle] + my->mc_wlen[toggle]);
 		mdb_page_copy(mo, mp, my->mc_env->me_psize);
 		mo->mp_pgno = my->mc_next_pgno++;
+		if (my->mc_env->me_flags & MDB_PAGECKSUM)
+			mdb_page_setcksum(my->mc_env, mo);
 		my->mc_wlen[toggle] += my->mc_env->me_psize;
 		if (mc.mc_top) {
 			/* Update parent if there is one */
@@ -9506,7 +9649,7 @@ mdb_env_copyfd0(MDB_env *env, HANDLE fd)
 	mdb_mutexref_t wmutex = NULL;
 	int rc;
 	size_t wsize, w3;
-	char *ptr;
+	char *ptr, *mbuf = NULL;
 #ifdef _WIN32
 	DWORD len, w2;
 #define DO_WRITE(rc, fd, ptr, w2, len)	rc = WriteFile(fd, ptr, w2, &len, NULL)
@@ -9541,6 +9684,36 @@ mdb_env_copyfd0(MDB_env *env, HANDLE fd)
 
 	wsize = env->me_psize * NUM_METAS;
 	ptr = env->me_map;
+	if (env->me_flags & MDB_PREVSNAPSHOT) {
+		/* Copy the previous meta over the latest one, which may
+		 * refer to pages beyond the end of the copy.
+		 */
+		MDB_meta *meta = mdb_env_pick_meta(env);
+		int latest = meta == env->me_metas[0];
+		/* The copy may be opened with O_DIRECT, align the buffer */
+#ifdef _WIN32
+		if ((mbuf = _aligned_malloc(wsize, env->me_os_psize)) == NULL)
+			rc = ERROR_NOT_ENOUGH_MEMORY;
+#elif defined(HAVE_MEMALIGN)
+		if ((mbuf = memalign(env->me_os_psize, wsize)) == NULL)
+			rc = errno;
+#else
+		{
+			void *p;
+			if ((rc = posix_memalign(&p, env->me_os_psize, wsize)) == 0)
+				mbuf = p;
+		}
+#endif
+		if (rc) {
+			if (wmutex)
+				UNLOCK_MUTEX(wmutex);
+			goto leave;
+		}
+		memcpy(mbuf, env->me_map, wsize);
+		memcpy(METADATA((MDB_page *)(mbuf + latest * env->me_psize)),
+			meta, sizeof(MDB_meta));
+		ptr = mbuf;
+	}
 	w2 = wsize;
 	while (w2 > 0) {
 		DO_WRITE(rc, fd, ptr, w2, len);
@@ -9564,6 +9737,7 @@ mdb_env_copyfd0(MDB_env *env, HANDLE fd)
 	if (rc)
 		goto leave;
 
+	ptr = env->me_map + wsize;
 	w3 = txn->mt_next_pgno * env->me_psize;
 	{
 		size_t fsize = 0;
@@ -9594,6 +9768,11 @@ mdb_env_copyfd0(MDB_env *env, HANDLE fd)
 	}
 
 leave:
+#ifdef _WIN32
+	if (mbuf) _aligned_free(mbuf);
+#else
+	free(mbuf);
+#endif
 	mdb_txn_abort(txn);
 	return rc;
 }
@@ -9758,6 +9937,40 @@ mdb_env_info(MDB_env *env, MDB_envinfo *arg)
 	return MDB_SUCCESS;
 }
 
+static void ESECT
+mdb_env_metadb(MDB_db *db, MDB_metadb *arg)
+{
+	arg->mmd_flags = db->md_flags;
+	arg->mmd_depth = db->md_depth;
+	arg->mmd_branch_pages = db->md_branch_pages;
+	arg->mmd_leaf_pages = db->md_leaf_pages;
+	arg->mmd_overflow_pages = db->md_overflow_pages;
+	arg->mmd_entries = db->md_entries;
+	arg->mmd_root = db->md_root;
+}
+
+int ESECT
+mdb_env_meta(MDB_env *env, unsigned int n, MDB_metainfo *arg)
+{
+	MDB_meta *meta;
+
+	if (env == NULL || arg == NULL || n >= NUM_METAS || env->me_map == NULL)
+		return EINVAL;
+
+	meta = env->me_metas[n];
+	arg->mmi_txnid = meta->mm_txnid;
+	arg->mmi_mapsize = meta->mm_mapsize;
+	arg->mmi_last_pgno = meta->mm_last_pg;
+	arg->mmi_psize = meta->mm_psize;
+	arg->mmi_flags = meta->mm_flags & ~MDB_INTEGERKEY;
+	arg->mmi_current = meta == mdb_env_pick_meta(env);
+	mdb_env_metadb(&meta->mm_dbs[FREE_DBI], &arg->mmi_free);
+	mdb_env_metadb(&meta->mm_dbs[MAIN_DBI], &arg->mmi_main);
+	/* The free DB's flags are shared with the environment flags */
+	arg->mmi_free.mmd_flags = MDB_INTEGERKEY;
+	return MDB_SUCCESS;
+}
+
 /** Set the default comparison functions for a database.
  * Called immediately after a database is opened to set the defaults.
  * The user can then override them with #mdb_set_compare() or
@@ -9918,6 +10131,189 @@ mdb_stat(MDB_txn *txn, MDB_dbi dbi, MDB_stat *arg)
 	return mdb_stat0(txn->mt_env, &txn->mt_dbs[dbi], arg);
 }
 
+/** Record a value in the largest values of a space measurement. */
+static void ESECT
+mdb_space_large(MDB_space *sp, MDB_node *node, size_t size, size_t ovpages)
+{
+	MDB_space_item *it = sp->ms_largest;
+	unsigned int i, n = sp->ms_nlargest;
+
+	if (!sp->ms_nlargest_max)
+		return;
+	if (n == sp->ms_nlargest_max) {
+		if (size <= it[n-1].msi_size)
+			return;
+		n--;
+	} else {
+		sp->ms_nlargest++;
+	}
+	for (i = n; i > 0 && it[i-1].msi_size < size; i--)
+		it[i] = it[i-1];
+	MDB_GET_KEY2(node, it[i].msi_key);
+	it[i].msi_size = size;
+	it[i].msi_overflow_pages = ovpages;
+}
+
+/** Add the space used by the tree rooted at page pg to a measurement.
+ * @param[in] mc a cursor on the database.
+ * @param[in] pg the root page of the tree.
+ * @param[in] dup non-zero if the tree holds duplicates.
+ * @param[in,out] sp the measurement.
+ */
+static int ESECT
+mdb_space_walk(MDB_cursor *mc, pgno_t pg, int dup, MDB_space *sp)
+{
+	MDB_page *mp, *omp;
+	MDB_node *node;
+	MDB_db db;
+	unsigned int i, j, nkeys;
+	size_t used, size, ovpages;
+	int rc;
+
+	if ((rc = mdb_page_get(mc, pg, &mp, NULL)))
+		return rc;
+	nkeys = NUMKEYS(mp);
+	used = mc->mc_txn->mt_env->me_psize - SIZELEFT(mp);
+	if (IS_BRANCH(mp)) {
+		if (dup) {
+			sp->ms_dup_branch_pages++;
+			sp->ms_dup_branch_used += used;
+		} else {
+			sp->ms_branch_pages++;
+			sp->ms_branch_used += used;
+		}
+		for (i = 0; i < nkeys; i++) {
+			if ((rc = mdb_space_walk(mc, NODEPGNO(NODEPTR(mp, i)), dup, sp)))
+				return rc;
+		}
+		return MDB_SUCCESS;
+	}
+	if (!IS_LEAF(mp))
+		return MDB_CORRUPTED;
+	if (dup) {
+		sp->ms_dup_leaf_pages++;
+		sp->ms_dup_leaf_used += used;
+		/* The keys of a duplicate tree are the values of the database. */
+		if (IS_LEAF2(mp)) {
+			sp->ms_value_bytes += (size_t)nkeys * mp->mp_pad;
+		} else {
+			for (i = 0; i < nkeys; i++)
+				sp->ms_value_bytes += NODEKSZ(NODEPTR(mp, i));
+		}
+		return MDB_SUCCESS;
+	}
+	sp->ms_leaf_pages++;
+	sp->ms_leaf_used += used;
+	for (i = 0; i < nkeys; i++) {
+		node = NODEPTR(mp, i);
+		sp->ms_key_bytes += NODEKSZ(node);
+		size = NODEDSZ(node);
+		if (F_ISSET(node->mn_flags, F_DUPDATA)) {
+			if (F_ISSET(node->mn_flags, F_SUBDATA)) {
+				memcpy(&db, NODEDATA(node), sizeof(db));
+				if ((rc = mdb_space_walk(mc, db.md_root, 1, sp)))
+					return rc;
+				continue;
+			}
+			omp = NODEDATA(node);
+			sp->ms_subpages++;
+			sp->ms_subpage_bytes += size;
+			if (IS_LEAF2(omp)) {
+				sp->ms_value_bytes += (size_t)NUMKEYS(omp) * omp->mp_pad;
+			} else {
+				for (j = 0; j < NUMKEYS(omp); j++)
+					sp->ms_value_bytes += NODEKSZ(NODEPTR(omp, j));
+			}
+			continue;
+		}
+		sp->ms_value_bytes += size;
+		ovpages = 0;
+		if (F_ISSET(node->mn_flags, F_BIGDATA)) {
+			memcpy(&pg, NODEDATA(node), sizeof(pg));
+			if ((rc = mdb_page_get(mc, pg, &omp, NULL)))
+				return rc;
+			if (!IS_OVERFLOW(omp))
+				return MDB_CORRUPTED;
+			ovpages = omp->mp_pages;
+			sp->ms_overflow_pages += ovpages;
+			sp->ms_overflow_used += PAGEHDRSZ + size;
+		}
+		mdb_space_large(sp, node, size, ovpages);
+	}
+	return MDB_SUCCESS;
+}
+
+int ESECT
+mdb_dbi_space(MDB_txn *txn, MDB_dbi dbi, MDB_space *sp)
+{
+	MDB_cursor mc;
+	MDB_xcursor mx;
+	MDB_space_item *largest;
+	unsigned int nlargest_max;
+
+	if (!sp || !TXN_DBI_EXIST(txn, dbi, DB_VALID))
+		return EINVAL;
+
+	if (txn->mt_flags & MDB_TXN_BLOCKED)
+		return MDB_BAD_TXN;
+
+	largest = sp->ms_largest;
+	nlargest_max = largest ? sp->ms_nlargest_max : 0;
+	memset(sp, 0, sizeof(*sp));
+	sp->ms_largest = largest;
+	sp->ms_nlargest_max = nlargest_max;
+
+	/* Reads the DB's root if it is stale. */
+	mdb_cursor_init(&mc, txn, dbi, &mx);
+	if (txn->mt_dbs[dbi].md_root == P_INVALID)
+		return MDB_SUCCESS;
+	return mdb_space_walk(&mc, txn->mt_dbs[dbi].md_root, 0, sp);
+}
+
+int ESECT
+mdb_txn_verify(MDB_txn *txn)
+{
+	MDB_cursor mc, m2;
+	MDB_space sp;
+	MDB_val key, data;
+	MDB_node *node;
+	MDB_db db;
+	MDB_dbi dbi;
+	int rc;
+
+	if (!txn)
+		return EINVAL;
+
+	for (dbi = FREE_DBI; dbi <= MAIN_DBI; dbi++) {
+		memset(&sp, 0, sizeof(sp));
+		if ((rc = mdb_dbi_space(txn, dbi, &sp)))
+			return rc;
+	}
+
+	/* Walk the named DBs recorded in the main DB.  A main DB with
+	 * MDB_DUPSORT cannot hold named DBs.
+	 */
+	if (txn->mt_dbs[MAIN_DBI].md_flags & MDB_DUPSORT)
+		return MDB_SUCCESS;
+	mdb_cursor_init(&mc, txn, MAIN_DBI, NULL);
+	mdb_cursor_init(&m2, txn, MAIN_DBI, NULL);
+	for (rc = mdb_cursor_first(&mc, &key, &data); rc == MDB_SUCCESS;
+		rc = mdb_cursor_next(&mc, &key, &data, MDB_NEXT)) {
+		node = NODEPTR(mc.mc_pg[mc.mc_top], mc.mc_ki[mc.mc_top]);
+		if ((node->mn_flags & (F_SUBDATA|F_DUPDATA)) != F_SUBDATA)
+			continue;
+		if (data.mv_size != sizeof(MDB_db))
+			return MDB_CORRUPTED;
+		memcpy(&db, data.mv_data, sizeof(db));
+		if (db.md_root == P_INVALID)
+			continue;
+		memset(&sp, 0, sizeof(sp));
+		if ((rc = mdb_space_walk(&m2, db.md_root, 0, &sp)))
+			return rc;
+	}
+	return rc == MDB_NOTFOUND ? MDB_SUCCESS : rc;
+}
+
 void mdb_dbi_close(MDB_env *env, MDB_dbi dbi)
 {
 	char *ptr;
@@ -0,0 +1,165 @@
+package lmdb
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrValueFull is returned by ValueWriter methods when data does not fit in
+// the space reserved for a value.
+var ErrValueFull = errors.New("reserved value is full")
+
+// ValueWriter is an io.Writer which fills space reserved for a value with
+// Txn.PutReserve or Cursor.PutReserve.  Data written to a ValueWriter is
+// copied directly into the memory map (or the dirty page holding the value) so
+// encoders such as encoding/binary.Write or encoding/json.Encoder can build a
+// value without an intermediate buffer.  The saving is greatest for large
+// values; for values of a few hundred bytes building the value in a reused
+// buffer and calling Put is as fast, and shrinking a value with Close costs a
+// second Put.
+//
+// A ValueWriter must be finished with Close or Pad before any other write is
+// made in its transaction, because the reserved space may move when the
+// database is modified.  The key passed to PutWriter must not be modified
+// before then.
+type ValueWriter struct {
+	txn *Txn
+	cur *Cursor
+	dbi DBI
+	key []byte
+	buf []byte
+	n   int
+}
+
+// PutWriter reserves n bytes for the value of key and returns a ValueWriter
+// to fill them.  The flags are passed to PutReserve.
+func (txn *Txn) PutWriter(dbi DBI, key []byte, n int, flags uint) (*ValueWriter, error) {
+	buf, err := txn.PutReserve(dbi, key, n, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &ValueWriter{txn: txn, dbi: dbi, key: key, buf: buf}, nil
+}
+
+// PutWriter reserves n bytes for the value of key and returns a ValueWriter
+// to fill them.  The flags are passed to PutReserve.
+func (c *Cursor) PutWriter(key []byte, n int, flags uint) (*ValueWriter, error) {
+	buf, err := c.PutReserve(key, n, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &ValueWriter{cur: c, key: key, buf: buf}, nil
+}
+
+// Len returns the number of bytes written.
+func (w *ValueWriter) Len() int {
+	return w.n
+}
+
+// Available returns the number of bytes which may still be written.
+func (w *ValueWriter) Available() int {
+	return len(w.buf) - w.n
+}
+
+// Write copies p into the reserved space.  If p does not fit Write copies as
+// much as possible and returns ErrValueFull.
+func (w *ValueWriter) Write(p []byte) (int, error) {
+	if w.buf == nil && len(p) > 0 {
+		return 0, ErrValueFull
+	}
+	n := copy(w.buf[w.n:], p)
+	w.n += n
+	if n < len(p) {
+		return n, ErrValueFull
+	}
+	return n, nil
+}
+
+// WriteString is like Write but takes a string.
+func (w *ValueWriter) WriteString(s string) (int, error) {
+	if w.buf == nil && len(s) > 0 {
+		return 0, ErrValueFull
+	}
+	n := copy(w.buf[w.n:], s)
+	w.n += n
+	if n < len(s) {
+		return n, ErrValueFull
+	}
+	return n, nil
+}
+
+// WriteByte implements io.ByteWriter.
+func (w *ValueWriter) WriteByte(c byte) error {
+	if w.n >= len(w.buf) {
+		return ErrValueFull
+	}
+	w.buf[w.n] = c
+	w.n++
+	return nil
+}
+
+// ReadFrom reads from r into the reserved space until r returns io.EOF.
+// ReadFrom returns ErrValueFull if r has more data than fits.
+func (w *ValueWriter) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		if w.n == len(w.buf) {
+			var b [1]byte
+			n, err := r.Read(b[:])
+			if n > 0 {
+				return total, ErrValueFull
+			}
+			if err == io.EOF {
+				return total, nil
+			}
+			if err != nil {
+				return total, err
+			}
+			continue
+		}
+		n, err := r.Read(w.buf[w.n:])
+		w.n += n
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Close finishes the value.  If fewer bytes were written than were reserved
+// the value is shrunk by storing the written bytes with a second Put, which
+// copies them.
+func (w *ValueWriter) Close() error {
+	if w.buf == nil {
+		return nil
+	}
+	buf, n := w.buf, w.n
+	w.buf, w.n = nil, 0
+	if n == len(buf) {
+		return nil
+	}
+	// The reserved space is in the page that the second Put modifies.
+	val := make([]byte, n)
+	copy(val, buf)
+	if w.cur != nil {
+		return w.cur.Put(w.key, val, Current)
+	}
+	return w.txn.Put(w.dbi, w.key, val, 0)
+}
+
+// Pad finishes the value, filling any unwritten space with zeros so that the
+// value keeps its reserved size.
+func (w *ValueWriter) Pad() error {
+	if w.buf == nil {
+		return nil
+	}
+	rest := w.buf[w.n:]
+	for i := range rest {
+		rest[i] = 0
+	}
+	w.buf, w.n = nil, 0
+	return nil
+}
@@ -0,0 +1,187 @@
+package lmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTxn_PutWriter(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var dbi DBI
+	err := env.Update(func(txn *Txn) (err error) {
+		dbi, err = txn.OpenDBI("testdb", Create)
+		if err != nil {
+			return err
+		}
+
+		// Exact fit.
+		w, err := txn.PutWriter(dbi, []byte("exact"), 12, 0)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(w, binary.BigEndian, [3]uint32{1, 2, 3})
+		if err != nil {
+			return err
+		}
+		if w.Available() != 0 {
+			t.Errorf("available: %d", w.Available())
+		}
+		err = w.WriteByte('x')
+		if err != ErrValueFull {
+			t.Errorf("write byte: unexpected error: %v", err)
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+
+		// Underflow shrinks the value.
+		w, err = txn.PutWriter(dbi, []byte("json"), 100, 0)
+		if err != nil {
+			return err
+		}
+		err = json.NewEncoder(w).Encode(map[string]int{"a": 1})
+		if err != nil {
+			return err
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+
+		// Underflow with padding.
+		w, err = txn.PutWriter(dbi, []byte("pad"), 8, 0)
+		if err != nil {
+			return err
+		}
+		_, err = w.WriteString("abc")
+		if err != nil {
+			return err
+		}
+		err = w.Pad()
+		if err != nil {
+			return err
+		}
+
+		// Overflow writes as much as fits.
+		w, err = txn.PutWriter(dbi, []byte("overflow"), 4, 0)
+		if err != nil {
+			return err
+		}
+		n, err := w.Write([]byte("abcdef"))
+		if n != 4 || err != ErrValueFull {
+			t.Errorf("overflow: %d %v", n, err)
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+
+		// ReadFrom.
+		w, err = txn.PutWriter(dbi, []byte("readfrom"), 10, 0)
+		if err != nil {
+			return err
+		}
+		_, err = w.ReadFrom(strings.NewReader("hello"))
+		if err != nil {
+			return err
+		}
+		_, err = w.ReadFrom(strings.NewReader("world"))
+		if err != nil {
+			return err
+		}
+		_, err = w.ReadFrom(strings.NewReader("!"))
+		if err != ErrValueFull {
+			t.Errorf("read from: unexpected error: %v", err)
+		}
+		return w.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"exact":    "\x00\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00\x03",
+		"json":     "{\"a\":1}\n",
+		"pad":      "abc\x00\x00\x00\x00\x00",
+		"overflow": "abcd",
+		"readfrom": "helloworld",
+	}
+	err = env.View(func(txn *Txn) (err error) {
+		for k, v := range expect {
+			b, err := txn.Get(dbi, []byte(k))
+			if err != nil {
+				return err
+			}
+			if string(b) != v {
+				t.Errorf("%s: %q (!= %q)", k, b, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCursor_PutWriter(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var dbi DBI
+	err := env.Update(func(txn *Txn) (err error) {
+		dbi, err = txn.OpenDBI("testdb", Create)
+		if err != nil {
+			return err
+		}
+		cur, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+		for _, k := range []string{"a", "b", "c"} {
+			w, err := cur.PutWriter([]byte(k), 1000, 0)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(bytes.Repeat([]byte(k), 10))
+			if err != nil {
+				return err
+			}
+			err = w.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.View(func(txn *Txn) (err error) {
+		stat, err := txn.Stat(dbi)
+		if err != nil {
+			return err
+		}
+		if stat.Entries != 3 {
+			t.Errorf("entries: %d", stat.Entries)
+		}
+		b, err := txn.Get(dbi, []byte("b"))
+		if err != nil {
+			return err
+		}
+		if string(b) != strings.Repeat("b", 10) {
+			t.Errorf("unexpected value: %q", b)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
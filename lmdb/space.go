@@ -0,0 +1,114 @@
+package lmdb
+
+/*
+#include <stdlib.h>
+#include "lmdb.h"
+*/
+import "C"
+
+import "unsafe"
+
+// PageSpace describes the pages of one kind in a database.
+type PageSpace struct {
+	Pages uint64 // Number of pages
+	Bytes uint64 // Size of the pages
+	Used  uint64 // Bytes in use, including page and node headers
+}
+
+// Fill returns the fraction of the bytes of the pages which are in use.
+func (s PageSpace) Fill() float64 {
+	if s.Bytes == 0 {
+		return 0
+	}
+	return float64(s.Used) / float64(s.Bytes)
+}
+
+func (s PageSpace) add(other PageSpace) PageSpace {
+	return PageSpace{
+		Pages: s.Pages + other.Pages,
+		Bytes: s.Bytes + other.Bytes,
+		Used:  s.Used + other.Used,
+	}
+}
+
+// LargeValue is a value reported in Space.Largest.
+type LargeValue struct {
+	Key           []byte
+	Size          uint64 // Size of the value
+	OverflowPages uint64 // Overflow pages holding the value, zero if it is stored in its leaf page
+}
+
+// Space describes the space used by a database, as measured by Txn.Space.
+// For a DupSort database the pages holding duplicates are reported
+// separately from the pages of the main tree, which are all that Txn.Stat
+// counts.  Duplicates stored in sub-pages use space within leaf pages.
+type Space struct {
+	PSize        uint      // Size of a database page
+	Branch       PageSpace // Branch pages
+	Leaf         PageSpace // Leaf pages
+	Overflow     PageSpace // Overflow pages
+	DupBranch    PageSpace // Branch pages of duplicates (DupSort)
+	DupLeaf      PageSpace // Leaf pages of duplicates (DupSort)
+	SubPages     uint64    // Number of sub-pages of duplicates (DupSort)
+	SubPageBytes uint64    // Size of sub-pages of duplicates (DupSort)
+	KeyBytes     uint64    // Size of the keys stored, counting each key once
+	ValueBytes   uint64    // Size of the values stored, counting each duplicate
+	Largest      []LargeValue
+}
+
+// Total returns the total of the pages used by the database.
+func (s *Space) Total() PageSpace {
+	return s.Branch.add(s.Leaf).add(s.Overflow).add(s.DupBranch).add(s.DupLeaf)
+}
+
+// Space measures the space used by the database dbi and reports the n
+// largest values, largest first.  Values in DupSort databases are not
+// reported in Largest as duplicates are always small.  Space visits every
+// page of the database so it is much slower than Stat.
+//
+// See mdb_dbi_space.
+func (txn *Txn) Space(dbi DBI, n int) (*Space, error) {
+	var _space C.MDB_space
+	if n > 0 {
+		size := C.size_t(unsafe.Sizeof(C.MDB_space_item{}))
+		_space.ms_largest = (*C.MDB_space_item)(C.calloc(C.size_t(n), size))
+		defer C.free(unsafe.Pointer(_space.ms_largest))
+		_space.ms_nlargest_max = C.uint(n)
+	}
+	ret := C.mdb_dbi_space(txn._txn, C.MDB_dbi(dbi), &_space)
+	if ret != success {
+		return nil, operrno("mdb_dbi_space", ret)
+	}
+	stat, err := txn.Stat(dbi)
+	if err != nil {
+		return nil, err
+	}
+	psize := uint64(stat.PSize)
+	pages := func(n, used C.size_t) PageSpace {
+		return PageSpace{Pages: uint64(n), Bytes: uint64(n) * psize, Used: uint64(used)}
+	}
+	space := &Space{
+		PSize:        uint(psize),
+		Branch:       pages(_space.ms_branch_pages, _space.ms_branch_used),
+		Leaf:         pages(_space.ms_leaf_pages, _space.ms_leaf_used),
+		Overflow:     pages(_space.ms_overflow_pages, _space.ms_overflow_used),
+		DupBranch:    pages(_space.ms_dup_branch_pages, _space.ms_dup_branch_used),
+		DupLeaf:      pages(_space.ms_dup_leaf_pages, _space.ms_dup_leaf_used),
+		SubPages:     uint64(_space.ms_subpages),
+		SubPageBytes: uint64(_space.ms_subpage_bytes),
+		KeyBytes:     uint64(_space.ms_key_bytes),
+		ValueBytes:   uint64(_space.ms_value_bytes),
+	}
+	if _space.ms_nlargest > 0 {
+		items := unsafe.Slice(_space.ms_largest, _space.ms_nlargest)
+		space.Largest = make([]LargeValue, len(items))
+		for i := range items {
+			space.Largest[i] = LargeValue{
+				Key:           getBytesCopy(&items[i].msi_key),
+				Size:          uint64(items[i].msi_size),
+				OverflowPages: uint64(items[i].msi_overflow_pages),
+			}
+		}
+	}
+	return space, nil
+}
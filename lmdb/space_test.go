@@ -0,0 +1,171 @@
+package lmdb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestTxn_Space(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var dbi DBI
+	var keyBytes, valBytes uint64
+	err := env.Update(func(txn *Txn) (err error) {
+		dbi, err = txn.OpenDBI("testspace", Create)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("key%05d", i))
+			v := bytes.Repeat([]byte{'x'}, 10+i%50)
+			switch i {
+			case 100:
+				v = make([]byte, 3<<13)
+			case 200:
+				v = make([]byte, 5<<13)
+			}
+			err = txn.Put(dbi, k, v, 0)
+			if err != nil {
+				return err
+			}
+			keyBytes += uint64(len(k))
+			valBytes += uint64(len(v))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.View(func(txn *Txn) error {
+		stat, err := txn.Stat(dbi)
+		if err != nil {
+			return err
+		}
+		space, err := txn.Space(dbi, 3)
+		if err != nil {
+			return err
+		}
+		if space.PSize != stat.PSize {
+			t.Errorf("psize: %d (!= %d)", space.PSize, stat.PSize)
+		}
+		if space.Branch.Pages != stat.BranchPages {
+			t.Errorf("branch pages: %d (!= %d)", space.Branch.Pages, stat.BranchPages)
+		}
+		if space.Leaf.Pages != stat.LeafPages {
+			t.Errorf("leaf pages: %d (!= %d)", space.Leaf.Pages, stat.LeafPages)
+		}
+		if space.Overflow.Pages != stat.OverflowPages {
+			t.Errorf("overflow pages: %d (!= %d)", space.Overflow.Pages, stat.OverflowPages)
+		}
+		if space.KeyBytes != keyBytes {
+			t.Errorf("key bytes: %d (!= %d)", space.KeyBytes, keyBytes)
+		}
+		if space.ValueBytes != valBytes {
+			t.Errorf("value bytes: %d (!= %d)", space.ValueBytes, valBytes)
+		}
+		if fill := space.Leaf.Fill(); fill <= 0 || fill > 1 {
+			t.Errorf("leaf fill: %g", fill)
+		}
+		total := space.Total()
+		if total.Pages != stat.BranchPages+stat.LeafPages+stat.OverflowPages {
+			t.Errorf("total pages: %d", total.Pages)
+		}
+
+		if len(space.Largest) != 3 {
+			t.Fatalf("largest: %d values", len(space.Largest))
+		}
+		if string(space.Largest[0].Key) != "key00200" || string(space.Largest[1].Key) != "key00100" {
+			t.Errorf("largest: %q %q", space.Largest[0].Key, space.Largest[1].Key)
+		}
+		for i, v := range space.Largest[:2] {
+			if v.OverflowPages == 0 {
+				t.Errorf("largest %d: no overflow pages", i)
+			}
+		}
+		if space.Largest[2].OverflowPages != 0 || space.Largest[2].Size != 59 {
+			t.Errorf("largest 2: %+v", space.Largest[2])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxn_Space_dupSort(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var dbi DBI
+	var keyBytes, valBytes uint64
+	err := env.Update(func(txn *Txn) (err error) {
+		dbi, err = txn.OpenDBI("testspace", Create|DupSort)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 50; i++ {
+			k := []byte(fmt.Sprintf("key%03d", i))
+			keyBytes += uint64(len(k))
+			// Keys with few duplicates are stored in sub-pages and keys
+			// with many in sub-databases.
+			n := 3
+			if i%10 == 0 {
+				n = 2000
+			}
+			for j := 0; j < n; j++ {
+				v := []byte(fmt.Sprintf("value%06d", j))
+				err = txn.Put(dbi, k, v, 0)
+				if err != nil {
+					return err
+				}
+				valBytes += uint64(len(v))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.View(func(txn *Txn) error {
+		stat, err := txn.Stat(dbi)
+		if err != nil {
+			return err
+		}
+		space, err := txn.Space(dbi, 10)
+		if err != nil {
+			return err
+		}
+		if space.Branch.Pages != stat.BranchPages {
+			t.Errorf("branch pages: %d (!= %d)", space.Branch.Pages, stat.BranchPages)
+		}
+		if space.Leaf.Pages != stat.LeafPages {
+			t.Errorf("leaf pages: %d (!= %d)", space.Leaf.Pages, stat.LeafPages)
+		}
+		if space.DupLeaf.Pages == 0 {
+			t.Errorf("dup leaf pages: 0")
+		}
+		if space.SubPages != 45 {
+			t.Errorf("sub-pages: %d (!= 45)", space.SubPages)
+		}
+		if space.SubPageBytes == 0 {
+			t.Errorf("sub-page bytes: 0")
+		}
+		if space.KeyBytes != keyBytes {
+			t.Errorf("key bytes: %d (!= %d)", space.KeyBytes, keyBytes)
+		}
+		if space.ValueBytes != valBytes {
+			t.Errorf("value bytes: %d (!= %d)", space.ValueBytes, valBytes)
+		}
+		if len(space.Largest) != 0 {
+			t.Errorf("largest: %d values", len(space.Largest))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -63,6 +63,11 @@ type Txn struct {
 	key  *C.MDB_val
 	val  *C.MDB_val
 
+	// watch records writes for delivery to watchers after a successful
+	// commit.  watch is nil unless the Env had watchers when txn began.
+	watch  *watchLog
+	parent *Txn
+
 	errLogf func(format string, v ...interface{})
 }
 
@@ -100,6 +105,14 @@ func beginTxn(env *Env, parent *Txn, flags uint) (*Txn, error) {
 	if ret != success {
 		return nil, operrno("mdb_txn_begin", ret)
 	}
+	if parent != nil {
+		txn.parent = parent
+		if parent.watch != nil {
+			txn.watch = &watchLog{}
+		}
+	} else if !txn.readonly && env.watching() {
+		txn.watch = &watchLog{}
+	}
 	return txn, nil
 }
 
@@ -190,9 +203,20 @@ func (txn *Txn) Commit() error {
 }
 
 func (txn *Txn) commit() error {
+	var id uintptr
+	if txn.watch != nil {
+		id = txn.ID()
+	}
 	ret := C.mdb_txn_commit(txn._txn)
 	txn.clearTxn()
-	return operrno("mdb_txn_commit", ret)
+	if ret != success {
+		txn.watch = nil
+		return operrno("mdb_txn_commit", ret)
+	}
+	if txn.watch != nil {
+		txn.commitWatch(id)
+	}
+	return nil
 }
 
 // Abort discards pending writes in the transaction and clears the finalizer on
@@ -222,6 +246,7 @@ func (txn *Txn) abort() {
 	txn.env.closeLock.RUnlock()
 
 	txn.clearTxn()
+	txn.watch = nil
 }
 
 func (txn *Txn) clearTxn() {
@@ -305,6 +330,9 @@ func (txn *Txn) OpenDBI(name string, flags uint) (DBI, error) {
 	cname := C.CString(name)
 	dbi, err := txn.openDBI(cname, flags)
 	C.free(unsafe.Pointer(cname))
+	if err == nil {
+		txn.env.setDBIName(dbi, name)
+	}
 	return dbi, err
 }
 
@@ -324,7 +352,11 @@ func (txn *Txn) Flags(dbi DBI) (uint, error) {
 // does not require env.SetMaxDBs() to be called beforehand.  And, OpenRoot can
 // be called without flags in a View transaction.
 func (txn *Txn) OpenRoot(flags uint) (DBI, error) {
-	return txn.openDBI(nil, flags)
+	dbi, err := txn.openDBI(nil, flags)
+	if err == nil {
+		txn.env.setDBIName(dbi, "")
+	}
+	return dbi, err
 }
 
 // openDBI returns returns whatever DBI value was set by mdb_open_dbi.  In an
@@ -356,12 +388,27 @@ func (txn *Txn) Stat(dbi DBI) (*Stat, error) {
 	return &stat, nil
 }
 
+// Verify reads every page of the free page database, the main database and
+// the named databases in the transaction's snapshot.  In an environment
+// created with PageChecksum the checksum of every page is verified and a
+// mismatch is reported as BadChecksum.  Named databases are read as recorded
+// in the main database, so Verify is best run in a read-only transaction.
+//
+// See mdb_txn_verify.
+func (txn *Txn) Verify() error {
+	ret := C.mdb_txn_verify(txn._txn)
+	return operrno("mdb_txn_verify", ret)
+}
+
 // Drop empties the database if del is false.  Drop deletes and closes the
 // database if del is true.
 //
 // See mdb_drop.
 func (txn *Txn) Drop(dbi DBI, del bool) error {
 	ret := C.mdb_drop(txn._txn, C.MDB_dbi(dbi), cbool(del))
+	if ret == success && txn.watch != nil {
+		txn.watch.addDrop(dbi)
+	}
 	return operrno("mdb_drop", ret)
 }
 
@@ -409,6 +456,49 @@ func (txn *Txn) bytes(val *C.MDB_val) []byte {
 //
 // See mdb_get.
 func (txn *Txn) Get(dbi DBI, key []byte) ([]byte, error) {
+	err := txn.get(dbi, key)
+	if err != nil {
+		return nil, err
+	}
+	b := txn.bytes(txn.val)
+	*txn.val = C.MDB_val{}
+	return b, nil
+}
+
+// GetInto retrieves items from database dbi like Get but appends the value
+// to dst and returns the extended slice, so that a buffer can be reused across
+// calls without allocation regardless of txn.RawRead.  On error dst is
+// returned unmodified.
+//
+// See mdb_get.
+func (txn *Txn) GetInto(dbi DBI, key, dst []byte) ([]byte, error) {
+	err := txn.get(dbi, key)
+	if err != nil {
+		return dst, err
+	}
+	dst = append(dst, getBytes(txn.val)...)
+	*txn.val = C.MDB_val{}
+	return dst, nil
+}
+
+// GetFunc retrieves items from database dbi and calls fn with the value.  The
+// value references a readonly section of memory, as if txn.RawRead were true,
+// and must not be retained or accessed after fn returns.  GetFunc returns the
+// error returned by fn.
+//
+// See mdb_get.
+func (txn *Txn) GetFunc(dbi DBI, key []byte, fn func(val []byte) error) error {
+	err := txn.get(dbi, key)
+	if err != nil {
+		return err
+	}
+	val := getBytes(txn.val)
+	*txn.val = C.MDB_val{}
+	return fn(val)
+}
+
+// get calls mdb_get, leaving the value in txn.val on success.
+func (txn *Txn) get(dbi DBI, key []byte) error {
 	kdata, kn := valBytes(key)
 	ret := C.lmdbgo_mdb_get(
 		txn._txn, C.MDB_dbi(dbi),
@@ -418,11 +508,8 @@ func (txn *Txn) Get(dbi DBI, key []byte) ([]byte, error) {
 	err := operrno("mdb_get", ret)
 	if err != nil {
 		*txn.val = C.MDB_val{}
-		return nil, err
 	}
-	b := txn.bytes(txn.val)
-	*txn.val = C.MDB_val{}
-	return b, nil
+	return err
 }
 
 func (txn *Txn) putNilKey(dbi DBI, flags uint) error {
@@ -450,6 +537,9 @@ func (txn *Txn) Put(dbi DBI, key []byte, val []byte, flags uint) error {
 		(*C.char)(unsafe.Pointer(&val[0])), C.size_t(vn),
 		C.uint(flags),
 	)
+	if ret == success && txn.watch != nil {
+		txn.watch.add(dbi, key)
+	}
 	return operrno("mdb_put", ret)
 }
 
@@ -472,6 +562,9 @@ func (txn *Txn) PutReserve(dbi DBI, key []byte, n int, flags uint) ([]byte, erro
 		*txn.val = C.MDB_val{}
 		return nil, err
 	}
+	if txn.watch != nil {
+		txn.watch.add(dbi, key)
+	}
 	b := getBytes(txn.val)
 	*txn.val = C.MDB_val{}
 	return b, nil
@@ -489,6 +582,9 @@ func (txn *Txn) Del(dbi DBI, key, val []byte) error {
 		(*C.char)(unsafe.Pointer(&kdata[0])), C.size_t(kn),
 		(*C.char)(unsafe.Pointer(&vdata[0])), C.size_t(vn),
 	)
+	if ret == success && txn.watch != nil {
+		txn.watch.add(dbi, key)
+	}
 	return operrno("mdb_del", ret)
 }
 
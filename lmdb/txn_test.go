@@ -3,6 +3,7 @@ package lmdb
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
@@ -337,6 +338,107 @@ func TestTxn_PutReserve(t *testing.T) {
 	}
 }
 
+func TestTxn_GetInto(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var db DBI
+	err := env.Update(func(txn *Txn) (err error) {
+		db, err = txn.OpenRoot(0)
+		if err != nil {
+			return err
+		}
+		err = txn.Put(db, []byte("k1"), []byte("v1"), 0)
+		if err != nil {
+			return err
+		}
+		return txn.Put(db, []byte("k2"), []byte("value2"), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = env.View(func(txn *Txn) (err error) {
+		buf := make([]byte, 0, 64)
+		buf, err = txn.GetInto(db, []byte("k1"), buf)
+		if err != nil {
+			return err
+		}
+		buf, err = txn.GetInto(db, []byte("k2"), append(buf, ','))
+		if err != nil {
+			return err
+		}
+		if string(buf) != "v1,value2" {
+			t.Errorf("value: %q", buf)
+		}
+		buf, err = txn.GetInto(db, []byte("k3"), buf)
+		if !IsNotFound(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if string(buf) != "v1,value2" {
+			t.Errorf("value: %q", buf)
+		}
+
+		key := []byte("k2")
+		allocs := testing.AllocsPerRun(100, func() {
+			buf, err = txn.GetInto(db, key, buf[:0])
+		})
+		if err != nil {
+			return err
+		}
+		if allocs != 0 {
+			t.Errorf("allocs: %g", allocs)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxn_GetFunc(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var db DBI
+	err := env.Update(func(txn *Txn) (err error) {
+		db, err = txn.OpenRoot(0)
+		if err != nil {
+			return err
+		}
+		return txn.Put(db, []byte("k"), []byte("v"), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errStop := errors.New("stop")
+	err = env.View(func(txn *Txn) (err error) {
+		var v string
+		err = txn.GetFunc(db, []byte("k"), func(val []byte) error {
+			v = string(val)
+			return errStop
+		})
+		if err != errStop {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if v != "v" {
+			t.Errorf("value: %q", v)
+		}
+		err = txn.GetFunc(db, []byte("missing"), func(val []byte) error {
+			t.Errorf("called for missing key")
+			return nil
+		})
+		if !IsNotFound(err) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestTxn_bytesBuffer(t *testing.T) {
 	env := setup(t)
 	defer clean(env, t)
@@ -0,0 +1,268 @@
+package lmdb
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// watchMaxKeys is the number of distinct keys a Watcher will accumulate for a
+// slow consumer before it stops tracking individual keys and marks the
+// pending WatchEvent with All.
+const watchMaxKeys = 1024
+
+// WatchEvent describes changes to a watched database committed by one or
+// more update transactions.
+type WatchEvent struct {
+	// TxnID is the identifier of the latest transaction included in the
+	// event.
+	TxnID uintptr
+
+	// DB is the name of the database that changed, as passed to Env.Watch.
+	DB string
+
+	// Keys contains the distinct keys matching the watched prefix that were
+	// written or deleted, in the order they were first changed.
+	Keys [][]byte
+
+	// All is true if keys matching the watched prefix may have changed that
+	// are not listed in Keys.  This happens when the database was dropped or
+	// when too many changes accumulated while the consumer was not receiving
+	// from the Watcher.
+	All bool
+}
+
+// Watcher delivers notifications about changes committed to a database in an
+// Env.  Notifications are only delivered for update transactions committed
+// through this package in the current process.
+//
+// Events are sent on C after the writing transaction commits successfully.
+// Changes made by aborted transactions and by aborted subtransactions are
+// never reported.  When the consumer of C is slow, changes committed while it
+// is busy are coalesced into a single WatchEvent.
+type Watcher struct {
+	// C receives events until the Watcher is closed.  C is closed by
+	// Watcher.Close and when the Env is closed.
+	C <-chan *WatchEvent
+
+	c      chan *WatchEvent
+	env    *Env
+	db     string
+	prefix []byte
+
+	mu      sync.Mutex
+	pending *WatchEvent
+	seen    map[string]bool
+	signal  chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+var errWatchClosed = errors.New("environment is closed")
+
+// Watch returns a Watcher that is notified about committed changes to keys
+// beginning with prefix in the database named db.  The root database is
+// named by the empty string.  An empty prefix watches every key in the
+// database.  The database does not need to exist when Watch is called.
+//
+// Tracking writes has a small cost for update transactions which begin
+// while the environment has any open Watcher.  Watchers must be closed when
+// no longer needed.
+func (env *Env) Watch(db string, prefix []byte) (*Watcher, error) {
+	c := make(chan *WatchEvent)
+	w := &Watcher{
+		C:      c,
+		c:      c,
+		env:    env,
+		db:     db,
+		prefix: append([]byte(nil), prefix...),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	env.watchMu.Lock()
+	if env.watchClosed {
+		env.watchMu.Unlock()
+		return nil, errWatchClosed
+	}
+	if env.watchers == nil {
+		env.watchers = make(map[*Watcher]bool)
+	}
+	env.watchers[w] = true
+	atomic.AddInt32(&env.numWatchers, 1)
+	env.watchMu.Unlock()
+
+	go w.loop()
+	return w, nil
+}
+
+// Close stops delivery of events and closes w.C.
+func (w *Watcher) Close() {
+	w.env.watchMu.Lock()
+	if w.env.watchers[w] {
+		delete(w.env.watchers, w)
+		atomic.AddInt32(&w.env.numWatchers, -1)
+	}
+	w.env.watchMu.Unlock()
+	w.stop()
+}
+
+func (w *Watcher) stop() {
+	w.once.Do(func() { close(w.done) })
+}
+
+func (w *Watcher) loop() {
+	defer close(w.c)
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.signal:
+		}
+		w.mu.Lock()
+		ev := w.pending
+		w.pending = nil
+		w.seen = nil
+		w.mu.Unlock()
+		if ev == nil {
+			continue
+		}
+		select {
+		case <-w.done:
+			return
+		case w.c <- ev:
+		}
+	}
+}
+
+// post merges the changes in a committed transaction into the pending event
+// and wakes the delivery goroutine.
+func (w *Watcher) post(id uintptr, keys [][]byte, all bool) {
+	w.mu.Lock()
+	ev := w.pending
+	if ev == nil {
+		ev = &WatchEvent{DB: w.db}
+		w.pending = ev
+		w.seen = make(map[string]bool)
+	}
+	ev.TxnID = id
+	ev.All = ev.All || all
+	for _, k := range keys {
+		if ev.All {
+			break
+		}
+		if w.seen[string(k)] {
+			continue
+		}
+		if len(ev.Keys) >= watchMaxKeys {
+			ev.All = true
+			break
+		}
+		w.seen[string(k)] = true
+		ev.Keys = append(ev.Keys, k)
+	}
+	if ev.All {
+		ev.Keys = nil
+		w.seen = nil
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// watching returns true if update transactions should track their writes.
+func (env *Env) watching() bool {
+	return atomic.LoadInt32(&env.numWatchers) > 0
+}
+
+// setDBIName records the name of an open database so that writes to it can
+// be matched with watchers.
+func (env *Env) setDBIName(dbi DBI, name string) {
+	env.watchMu.Lock()
+	if env.dbiNames == nil {
+		env.dbiNames = make(map[DBI]string)
+	}
+	env.dbiNames[dbi] = name
+	env.watchMu.Unlock()
+}
+
+// closeWatchers stops all watchers and prevents new ones from being added.
+// closeWatchers is called when env is closed.
+func (env *Env) closeWatchers() {
+	env.watchMu.Lock()
+	env.watchClosed = true
+	for w := range env.watchers {
+		delete(env.watchers, w)
+		w.stop()
+	}
+	atomic.StoreInt32(&env.numWatchers, 0)
+	env.watchMu.Unlock()
+}
+
+// notify delivers the changes recorded by a committed transaction to
+// matching watchers.
+func (env *Env) notify(id uintptr, log *watchLog) {
+	if len(log.writes) == 0 {
+		return
+	}
+	env.watchMu.RLock()
+	defer env.watchMu.RUnlock()
+	for w := range env.watchers {
+		var keys [][]byte
+		all := false
+		for _, wr := range log.writes {
+			name, ok := env.dbiNames[wr.dbi]
+			if !ok || name != w.db {
+				continue
+			}
+			if wr.drop {
+				all = true
+				continue
+			}
+			if bytes.HasPrefix(wr.key, w.prefix) {
+				keys = append(keys, wr.key)
+			}
+		}
+		if all || len(keys) > 0 {
+			w.post(id, keys, all)
+		}
+	}
+}
+
+// watchLog records the writes made by an update transaction while watchers
+// exist.
+type watchLog struct {
+	writes []watchWrite
+}
+
+type watchWrite struct {
+	dbi  DBI
+	key  []byte
+	drop bool
+}
+
+func (log *watchLog) add(dbi DBI, key []byte) {
+	log.writes = append(log.writes, watchWrite{dbi: dbi, key: append([]byte(nil), key...)})
+}
+
+func (log *watchLog) addDrop(dbi DBI) {
+	log.writes = append(log.writes, watchWrite{dbi: dbi, drop: true})
+}
+
+// commitWatch passes the writes of a committed txn to its parent, or to
+// watchers if txn is not a subtransaction.
+func (txn *Txn) commitWatch(id uintptr) {
+	log := txn.watch
+	txn.watch = nil
+	if txn.parent != nil {
+		if txn.parent.watch != nil {
+			txn.parent.watch.writes = append(txn.parent.watch.writes, log.writes...)
+		}
+		return
+	}
+	txn.env.notify(id, log)
+}
@@ -0,0 +1,296 @@
+package lmdb
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func recvWatch(t *testing.T, w *Watcher) *WatchEvent {
+	select {
+	case ev, ok := <-w.C:
+		if !ok {
+			t.Fatalf("watcher closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for event")
+	}
+	return nil
+}
+
+func expectNoWatch(t *testing.T, w *Watcher) {
+	select {
+	case ev := <-w.C:
+		t.Errorf("unexpected event: %+v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func watchKeys(ev *WatchEvent) []string {
+	var keys []string
+	for _, k := range ev.Keys {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
+
+func TestEnv_Watch(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var dbi, other DBI
+	err := env.Update(func(txn *Txn) (err error) {
+		dbi, err = txn.OpenDBI("watched", Create)
+		if err != nil {
+			return err
+		}
+		other, err = txn.OpenDBI("other", Create)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := env.Watch("watched", []byte("user/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var id uintptr
+	err = env.Update(func(txn *Txn) (err error) {
+		id = txn.ID()
+		err = txn.Put(dbi, []byte("user/1"), []byte("a"), 0)
+		if err != nil {
+			return err
+		}
+		err = txn.Put(dbi, []byte("group/1"), []byte("b"), 0)
+		if err != nil {
+			return err
+		}
+		err = txn.Put(other, []byte("user/2"), []byte("c"), 0)
+		if err != nil {
+			return err
+		}
+		cur, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+		return cur.Put([]byte("user/3"), []byte("d"), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := recvWatch(t, w)
+	if ev.TxnID != id || ev.DB != "watched" || ev.All {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+	if keys := watchKeys(ev); !reflect.DeepEqual(keys, []string{"user/1", "user/3"}) {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+
+	err = env.Update(func(txn *Txn) (err error) {
+		cur, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+		_, _, err = cur.Get([]byte("user/3"), nil, SetKey)
+		if err != nil {
+			return err
+		}
+		return cur.Del(0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = recvWatch(t, w)
+	if keys := watchKeys(ev); !reflect.DeepEqual(keys, []string{"user/3"}) {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+
+	err = env.Update(func(txn *Txn) (err error) {
+		return txn.Drop(dbi, false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = recvWatch(t, w)
+	if !ev.All {
+		t.Errorf("expected All after drop: %+v", ev)
+	}
+}
+
+func TestEnv_Watch_abort(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var dbi DBI
+	err := env.Update(func(txn *Txn) (err error) {
+		dbi, err = txn.OpenRoot(0)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := env.Watch("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	errAbort := errors.New("abort")
+	err = env.Update(func(txn *Txn) (err error) {
+		err = txn.Put(dbi, []byte("k"), []byte("v"), 0)
+		if err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectNoWatch(t, w)
+
+	err = env.Update(func(txn *Txn) (err error) {
+		err = txn.Sub(func(txn *Txn) error {
+			err := txn.Put(dbi, []byte("rolledback"), []byte("v"), 0)
+			if err != nil {
+				return err
+			}
+			return errAbort
+		})
+		if err != errAbort {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = txn.Sub(func(txn *Txn) error {
+			return txn.Put(dbi, []byte("nested"), []byte("v"), 0)
+		})
+		if err != nil {
+			return err
+		}
+		return txn.Put(dbi, []byte("top"), []byte("v"), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := recvWatch(t, w)
+	if keys := watchKeys(ev); !reflect.DeepEqual(keys, []string{"nested", "top"}) {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+	expectNoWatch(t, w)
+}
+
+func TestEnv_Watch_coalesce(t *testing.T) {
+	env := setup(t)
+	defer clean(env, t)
+
+	var dbi DBI
+	err := env.Update(func(txn *Txn) (err error) {
+		dbi, err = txn.OpenDBI("coalesce", Create)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := env.Watch("coalesce", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// The first commit may be picked up by the delivery goroutine before the
+	// others so it is received separately.
+	put := func(key string) uintptr {
+		var id uintptr
+		err := env.Update(func(txn *Txn) (err error) {
+			id = txn.ID()
+			return txn.Put(dbi, []byte(key), nil, 0)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	put("a")
+	time.Sleep(20 * time.Millisecond)
+	put("b")
+	put("a")
+	last := put("c")
+
+	var keys []string
+	ev := recvWatch(t, w)
+	keys = append(keys, watchKeys(ev)...)
+	ev = recvWatch(t, w)
+	keys = append(keys, watchKeys(ev)...)
+	if ev.TxnID != last {
+		t.Errorf("unexpected txn id: %d (!= %d)", ev.TxnID, last)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b", "a", "c"}) {
+		t.Errorf("unexpected keys: %q", keys)
+	}
+	expectNoWatch(t, w)
+
+	w.Close()
+	if _, ok := <-w.C; ok {
+		t.Errorf("watcher not closed")
+	}
+}
+
+func TestEnv_Watch_close(t *testing.T) {
+	env := setup(t)
+	w, err := env.Watch("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean(env, t)
+	if _, ok := <-w.C; ok {
+		t.Errorf("watcher not closed")
+	}
+	w.Close()
+}
+
+func TestEnv_Watch_closeConcurrent(t *testing.T) {
+	env := setup(t)
+
+	// Watchers added while the environment closes are either refused or
+	// closed with it.
+	var mu sync.Mutex
+	var ws []*Watcher
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				w, err := env.Watch("", nil)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				ws = append(ws, w)
+				mu.Unlock()
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	clean(env, t)
+	wg.Wait()
+
+	for _, w := range ws {
+		select {
+		case _, ok := <-w.C:
+			if ok {
+				t.Errorf("unexpected event")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watcher not closed")
+		}
+	}
+}